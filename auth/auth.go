@@ -575,9 +575,10 @@ func handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			renderMessage(w, "Approval requested", fmt.Sprintf(`%s wants to act on your behalf on %s. Is this OK? Your decision will be remembered.</br>
-<form method="GET" action="%s"><input type="hidden" name="state" value="%s"><input type="submit" value="Yes"/></form>
-<form method="GET" action="%s"><input type="submit" value="No"/></form>`, strippedRedirectURL.String(), requestedURL.String(), approveURL.String(), cipher, redirectURL.String()))
+			localizer := LoadLocalizer(ctx, user)
+			renderMessage(w, localizer.Translate("Approval requested"), fmt.Sprintf(`%s</br>
+<form method="GET" action="%s"><input type="hidden" name="state" value="%s"><input type="submit" value="%s"/></form>
+<form method="GET" action="%s"><input type="submit" value="%s"/></form>`, localizer.Sprintf("%s wants to act on your behalf on %s. Is this OK? Your decision will be remembered.", strippedRedirectURL.String(), requestedURL.String()), approveURL.String(), cipher, localizer.Translate("Yes"), redirectURL.String(), localizer.Translate("No")))
 			return
 		} else if err != nil {
 			HTTPError(w, r, err)
@@ -947,7 +948,8 @@ func unsubscribe(w ResponseWriter, r Request) error {
 		return err
 	}
 
-	renderMessage(w, "Unsubscribed", fmt.Sprintf("%v has been unsubscribed from diplicity mail.", user.Name))
+	localizer := NewUserLocalizer(user, userConfig)
+	renderMessage(w, localizer.Translate("Unsubscribed"), localizer.Sprintf("%v has been unsubscribed from diplicity mail.", user.Name))
 
 	return nil
 }
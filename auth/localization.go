@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// DefaultLanguage is the language of the server generated strings, which are also the keys of the catalogs.
+	DefaultLanguage = "en"
+)
+
+// Catalog maps English server generated strings, often fmt format strings, to translations.
+type Catalog map[string]string
+
+// Catalogs contains the translations of server generated strings, like notifications and emails, per language.
+// Strings missing from a catalog are left in English.
+var Catalogs = map[string]Catalog{
+	"sv": Catalog{
+		"Spring":     "Vår",
+		"Summer":     "Sommar",
+		"Fall":       "Höst",
+		"Winter":     "Vinter",
+		"Movement":   "Förflyttning",
+		"Retreat":    "Reträtt",
+		"Adjustment": "Justering",
+		"%s\n\nVisit %s to stop receiving email like this.\n\nVisit %s to see the latest phase in this game.": "%s\n\nBesök %s för att sluta få mejl som detta.\n\nBesök %s för att se den senaste fasen i partiet.",
+		"Orders of the previous phase:\n\n%s\n\n":                                                             "Order från föregående fas:\n\n%s\n\n",
+		"%s has a new phase: %s.\n\n%sReply to this email with orders, one per line, like \"A PAR - BUR\" or \"F NTH C A LON - NWY\". Add a line with READY to mark yourself ready to resolve the phase, or DIAS to vote for a draw including all surviving players.\n\nVisit %s to stop receiving email like this.": "%s har en ny fas: %s.\n\n%sSvara på det här mejlet med order, en per rad, som \"A PAR - BUR\" eller \"F NTH C A LON - NWY\". Lägg till en rad med READY för att markera dig redo att avgöra fasen, eller DIAS för att rösta för oavgjort mellan alla överlevande spelare.\n\nBesök %s för att sluta få mejl som detta.",
+		"%s has a new phase.":                     "%s har en ny fas.",
+		"%s: %s deadline in %v":                   "%s: %s, deadline om %v",
+		"You haven't given any orders in %s yet.": "Du har inte gett några order i %s än.",
+		"The deadline of %s is at %s, and you haven't given any orders or marked yourself ready yet.\n\nVisit %s to see the map, or reply to this email with orders, one per line, like \"A PAR - BUR\". Add a line with READY to mark yourself ready to resolve the phase.\n\nVisit %s to stop receiving email like this.": "Deadline för %s är %s, och du har inte gett några order eller markerat dig redo än.\n\nBesök %s för att se kartan, eller svara på det här mejlet med order, en per rad, som \"A PAR - BUR\". Lägg till en rad med READY för att markera dig redo att avgöra fasen.\n\nBesök %s för att sluta få mejl som detta.",
+		"New phase: %s\n%s\nReply with orders to %s\n\n":   "Ny fas: %s\n%s\nSvara med order till %s\n\n",
+		"Reply to this channel at %s\n\n":                  "Svara i den här kanalen på %s\n\n",
+		"Visit %s to stop receiving email like this.":      "Besök %s för att sluta få mejl som detta.",
+		"Diplicity digest: %d new messages, %d new phases": "Diplicity-sammanfattning: %d nya meddelanden, %d nya faser",
+		"%d notifications during your quiet hours":         "%d notiser under dina tysta timmar",
+		"%d mails during your quiet hours":                 "%d mejl under dina tysta timmar",
+		"Unsuccessfully parsed":                            "Kunde inte tolkas",
+		"Your recent mail to diplicity was not successfully parsed.\n\nAn error message follows.\n\n%v": "Ditt senaste mejl till diplicity kunde inte tolkas.\n\nEtt felmeddelande följer.\n\n%v",
+		"%s: orders accepted":                                "%s: order accepterade",
+		"%s: %d orders not accepted":                         "%s: %d order accepterades inte",
+		"Your recent mail to diplicity was processed.\n\n%s": "Ditt senaste mejl till diplicity har behandlats.\n\n%s",
+		"Approval requested":                                 "Godkännande begärt",
+		"%s wants to act on your behalf on %s. Is this OK? Your decision will be remembered.": "%s vill agera för din räkning på %s. Är det OK? Ditt beslut kommer att sparas.",
+		"Yes":          "Ja",
+		"No":           "Nej",
+		"Unsubscribed": "Avprenumererad",
+		"%v has been unsubscribed from diplicity mail.": "%v har avprenumererats från diplicitys mejl.",
+	},
+	"de": Catalog{
+		"Spring":     "Frühling",
+		"Summer":     "Sommer",
+		"Fall":       "Herbst",
+		"Winter":     "Winter",
+		"Movement":   "Bewegung",
+		"Retreat":    "Rückzug",
+		"Adjustment": "Anpassung",
+		"%s\n\nVisit %s to stop receiving email like this.\n\nVisit %s to see the latest phase in this game.": "%s\n\nBesuche %s, um keine solchen E-Mails mehr zu erhalten.\n\nBesuche %s, um die neueste Phase dieses Spiels zu sehen.",
+		"Orders of the previous phase:\n\n%s\n\n":                                                             "Befehle der vorherigen Phase:\n\n%s\n\n",
+		"%s has a new phase: %s.\n\n%sReply to this email with orders, one per line, like \"A PAR - BUR\" or \"F NTH C A LON - NWY\". Add a line with READY to mark yourself ready to resolve the phase, or DIAS to vote for a draw including all surviving players.\n\nVisit %s to stop receiving email like this.": "%s hat eine neue Phase: %s.\n\n%sAntworte auf diese E-Mail mit Befehlen, einem pro Zeile, wie \"A PAR - BUR\" oder \"F NTH C A LON - NWY\". Füge eine Zeile mit READY hinzu, um dich als bereit zur Auswertung der Phase zu markieren, oder DIAS, um für ein Unentschieden aller überlebenden Spieler zu stimmen.\n\nBesuche %s, um keine solchen E-Mails mehr zu erhalten.",
+		"%s has a new phase.":                     "%s hat eine neue Phase.",
+		"%s: %s deadline in %v":                   "%s: %s, Frist endet in %v",
+		"You haven't given any orders in %s yet.": "Du hast in %s noch keine Befehle gegeben.",
+		"The deadline of %s is at %s, and you haven't given any orders or marked yourself ready yet.\n\nVisit %s to see the map, or reply to this email with orders, one per line, like \"A PAR - BUR\". Add a line with READY to mark yourself ready to resolve the phase.\n\nVisit %s to stop receiving email like this.": "Die Frist von %s endet am %s, und du hast noch keine Befehle gegeben oder dich als bereit markiert.\n\nBesuche %s, um die Karte zu sehen, oder antworte auf diese E-Mail mit Befehlen, einem pro Zeile, wie \"A PAR - BUR\". Füge eine Zeile mit READY hinzu, um dich als bereit zur Auswertung der Phase zu markieren.\n\nBesuche %s, um keine solchen E-Mails mehr zu erhalten.",
+		"New phase: %s\n%s\nReply with orders to %s\n\n":   "Neue Phase: %s\n%s\nAntworte mit Befehlen an %s\n\n",
+		"Reply to this channel at %s\n\n":                  "Antworte in diesem Kanal an %s\n\n",
+		"Visit %s to stop receiving email like this.":      "Besuche %s, um keine solchen E-Mails mehr zu erhalten.",
+		"Diplicity digest: %d new messages, %d new phases": "Diplicity-Zusammenfassung: %d neue Nachrichten, %d neue Phasen",
+		"%d notifications during your quiet hours":         "%d Benachrichtigungen während deiner Ruhezeit",
+		"%d mails during your quiet hours":                 "%d E-Mails während deiner Ruhezeit",
+		"Unsuccessfully parsed":                            "Nicht erfolgreich verarbeitet",
+		"Your recent mail to diplicity was not successfully parsed.\n\nAn error message follows.\n\n%v": "Deine letzte E-Mail an diplicity konnte nicht verarbeitet werden.\n\nEs folgt eine Fehlermeldung.\n\n%v",
+		"%s: orders accepted":                                "%s: Befehle angenommen",
+		"%s: %d orders not accepted":                         "%s: %d Befehle nicht angenommen",
+		"Your recent mail to diplicity was processed.\n\n%s": "Deine letzte E-Mail an diplicity wurde verarbeitet.\n\n%s",
+		"Approval requested":                                 "Genehmigung angefragt",
+		"%s wants to act on your behalf on %s. Is this OK? Your decision will be remembered.": "%s möchte auf %s in deinem Namen handeln. Ist das in Ordnung? Deine Entscheidung wird gespeichert.",
+		"Yes":          "Ja",
+		"No":           "Nein",
+		"Unsubscribed": "Abgemeldet",
+		"%v has been unsubscribed from diplicity mail.": "%v wurde von den diplicity-E-Mails abgemeldet.",
+	},
+}
+
+// Languages returns the languages with translations of the server generated strings, including DefaultLanguage.
+func Languages() []string {
+	languages := []string{DefaultLanguage}
+	for language := range Catalogs {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// matchLanguage returns the supported language of locale, like "sv" for "sv-SE", or "" if it has none.
+func matchLanguage(locale string) string {
+	locale = strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+	if locale == "" {
+		return ""
+	}
+	for _, candidate := range []string{locale, strings.Split(locale, "-")[0]} {
+		if candidate == DefaultLanguage {
+			return candidate
+		}
+		if _, found := Catalogs[candidate]; found {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// Localizer translates server generated strings to a language.
+type Localizer struct {
+	Language string
+	catalog  Catalog
+}
+
+// NewLocalizer returns a localizer for the first of the locales that has a supported language, or for
+// DefaultLanguage if none of them has.
+func NewLocalizer(locales ...string) *Localizer {
+	for _, locale := range locales {
+		if language := matchLanguage(locale); language != "" {
+			return &Localizer{
+				Language: language,
+				catalog:  Catalogs[language],
+			}
+		}
+	}
+	return &Localizer{Language: DefaultLanguage}
+}
+
+// NewUserLocalizer returns a localizer for the locale in the user config, or the locale from the OAuth profile
+// of the user. userConfig may be nil.
+func NewUserLocalizer(user *User, userConfig *UserConfig) *Localizer {
+	locales := []string{}
+	if userConfig != nil {
+		locales = append(locales, userConfig.Locale)
+	}
+	if user != nil {
+		locales = append(locales, user.Locale)
+	}
+	return NewLocalizer(locales...)
+}
+
+// LoadLocalizer loads the user config of the user and returns a localizer for the user.
+// Since translations are never important enough to fail for, errors are only logged.
+func LoadLocalizer(ctx context.Context, user *User) *Localizer {
+	userConfig := &UserConfig{}
+	if err := datastore.Get(ctx, UserConfigID(ctx, UserID(ctx, user.Id)), userConfig); err == datastore.ErrNoSuchEntity {
+		userConfig = nil
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to load user config of %q: %v; hope datastore gets fixed", user.Id, err)
+		userConfig = nil
+	}
+	return NewUserLocalizer(user, userConfig)
+}
+
+// LoadLocalizerByEmail returns a localizer for the user with the email address, like the sender of a mail.
+// Unknown addresses get a localizer for DefaultLanguage.
+func LoadLocalizerByEmail(ctx context.Context, address string) *Localizer {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return NewLocalizer()
+	}
+	users := []User{}
+	if _, err := datastore.NewQuery(userKind).Filter("Email=", parsed.Address).Limit(1).GetAll(ctx, &users); err != nil {
+		log.Errorf(ctx, "Unable to load user with email %q: %v; hope datastore gets fixed", parsed.Address, err)
+		return NewLocalizer()
+	}
+	if len(users) == 0 {
+		return NewLocalizer()
+	}
+	return LoadLocalizer(ctx, &users[0])
+}
+
+// Translate returns the translation of s, or s if it has none.
+func (l *Localizer) Translate(s string) string {
+	if translation, found := l.catalog[s]; found {
+		return translation
+	}
+	return s
+}
+
+// Sprintf translates format and formats it with args.
+func (l *Localizer) Sprintf(format string, args ...interface{}) string {
+	return fmt.Sprintf(l.Translate(format), args...)
+}
@@ -1,7 +1,12 @@
 package auth
 
 import (
+	"encoding/base64"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/aymerick/raymond"
 	"github.com/zond/go-fcm"
@@ -16,6 +21,14 @@ import (
 
 const (
 	userConfigKind = "UserConfig"
+
+	maxDeadlineReminders       = 5
+	maxDeadlineReminderMinutes = 30 * 24 * 60
+
+	quietHoursFormat = "15:04"
+
+	HourlyMailDigest = "Hourly"
+	DailyMailDigest  = "Daily"
 )
 
 func init() {
@@ -129,7 +142,52 @@ type FCMToken struct {
 	App           string                `methods:"PUT"`
 	MessageConfig FCMNotificationConfig `methods:"PUT"`
 	PhaseConfig   FCMNotificationConfig `methods:"PUT"`
-	ReplaceToken  string                `methods:"PUT"`
+	// ReminderConfig customizes deadline reminders.
+	ReminderConfig FCMNotificationConfig `methods:"PUT"`
+	ReplaceToken   string                `methods:"PUT"`
+}
+
+// WebPushSubscription is a standard Web Push subscription, with the endpoint and keys of the JSON serialization
+// of a PushSubscription in the browser.
+type WebPushSubscription struct {
+	Endpoint       string                `methods:"PUT" datastore:",noindex"`
+	P256dh         string                `methods:"PUT" datastore:",noindex"`
+	Auth           string                `methods:"PUT" datastore:",noindex"`
+	Disabled       bool                  `methods:"PUT"`
+	Note           string                `methods:"PUT" datastore:",noindex"`
+	App            string                `methods:"PUT"`
+	MessageConfig  FCMNotificationConfig `methods:"PUT"`
+	PhaseConfig    FCMNotificationConfig `methods:"PUT"`
+	ReminderConfig FCMNotificationConfig `methods:"PUT"`
+}
+
+// DecodeWebPushKey decodes the URL safe base64 keys of Web Push subscriptions and VAPID configurations, with or
+// without padding.
+func DecodeWebPushKey(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (w *WebPushSubscription) Validate() error {
+	endpoint, err := url.Parse(w.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return HTTPErr{fmt.Sprintf("Web Push endpoint %q isn't an https URL", w.Endpoint), http.StatusBadRequest}
+	}
+	if b, err := DecodeWebPushKey(w.P256dh); err != nil || len(b) != 65 || b[0] != 4 {
+		return HTTPErr{fmt.Sprintf("Web Push key %q isn't an uncompressed P-256 public key", w.P256dh), http.StatusBadRequest}
+	}
+	if b, err := DecodeWebPushKey(w.Auth); err != nil || len(b) != 16 {
+		return HTTPErr{fmt.Sprintf("Web Push auth secret %q isn't 16 bytes", w.Auth), http.StatusBadRequest}
+	}
+	if err := w.MessageConfig.Validate(); err != nil {
+		return err
+	}
+	if err := w.PhaseConfig.Validate(); err != nil {
+		return err
+	}
+	if err := w.ReminderConfig.Validate(); err != nil {
+		return err
+	}
+	return nil
 }
 
 type UnsubscribeConfig struct {
@@ -151,20 +209,91 @@ func (u *UnsubscribeConfig) Validate() error {
 	return nil
 }
 
+// QuietHours is a daily window during which FCM, Web Push and mail notifications are held.
+type QuietHours struct {
+	// Location is the IANA time zone of Start and End, like "Europe/Stockholm". Empty means UTC.
+	Location string `methods:"PUT"`
+	// Start and End are formatted like "22:30". Windows where End is before Start span midnight.
+	// Quiet hours are disabled when both are empty.
+	Start string `methods:"PUT"`
+	End   string `methods:"PUT"`
+}
+
+// Enabled returns whether the user has configured quiet hours.
+func (q *QuietHours) Enabled() bool {
+	return q.Start != "" || q.End != ""
+}
+
+func (q *QuietHours) Validate() error {
+	if !q.Enabled() {
+		return nil
+	}
+	if _, err := time.LoadLocation(q.Location); err != nil {
+		return HTTPErr{fmt.Sprintf("unknown quiet hours location %q", q.Location), http.StatusBadRequest}
+	}
+	start, err := time.Parse(quietHoursFormat, q.Start)
+	if err != nil {
+		return HTTPErr{fmt.Sprintf("quiet hours start %q isn't formatted like %q", q.Start, quietHoursFormat), http.StatusBadRequest}
+	}
+	end, err := time.Parse(quietHoursFormat, q.End)
+	if err != nil {
+		return HTTPErr{fmt.Sprintf("quiet hours end %q isn't formatted like %q", q.End, quietHoursFormat), http.StatusBadRequest}
+	}
+	if start.Equal(end) {
+		return HTTPErr{"quiet hours can't start and end at the same time", http.StatusBadRequest}
+	}
+	return nil
+}
+
+// Window returns the start and end of the quiet hours containing at, or zero times if at isn't inside quiet hours.
+// Invalid quiet hours never contain anything.
+func (q *QuietHours) Window(at time.Time) (time.Time, time.Time) {
+	if q.Validate() != nil || !q.Enabled() {
+		return time.Time{}, time.Time{}
+	}
+	location, _ := time.LoadLocation(q.Location)
+	startClock, _ := time.Parse(quietHoursFormat, q.Start)
+	endClock, _ := time.Parse(quietHoursFormat, q.End)
+	local := at.In(location)
+	// The window containing at started either the same day or the day before.
+	for _, days := range []int{-1, 0} {
+		day := local.AddDate(0, 0, days)
+		start := time.Date(day.Year(), day.Month(), day.Day(), startClock.Hour(), startClock.Minute(), 0, 0, location)
+		end := time.Date(day.Year(), day.Month(), day.Day(), endClock.Hour(), endClock.Minute(), 0, 0, location)
+		if !end.After(start) {
+			end = time.Date(day.Year(), day.Month(), day.Day()+1, endClock.Hour(), endClock.Minute(), 0, 0, location)
+		}
+		if !at.Before(start) && at.Before(end) {
+			return start, end
+		}
+	}
+	return time.Time{}, time.Time{}
+}
+
 type MailConfig struct {
 	Enabled           bool                   `methods:"PUT"`
 	UnsubscribeConfig UnsubscribeConfig      `methods:"PUT"`
 	MessageConfig     MailNotificationConfig `methods:"PUT"`
 	PhaseConfig       MailNotificationConfig `methods:"PUT"`
+	ReminderConfig    MailNotificationConfig `methods:"PUT"`
+	// Digest is empty for one mail per notification, or HourlyMailDigest or DailyMailDigest to batch message
+	// and phase notifications.
+	Digest string `methods:"PUT"`
 }
 
 func (m *MailConfig) Validate() error {
+	if m.Digest != "" && m.Digest != HourlyMailDigest && m.Digest != DailyMailDigest {
+		return HTTPErr{fmt.Sprintf("unknown digest %q, pick %q, %q or %q", m.Digest, "", HourlyMailDigest, DailyMailDigest), http.StatusBadRequest}
+	}
 	if err := m.MessageConfig.Validate(); err != nil {
 		return err
 	}
 	if err := m.PhaseConfig.Validate(); err != nil {
 		return err
 	}
+	if err := m.ReminderConfig.Validate(); err != nil {
+		return err
+	}
 	if err := m.UnsubscribeConfig.Validate(); err != nil {
 		return err
 	}
@@ -176,6 +305,39 @@ type UserConfig struct {
 	FCMTokens  []FCMToken `methods:"PUT"`
 	MailConfig MailConfig `methods:"PUT"`
 	Colors     []string   `methods:"PUT"`
+	// DeadlineReminderMinutes lists how many minutes before phase deadlines to remind the user, if the user has
+	// neither given orders nor marked themselves ready.
+	DeadlineReminderMinutes []int `methods:"PUT"`
+	// WebPushSubscriptions get the same notifications as FCMTokens, via standard Web Push.
+	WebPushSubscriptions []WebPushSubscription `methods:"PUT"`
+	// Locale overrides the locale from the OAuth profile when translating notifications and emails.
+	Locale     string     `methods:"PUT"`
+	QuietHours QuietHours `methods:"PUT"`
+	// CalendarToken authenticates the deadlines calendar of the user. It can't be PUT, only reset.
+	CalendarToken string `json:"-" datastore:",noindex"`
+}
+
+func (u *UserConfig) Validate() error {
+	if len(u.DeadlineReminderMinutes) > maxDeadlineReminders {
+		return HTTPErr{fmt.Sprintf("can't have more than %v deadline reminders", maxDeadlineReminders), http.StatusBadRequest}
+	}
+	for _, minutes := range u.DeadlineReminderMinutes {
+		if minutes < 1 || minutes > maxDeadlineReminderMinutes {
+			return HTTPErr{fmt.Sprintf("deadline reminders must be between 1 and %v minutes before the deadline", maxDeadlineReminderMinutes), http.StatusBadRequest}
+		}
+	}
+	for i := range u.WebPushSubscriptions {
+		if err := u.WebPushSubscriptions[i].Validate(); err != nil {
+			return err
+		}
+	}
+	if err := u.QuietHours.Validate(); err != nil {
+		return err
+	}
+	if u.Locale != "" && matchLanguage(u.Locale) == "" {
+		return HTTPErr{fmt.Sprintf("unsupported locale %q, supported languages are %v", u.Locale, Languages()), http.StatusBadRequest}
+	}
+	return nil
 }
 
 var UserConfigResource = &Resource{
@@ -208,7 +370,7 @@ func (u *UserConfig) Item(r Request) *Item {
 				"A disabled flag which will turn notification to that token off, and which the server toggles if FCM returns errors when notifications are sent to that token.",
 				"A note field, which the server will populate with the reason the token was disabled.",
 				"An app field, which the app populating the token can use to identify tokens belonging to it to avoid removing/updating tokens belonging to other apps.",
-				"Two template fields, one for phase and one for message notifications.",
+				"Three template fields, for phase notifications, message notifications and deadline reminders.",
 				"Each token also has a `ReplaceToken` defined by the client. Defining a `ReplaceToken` other than the empty strings allows the client to replace the `Value` in the token without requiring a regular authentication token.",
 			},
 			[]string{
@@ -228,14 +390,38 @@ func (u *UserConfig) Item(r Request) *Item {
 				"New message FCM notifications",
 				"FCM notifications for new messages will have the payload `{ DiplicityJSON: DATA }` where DATA is `{ message: [message JSON], type: 'message' }` compressed with libz.",
 			},
+			[]string{
+				"Web Push subscriptions",
+				"Browsers can receive the same notifications as FCM tokens without Firebase, by subscribing with the VAPID public key from `/WebPush/VAPIDPublicKey` as `applicationServerKey` and adding the JSON serialization of the subscription (`Endpoint` and the `P256dh` and `Auth` keys) to `WebPushSubscriptions`.",
+				"Each subscription has the same disabled flag, note, app and template fields as FCM tokens, and is disabled by the server if the push service reports it gone.",
+				"The pushed payload is the JSON object `{ notification: { title, body, tag, click_action }, data: { DiplicityJSON: DATA } }`, where DATA is the same as for FCM. The data is left out if the payload would be too large for the push service.",
+			},
+			[]string{
+				"Deadline reminders",
+				fmt.Sprintf("`DeadlineReminderMinutes` lists up to %v reminders, in minutes before phase deadlines, e.g. `[1440, 360, 60]`.", maxDeadlineReminders),
+				"Reminders are only sent for phases where the user has neither given any orders nor marked themselves ready to resolve, using both FCM and email.",
+				"FCM reminders will have the payload `{ DiplicityJSON: DATA }` where DATA is `{ phaseMeta: [phase JSON], gameID: [game ID], type: 'deadlineReminder' }` compressed with libz. The templates get `remainingMinutes` in addition to the phase notification data.",
+			},
+			[]string{
+				"Locale",
+				fmt.Sprintf("Notifications, emails and pages generated by the server are translated to the language of `Locale`, or of the locale in the OAuth profile if `Locale` is empty. The supported languages are %v, and other locales get English.", Languages()),
+				"Custom templates are not translated.",
+			},
+			[]string{
+				"Quiet hours",
+				"`QuietHours` holds FCM, Web Push and mail notifications between `Start` and `End`, formatted like `22:30`, every day in the IANA time zone `Location` (e.g. `Europe/Stockholm`, or UTC if empty). Held notifications are delivered when the quiet hours end, summarized in one notification per destination if several were held.",
+				"Deadline reminders that would be sent during quiet hours are sent just before the quiet hours start instead, or skipped if that time has already passed.",
+			},
 			[]string{
 				"Email config",
 				"A user has an email config, defining if and how this user should receive email about new phases and messages.",
 				"The email config contains several fields.",
 				"An enabled flag which turns email notifications on.",
 				"Information about whether the unsubscribe link in the email should render some HTML or redirect to another host, defined by two Handlebars templates, one for the redirect link and one for the HTML to display.",
-				"Two template fields, one for phase and one for message notifications.",
+				"Three template fields, for phase notifications, message notifications and deadline reminders.",
 				"All templates will be parsed by the same parser as the FCM templates.",
+				fmt.Sprintf("A digest field, which batches message and phase notifications into one email per hour (`%s`) or per day (`%s`), grouped by game and channel. Each channel and phase in a digest lists its own reply address.", HourlyMailDigest, DailyMailDigest),
+				"Replies to phase notification email can contain orders, one per line in standard notation (e.g. `A PAR - BUR`), and the commands `READY`, `NOT READY`, `DIAS` and `NO DIAS`. A mail confirming which orders were accepted will be sent back.",
 			},
 		})
 }
@@ -285,13 +471,29 @@ func updateUserConfig(w ResponseWriter, r Request) (*UserConfig, error) {
 		if err := token.PhaseConfig.Validate(); err != nil {
 			return nil, err
 		}
+		if err := token.ReminderConfig.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
 
 	if err := config.MailConfig.Validate(); err != nil {
 		return nil, err
 	}
 
-	if _, err := datastore.Put(ctx, config.ID(ctx), config); err != nil {
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		existing := &UserConfig{}
+		if err := datastore.Get(ctx, config.ID(ctx), existing); err == nil {
+			config.CalendarToken = existing.CalendarToken
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err := datastore.Put(ctx, config.ID(ctx), config)
+		return err
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,82 @@
+package diptest
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/game"
+	"github.com/zond/godip"
+)
+
+func TestDeadlinesICalendar(t *testing.T) {
+	deadline := time.Date(2026, 3, 1, 18, 30, 0, 0, time.FixedZone("CET", 3600))
+	ical := string(game.RenderDeadlinesICalendar([]game.DeadlineEvent{
+		{
+			GameID: "game1",
+			Desc:   "Friendly, casual; " + strings.Repeat("long ", 20),
+			Phase: game.PhaseMeta{
+				PhaseOrdinal: 3,
+				Season:       godip.Fall,
+				Year:         1901,
+				Type:         godip.Movement,
+				DeadlineAt:   deadline,
+			},
+			GameURL: "https://example.com/Game/game1",
+		},
+	}, deadline.Add(-time.Hour)))
+
+	if !strings.HasPrefix(ical, "BEGIN:VCALENDAR\r\n") || !strings.HasSuffix(ical, "END:VCALENDAR\r\n") {
+		t.Errorf("Got %q, wanted a VCALENDAR", ical)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(ical, "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("Got unfolded line %q", line)
+		}
+	}
+	unfolded := strings.Replace(ical, "\r\n ", "", -1)
+	for _, want := range []string{
+		"UID:game1-3@diplicity\r\n",
+		"DTSTART:20260301T173000Z\r\n",
+		"DTSTAMP:20260301T163000Z\r\n",
+		"SUMMARY:Friendly\\, casual\\; long ",
+		"URL:https://example.com/Game/game1\r\n",
+		"\\nhttps://example.com/Game/game1\r\n",
+	} {
+		if !strings.Contains(unfolded, want) {
+			t.Errorf("Got %q, wanted it to contain %q", unfolded, want)
+		}
+	}
+}
+
+func TestResetDeadlinesCalendar(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+	calendarURL := func() string {
+		return env.GetRoute(game.IndexRoute).Success().
+			Find("deadlines-calendar", []string{"Links"}, []string{"Rel"}).
+			GetValue("URL").(string)
+	}
+
+	oldURL := calendarURL()
+	if got := calendarURL(); got != oldURL {
+		t.Errorf("Got calendar URL %q, wanted the same %q as before", got, oldURL)
+	}
+	if body := string(NewEnv().GetURL(oldURL).Raw().Success().BodyBytes); !strings.Contains(body, "BEGIN:VCALENDAR") {
+		t.Errorf("Got %q, wanted a calendar", body)
+	}
+	NewEnv().GetURL(oldURL + "x").Raw().Status(http.StatusForbidden)
+
+	NewEnv().SetUID(String("fake")).PostRoute(game.ResetDeadlinesCalendarRoute).
+		RouteParams("user_id", env.GetUID()).Status(http.StatusForbidden)
+
+	newURL := env.GetRoute(game.IndexRoute).Success().
+		Follow("reset-deadlines-calendar", "Links").Success().
+		Find("deadlines-calendar", []string{"Links"}, []string{"Rel"}).
+		GetValue("URL").(string)
+	if newURL == oldURL || calendarURL() != newURL {
+		t.Errorf("Got calendar URL %q after resetting %q, wanted a new one", newURL, oldURL)
+	}
+	NewEnv().GetURL(oldURL).Raw().Status(http.StatusForbidden)
+	NewEnv().GetURL(newURL).Raw().Success()
+}
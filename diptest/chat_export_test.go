@@ -0,0 +1,56 @@
+package diptest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/game"
+	"github.com/zond/godip"
+)
+
+func TestChatExportRendering(t *testing.T) {
+	created := time.Date(1901, 1, 1, 12, 0, 0, 0, time.UTC)
+	export := &game.ChatExport{
+		Desc:    "post mortem",
+		Variant: "Classical",
+		Channels: []game.ChatExportChannel{
+			{
+				Members: game.Nations{godip.Austria, godip.England},
+				Phases: []game.ChatExportPhase{
+					{
+						Season:     godip.Spring,
+						Year:       1901,
+						Type:       godip.Movement,
+						CreatedAt:  created,
+						ResolvedAt: created.Add(time.Hour),
+						Messages: game.Messages{
+							{
+								Sender:    godip.Austria,
+								Body:      "<b>hello</b>",
+								CreatedAt: created.Add(time.Minute),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	text := export.Text()
+	for _, want := range []string{
+		"=== Austria, England ===",
+		"--- Spring 1901, Movement (started 1901-01-01 12:00:00 UTC, resolved 1901-01-01 13:00:00 UTC) ---",
+		"[1901-01-01 12:01:00 UTC] Austria: <b>hello</b>",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Got %q, wanted it to contain %q", text, want)
+		}
+	}
+	html, err := export.HTML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(html), "<b>hello</b>") || !strings.Contains(string(html), "&lt;b&gt;hello&lt;/b&gt;") {
+		t.Errorf("Got %q, wanted escaped message body", html)
+	}
+}
@@ -1,9 +1,14 @@
 package diptest
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/zond/diplicity/game"
 	"github.com/zond/godip/variants/classical"
@@ -140,7 +145,7 @@ func testChat(t *testing.T) {
 			Follow("my-started-games", "Links").Success().
 			Find(startedGameID, []string{"Properties"}, []string{"Properties", "ID"}).
 			Find(startedGameNats[0], []string{"Properties", "Members"}, []string{"Nation"}).
-			AssertEq(float64(0), "UnreadMessages")
+			AssertEq(float64(1), "UnreadMessages")
 		startedGames[0].Follow("channels", "Links").Success().
 			Find(chanName, []string{"Properties"}, []string{"Name"}).
 			AssertEq(2.0, "Properties", "NMessages").
@@ -189,6 +194,340 @@ func testChat(t *testing.T) {
 				AssertEq(0.0, "Properties", "NMessagesSince", "NMessages")
 		}
 	})
+
+	t.Run("TestEditingDeletingAndReacting", func(t *testing.T) {
+		members := sort.StringSlice{startedGameNats[0], startedGameNats[2]}
+		sort.Sort(members)
+		chanName := strings.Join(members, ",")
+
+		bdy := String("body")
+		editedBdy := String("body")
+
+		startedGames[0].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           bdy,
+			"ChannelMembers": members,
+		}).Success()
+
+		startedGames[2].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			Follow("messages", "Links").Success().
+			Find(bdy, []string{"Properties"}, []string{"Properties", "Body"}).
+			AssertNotRel("update", "Links").
+			Follow("react", "Links").Body(map[string]interface{}{
+			"Reaction": "ack",
+		}).Success()
+
+		startedGames[0].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			Follow("messages", "Links").Success().
+			Find(bdy, []string{"Properties"}, []string{"Properties", "Body"}).
+			AssertEq("ack", "Properties", "Reactions", "0", "Reaction").
+			Follow("update", "Links").Body(map[string]interface{}{
+			"Body": editedBdy,
+		}).Success().
+			AssertEq(editedBdy, "Properties", "Body").
+			AssertEq(bdy, "Properties", "Edits", "0", "Body")
+
+		startedGames[0].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			AssertEq(1.0, "Properties", "NMessages").
+			Follow("messages", "Links").Success().
+			Find(editedBdy, []string{"Properties"}, []string{"Properties", "Body"}).
+			Follow("delete", "Links").Success()
+
+		startedGames[2].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			AssertEq(0.0, "Properties", "NMessages").
+			AssertEq(0.0, "Properties", "NMessagesSince", "NMessages").
+			Follow("messages", "Links").Success().
+			AssertNotFind(editedBdy, []string{"Properties"}, []string{"Properties", "Body"}).
+			Find(true, []string{"Properties"}, []string{"Properties", "Deleted"}).
+			AssertEq("", "Properties", "Body")
+	})
+
+	t.Run("TestSearchMessages", func(t *testing.T) {
+		needle := String("needle")
+
+		startedGames[0].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           "I promise " + needle + " in 1903",
+			"ChannelMembers": members,
+		}).Success()
+
+		for _, i := range []int{0, 1} {
+			startedGames[i].Follow("search-messages", "Links").
+				QueryParams(url.Values{"q": []string{strings.ToUpper(needle) + " 1903"}}).Success().
+				AssertLen(1, "Properties").
+				AssertEq(startedGameNats[0], "Properties", "0", "Properties", "Sender")
+		}
+
+		startedGames[2].Follow("search-messages", "Links").
+			QueryParams(url.Values{"q": []string{needle}}).Success().
+			AssertEmpty("Properties")
+
+		startedGames[0].Follow("search-messages", "Links").
+			QueryParams(url.Values{"q": []string{needle + " from:" + startedGameNats[1]}}).Success().
+			AssertEmpty("Properties")
+
+		startedGames[0].Follow("search-messages", "Links").
+			QueryParams(url.Values{"q": []string{needle + " before:2000-01-01"}}).Success().
+			AssertEmpty("Properties")
+
+		startedGames[0].Follow("search-messages", "Links").
+			QueryParams(url.Values{"q": []string{needle + " after:2000-01-01"}}).Success().
+			AssertLen(1, "Properties")
+
+		startedGames[0].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           "Another " + needle,
+			"ChannelMembers": members,
+		}).Success()
+
+		newest := startedGames[0].Follow("search-messages", "Links").
+			QueryParams(url.Values{"q": []string{needle}, "limit": []string{"1"}}).Success().
+			AssertLen(1, "Properties").
+			AssertEq("Another "+needle, "Properties", "0", "Properties", "Body")
+		newest.Follow("next", "Links").Success().
+			AssertLen(1, "Properties").
+			AssertEq("I promise "+needle+" in 1903", "Properties", "0", "Properties", "Body").
+			AssertNotRel("next", "Links")
+	})
+
+	t.Run("TestChatBridge", func(t *testing.T) {
+		members := sort.StringSlice{startedGameNats[0], startedGameNats[2]}
+		sort.Sort(members)
+		chanName := strings.Join(members, ",")
+
+		mirrored := make(chan game.ChatBridgeMessage, 10)
+		stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			msg := game.ChatBridgeMessage{}
+			if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mirrored <- msg
+		}))
+		defer stub.Close()
+
+		bridge := startedGames[2].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			Follow("bridges", "Links").Success().
+			Follow("create", "Links").Body(map[string]interface{}{
+			"URL": stub.URL,
+		}).Success()
+
+		bdy := String("body")
+		startedGames[0].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           bdy,
+			"ChannelMembers": members,
+		}).Success()
+
+		WaitForEmptyQueue("game-mirrorToChatBridges")
+		WaitForEmptyQueue("game-postToChatBridge")
+
+		select {
+		case msg := <-mirrored:
+			if msg.Text != bdy || msg.Username != startedGameNats[0] {
+				t.Errorf("Wanted %q from %q to be mirrored, got %+v", bdy, startedGameNats[0], msg)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Got no mirrored message")
+		}
+
+		reply := String("reply")
+		bridge.Follow("incoming", "Links").Body(map[string]interface{}{
+			"text": reply,
+		}).Success()
+
+		startedGames[0].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			Follow("messages", "Links").Success().
+			Find(reply, []string{"Properties"}, []string{"Properties", "Body"}).
+			AssertEq(startedGameNats[2], "Properties", "Sender")
+
+		bridge.Follow("delete", "Links").Success()
+		bridge.Follow("incoming", "Links").Body(map[string]interface{}{
+			"text": String("reply"),
+		}).Failure()
+	})
+
+	t.Run("TestAttachments", func(t *testing.T) {
+		members := sort.StringSlice{startedGameNats[0], startedGameNats[2]}
+		sort.Sort(members)
+		chanName := strings.Join(members, ",")
+
+		capitals := map[string]string{
+			"Austria": "vie",
+			"England": "lon",
+			"France":  "par",
+			"Germany": "ber",
+			"Italy":   "rom",
+			"Russia":  "mos",
+			"Turkey":  "con",
+		}
+
+		bdy := String("body")
+		startedGames[0].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           bdy,
+			"ChannelMembers": members,
+			"Attachment": map[string]interface{}{
+				"Type":         game.OrdersAttachment,
+				"PhaseOrdinal": 1,
+				"Orders": []map[string]interface{}{
+					{
+						"Nation": startedGameNats[2],
+						"Order":  capitals[startedGameNats[2]] + " Hold",
+					},
+				},
+			},
+		}).Success()
+
+		startedGames[0].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           String("body"),
+			"ChannelMembers": members,
+			"Attachment": map[string]interface{}{
+				"Type":         game.MapAttachment,
+				"PhaseOrdinal": 1,
+				"Annotations": []map[string]interface{}{
+					{
+						"Type":     "Cross",
+						"Province": "not-a-province",
+					},
+				},
+			},
+		}).Failure()
+
+		startedGames[0].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			Follow("messages", "Links").Success().
+			Find(bdy, []string{"Properties"}, []string{"Properties", "Body"}).
+			AssertRel("attachment-map", "Links").
+			AssertNotRel("copy-orders", "Links")
+
+		startedGames[2].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			Follow("messages", "Links").Success().
+			Find(bdy, []string{"Properties"}, []string{"Properties", "Body"}).
+			Follow("copy-orders", "Links").Success().
+			AssertLen(1, "Properties")
+	})
+
+	t.Run("TestPendingMessages", func(t *testing.T) {
+		members := sort.StringSlice{startedGameNats[0], startedGameNats[2]}
+		sort.Sort(members)
+		chanName := strings.Join(members, ",")
+
+		soonBdy := String("body")
+		startedGames[0].Follow("pending-messages", "Links").Success().
+			Follow("create", "Links").Body(map[string]interface{}{
+			"Body":           soonBdy,
+			"ChannelMembers": members,
+			"DeliverAt":      time.Now().Add(2 * time.Second).Format(time.RFC3339Nano),
+		}).Success()
+
+		startedGames[0].Follow("pending-messages", "Links").Success().
+			Find(soonBdy, []string{"Properties"}, []string{"Properties", "Body"})
+
+		time.Sleep(3 * time.Second)
+		WaitForEmptyQueue("game-deliverPendingMessage")
+
+		startedGames[2].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			Follow("messages", "Links").Success().
+			Find(soonBdy, []string{"Properties"}, []string{"Properties", "Body"})
+		startedGames[0].Follow("pending-messages", "Links").Success().
+			AssertNotFind(soonBdy, []string{"Properties"}, []string{"Properties", "Body"})
+
+		laterBdy := String("body")
+		startedGames[0].Follow("pending-messages", "Links").Success().
+			Follow("create", "Links").Body(map[string]interface{}{
+			"Body":           laterBdy,
+			"ChannelMembers": members,
+			"DeliverAt":      time.Now().Add(time.Hour).Format(time.RFC3339Nano),
+		}).Success()
+
+		startedGames[2].Follow("pending-messages", "Links").Success().
+			AssertNotFind(laterBdy, []string{"Properties"}, []string{"Properties", "Body"})
+
+		startedGames[0].Follow("pending-messages", "Links").Success().
+			Find(laterBdy, []string{"Properties"}, []string{"Properties", "Body"}).
+			Follow("cancel", "Links").Success()
+
+		startedGames[0].Follow("pending-messages", "Links").Success().
+			AssertNotFind(laterBdy, []string{"Properties"}, []string{"Properties", "Body"})
+
+		startedGames[0].Follow("pending-messages", "Links").Success().
+			Follow("create", "Links").Body(map[string]interface{}{
+			"Body":           String("body"),
+			"ChannelMembers": members,
+		}).Failure()
+	})
+}
+
+func TestReadReceiptsAndMarkAllRead(t *testing.T) {
+	withStartedGameOpts(func(opts map[string]interface{}) {
+		opts["EnableReadReceipts"] = true
+	}, func() {
+		members := sort.StringSlice{startedGameNats[0], startedGameNats[1]}
+		sort.Sort(members)
+		chanName := strings.Join(members, ",")
+
+		bdy := String("body")
+		startedGames[0].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           bdy,
+			"ChannelMembers": members,
+		}).Success()
+
+		startedGames[0].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			Follow("messages", "Links").Success().
+			Find(bdy, []string{"Properties"}, []string{"Properties", "Body"}).
+			AssertLen(0, "Properties", "ReadBy")
+
+		startedGames[1].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			Follow("messages", "Links").Success()
+
+		startedGames[0].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			Follow("messages", "Links").Success().
+			Find(bdy, []string{"Properties"}, []string{"Properties", "Body"}).
+			AssertEq([]interface{}{startedGameNats[1]}, "Properties", "ReadBy")
+
+		for i := 0; i < 2; i++ {
+			startedGames[0].Follow("channels", "Links").Success().
+				Follow("message", "Links").Body(map[string]interface{}{
+				"Body":           String("body"),
+				"ChannelMembers": members,
+			}).Success()
+		}
+
+		startedGames[1].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			AssertEq(2.0, "Properties", "NMessagesSince", "NMessages")
+		startedGameEnvs[1].GetRoute(game.IndexRoute).Success().
+			Follow("my-started-games", "Links").Success().
+			Find(startedGameID, []string{"Properties"}, []string{"Properties", "ID"}).
+			Find(startedGameNats[1], []string{"Properties", "Members"}, []string{"Nation"}).
+			AssertEq(float64(2), "UnreadMessages")
+
+		startedGames[1].Follow("channels", "Links").Success().
+			Follow("mark-all-read", "Links").Success()
+
+		startedGames[1].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			AssertEq(0.0, "Properties", "NMessagesSince", "NMessages")
+		startedGameEnvs[1].GetRoute(game.IndexRoute).Success().
+			Follow("my-started-games", "Links").Success().
+			Find(startedGameID, []string{"Properties"}, []string{"Properties", "ID"}).
+			Find(startedGameNats[1], []string{"Properties", "Members"}, []string{"Nation"}).
+			AssertEq(float64(0), "UnreadMessages")
+	})
 }
 
 func TestDisabledChats(t *testing.T) {
@@ -310,3 +649,76 @@ func TestNonMemberSeeingAllMessagesInFinishedGames(t *testing.T) {
 
 	})
 }
+
+func TestPressRevealInFinishedGames(t *testing.T) {
+	t.Run("HidePress", func(t *testing.T) {
+		testPressRevealInFinishedGame(game.HidePress, false, false)
+	})
+	t.Run("RevealPressToMembers", func(t *testing.T) {
+		testPressRevealInFinishedGame(game.RevealPressToMembers, true, false)
+	})
+	t.Run("RevealPressToPublic", func(t *testing.T) {
+		testPressRevealInFinishedGame(game.RevealPressToPublic, true, true)
+	})
+}
+
+func testPressRevealInFinishedGame(reveal game.PressReveal, revealedToMembers bool, revealedToPublic bool) {
+	withStartedGameOpts(func(opts map[string]interface{}) {
+		opts["RevealPress"] = reveal
+	}, func() {
+		msg := String("message")
+		startedGames[0].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           msg,
+			"ChannelMembers": []string{startedGameNats[0], startedGameNats[1]},
+		}).Success()
+
+		newEnv := NewEnv().SetUID(String("fake"))
+
+		extGame := newEnv.GetRoute(game.ListStartedGamesRoute).Success().
+			Find(startedGameDesc, []string{"Properties"}, []string{"Properties", "Desc"})
+
+		extGame.Follow("channels", "Links").Success().
+			AssertNotRel("message", "Links").
+			AssertLen(0, "Properties")
+		startedGames[2].Follow("channels", "Links").Success().
+			AssertLen(0, "Properties")
+
+		for _, game := range startedGames {
+			p := game.Follow("phases", "Links").Success().
+				Find("Spring", []string{"Properties"}, []string{"Properties", "Season"})
+
+			p.Follow("phase-states", "Links").Success().
+				Find("", []string{"Properties"}, []string{"Properties", "Note"}).
+				Follow("update", "Links").Body(map[string]interface{}{
+				"ReadyToResolve": true,
+				"WantsDIAS":      true,
+			}).Success()
+		}
+
+		WaitForEmptyQueue("game-asyncResolvePhase")
+
+		extGame.Follow("channels", "Links").Success().
+			AssertNotRel("message", "Links")
+		if revealedToPublic {
+			extGame.Follow("channels", "Links").Success().
+				AssertLen(1, "Properties").
+				Find(1, []string{"Properties"}, []string{"Properties", "NMessages"}).
+				Follow("messages", "Links").Success().
+				Find(msg, []string{"Properties"}, []string{"Properties", "Body"})
+		} else {
+			extGame.Follow("channels", "Links").Success().
+				AssertLen(0, "Properties")
+		}
+		if revealedToMembers {
+			startedGames[2].Follow("channels", "Links").Success().
+				AssertLen(1, "Properties").
+				Find(1, []string{"Properties"}, []string{"Properties", "NMessages"}).
+				Follow("messages", "Links").Success().
+				Find(msg, []string{"Properties"}, []string{"Properties", "Body"})
+		} else {
+			startedGames[2].Follow("channels", "Links").Success().
+				AssertLen(0, "Properties")
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package diptest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/game"
+)
+
+func TestDeadlineReminderForNewPhase(t *testing.T) {
+	defer InstallFakeTransports(nil)()
+
+	withStartedGameOpts(func(opts map[string]interface{}) {
+		opts["PhaseLengthMinutes"] = 60
+	}, func() {
+		// With 60 minute phases, a reminder 59 minutes before the deadline is sent a minute into the phase.
+		configureNotifications(startedGameEnvs[0], String("token"), map[string]interface{}{
+			"DeadlineReminderMinutes": []int{59},
+		})
+
+		startedGameEnvs[0].GetRoute(game.DevResolvePhaseTimeoutRoute).
+			RouteParams("game_id", startedGameID, "phase_ordinal", "1").Success()
+		WaitForEmptyQueue("game-asyncResolvePhase")
+		startedGames[0].Follow("self", "Links").Success().
+			Find(2, []string{"Properties", "NewestPhaseMeta"}, []string{"PhaseOrdinal"}).
+			AssertEq(false, "Resolved")
+
+		// The user config was created after the first phase started, so any reminder is for the second phase.
+		recipient := startedGameEnvs[0].GetUID()
+		notifications := WaitForFakeNotifications(3*time.Minute, func(n *game.DevFakeNotifications) bool {
+			return len(notificationsTo(n.Mail, recipient, game.DeadlineReminderNotification, startedGameID)) > 0 &&
+				len(notificationsTo(n.FCM, recipient, game.DeadlineReminderNotification, startedGameID)) > 0
+		})
+		mails := notificationsTo(notifications.Mail, recipient, game.DeadlineReminderNotification, startedGameID)
+		if len(mails) != 1 || !strings.Contains(mails[0].Mail.Subject, "Fall 1901, Movement") {
+			t.Errorf("Got %v, wanted one reminder mail about Fall 1901, Movement", pp(mails))
+		}
+		pushes := notificationsTo(notifications.FCM, recipient, game.DeadlineReminderNotification, startedGameID)
+		if len(pushes) != 1 || !strings.Contains(pushes[0].Payload.Title, "Fall 1901, Movement") {
+			t.Errorf("Got %v, wanted one FCM reminder about Fall 1901, Movement", pp(pushes))
+		}
+	})
+}
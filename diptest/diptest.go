@@ -18,6 +18,7 @@ import (
 	"github.com/jmoiron/jsonq"
 	"github.com/kr/pretty"
 	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
 	"github.com/zond/diplicity/routes"
 	"google.golang.org/appengine/aetest"
 )
@@ -53,6 +54,42 @@ func WaitForEmptyQueue(name string) {
 	panic(fmt.Errorf("Queue not empty within deadline"))
 }
 
+// InstallFakeTransports makes the dev server record FCM messages and mail instead of delivering them, with the
+// fake FCM service reporting fcmErrors for the tokens. Call the returned func to uninstall the fakes.
+func InstallFakeTransports(fcmErrors map[string]string) func() {
+	NewEnv().PutRoute(game.DevFakeTransportsRoute).Body(game.DevFakeTransports{
+		FCMErrors: fcmErrors,
+	}).Success()
+	return func() {
+		NewEnv().DeleteRoute(game.DevFakeTransportsRoute).Success()
+	}
+}
+
+// FakeNotifications returns the notifications recorded by the fake transports of the dev server.
+func FakeNotifications() *game.DevFakeNotifications {
+	result := &game.DevFakeNotifications{}
+	if err := json.Unmarshal(NewEnv().GetRoute(game.DevFakeTransportsRoute).Success().BodyBytes, result); err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// WaitForFakeNotifications returns the notifications recorded by the fake transports once found returns true for
+// them, and panics if that doesn't happen within timeout.
+func WaitForFakeNotifications(timeout time.Duration, found func(*game.DevFakeNotifications) bool) *game.DevFakeNotifications {
+	deadline := time.Now().Add(timeout)
+	for {
+		notifications := FakeNotifications()
+		if found(notifications) {
+			return notifications
+		}
+		if deadline.Before(time.Now()) {
+			panic(fmt.Errorf("expected notifications not found within deadline, got %v", pp(notifications)))
+		}
+		time.Sleep(time.Millisecond * 200)
+	}
+}
+
 type aetestTransport struct {
 	instance aetest.Instance
 }
@@ -164,6 +201,7 @@ func NewEnv() *Env {
 type Env struct {
 	uid   string
 	email string
+	admin bool
 }
 
 func (e *Env) GetUID() string {
@@ -175,6 +213,13 @@ func (e *Env) SetEmail(m string) *Env {
 	return e
 }
 
+// SetAdmin makes the requests log in as an admin of the dev server, for handlers restricted to admins in
+// app.yaml, like the cron jobs.
+func (e *Env) SetAdmin(admin bool) *Env {
+	e.admin = admin
+	return e
+}
+
 func (e *Env) SetUID(uid string) *Env {
 	e.uid = uid
 	return e
@@ -188,6 +233,9 @@ type Req struct {
 	url         *url.URL
 	method      string
 	body        []byte
+	contentType string
+	header      http.Header
+	raw         bool
 }
 
 func (e *Env) PutRoute(route string) *Req {
@@ -198,6 +246,22 @@ func (e *Env) PutRoute(route string) *Req {
 	}
 }
 
+func (e *Env) PostRoute(route string) *Req {
+	return &Req{
+		env:    e,
+		route:  route,
+		method: "POST",
+	}
+}
+
+func (e *Env) DeleteRoute(route string) *Req {
+	return &Req{
+		env:    e,
+		route:  route,
+		method: "DELETE",
+	}
+}
+
 func (e *Env) GetRoute(route string) *Req {
 	return &Req{
 		env:    e,
@@ -237,6 +301,28 @@ func (r *Req) Body(i interface{}) *Req {
 	return r
 }
 
+// RawBody sets a non JSON body, like a mail to the mail receiving route.
+func (r *Req) RawBody(b []byte, contentType string) *Req {
+	r.body = b
+	r.contentType = contentType
+	return r
+}
+
+// Header adds a request header.
+func (r *Req) Header(key, value string) *Req {
+	if r.header == nil {
+		r.header = http.Header{}
+	}
+	r.header.Add(key, value)
+	return r
+}
+
+// Raw makes the request keep the response as is, instead of parsing it as JSON.
+func (r *Req) Raw() *Req {
+	r.raw = true
+	return r
+}
+
 type Result struct {
 	Env       *Env
 	URL       *url.URL
@@ -469,7 +555,17 @@ func (r *Req) do() *Result {
 		panic(fmt.Errorf("creating GET %q: %v", r.url, err))
 	}
 	req.Header.Set("Accept", "application/json; charset=utf-8")
-	if r.body != nil {
+	if r.env.admin {
+		req.AddCookie(&http.Cookie{Name: "dev_appserver_login", Value: "admin@example.com:True:1"})
+	}
+	for key, values := range r.header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if r.contentType != "" {
+		req.Header.Set("Content-Type", r.contentType)
+	} else if r.body != nil {
 		req.Header.Set("Content-Type", "application/json; charset=utf-8")
 	}
 	status, _, responseReader, err := T.Execute(req)
@@ -481,7 +577,7 @@ func (r *Req) do() *Result {
 		panic(fmt.Errorf("reading body from %+v: %v", req, err))
 	}
 	var result interface{}
-	if status > 199 && status < 300 {
+	if status > 199 && status < 300 && r.contentType == "" && !r.raw {
 		if len(responseBytes) > 0 {
 			if err := json.Unmarshal(responseBytes, &result); err != nil {
 				panic(fmt.Errorf("unmarshaling %q: %v", string(responseBytes), err))
@@ -0,0 +1,141 @@
+package diptest
+
+import (
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// smtpSinkMail is a mail received by an SMTP sink.
+type smtpSinkMail struct {
+	// Auth is the decoded AUTH PLAIN response, if the client authenticated.
+	Auth string
+	From string
+	To   []string
+	Data []byte
+}
+
+// smtpSink is a minimal local SMTP server recording all mail it receives, to test mail without network access.
+type smtpSink struct {
+	listener net.Listener
+	lock     sync.Mutex
+	received []smtpSinkMail
+}
+
+// newSMTPSink starts a sink listening on addr, e.g. "127.0.0.1:0".
+func newSMTPSink(addr string) (*smtpSink, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sink := &smtpSink{
+		listener: listener,
+	}
+	go sink.serve()
+	return sink, nil
+}
+
+func (s *smtpSink) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *smtpSink) Close() error {
+	return s.listener.Close()
+}
+
+// Received returns the mail received so far.
+func (s *smtpSink) Received() []smtpSinkMail {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]smtpSinkMail{}, s.received...)
+}
+
+func (s *smtpSink) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// smtpPath returns the address in MAIL FROM:<address> or RCPT TO:<address>, ignoring any parameters.
+func smtpPath(arg, prefix string) string {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return ""
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	if end := strings.Index(path, ">"); end != -1 {
+		path = path[:end]
+	}
+	return strings.TrimPrefix(path, "<")
+}
+
+func (s *smtpSink) handle(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	current := smtpSinkMail{}
+	tp.PrintfLine("220 localhost ESMTP sink")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		arg := strings.TrimSpace(line[len(verb):])
+		switch verb {
+		case "EHLO":
+			tp.PrintfLine("250-localhost")
+			tp.PrintfLine("250 AUTH PLAIN")
+		case "HELO", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "AUTH":
+			parts := strings.SplitN(arg, " ", 2)
+			if len(parts) != 2 || strings.ToUpper(parts[0]) != "PLAIN" {
+				tp.PrintfLine("504 only AUTH PLAIN with an initial response is supported")
+				continue
+			}
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				tp.PrintfLine("501 %v", err)
+				continue
+			}
+			current.Auth = string(decoded)
+			tp.PrintfLine("235 Authentication successful")
+		case "MAIL":
+			current.From = smtpPath(arg, "FROM:")
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			to := smtpPath(arg, "TO:")
+			if to == "" {
+				tp.PrintfLine("501 missing recipient")
+				continue
+			}
+			current.To = append(current.To, to)
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			current.Data = data
+			s.lock.Lock()
+			s.received = append(s.received, current)
+			s.lock.Unlock()
+			current = smtpSinkMail{Auth: current.Auth}
+			tp.PrintfLine("250 OK")
+		case "RSET":
+			current = smtpSinkMail{Auth: current.Auth}
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 %q not implemented", verb)
+		}
+	}
+}
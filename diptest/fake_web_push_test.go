@@ -0,0 +1,284 @@
+package diptest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	webPushRecordSize = 4096
+	webPushKeyInfo    = "WebPush: info\x00"
+	webPushCEKInfo    = "Content-Encoding: aes128gcm\x00"
+	webPushNonceInfo  = "Content-Encoding: nonce\x00"
+	webPushKeyLen     = 32
+	webPushCEKLen     = 16
+	webPushNonceLen   = 12
+	webPushSaltLen    = 16
+	webPushAuthLen    = 16
+	webPushPaddingEnd = 2
+)
+
+func fixedBytes(i *big.Int) []byte {
+	b := i.Bytes()
+	result := make([]byte, webPushKeyLen)
+	copy(result[webPushKeyLen-len(b):], b)
+	return result
+}
+
+func hkdfBytes(secret, salt []byte, info string, n int) ([]byte, error) {
+	result := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// webPushAEAD derives the content encryption key and nonce of RFC 8291, like the game package does when encrypting.
+func webPushAEAD(ecdhSecret, authSecret, uaPublic, asPublic, salt []byte) (cipher.AEAD, []byte, error) {
+	ikm, err := hkdfBytes(ecdhSecret, authSecret, webPushKeyInfo+string(uaPublic)+string(asPublic), webPushKeyLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	cek, err := hkdfBytes(ikm, salt, webPushCEKInfo, webPushCEKLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := hkdfBytes(ikm, salt, webPushNonceInfo, webPushNonceLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, nonce, nil
+}
+
+// decryptWebPush decrypts a single record aes128gcm body pushed to the subscription owning uaPrivate.
+func decryptWebPush(uaPrivate *ecdsa.PrivateKey, authSecret, body []byte) ([]byte, error) {
+	if len(body) < webPushSaltLen+5 {
+		return nil, fmt.Errorf("body of %v bytes is too short", len(body))
+	}
+	salt := body[:webPushSaltLen]
+	recordSize := binary.BigEndian.Uint32(body[webPushSaltLen:])
+	keyLen := int(body[webPushSaltLen+4])
+	if len(body) < webPushSaltLen+5+keyLen {
+		return nil, fmt.Errorf("body of %v bytes is too short", len(body))
+	}
+	asPublic := body[webPushSaltLen+5 : webPushSaltLen+5+keyLen]
+	ciphertext := body[webPushSaltLen+5+keyLen:]
+	if uint32(len(ciphertext)) > recordSize {
+		return nil, fmt.Errorf("only single record bodies are supported")
+	}
+	ax, ay := elliptic.Unmarshal(elliptic.P256(), asPublic)
+	if ax == nil {
+		return nil, fmt.Errorf("body doesn't contain a P-256 public key")
+	}
+	sx, _ := elliptic.P256().ScalarMult(ax, ay, fixedBytes(uaPrivate.D))
+	uaPublic := elliptic.Marshal(elliptic.P256(), uaPrivate.X, uaPrivate.Y)
+	aead, nonce, err := webPushAEAD(fixedBytes(sx), authSecret, uaPublic, asPublic, salt)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	plaintext = bytes.TrimRight(plaintext, "\x00")
+	if len(plaintext) == 0 || plaintext[len(plaintext)-1] != webPushPaddingEnd {
+		return nil, fmt.Errorf("last record doesn't end with the padding delimiter")
+	}
+	return plaintext[:len(plaintext)-1], nil
+}
+
+// fakeWebPushService is a Web Push service verifying VAPID authorization and decrypting pushes with the keys of
+// the subscriptions it created, to test Web Push without network access.
+type fakeWebPushService struct {
+	lock        sync.Mutex
+	publicKey   string
+	subscribers map[string]*fakeWebPushSubscriber
+	received    map[string][][]byte
+}
+
+type fakeWebPushSubscriber struct {
+	origin     string
+	private    *ecdsa.PrivateKey
+	authSecret []byte
+}
+
+// newFakeWebPushService creates a service accepting pushes authorized by the VAPID key pair with vapidPublicKey.
+func newFakeWebPushService(vapidPublicKey string) *fakeWebPushService {
+	return &fakeWebPushService{
+		publicKey:   strings.TrimRight(vapidPublicKey, "="),
+		subscribers: map[string]*fakeWebPushSubscriber{},
+		received:    map[string][][]byte{},
+	}
+}
+
+// Subscribe creates a subscription pushing to endpoint, which must be served by this service, like a browser would.
+func (f *fakeWebPushService) Subscribe(endpoint string) (*auth.WebPushSubscription, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	authSecret := make([]byte, webPushAuthLen)
+	if _, err := rand.Read(authSecret); err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.subscribers[u.Path] = &fakeWebPushSubscriber{
+		origin:     fmt.Sprintf("%s://%s", u.Scheme, u.Host),
+		private:    private,
+		authSecret: authSecret,
+	}
+	return &auth.WebPushSubscription{
+		Endpoint: endpoint,
+		P256dh:   base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), private.X, private.Y)),
+		Auth:     base64.RawURLEncoding.EncodeToString(authSecret),
+	}, nil
+}
+
+// Unsubscribe makes the service respond 410 Gone to further pushes to endpoint.
+func (f *fakeWebPushService) Unsubscribe(endpoint string) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.subscribers, u.Path)
+}
+
+// Received returns the decrypted payloads pushed to endpoint.
+func (f *fakeWebPushService) Received(endpoint string) [][]byte {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([][]byte{}, f.received[u.Path]...)
+}
+
+func (f *fakeWebPushService) verifyVAPID(authorization, origin string) error {
+	if !strings.HasPrefix(authorization, "vapid ") {
+		return fmt.Errorf("authorization %q isn't vapid", authorization)
+	}
+	params := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(authorization, "vapid "), ",") {
+		if kv := strings.SplitN(strings.TrimSpace(part), "=", 2); len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		}
+	}
+	if params["k"] != f.publicKey {
+		return fmt.Errorf("VAPID key %q isn't %q", params["k"], f.publicKey)
+	}
+	publicKey, err := auth.DecodeWebPushKey(params["k"])
+	if err != nil {
+		return err
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), publicKey)
+	if x == nil {
+		return fmt.Errorf("VAPID key isn't a P-256 public key")
+	}
+	parts := strings.Split(params["t"], ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("VAPID token %q isn't a JWT", params["t"])
+	}
+	signature, err := auth.DecodeWebPushKey(parts[2])
+	if err != nil {
+		return err
+	}
+	if len(signature) != 2*webPushKeyLen {
+		return fmt.Errorf("VAPID signature isn't %v bytes", 2*webPushKeyLen)
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, hash[:], new(big.Int).SetBytes(signature[:webPushKeyLen]), new(big.Int).SetBytes(signature[webPushKeyLen:])) {
+		return fmt.Errorf("VAPID signature doesn't verify")
+	}
+	claimBytes, err := auth.DecodeWebPushKey(parts[1])
+	if err != nil {
+		return err
+	}
+	claims := struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}{}
+	if err := json.Unmarshal(claimBytes, &claims); err != nil {
+		return err
+	}
+	if claims.Aud != origin {
+		return fmt.Errorf("VAPID audience %q isn't %q", claims.Aud, origin)
+	}
+	if time.Unix(claims.Exp, 0).Before(time.Now()) {
+		return fmt.Errorf("VAPID token expired at %v", time.Unix(claims.Exp, 0))
+	}
+	if claims.Sub == "" {
+		return fmt.Errorf("VAPID token has no subject")
+	}
+	return nil
+}
+
+func (f *fakeWebPushService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	subscriber, found := f.subscribers[r.URL.Path]
+	if !found {
+		http.Error(w, "subscription gone", http.StatusGone)
+		return
+	}
+	if err := f.verifyVAPID(r.Header.Get("Authorization"), subscriber.origin); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("TTL") == "" {
+		http.Error(w, "missing aes128gcm Content-Encoding or TTL", http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > webPushRecordSize {
+		http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	payload, err := decryptWebPush(subscriber.private, subscriber.authSecret, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.received[r.URL.Path] = append(f.received[r.URL.Path], payload)
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,133 @@
+package diptest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/game"
+)
+
+type streamedEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// streamGameEvents returns the events of one response of the game event stream, and the ID to resume from.
+func streamGameEvents(env *Env, lastEventID string) ([]streamedEvent, string) {
+	req := env.GetRoute(game.StreamGameEventsRoute).RouteParams("game_id", startedGameID).Raw()
+	if lastEventID != "" {
+		req.Header("Last-Event-ID", lastEventID)
+	}
+	body := string(req.Success().BodyBytes)
+
+	events := []streamedEvent{}
+	resumeID := ""
+	for _, block := range strings.Split(body, "\n\n") {
+		event := streamedEvent{}
+		for _, line := range strings.Split(block, "\n") {
+			if strings.HasPrefix(line, "id: ") {
+				event.ID = strings.TrimPrefix(line, "id: ")
+				resumeID = event.ID
+			} else if strings.HasPrefix(line, "event: ") {
+				event.Event = strings.TrimPrefix(line, "event: ")
+			} else if strings.HasPrefix(line, "data: ") {
+				event.Data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+		if event.Event != "" {
+			events = append(events, event)
+		}
+	}
+	return events, resumeID
+}
+
+// streamedMessages returns which of the message bodies the message events contain.
+func streamedMessages(events []streamedEvent, bodies ...string) map[string]bool {
+	result := map[string]bool{}
+	for _, event := range events {
+		if event.Event != "message" {
+			continue
+		}
+		for _, body := range bodies {
+			if strings.Contains(event.Data, body) {
+				result[body] = true
+			}
+		}
+	}
+	return result
+}
+
+func TestGameEventStream(t *testing.T) {
+	withStartedGame(func() {
+		publicChannel := sort.StringSlice(append([]string{}, startedGameNats...))
+		sort.Sort(publicChannel)
+
+		// Messages created before the stream was first connected aren't streamed.
+		start := fmt.Sprint(time.Now().UnixNano())
+
+		startedGames[1].Follow("game-states", "Links").Success().
+			Find(startedGameNats[1], []string{"Properties"}, []string{"Properties", "Nation"}).
+			Follow("update", "Links").Body(map[string]interface{}{
+			"Muted": []string{startedGameNats[2]},
+		}).Success()
+
+		private := String("private")
+		muted := String("muted")
+		public := String("public")
+		for _, msg := range []struct {
+			sender  int
+			body    string
+			members []string
+		}{
+			{0, private, []string{startedGameNats[0], startedGameNats[1]}},
+			{2, muted, publicChannel},
+			{3, public, publicChannel},
+		} {
+			startedGames[msg.sender].Follow("channels", "Links").Success().
+				Follow("message", "Links").Body(map[string]interface{}{
+				"Body":           msg.body,
+				"ChannelMembers": msg.members,
+			}).Success()
+		}
+
+		var resumeID string
+		t.Run("TestVisibility", func(t *testing.T) {
+			for _, viewer := range []struct {
+				desc string
+				env  *Env
+				want map[string]bool
+			}{
+				{"channel member muting the sender", startedGameEnvs[1], map[string]bool{private: true, public: true}},
+				{"member", startedGameEnvs[4], map[string]bool{muted: true, public: true}},
+				{"non member", NewEnv().SetUID(String("fake")), map[string]bool{muted: true, public: true}},
+			} {
+				events, id := streamGameEvents(viewer.env, start)
+				if got := streamedMessages(events, private, muted, public); fmt.Sprint(got) != fmt.Sprint(viewer.want) {
+					t.Errorf("Got %v streamed to %v, wanted %v", got, viewer.desc, viewer.want)
+				}
+				if viewer.env == startedGameEnvs[1] {
+					resumeID = id
+				}
+			}
+		})
+
+		t.Run("TestResume", func(t *testing.T) {
+			later := String("later")
+			startedGames[0].Follow("channels", "Links").Success().
+				Follow("message", "Links").Body(map[string]interface{}{
+				"Body":           later,
+				"ChannelMembers": []string{startedGameNats[0], startedGameNats[1]},
+			}).Success()
+
+			events, _ := streamGameEvents(startedGameEnvs[1], resumeID)
+			want := map[string]bool{later: true}
+			if got := streamedMessages(events, private, public, later); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("Got %v streamed after resuming, wanted only %v", got, want)
+			}
+		})
+	})
+}
@@ -1,6 +1,11 @@
 package diptest
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/zond/diplicity/game"
+	"github.com/zond/godip"
+)
 
 func testGameState(t *testing.T) {
 	g0 := startedGames[0]
@@ -40,4 +45,70 @@ func testGameState(t *testing.T) {
 		Find(nat1, []string{"Properties"}, []string{"Properties", "Nation"}).
 		AssertNil("Properties", "Muted")
 
+	channel := game.Nations{godip.Nation(nat0), godip.Nation(nat1)}
+	g1.Follow("game-states", "Links").Success().
+		Find(nat1, []string{"Properties"}, []string{"Properties", "Nation"}).
+		Follow("update", "Links").Body(map[string]interface{}{
+		"Notifications": "Sometimes",
+	}).Failure()
+	g1.Follow("game-states", "Links").Success().
+		Find(nat1, []string{"Properties"}, []string{"Properties", "Nation"}).
+		Follow("update", "Links").Body(map[string]interface{}{
+		"Notifications": game.PhaseNotificationsOnly,
+		"ChannelNotifications": []interface{}{
+			map[string]interface{}{
+				"Channel":       channel.String(),
+				"Notifications": game.MentionNotificationsOnly,
+			},
+		},
+	}).Success().
+		AssertEq(game.PhaseNotificationsOnly, "Properties", "Notifications")
+	g1.Follow("game-states", "Links").Success().
+		Find(nat1, []string{"Properties"}, []string{"Properties", "Nation"}).
+		Follow("update", "Links").Body(map[string]interface{}{
+		"Notifications": game.AllNotifications,
+	}).Success()
+}
+
+func TestGameStateNotifications(t *testing.T) {
+	gameState := &game.GameState{
+		Nation:        godip.England,
+		Notifications: game.PhaseNotificationsOnly,
+		ChannelNotifications: []game.ChannelNotifications{
+			{
+				Channel:       "England,France",
+				Notifications: game.MentionNotificationsOnly,
+			},
+		},
+	}
+	for _, tc := range []struct {
+		message *game.Message
+		want    bool
+	}{
+		{&game.Message{ChannelMembers: game.Nations{godip.England, godip.Germany}, Body: "hello"}, false},
+		{&game.Message{ChannelMembers: game.Nations{godip.England, godip.Germany}, Body: "hello @england"}, true},
+		{&game.Message{ChannelMembers: game.Nations{godip.France, godip.England}, Body: "hello"}, false},
+		{&game.Message{ChannelMembers: game.Nations{godip.France, godip.England}, Body: "hello @Englandish"}, false},
+		{&game.Message{ChannelMembers: game.Nations{godip.France, godip.England}, Body: "hello @England"}, true},
+		{&game.Message{ChannelMembers: game.Nations{godip.France, godip.England}, Body: "hello @all"}, true},
+		{&game.Message{ChannelMembers: game.Nations{godip.France, godip.Germany}, Body: "hello @England"}, false},
+		{&game.Message{ChannelMembers: game.Nations{godip.France, godip.England}, Sender: godip.England, Body: "hello @England"}, false},
+	} {
+		tc.message.ParseMentions()
+		if got := gameState.WantsMessageNotification(tc.message); got != tc.want {
+			t.Errorf("Got %v for %+v, wanted %v", got, tc.message, tc.want)
+		}
+	}
+	if !gameState.WantsPhaseNotifications() {
+		t.Errorf("Got no phase notifications for %+v, wanted some", gameState)
+	}
+	gameState.Notifications = game.NoNotifications
+	if gameState.WantsPhaseNotifications() {
+		t.Errorf("Got phase notifications for %+v, wanted none", gameState)
+	}
+	mention := &game.Message{ChannelMembers: game.Nations{godip.France, godip.England}, Body: "hello @England"}
+	mention.ParseMentions()
+	if gameState.WantsMessageNotification(mention) {
+		t.Errorf("Got message notification for %+v, wanted none", gameState)
+	}
 }
@@ -0,0 +1,65 @@
+package diptest
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+
+	"github.com/zond/diplicity/auth"
+)
+
+var formatVerbReg = regexp.MustCompile(`%(\[\d+\])?[-+# 0]*\d*(\.\d+)?[a-zA-Z%]`)
+
+func formatVerbs(format string) []string {
+	verbs := []string{}
+	for _, match := range formatVerbReg.FindAllString(format, -1) {
+		verbs = append(verbs, match[len(match)-1:])
+	}
+	sort.Strings(verbs)
+	return verbs
+}
+
+func TestLocalization(t *testing.T) {
+	for _, tc := range []struct {
+		locales  []string
+		language string
+	}{
+		{[]string{"sv-SE"}, "sv"},
+		{[]string{"", "de_DE"}, "de"},
+		{[]string{"xx", "sv"}, "sv"},
+		{[]string{"en-GB", "sv"}, "en"},
+		{[]string{"xx"}, auth.DefaultLanguage},
+		{nil, auth.DefaultLanguage},
+	} {
+		if got := auth.NewLocalizer(tc.locales...).Language; got != tc.language {
+			t.Errorf("Got %q for %+v, wanted %q", got, tc.locales, tc.language)
+		}
+	}
+
+	user := &auth.User{Locale: "de"}
+	if got := auth.NewUserLocalizer(user, &auth.UserConfig{Locale: "sv"}).Sprintf("%s has a new phase.", "Game"); got != "Game har en ny fas." {
+		t.Errorf("Got %q, wanted the user config locale to override the user locale", got)
+	}
+	if got := auth.NewUserLocalizer(user, nil).Translate("Spring"); got != "Frühling" {
+		t.Errorf("Got %q, wanted the user locale", got)
+	}
+	if got := auth.NewLocalizer("sv").Translate("Untranslated"); got != "Untranslated" {
+		t.Errorf("Got %q, wanted untranslated strings to be kept", got)
+	}
+
+	if err := (&auth.UserConfig{Locale: "xx"}).Validate(); err == nil {
+		t.Errorf("Got no error for unsupported locale")
+	}
+	if err := (&auth.UserConfig{Locale: "sv_SE"}).Validate(); err != nil {
+		t.Errorf("Got %v for supported locale", err)
+	}
+
+	for language, catalog := range auth.Catalogs {
+		for key, translation := range catalog {
+			if want, got := formatVerbs(key), formatVerbs(translation); !reflect.DeepEqual(want, got) {
+				t.Errorf("Got verbs %v in %q translation %q, wanted %v", got, language, translation, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package diptest
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
+)
+
+func TestMailDigest(t *testing.T) {
+	defer InstallFakeTransports(nil)()
+
+	withStartedGame(func() {
+		recipient := startedGameEnvs[1].GetUID()
+		setDigest := func(digest string) {
+			configureNotifications(startedGameEnvs[1], String("token"), map[string]interface{}{
+				"MailConfig": map[string]interface{}{
+					"Enabled": true,
+					"Digest":  digest,
+				},
+			})
+		}
+		setDigest(auth.DailyMailDigest)
+
+		pair := sort.StringSlice{startedGameNats[0], startedGameNats[1]}
+		sort.Sort(pair)
+		trio := sort.StringSlice{startedGameNats[0], startedGameNats[1], startedGameNats[2]}
+		sort.Sort(trio)
+		send := func(members []string, body string) {
+			startedGames[0].Follow("channels", "Links").Success().
+				Follow("message", "Links").Body(map[string]interface{}{
+				"Body":           body,
+				"ChannelMembers": members,
+			}).Success()
+		}
+		first, second, third, deleted := String("first"), String("second"), String("third"), String("deleted")
+		send(pair, first)
+		send(trio, second)
+		send(pair, deleted)
+		startedGames[0].Follow("channels", "Links").Success().
+			Find(strings.Join(pair, ","), []string{"Properties"}, []string{"Name"}).
+			Follow("messages", "Links").Success().
+			Find(deleted, []string{"Properties"}, []string{"Properties", "Body"}).
+			Follow("delete", "Links").Success()
+		send(pair, third)
+		WaitForEmptyQueue("game-sendMsgNotificationsToUsers")
+		WaitForEmptyQueue("game-sendMsgNotificationsToMail")
+
+		startedGameEnvs[0].GetRoute(game.DevResolvePhaseTimeoutRoute).
+			RouteParams("game_id", startedGameID, "phase_ordinal", "1").Success()
+		WaitForEmptyQueue("game-asyncResolvePhase")
+		WaitForEmptyQueue("game-sendPhaseNotificationsToUsers")
+		WaitForEmptyQueue("game-sendPhaseNotificationsToMail")
+
+		sendDigests := func() []game.Notification {
+			NewEnv().SetAdmin(true).GetRoute(game.SendMailDigestsRoute).Success()
+			WaitForEmptyQueue("game-sendMailDigest")
+			digests := []game.Notification{}
+			for _, notif := range FakeNotifications().Mail {
+				if notif.UserId == recipient && notif.Type == game.MailDigestNotification {
+					digests = append(digests, notif)
+				}
+			}
+			return digests
+		}
+
+		t.Run("TestDailyDigestWaitsForADay", func(t *testing.T) {
+			if digests := sendDigests(); len(digests) != 0 {
+				t.Errorf("Got %v, wanted no digest before the oldest entry is a day old", pp(digests))
+			}
+		})
+
+		setDigest(auth.HourlyMailDigest)
+		digests := sendDigests()
+		if len(digests) != 1 {
+			t.Fatalf("Got %v, wanted one digest", pp(digests))
+		}
+		text := digests[0].Mail.Text
+
+		t.Run("TestGrouping", func(t *testing.T) {
+			if want := "3 new messages, 1 new phases"; !strings.Contains(digests[0].Mail.Subject, want) {
+				t.Errorf("Got subject %q, wanted %q", digests[0].Mail.Subject, want)
+			}
+			if n := strings.Count(text, "=== "+startedGameDesc); n != 1 {
+				t.Errorf("Got %v headers for the game in %q, wanted 1", n, text)
+			}
+			if n := strings.Count(text, "Reply to this channel at"); n != 2 {
+				t.Errorf("Got %v channels in %q, wanted 2", n, text)
+			}
+			// The channel of the oldest entry comes first, with its messages in order.
+			firstIdx, secondIdx, thirdIdx := strings.Index(text, first), strings.Index(text, second), strings.Index(text, third)
+			if firstIdx == -1 || secondIdx == -1 || thirdIdx == -1 || !(firstIdx < thirdIdx && thirdIdx < secondIdx) {
+				t.Errorf("Got %q, wanted %q and %q in one channel before %q in another", text, first, third, second)
+			}
+			if !strings.Contains(text, "New phase: Fall 1901, Movement") {
+				t.Errorf("Got %q, wanted the new phase", text)
+			}
+		})
+
+		t.Run("TestReplyGivesOrdersForNewPhase", func(t *testing.T) {
+			match := regexp.MustCompile("Reply with orders to (\\S+)").FindStringSubmatch(text)
+			if match == nil {
+				t.Fatalf("Got %q, wanted a reply address for the new phase", text)
+			}
+			fleet := homeFleets[startedGameNats[1]]
+			NewEnv().PostRoute(game.ReceiveMailRoute).
+				RouteParams("recipient", match[1]).
+				RawBody(replyMail("fake@fake.fake", match[1], fmt.Sprintf("F %s H", strings.ToUpper(fleet))), "message/rfc822").Success()
+			startedGames[1].Follow("phases", "Links").Success().
+				Find(2, []string{"Properties"}, []string{"Properties", "PhaseOrdinal"}).
+				Follow("orders", "Links").Success().
+				Find(fleet, []string{"Properties"}, []string{"Properties", "Parts"}, []string{})
+		})
+
+		t.Run("TestDeletedMessagesSkipped", func(t *testing.T) {
+			if strings.Contains(text, deleted) {
+				t.Errorf("Got %q, wanted no deleted message", text)
+			}
+		})
+
+		t.Run("TestProcessedEntriesDeleted", func(t *testing.T) {
+			if digests := sendDigests(); len(digests) != 1 {
+				t.Errorf("Got %v, wanted no new digest without new entries", pp(digests))
+			}
+		})
+	})
+}
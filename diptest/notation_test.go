@@ -0,0 +1,72 @@
+package diptest
+
+import (
+	"testing"
+
+	"github.com/kr/pretty"
+	"github.com/zond/diplicity/game"
+	"github.com/zond/godip"
+	"github.com/zond/godip/variants"
+)
+
+func TestOrderNotation(t *testing.T) {
+	variant := variants.Variants["Classical"]
+	for notation, wantParts := range map[string][]string{
+		"A PAR - BUR":            []string{"par", "Move", "bur"},
+		"a par-bur":              []string{"par", "Move", "bur"},
+		"PAR -> BUR":             []string{"par", "Move", "bur"},
+		"A LON - NWY via convoy": []string{"lon", "MoveViaConvoy", "nwy"},
+		"F NTH C A LON - NWY":    []string{"nth", "Convoy", "lon", "nwy"},
+		"A MUN S A KIE - BER":    []string{"mun", "Support", "kie", "ber"},
+		"A MUN S A BER":          []string{"mun", "Support", "ber", "ber"},
+		"F BRE H":                []string{"bre", "Hold"},
+		"F STP(SC) - BOT":        []string{"stp/sc", "Move", "bot"},
+		"Build F STP/NC":         []string{"stp/nc", "Build", "Fleet"},
+		"A PAR B":                []string{"par", "Build", "Army"},
+		"F BRE Disband":          []string{"bre", "Disband"},
+		"A PAR R PIC":            []string{"par", "Move", "pic"},
+	} {
+		parts, err := game.ParseOrderNotation(variant, notation)
+		if err != nil {
+			t.Errorf("Unable to parse %q: %v", notation, err)
+			continue
+		}
+		if diff := pretty.Diff(parts, wantParts); diff != nil {
+			t.Errorf("Parsed %q into %+v, wanted %+v: %+v", notation, parts, wantParts, diff)
+		}
+	}
+	for _, notation := range []string{
+		"",
+		"A XYZ - BUR",
+		"A PAR",
+		"A PAR - ",
+		"F NTH C A LON",
+		"Build PAR",
+		"A PAR - BUR BUR",
+	} {
+		if parts, err := game.ParseOrderNotation(variant, notation); err == nil {
+			t.Errorf("Parsed %q into %+v, wanted error", notation, parts)
+		}
+	}
+
+	units := map[godip.Province]godip.Unit{
+		"par":    godip.Unit{Type: godip.Army, Nation: godip.France},
+		"nth":    godip.Unit{Type: godip.Fleet, Nation: godip.England},
+		"lon":    godip.Unit{Type: godip.Army, Nation: godip.England},
+		"stp/sc": godip.Unit{Type: godip.Fleet, Nation: godip.Russia},
+	}
+	for wantNotation, parts := range map[string][]string{
+		"A PAR - BUR":            []string{"par", "Move", "bur"},
+		"A LON - NWY via convoy": []string{"lon", "MoveViaConvoy", "nwy"},
+		"F NTH C A LON - NWY":    []string{"nth", "Convoy", "lon", "nwy"},
+		"F NTH S A LON":          []string{"nth", "Support", "lon", "lon"},
+		"F STP/SC H":             []string{"stp/sc", "Hold"},
+		"Build A MUN":            []string{"mun", "Build", "Army"},
+		"A PAR Disband":          []string{"par", "Disband"},
+		"KIE - BER":              []string{"kie", "Move", "ber"},
+	} {
+		if notation := game.FormatOrderNotation(parts, units); notation != wantNotation {
+			t.Errorf("Formatted %+v into %q, wanted %q", parts, notation, wantNotation)
+		}
+	}
+}
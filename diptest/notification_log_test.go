@@ -0,0 +1,97 @@
+package diptest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/game"
+)
+
+func TestNotificationLog(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("notification-log", "Links").Success().
+		AssertLen(0, "Properties")
+
+	env2 := NewEnv().SetUID(String("fake"))
+	env2.GetRoute(game.ListNotificationLogRoute).
+		RouteParams("user_id", env.GetUID()).Failure()
+}
+
+// waitForNotificationLog returns the notification log of env when it has at least n entries.
+func waitForNotificationLog(env *Env, n int) *Result {
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		entries := env.GetRoute(game.ListNotificationLogRoute).
+			RouteParams("user_id", env.GetUID()).Success()
+		if len(entries.GetValue("Properties").([]interface{})) >= n {
+			return entries
+		}
+		if time.Now().After(deadline) {
+			panic(fmt.Errorf("Got %v within deadline, wanted %v notification log entries", pp(entries.Body), n))
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func TestNotificationLogDeliveries(t *testing.T) {
+	sentToken := String("token")
+	failedToken := String("token")
+	disabledToken := String("token")
+	defer InstallFakeTransports(map[string]string{
+		failedToken:   "InvalidDataKey",
+		disabledToken: "NotRegistered",
+	})()
+
+	withStartedGame(func() {
+		env := startedGameEnvs[1]
+		tokens := []interface{}{}
+		for _, token := range []string{sentToken, failedToken, disabledToken} {
+			tokens = append(tokens, map[string]interface{}{
+				"Value": token,
+				"App":   String("app"),
+			})
+		}
+		configureNotifications(env, sentToken, map[string]interface{}{
+			"FCMTokens": tokens,
+		})
+
+		startedGames[0].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           String("message"),
+			"ChannelMembers": []string{startedGameNats[0], startedGameNats[1]},
+		}).Success()
+
+		entries := waitForNotificationLog(env, 4).AssertLen(4, "Properties")
+		for _, entry := range []struct {
+			destination string
+			transport   string
+			status      string
+			err         string
+		}{
+			{sentToken, game.FCMNotificationTransport, game.NotificationSent, ""},
+			{failedToken, game.FCMNotificationTransport, game.NotificationFailed, "InvalidDataKey"},
+			{disabledToken, game.FCMNotificationTransport, game.NotificationDisabled, "NotRegistered"},
+		} {
+			entries.Find(entry.destination, []string{"Properties"}, []string{"Properties", "Destination"}).
+				AssertEq(entry.transport, "Properties", "Transport").
+				AssertEq(game.MessageNotification, "Properties", "Type").
+				AssertEq(startedGameID, "Properties", "GameID").
+				AssertEq(entry.status, "Properties", "Status").
+				AssertEq(entry.err, "Properties", "Error")
+		}
+		entries.Find(game.MailNotificationTransport, []string{"Properties"}, []string{"Properties", "Transport"}).
+			AssertEq(game.MessageNotification, "Properties", "Type").
+			AssertEq(game.NotificationSent, "Properties", "Status")
+
+		WaitForEmptyQueue("game-manageFCMTokens")
+		userConfig := env.GetRoute(game.IndexRoute).Success().
+			Follow("user-config", "Links").Success()
+		userConfig.Find(disabledToken, []string{"Properties", "FCMTokens"}, []string{"Value"}).
+			AssertBoolEq(true, "Disabled").
+			AssertEq("NotRegistered", "Note")
+		userConfig.Find(failedToken, []string{"Properties", "FCMTokens"}, []string{"Value"}).
+			AssertBoolEq(false, "Disabled")
+	})
+}
@@ -0,0 +1,80 @@
+package diptest
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/game"
+)
+
+// configureNotifications replaces the user config of env with one notifying via the FCM token and mail.
+func configureNotifications(env *Env, fcmToken string, config map[string]interface{}) {
+	body := map[string]interface{}{
+		"FCMTokens": []interface{}{
+			map[string]interface{}{
+				"Value": fcmToken,
+				"App":   String("app"),
+			},
+		},
+		"MailConfig": map[string]interface{}{
+			"Enabled": true,
+		},
+	}
+	for k, v := range config {
+		body[k] = v
+	}
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success().
+		Follow("update", "Links").Body(body).Success()
+}
+
+// notificationsTo returns the notifications to the user, of the type, about the game.
+func notificationsTo(notifications []game.Notification, userId string, notifType string, gameID string) []game.Notification {
+	result := []game.Notification{}
+	for _, notif := range notifications {
+		if notif.UserId == userId && notif.Type == notifType && notif.GameID != nil && notif.GameID.Encode() == gameID {
+			result = append(result, notif)
+		}
+	}
+	return result
+}
+
+func TestFakeTransports(t *testing.T) {
+	defer InstallFakeTransports(nil)()
+
+	withStartedGame(func() {
+		fcmToken := String("token")
+		configureNotifications(startedGameEnvs[1], fcmToken, nil)
+
+		msg := String("message")
+		members := sort.StringSlice{startedGameNats[0], startedGameNats[1]}
+		sort.Sort(members)
+		startedGames[0].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           msg,
+			"ChannelMembers": members,
+		}).Success()
+
+		recipient := startedGameEnvs[1].GetUID()
+		notifications := WaitForFakeNotifications(30*time.Second, func(n *game.DevFakeNotifications) bool {
+			return len(notificationsTo(n.FCM, recipient, game.MessageNotification, startedGameID)) > 0 &&
+				len(notificationsTo(n.Mail, recipient, game.MessageNotification, startedGameID)) > 0
+		})
+
+		fcmNotifs := notificationsTo(notifications.FCM, recipient, game.MessageNotification, startedGameID)
+		if len(fcmNotifs) != 1 || fcmNotifs[0].To != fcmToken || fcmNotifs[0].Payload == nil || fcmNotifs[0].Payload.Body != msg {
+			t.Errorf("Got %v, wanted one FCM message with %q to %q", pp(fcmNotifs), msg, fcmToken)
+		}
+		mails := notificationsTo(notifications.Mail, recipient, game.MessageNotification, startedGameID)
+		if len(mails) != 1 || mails[0].Mail == nil || !strings.Contains(mails[0].Mail.Text, msg) {
+			t.Errorf("Got %v, wanted one mail with %q", pp(mails), msg)
+		}
+
+		sender := startedGameEnvs[0].GetUID()
+		if sent := notificationsTo(append(notifications.FCM, notifications.Mail...), sender, game.MessageNotification, startedGameID); len(sent) != 0 {
+			t.Errorf("Got %v, wanted no notifications to the sender", pp(sent))
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package diptest
+
+import (
+	"testing"
+
+	"github.com/kr/pretty"
+	"github.com/zond/diplicity/game"
+	"github.com/zond/godip"
+	"github.com/zond/godip/variants"
+)
+
+func TestOrderValidation(t *testing.T) {
+	variant := variants.Variants["Classical"]
+	s, err := variant.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := game.ValidateOrder(variant, s, godip.France, []string{"par", "Move", "bur"}); err != nil {
+		t.Errorf("Wanted par-bur to be valid, got %v", err)
+	}
+	for _, tc := range []struct {
+		parts       []string
+		code        string
+		partIndex   int
+		suggestions []string
+	}{
+		{
+			parts:       []string{"par", "Move", "mun"},
+			code:        godip.ErrMissingConvoyPath.Error(),
+			partIndex:   2,
+			suggestions: []string{"bre", "bur", "gas", "pic"},
+		},
+		{
+			parts:     []string{"pic", "Move", "bel"},
+			code:      godip.ErrMissingUnit.Error(),
+			partIndex: 0,
+		},
+		{
+			parts:     []string{"par", "Jump", "bur"},
+			code:      game.ErrInvalidOrderType,
+			partIndex: 1,
+		},
+		{
+			parts:     []string{"mun", "Move", "bur"},
+			code:      game.ErrNotOwnUnit,
+			partIndex: 0,
+		},
+	} {
+		err := game.ValidateOrder(variant, s, godip.France, tc.parts)
+		verr, ok := err.(*game.OrderValidationError)
+		if !ok {
+			t.Errorf("Wanted OrderValidationError for %+v, got %v", tc.parts, err)
+			continue
+		}
+		if verr.Code != tc.code || verr.PartIndex != tc.partIndex {
+			t.Errorf("Wanted %v at %v for %+v, got %+v", tc.code, tc.partIndex, tc.parts, verr)
+		}
+		if tc.suggestions != nil {
+			if diff := pretty.Diff(verr.Suggestions, tc.suggestions); diff != nil {
+				t.Errorf("Wanted suggestions %+v for %+v, got %+v: %+v", tc.suggestions, tc.parts, verr.Suggestions, diff)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package diptest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/game"
+)
+
+var (
+	// An army move per nation in the first phase of Classical, with its notation.
+	firstPhaseMoves = map[string][]string{
+		"Austria": []string{"vie", "Move", "gal", "A VIE - GAL"},
+		"England": []string{"lvp", "Move", "yor", "A LVP - YOR"},
+		"France":  []string{"par", "Move", "bur", "A PAR - BUR"},
+		"Germany": []string{"mun", "Move", "ruh", "A MUN - RUH"},
+		"Italy":   []string{"rom", "Move", "apu", "A ROM - APU"},
+		"Russia":  []string{"mos", "Move", "ukr", "A MOS - UKR"},
+		"Turkey":  []string{"con", "Move", "bul", "A CON - BUL"},
+	}
+	// A fleet per nation that stays home in the first phase of Classical.
+	homeFleets = map[string]string{
+		"Austria": "tri",
+		"England": "lon",
+		"France":  "bre",
+		"Germany": "kie",
+		"Italy":   "nap",
+		"Russia":  "sev",
+		"Turkey":  "ank",
+	}
+)
+
+// replyMail returns a plain text mail from to, like the reply of a mail client.
+func replyMail(from, to, text string) []byte {
+	return []byte(fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Re: diplicity\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", from, to, strings.Replace(text, "\n", "\r\n", -1)))
+}
+
+func TestPhaseMail(t *testing.T) {
+	defer InstallFakeTransports(nil)()
+
+	withStartedGame(func() {
+		configureNotifications(startedGameEnvs[0], String("token"), nil)
+		move := firstPhaseMoves[startedGameNats[0]]
+		startedGames[0].Follow("phases", "Links").Success().
+			Find("Spring", []string{"Properties"}, []string{"Properties", "Season"}).
+			Follow("create-order", "Links").Body(map[string]interface{}{
+			"Parts": move[:3],
+		}).Success()
+
+		startedGameEnvs[0].GetRoute(game.DevResolvePhaseTimeoutRoute).
+			RouteParams("game_id", startedGameID, "phase_ordinal", "1").Success()
+		WaitForEmptyQueue("game-asyncResolvePhase")
+
+		recipient := startedGameEnvs[0].GetUID()
+		notifications := WaitForFakeNotifications(30*time.Second, func(n *game.DevFakeNotifications) bool {
+			return len(notificationsTo(n.Mail, recipient, game.PhaseNotification, startedGameID)) > 0
+		})
+		mails := notificationsTo(notifications.Mail, recipient, game.PhaseNotification, startedGameID)
+		if len(mails) != 1 {
+			t.Fatalf("Got %v, wanted one phase mail", pp(mails))
+		}
+
+		t.Run("TestPreviousOrders", func(t *testing.T) {
+			wantOrder := startedGameNats[0] + ": " + move[3]
+			if !strings.Contains(mails[0].Mail.Text, "Orders of the previous phase:") || !strings.Contains(mails[0].Mail.Text, wantOrder) {
+				t.Errorf("Got %q, wanted the previous orders with %q", mails[0].Mail.Text, wantOrder)
+			}
+		})
+
+		t.Run("TestReplyGivesOrdersForNewPhase", func(t *testing.T) {
+			fleet := homeFleets[startedGameNats[0]]
+			notation := fmt.Sprintf("F %s H", strings.ToUpper(fleet))
+			NewEnv().PostRoute(game.ReceiveMailRoute).
+				RouteParams("recipient", mails[0].Mail.From).
+				RawBody(replyMail("fake@fake.fake", mails[0].Mail.From, notation+"\nREADY"), "message/rfc822").Success()
+
+			phase := startedGames[0].Follow("phases", "Links").Success().
+				Find(2, []string{"Properties"}, []string{"Properties", "PhaseOrdinal"})
+			phase.Follow("orders", "Links").Success().
+				Find(fleet, []string{"Properties"}, []string{"Properties", "Parts"}, []string{})
+			phase.Follow("phase-states", "Links").Success().
+				Find(startedGameNats[0], []string{"Properties"}, []string{"Properties", "Nation"}).
+				AssertBoolEq(true, "Properties", "ReadyToResolve")
+
+			replies := WaitForFakeNotifications(30*time.Second, func(n *game.DevFakeNotifications) bool {
+				for _, notif := range n.Mail {
+					if strings.Contains(notif.Mail.Subject, "orders accepted") {
+						return true
+					}
+				}
+				return false
+			})
+			for _, notif := range replies.Mail {
+				if strings.Contains(notif.Mail.Subject, "orders accepted") && !strings.Contains(notif.Mail.Text, notation+": OK") {
+					t.Errorf("Got reply %q, wanted %q accepted", notif.Mail.Text, notation)
+				}
+			}
+		})
+	})
+}
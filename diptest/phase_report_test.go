@@ -0,0 +1,66 @@
+package diptest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zond/diplicity/game"
+	"github.com/zond/godip"
+)
+
+func TestPhaseReport(t *testing.T) {
+	phase := &game.Phase{
+		PhaseMeta: game.PhaseMeta{
+			PhaseOrdinal: 1,
+			Season:       godip.Spring,
+			Year:         1901,
+			Type:         godip.Movement,
+		},
+		Units: []game.UnitWrapper{
+			{Province: "par", Unit: godip.Unit{Type: godip.Army, Nation: godip.France}},
+			{Province: "mun", Unit: godip.Unit{Type: godip.Army, Nation: godip.Germany}},
+			{Province: "kie", Unit: godip.Unit{Type: godip.Fleet, Nation: godip.Germany}},
+			{Province: "bre", Unit: godip.Unit{Type: godip.Fleet, Nation: godip.France}},
+		},
+		SCs: []game.SC{
+			{Province: "par", Owner: godip.France},
+			{Province: "mun", Owner: godip.Germany},
+		},
+		Resolutions: []game.Resolution{
+			{Province: "par", Resolution: "ErrBounce:mun"},
+			{Province: "mun", Resolution: "ErrBounce:par"},
+			{Province: "kie", Resolution: "OK"},
+		},
+	}
+	orders := map[godip.Nation]map[godip.Province][]string{
+		godip.France: {
+			"par": {"Move", "bur"},
+		},
+		godip.Germany: {
+			"mun": {"Move", "bur"},
+			"kie": {"Move", "hol"},
+		},
+	}
+	nextPhase := &game.Phase{
+		SCs: []game.SC{
+			{Province: "par", Owner: godip.France},
+			{Province: "mun", Owner: godip.Germany},
+			{Province: "hol", Owner: godip.Germany},
+		},
+	}
+	report := game.NewPhaseReport(phase, orders, nextPhase)
+	if len(report.Orders) != 4 {
+		t.Fatalf("Wanted 4 orders, got %+v", report.Orders)
+	}
+	for _, want := range []string{
+		"A PAR - BUR: failed, bounced with A MUN",
+		"A MUN - BUR: failed, bounced with A PAR",
+		"F KIE - HOL: succeeded",
+		"F BRE H: no order given",
+		"HOL: Neutral -> Germany",
+	} {
+		if !strings.Contains(report.Text, want) {
+			t.Errorf("Wanted %q in report, got %q", want, report.Text)
+		}
+	}
+}
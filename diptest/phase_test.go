@@ -23,8 +23,6 @@ func withStartedGame(f func()) {
 
 // Not concurrency safe
 func withStartedGameOpts(conf func(m map[string]interface{}), f func()) {
-	gameDesc := String("test-game")
-
 	envs := []*Env{
 		NewEnv().SetUID(String("fake")),
 		NewEnv().SetUID(String("fake")),
@@ -34,6 +32,13 @@ func withStartedGameOpts(conf func(m map[string]interface{}), f func()) {
 		NewEnv().SetUID(String("fake")),
 		NewEnv().SetUID(String("fake")),
 	}
+	withStartedGameEnvs(envs, conf, f)
+}
+
+// withStartedGameEnvs is withStartedGameOpts with seven prepared envs to play the game.
+// Not concurrency safe
+func withStartedGameEnvs(envs []*Env, conf func(m map[string]interface{}), f func()) {
+	gameDesc := String("test-game")
 
 	opts := map[string]interface{}{
 		"Variant":            "Classical",
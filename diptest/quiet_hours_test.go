@@ -0,0 +1,59 @@
+package diptest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+)
+
+func TestQuietHours(t *testing.T) {
+	stockholm, err := time.LoadLocation("Europe/Stockholm")
+	if err != nil {
+		t.Skipf("No time zone database: %v", err)
+	}
+	quietHours := &auth.QuietHours{
+		Location: "Europe/Stockholm",
+		Start:    "22:30",
+		End:      "07:00",
+	}
+	if err := quietHours.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		at    time.Time
+		start time.Time
+		end   time.Time
+	}{
+		{time.Date(2026, 3, 10, 21, 0, 0, 0, stockholm), time.Time{}, time.Time{}},
+		{time.Date(2026, 3, 10, 22, 30, 0, 0, stockholm), time.Date(2026, 3, 10, 22, 30, 0, 0, stockholm), time.Date(2026, 3, 11, 7, 0, 0, 0, stockholm)},
+		{time.Date(2026, 3, 11, 3, 0, 0, 0, stockholm), time.Date(2026, 3, 10, 22, 30, 0, 0, stockholm), time.Date(2026, 3, 11, 7, 0, 0, 0, stockholm)},
+		{time.Date(2026, 3, 11, 7, 0, 0, 0, stockholm), time.Time{}, time.Time{}},
+		// The night the clocks move forward.
+		{time.Date(2026, 3, 29, 1, 0, 0, 0, time.UTC), time.Date(2026, 3, 28, 22, 30, 0, 0, stockholm), time.Date(2026, 3, 29, 7, 0, 0, 0, stockholm)},
+	} {
+		start, end := quietHours.Window(tc.at)
+		if !start.Equal(tc.start) || !end.Equal(tc.end) {
+			t.Errorf("Got %v - %v for %v, wanted %v - %v", start, end, tc.at, tc.start, tc.end)
+		}
+	}
+
+	daytime := &auth.QuietHours{Start: "09:00", End: "17:00"}
+	if start, _ := daytime.Window(time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)); !start.Equal(time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("Got start %v, wanted 09:00 UTC", start)
+	}
+	if start, _ := (&auth.QuietHours{}).Window(time.Now()); !start.IsZero() {
+		t.Errorf("Got start %v for disabled quiet hours", start)
+	}
+
+	for _, invalid := range []auth.QuietHours{
+		{Location: "Nowhere/Special", Start: "22:00", End: "07:00"},
+		{Start: "22", End: "07:00"},
+		{Start: "22:00"},
+		{Start: "07:00", End: "07:00"},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("Got no error for %+v", invalid)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package diptest
+
+import (
+	"testing"
+
+	"github.com/zond/diplicity/game"
+	"github.com/zond/goaeoas"
+)
+
+func waitForRollback() {
+	WaitForEmptyQueue("game-rollbackGame")
+	WaitForEmptyQueue("game-replayPhase")
+}
+
+func TestRollback(t *testing.T) {
+	withStartedGame(func() {
+		move := firstPhaseMoves[startedGameNats[0]]
+		firstPhase := startedGames[0].Follow("phases", "Links").Success().
+			Find(1, []string{"Properties"}, []string{"Properties", "PhaseOrdinal"})
+		firstPhase.Follow("create-order", "Links").Body(map[string]interface{}{
+			"Parts": move[:3],
+		}).Success()
+		firstPhase.Follow("phase-states", "Links").Success().
+			Find(startedGameNats[0], []string{"Properties"}, []string{"Properties", "Nation"}).
+			Follow("update", "Links").Body(map[string]interface{}{
+			"ReadyToResolve": true,
+			"WantsDIAS":      true,
+		}).Success()
+
+		startedGameEnvs[0].GetRoute(game.DevResolvePhaseTimeoutRoute).
+			RouteParams("game_id", startedGameID, "phase_ordinal", "1").Success()
+		WaitForEmptyQueue("game-asyncResolvePhase")
+
+		fleet := homeFleets[startedGameNats[0]]
+		startedGames[0].Follow("phases", "Links").Success().
+			Find(2, []string{"Properties"}, []string{"Properties", "PhaseOrdinal"}).
+			Follow("create-order", "Links").Body(map[string]interface{}{
+			"Parts": []string{fleet, "Hold"},
+		}).Success()
+
+		t.Run("TestRollbackAndResolve", func(t *testing.T) {
+			startedGameEnvs[0].PostRoute(game.RollbackResource.Route(goaeoas.Create)).
+				RouteParams("game_id", startedGameID).Body(map[string]interface{}{
+				"PhaseOrdinal": 1,
+				"Resolve":      true,
+			}).Success().
+				AssertEq(game.RollbackDeleting, "Properties", "Status")
+			waitForRollback()
+
+			phases := startedGameEnvs[0].GetRoute(game.ListPhasesRoute).
+				RouteParams("game_id", startedGameID).Success().
+				AssertLen(2, "Properties")
+			// The readiness and DIAS vote from before the rollback are gone.
+			phases.Find(1, []string{"Properties"}, []string{"Properties", "PhaseOrdinal"}).
+				AssertBoolEq(true, "Properties", "Resolved").
+				Follow("phase-states", "Links").Success().
+				Find(startedGameNats[0], []string{"Properties"}, []string{"Properties", "Nation"}).
+				AssertBoolEq(false, "Properties", "ReadyToResolve").
+				AssertBoolEq(false, "Properties", "WantsDIAS")
+			newPhase := phases.Find(2, []string{"Properties"}, []string{"Properties", "PhaseOrdinal"}).
+				AssertBoolEq(false, "Properties", "Resolved")
+			// The order of the rolled back phase was resolved again, and the order of the newest phase was restored.
+			newPhase.Find(move[2], []string{"Properties", "Units"}, []string{"Province"})
+			newPhase.Follow("orders", "Links").Success().
+				Find(fleet, []string{"Properties"}, []string{"Properties", "Parts"}, []string{})
+
+			rollback := startedGameEnvs[0].GetRoute(game.ListRollbacksRoute).
+				RouteParams("game_id", startedGameID).Success().
+				AssertLen(1, "Properties").
+				Find(game.RollbackDone, []string{"Properties"}, []string{"Properties", "Status"}).
+				AssertEq(1.0, "Properties", "PhaseOrdinal").
+				AssertEq(2.0, "Properties", "NewestPhaseOrdinal").
+				AssertEq(startedGameEnvs[0].GetUID(), "Properties", "UserId").
+				AssertEq(1.0, "Properties", "ReplayedOrders")
+			if deleted := rollback.GetValue("Properties", "DeletedEntities").(float64); deleted < 1 {
+				t.Errorf("Got %v deleted entities, wanted the second phase deleted", deleted)
+			}
+		})
+
+		t.Run("TestRollbackWithoutResolve", func(t *testing.T) {
+			startedGameEnvs[0].PostRoute(game.RollbackResource.Route(goaeoas.Create)).
+				RouteParams("game_id", startedGameID).Body(map[string]interface{}{
+				"PhaseOrdinal": 1,
+			}).Success()
+			waitForRollback()
+
+			startedGameEnvs[0].GetRoute(game.ListPhasesRoute).
+				RouteParams("game_id", startedGameID).Success().
+				AssertLen(1, "Properties").
+				Find(1, []string{"Properties"}, []string{"Properties", "PhaseOrdinal"}).
+				AssertBoolEq(false, "Properties", "Resolved").
+				Follow("orders", "Links").Success().
+				Find(move[0], []string{"Properties"}, []string{"Properties", "Parts"}, []string{})
+
+			startedGameEnvs[0].GetRoute(game.ListRollbacksRoute).
+				RouteParams("game_id", startedGameID).Success().
+				AssertLen(2, "Properties").
+				Find(0.0, []string{"Properties"}, []string{"Properties", "ReplayedOrders"}).
+				AssertEq(game.RollbackDone, "Properties", "Status").
+				AssertBoolEq(false, "Properties", "Resolve")
+		})
+	})
+}
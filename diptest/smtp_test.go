@@ -0,0 +1,107 @@
+package diptest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"reflect"
+	"testing"
+
+	"github.com/zond/diplicity/game"
+	"gopkg.in/sendgrid/sendgrid-go.v2"
+)
+
+func TestSMTPMail(t *testing.T) {
+	sink, err := newSMTPSink("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	replyAddress := "replies+token@diplicity-engine.appspotmail.com"
+	msg := sendgrid.NewMail()
+	msg.SetText("Plain body")
+	msg.SetHTML("<p>HTML body</p>")
+	msg.SetSubject("Diplicity: Österrike => England")
+	if err := msg.AddTo("player@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	msg.AddToName("England")
+	if err := msg.SetFrom(replyAddress); err != nil {
+		t.Fatal(err)
+	}
+	msg.SetFromName("Austria")
+	msg.AddHeader("List-Unsubscribe", "<https://example.com/unsubscribe>")
+
+	conn, err := net.Dial("tcp", sink.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &game.SMTPConf{
+		Addr:     sink.Addr(),
+		Username: "user",
+		Password: "pass",
+	}
+	if err := game.SendSMTPMail(conn, conf, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	received := sink.Received()
+	if len(received) != 1 {
+		t.Fatalf("Got %v mails, wanted 1", len(received))
+	}
+	if received[0].Auth != "\x00user\x00pass" {
+		t.Errorf("Got auth %q, wanted %q", received[0].Auth, "\x00user\x00pass")
+	}
+	if received[0].From != replyAddress || !reflect.DeepEqual(received[0].To, []string{"player@example.com"}) {
+		t.Errorf("Got envelope %q => %q, wanted %q => %q", received[0].From, received[0].To, replyAddress, "player@example.com")
+	}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(received[0].Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replyTo, err := mail.ParseAddress(parsed.Header.Get("Reply-To")); err != nil || replyTo.Address != replyAddress {
+		t.Errorf("Got Reply-To %q, wanted %q", parsed.Header.Get("Reply-To"), replyAddress)
+	}
+	if from, err := mail.ParseAddress(parsed.Header.Get("From")); err != nil || from.Name != "Austria" {
+		t.Errorf("Got From %q, wanted the name %q", parsed.Header.Get("From"), "Austria")
+	}
+	if subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject")); err != nil || subject != msg.Subject {
+		t.Errorf("Got Subject %q, wanted %q", subject, msg.Subject)
+	}
+	if got := parsed.Header.Get("List-Unsubscribe"); got != "<https://example.com/unsubscribe>" {
+		t.Errorf("Got List-Unsubscribe %q", got)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Got Content-Type %q, wanted multipart/alternative", parsed.Header.Get("Content-Type"))
+	}
+	parts := multipart.NewReader(parsed.Body, params["boundary"])
+	for _, want := range []struct {
+		mediaType string
+		body      string
+	}{
+		{"text/plain", "Plain body"},
+		{"text/html", "<p>HTML body</p>"},
+	} {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if partType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type")); err != nil || partType != want.mediaType {
+			t.Errorf("Got part type %q, wanted %q", part.Header.Get("Content-Type"), want.mediaType)
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != want.body {
+			t.Errorf("Got part body %q, wanted %q", body, want.body)
+		}
+	}
+}
@@ -27,6 +27,11 @@ func TestUserConfig(t *testing.T) {
 				"TitleTemplate":       "",
 				"BodyTemplate":        "",
 			},
+			"ReminderConfig": map[string]interface{}{
+				"ClickActionTemplate": "",
+				"TitleTemplate":       "",
+				"BodyTemplate":        "",
+			},
 		},
 		map[string]interface{}{
 			"Value":        String("token"),
@@ -44,6 +49,11 @@ func TestUserConfig(t *testing.T) {
 				"TitleTemplate":       "",
 				"BodyTemplate":        "",
 			},
+			"ReminderConfig": map[string]interface{}{
+				"ClickActionTemplate": "",
+				"TitleTemplate":       "",
+				"BodyTemplate":        "",
+			},
 		},
 	}
 	env.GetRoute(game.IndexRoute).Success().
@@ -69,4 +79,49 @@ func TestUserConfig(t *testing.T) {
 		Follow("user-config", "Links").Success().
 		AssertEq(tokens, "Properties", "FCMTokens")
 
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"DeadlineReminderMinutes": []int{1440, 360, 60},
+	}).Success().AssertEq([]interface{}{1440.0, 360.0, 60.0}, "Properties", "DeadlineReminderMinutes")
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"DeadlineReminderMinutes": []int{0},
+	}).Failure()
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"DeadlineReminderMinutes": []int{1, 2, 3, 4, 5, 6},
+	}).Failure()
+
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"MailConfig": map[string]interface{}{
+			"Enabled": true,
+			"Digest":  auth.DailyMailDigest,
+		},
+	}).Success().AssertEq(auth.DailyMailDigest, "Properties", "MailConfig", "Digest")
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"MailConfig": map[string]interface{}{
+			"Enabled": true,
+			"Digest":  "Weekly",
+		},
+	}).Failure()
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"WebPushSubscriptions": []interface{}{
+			map[string]interface{}{
+				"Endpoint": "http://push.example.com/1",
+				"P256dh":   "invalid",
+				"Auth":     "invalid",
+			},
+		},
+	}).Failure()
+	env.GetRoute(game.SendMailDigestsRoute).Success()
+	WaitForEmptyQueue("game-sendMailDigest")
 }
@@ -0,0 +1,62 @@
+package diptest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/game"
+)
+
+func TestWebPush(t *testing.T) {
+	conf, err := game.NewWebPushConf("mailto:admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := newFakeWebPushService(conf.PublicKey)
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	subscription, err := service.Subscribe(server.URL + "/push/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := func(conf *game.WebPushConf, payload []byte) int {
+		req, err := game.NewWebPushRequest(conf, subscription, payload, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	payload := []byte(`{"notification":{"title":"hello"}}`)
+	if status := push(conf, payload); status != http.StatusCreated {
+		t.Fatalf("Got %v, wanted %v", status, http.StatusCreated)
+	}
+	if received := service.Received(subscription.Endpoint); !reflect.DeepEqual(received, [][]byte{payload}) {
+		t.Errorf("Got %q, wanted %q", received, [][]byte{payload})
+	}
+
+	otherConf, err := game.NewWebPushConf("mailto:admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := push(otherConf, payload); status != http.StatusForbidden {
+		t.Errorf("Got %v for a push with the wrong VAPID key, wanted %v", status, http.StatusForbidden)
+	}
+
+	service.Unsubscribe(subscription.Endpoint)
+	if status := push(conf, payload); status != http.StatusGone {
+		t.Errorf("Got %v for a push to a gone subscription, wanted %v", status, http.StatusGone)
+	}
+	if received := service.Received(subscription.Endpoint); len(received) != 1 {
+		t.Errorf("Got %q after failed pushes, wanted only the first payload", received)
+	}
+}
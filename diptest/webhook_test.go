@@ -0,0 +1,271 @@
+package diptest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/game"
+	"github.com/zond/goaeoas"
+)
+
+func TestSignWebhookPayload(t *testing.T) {
+	// Verify with: echo -n '{"Event":"game-started"}' | openssl dgst -sha256 -hmac secret
+	want := "sha256=dc6fcb9bb3552dbfbc5d7a7354c9a77d2ccfcbe837a433ff8ab17e03211203a9"
+	if got := game.SignWebhookPayload("secret", []byte(`{"Event":"game-started"}`)); got != want {
+		t.Errorf("Got %q, wanted %q", got, want)
+	}
+}
+
+type webhookDelivery struct {
+	Event     string
+	Signature string
+	Body      []byte
+	Payload   struct {
+		Event string
+		Game  struct {
+			ID string
+		}
+		Phase *struct {
+			PhaseOrdinal int64
+		}
+		Message *struct {
+			Body string
+		}
+	}
+}
+
+// webhookReceiver records the deliveries to each path, and fails the first delivery to paths in failFirst.
+type webhookReceiver struct {
+	lock       sync.Mutex
+	deliveries map[string][]webhookDelivery
+	failFirst  map[string]bool
+	server     *httptest.Server
+}
+
+func newWebhookReceiver(failFirst ...string) *webhookReceiver {
+	receiver := &webhookReceiver{
+		deliveries: map[string][]webhookDelivery{},
+		failFirst:  map[string]bool{},
+	}
+	for _, path := range failFirst {
+		receiver.failFirst[path] = true
+	}
+	receiver.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivery := webhookDelivery{
+			Event:     r.Header.Get("X-Diplicity-Event"),
+			Signature: r.Header.Get("X-Diplicity-Signature"),
+		}
+		var err error
+		if delivery.Body, err = ioutil.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal(delivery.Body, &delivery.Payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		receiver.lock.Lock()
+		defer receiver.lock.Unlock()
+		receiver.deliveries[r.URL.Path] = append(receiver.deliveries[r.URL.Path], delivery)
+		if receiver.failFirst[r.URL.Path] {
+			delete(receiver.failFirst, r.URL.Path)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	return receiver
+}
+
+// events returns the sorted events delivered to path, leaving out member-joined since members join in any order.
+func (w *webhookReceiver) events(path string) []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	result := []string{}
+	for _, delivery := range w.deliveries[path] {
+		if delivery.Event != game.WebhookMemberJoined {
+			result = append(result, delivery.Event)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (w *webhookReceiver) waitForEvents(t *testing.T, path string, want ...string) {
+	sort.Strings(want)
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		got := w.events(path)
+		if len(got) >= len(want) {
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("Got events %+v to %q, wanted %+v", got, path, want)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Got events %+v to %q within deadline, wanted %+v", got, path, want)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func (w *webhookReceiver) last(path string) webhookDelivery {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	deliveries := w.deliveries[path]
+	return deliveries[len(deliveries)-1]
+}
+
+func createWebhook(env *Env, receiver *webhookReceiver, path string, body map[string]interface{}) *Result {
+	body["URL"] = receiver.server.URL + path
+	return env.GetRoute(game.ListWebhooksRoute).RouteParams("user_id", env.GetUID()).Success().
+		Follow("create", "Links").Body(body).Success()
+}
+
+func TestWebhooks(t *testing.T) {
+	receiver := newWebhookReceiver("/retry")
+	defer receiver.server.Close()
+
+	envs := []*Env{
+		NewEnv().SetUID(String("fake")),
+		NewEnv().SetUID(String("fake")),
+		NewEnv().SetUID(String("fake")),
+		NewEnv().SetUID(String("fake")),
+		NewEnv().SetUID(String("fake")),
+		NewEnv().SetUID(String("fake")),
+		NewEnv().SetUID(String("fake")),
+	}
+
+	secrets := map[string]string{}
+	for i, hook := range []struct {
+		path   string
+		events []string
+	}{
+		{"/all", nil},
+		{"/resolved", []string{game.WebhookPhaseResolved, game.WebhookGameFinished}},
+		{"/retry", []string{game.WebhookGameStarted}},
+		{"/messages", []string{game.WebhookMessageReceived}},
+	} {
+		secrets[hook.path] = createWebhook(envs[i], receiver, hook.path, map[string]interface{}{
+			"Events": hook.events,
+		}).GetValue("Properties", "Secret").(string)
+	}
+
+	withStartedGameEnvs(envs, nil, func() {
+		t.Run("TestOwnerChecks", func(t *testing.T) {
+			envs[1].PostRoute(game.WebhookResource.Route(goaeoas.Create)).
+				RouteParams("user_id", envs[0].GetUID()).Body(map[string]interface{}{
+				"URL": receiver.server.URL + "/stolen",
+			}).Status(http.StatusForbidden)
+			envs[1].GetRoute(game.ListWebhooksRoute).
+				RouteParams("user_id", envs[0].GetUID()).Status(http.StatusForbidden)
+
+			webhookID := envs[0].GetRoute(game.ListWebhooksRoute).
+				RouteParams("user_id", envs[0].GetUID()).Success().
+				AssertLen(1, "Properties").
+				GetValue("Properties", "0", "Properties", "ID").(string)
+			envs[1].DeleteRoute(game.WebhookResource.Route(goaeoas.Delete)).
+				RouteParams("id", webhookID).Status(http.StatusForbidden)
+
+			outsider := NewEnv().SetUID(String("fake"))
+			outsider.GetRoute(game.ListWebhooksRoute).RouteParams("user_id", outsider.GetUID()).Success().
+				Follow("create", "Links").Body(map[string]interface{}{
+				"URL":    receiver.server.URL + "/outsider",
+				"GameID": startedGameID,
+			}).Status(http.StatusForbidden)
+
+			createWebhook(envs[0], receiver, "/game", map[string]interface{}{
+				"GameID": startedGameID,
+				"Events": []string{game.WebhookPhaseResolved},
+			}).Follow("delete", "Links").Success()
+			envs[0].GetRoute(game.ListWebhooksRoute).
+				RouteParams("user_id", envs[0].GetUID()).Success().
+				AssertLen(1, "Properties")
+		})
+
+		t.Run("TestGameStarted", func(t *testing.T) {
+			receiver.waitForEvents(t, "/all", game.WebhookGameStarted)
+			// The first delivery failed, and was retried.
+			receiver.waitForEvents(t, "/retry", game.WebhookGameStarted, game.WebhookGameStarted)
+			delivery := receiver.last("/retry")
+			if delivery.Payload.Game.ID != startedGameID || delivery.Payload.Phase == nil || delivery.Payload.Phase.PhaseOrdinal != 1 {
+				t.Errorf("Got %s, wanted the first phase of %v", delivery.Body, startedGameID)
+			}
+		})
+
+		t.Run("TestPrivatePress", func(t *testing.T) {
+			msg := String("message")
+			startedGames[1].Follow("channels", "Links").Success().
+				Follow("message", "Links").Body(map[string]interface{}{
+				"Body":           msg,
+				"ChannelMembers": []string{startedGameNats[0], startedGameNats[1]},
+			}).Success()
+
+			receiver.waitForEvents(t, "/all", game.WebhookGameStarted, game.WebhookMessageReceived)
+			if delivery := receiver.last("/all"); delivery.Payload.Message == nil || delivery.Payload.Message.Body != msg {
+				t.Errorf("Got %s, wanted the message %q", delivery.Body, msg)
+			}
+
+			WaitForEmptyQueue("game-sendMsgNotificationsToUsers")
+			WaitForEmptyQueue("game-sendWebhooks")
+			WaitForEmptyQueue("game-deliverWebhook")
+			// The member with the message webhook isn't in the channel, and doesn't get the message.
+			if got := receiver.events("/messages"); len(got) > 0 {
+				t.Errorf("Got events %+v to a member outside the channel, wanted none", got)
+			}
+		})
+
+		t.Run("TestPhaseResolved", func(t *testing.T) {
+			startedGameEnvs[0].GetRoute(game.DevResolvePhaseTimeoutRoute).
+				RouteParams("game_id", startedGameID, "phase_ordinal", "1").Success()
+			WaitForEmptyQueue("game-asyncResolvePhase")
+
+			receiver.waitForEvents(t, "/all", game.WebhookGameStarted, game.WebhookMessageReceived, game.WebhookPhaseResolved)
+			receiver.waitForEvents(t, "/resolved", game.WebhookPhaseResolved)
+			if delivery := receiver.last("/resolved"); delivery.Payload.Phase == nil || delivery.Payload.Phase.PhaseOrdinal != 1 {
+				t.Errorf("Got %s, wanted the first phase resolved", delivery.Body)
+			}
+		})
+
+		t.Run("TestGameFinished", func(t *testing.T) {
+			for _, startedGame := range startedGames {
+				startedGame.Follow("phases", "Links").Success().
+					Find(2, []string{"Properties"}, []string{"Properties", "PhaseOrdinal"}).
+					Follow("phase-states", "Links").Success().
+					Find("", []string{"Properties"}, []string{"Properties", "Note"}).
+					Follow("update", "Links").Body(map[string]interface{}{
+					"ReadyToResolve": true,
+					"WantsDIAS":      true,
+				}).Success()
+			}
+			WaitForEmptyQueue("game-asyncResolvePhase")
+
+			receiver.waitForEvents(t, "/all", game.WebhookGameStarted, game.WebhookMessageReceived, game.WebhookPhaseResolved, game.WebhookPhaseResolved, game.WebhookGameFinished)
+			receiver.waitForEvents(t, "/resolved", game.WebhookPhaseResolved, game.WebhookPhaseResolved, game.WebhookGameFinished)
+
+			WaitForEmptyQueue("game-sendPhaseNotificationsToUsers")
+			WaitForEmptyQueue("game-sendWebhooks")
+			WaitForEmptyQueue("game-deliverWebhook")
+			receiver.waitForEvents(t, "/retry", game.WebhookGameStarted, game.WebhookGameStarted)
+			receiver.waitForEvents(t, "/messages")
+		})
+
+		t.Run("TestSignatures", func(t *testing.T) {
+			for path, secret := range secrets {
+				receiver.lock.Lock()
+				deliveries := receiver.deliveries[path]
+				receiver.lock.Unlock()
+				for _, delivery := range deliveries {
+					if want := game.SignWebhookPayload(secret, delivery.Body); delivery.Signature != want {
+						t.Errorf("Got signature %q for %s to %q, wanted %q", delivery.Signature, delivery.Body, path, want)
+					}
+				}
+			}
+		})
+	})
+}
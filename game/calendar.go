@@ -0,0 +1,251 @@
+package game
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	iCalendarTimeFormat = "20060102T150405Z"
+	// Lines longer than this many octets are folded, as required by RFC 5545.
+	iCalendarLineLength = 75
+)
+
+// CalendarToken returns the token authenticating the deadlines calendar of the user, creating it if the user
+// doesn't have one yet. Unlike login tokens, it doesn't time out, since calendar apps can't log in, but the user
+// can reset it to revoke leaked calendar URLs.
+func CalendarToken(ctx context.Context, userId string) (string, error) {
+	userConfig := &auth.UserConfig{}
+	if err := datastore.Get(ctx, auth.UserConfigID(ctx, auth.UserID(ctx, userId)), userConfig); err == nil && userConfig.CalendarToken != "" {
+		return userConfig.CalendarToken, nil
+	} else if err != nil && err != datastore.ErrNoSuchEntity {
+		return "", err
+	}
+	return storeCalendarToken(ctx, userId, false)
+}
+
+// storeCalendarToken stores a new random calendar token in the user config, unless the user already has one and
+// reset is false, and returns the calendar token of the user.
+func storeCalendarToken(ctx context.Context, userId string, reset bool) (string, error) {
+	token := ""
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		userConfigID := auth.UserConfigID(ctx, auth.UserID(ctx, userId))
+		userConfig := &auth.UserConfig{}
+		if err := datastore.Get(ctx, userConfigID, userConfig); err == datastore.ErrNoSuchEntity {
+			userConfig.UserId = userId
+		} else if err != nil {
+			return err
+		}
+		if userConfig.CalendarToken != "" && !reset {
+			token = userConfig.CalendarToken
+			return nil
+		}
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		userConfig.CalendarToken = hex.EncodeToString(b)
+		token = userConfig.CalendarToken
+		_, err := datastore.Put(ctx, userConfigID, userConfig)
+		return err
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// DeadlinesCalendar is the deadlines calendar subscription of a user.
+type DeadlinesCalendar struct {
+	UserId string
+	Token  string
+}
+
+func (d *DeadlinesCalendar) Item(r Request) *Item {
+	return NewItem(d).SetName("deadlines-calendar").
+		AddLink(r.NewLink(d.Link("deadlines-calendar"))).
+		AddLink(r.NewLink(Link{
+			Rel:         "reset-deadlines-calendar",
+			Route:       ResetDeadlinesCalendarRoute,
+			RouteParams: []string{"user_id", d.UserId},
+			Method:      "POST",
+		}))
+}
+
+// Link returns a link to the calendar, authenticated by the calendar token.
+func (d *DeadlinesCalendar) Link(rel string) Link {
+	return Link{
+		Rel:         rel,
+		Route:       DeadlinesICalendarRoute,
+		RouteParams: []string{"user_id", d.UserId},
+		QueryParams: url.Values{
+			"t": []string{d.Token},
+		},
+	}
+}
+
+// DeadlineEvent is a deadline of the newest phase of a game.
+type DeadlineEvent struct {
+	GameID  string
+	Desc    string
+	Phase   PhaseMeta
+	GameURL string
+}
+
+// iCalendarText escapes s as an RFC 5545 TEXT value.
+func iCalendarText(s string) string {
+	return strings.NewReplacer(
+		"\\", "\\\\",
+		";", "\\;",
+		",", "\\,",
+		"\r\n", "\\n",
+		"\n", "\\n",
+	).Replace(s)
+}
+
+// writeICalendarLine writes the content line, folded so that no line is longer than iCalendarLineLength octets
+// without splitting UTF-8 sequences.
+func writeICalendarLine(buf *bytes.Buffer, line string) {
+	octets := 0
+	for _, r := range line {
+		size := len(string(r))
+		if octets+size > iCalendarLineLength {
+			buf.WriteString("\r\n ")
+			octets = 1
+		}
+		buf.WriteRune(r)
+		octets += size
+	}
+	buf.WriteString("\r\n")
+}
+
+// RenderDeadlinesICalendar renders the events as an iCalendar with one VEVENT per deadline.
+// The UID of each event is stable for the phase, so calendar apps update the event when the deadline moves.
+func RenderDeadlinesICalendar(events []DeadlineEvent, now time.Time) []byte {
+	buf := &bytes.Buffer{}
+	for _, line := range []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//diplicity//deadlines//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:Diplicity deadlines",
+		"REFRESH-INTERVAL;VALUE=DURATION:PT1H",
+		"X-PUBLISHED-TTL:PT1H",
+	} {
+		writeICalendarLine(buf, line)
+	}
+	for _, event := range events {
+		phaseName := fmt.Sprintf("%s %d, %s", event.Phase.Season, event.Phase.Year, event.Phase.Type)
+		deadline := event.Phase.DeadlineAt.UTC().Format(iCalendarTimeFormat)
+		for _, line := range []string{
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:%s-%d@diplicity", event.GameID, event.Phase.PhaseOrdinal),
+			fmt.Sprintf("DTSTAMP:%s", now.UTC().Format(iCalendarTimeFormat)),
+			fmt.Sprintf("DTSTART:%s", deadline),
+			fmt.Sprintf("DTEND:%s", deadline),
+			fmt.Sprintf("SUMMARY:%s", iCalendarText(fmt.Sprintf("%s: %s deadline", event.Desc, phaseName))),
+			fmt.Sprintf("DESCRIPTION:%s", iCalendarText(fmt.Sprintf("Deadline of %s in %s.\n%s", phaseName, event.Desc, event.GameURL))),
+			fmt.Sprintf("URL:%s", event.GameURL),
+			"TRANSP:TRANSPARENT",
+			"END:VEVENT",
+		} {
+			writeICalendarLine(buf, line)
+		}
+	}
+	writeICalendarLine(buf, "END:VCALENDAR")
+	return buf.Bytes()
+}
+
+func deadlinesICalendar(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	// Calendar apps can't log in or send headers, so the calendar is authenticated by the calendar token instead.
+	userId := r.Vars()["user_id"]
+	userConfig := &auth.UserConfig{}
+	if err := datastore.Get(ctx, auth.UserConfigID(ctx, auth.UserID(ctx, userId)), userConfig); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if userConfig.CalendarToken == "" || subtle.ConstantTimeCompare([]byte(userConfig.CalendarToken), []byte(r.Req().URL.Query().Get("t"))) != 1 {
+		return HTTPErr{"invalid calendar token", http.StatusForbidden}
+	}
+
+	games := Games{}
+	ids, err := datastore.NewQuery(gameKind).Filter("Members.User.Id=", userId).Filter("Started=", true).Filter("Finished=", false).GetAll(ctx, &games)
+	if err != nil {
+		return err
+	}
+
+	scheme := "http"
+	if r.Req().TLS != nil {
+		scheme = "https"
+	}
+	events := []DeadlineEvent{}
+	for i := range games {
+		game := &games[i]
+		if len(game.NewestPhaseMeta) == 0 {
+			continue
+		}
+		phase := game.NewestPhaseMeta[0]
+		if phase.Resolved || phase.DeadlineAt.IsZero() {
+			continue
+		}
+		desc := game.Desc
+		if member, found := game.GetMemberByUserId(userId); found {
+			desc = game.DescFor(member.Nation)
+		}
+		events = append(events, DeadlineEvent{
+			GameID:  ids[i].Encode(),
+			Desc:    desc,
+			Phase:   phase,
+			GameURL: fmt.Sprintf("%s://%s/Game/%s", scheme, r.Req().Host, ids[i].Encode()),
+		})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Phase.DeadlineAt.Before(events[j].Phase.DeadlineAt)
+	})
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	_, err = w.Write(RenderDeadlinesICalendar(events, time.Now()))
+	return err
+}
+
+// resetDeadlinesCalendar replaces the calendar token of the user, so that the old calendar URL stops working.
+func resetDeadlinesCalendar(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if user.Id != r.Vars()["user_id"] {
+		return HTTPErr{"can only reset your own deadlines calendar", http.StatusForbidden}
+	}
+
+	token, err := storeCalendarToken(ctx, user.Id, true)
+	if err != nil {
+		return err
+	}
+
+	calendar := &DeadlinesCalendar{
+		UserId: user.Id,
+		Token:  token,
+	}
+	w.SetContent(calendar.Item(r))
+	return nil
+}
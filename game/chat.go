@@ -8,9 +8,11 @@ import (
 	"net/mail"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/aymerick/raymond"
 	"github.com/davecgh/go-spew/spew"
@@ -23,9 +25,10 @@ import (
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/urlfetch"
 	"gopkg.in/sendgrid/sendgrid-go.v2"
 
+	dvars "github.com/zond/diplicity/variants"
+
 	. "github.com/zond/goaeoas"
 )
 
@@ -43,6 +46,9 @@ const (
 	messageKind    = "Message"
 	channelKind    = "Channel"
 	seenMarkerKind = "SeenMarker"
+
+	// messageEditWindow is how long after creating a message the sender is allowed to edit or delete it.
+	messageEditWindow = 15 * time.Minute
 )
 
 var (
@@ -60,7 +66,10 @@ func init() {
 
 	MessageResource = &Resource{
 		Create:     createMessage,
+		Update:     updateMessage,
+		Delete:     deleteMessage,
 		CreatePath: "/Game/{game_id}/Messages",
+		FullPath:   "/Game/{game_id}/Channel/{channel_members}/Messages/{message_id}",
 		Listers: []Lister{
 			{
 				Path:    "/Game/{game_id}/Channel/{channel_members}/Messages",
@@ -81,6 +90,7 @@ type msgNotificationContext struct {
 	message      *Message
 	user         *auth.User
 	userConfig   *auth.UserConfig
+	localizer    *auth.Localizer
 	fcmData      map[string]interface{}
 	mailData     map[string]interface{}
 	mapURL       *url.URL
@@ -124,6 +134,7 @@ func getMsgNotificationContext(ctx context.Context, host, scheme string, gameID
 		}
 	}
 	res.game.ID = gameID
+	res.localizer = auth.NewUserLocalizer(res.user, res.userConfig)
 
 	isMember := false
 	res.member, isMember = res.game.GetMemberByUserId(userId)
@@ -156,30 +167,24 @@ func getMsgNotificationContext(ctx context.Context, host, scheme string, gameID
 }
 
 func sendEmailError(ctx context.Context, to string, errorMessage string) error {
-	sendGridConf, err := GetSendGrid(ctx)
-	if err != nil {
-		return err
-	}
+	localizer := auth.LoadLocalizerByEmail(ctx, to)
+	return sendEmailReply(ctx, to, localizer.Translate("Unsuccessfully parsed"), localizer.Sprintf("Your recent mail to diplicity was not successfully parsed.\n\nAn error message follows.\n\n%v", errorMessage))
+}
 
+func sendEmailReply(ctx context.Context, to string, subject string, text string) error {
 	msg := sendgrid.NewMail()
-	msg.SetText(fmt.Sprintf("Your recent mail to diplicity was not successfully parsed.\n\nAn error message follows.\n\n%v", errorMessage))
-	msg.SetSubject("Unsuccessfully parsed")
+	msg.SetText(text)
+	msg.SetSubject(subject)
 
-	if err = msg.AddTo(to); err != nil {
+	if err := msg.AddTo(to); err != nil {
 		return err
 	}
 
-	if err = msg.SetFrom(noreplyFromAddr); err != nil {
+	if err := msg.SetFrom(noreplyFromAddr); err != nil {
 		return err
 	}
 
-	client := sendgrid.NewSendGridClientWithApiKey(sendGridConf.APIKey)
-	client.Client = urlfetch.Client(ctx)
-	if err := client.Send(msg); err != nil {
-		return err
-	}
-
-	return nil
+	return MailTransport.Send(ctx, &Notification{Mail: msg})
 }
 
 func sendMsgNotificationsToMail(ctx context.Context, host, scheme string, gameID *datastore.Key, channelMembers Nations, messageID *datastore.Key, userId string) error {
@@ -199,10 +204,16 @@ func sendMsgNotificationsToMail(ctx context.Context, host, scheme string, gameID
 		return nil
 	}
 
-	sendGridConf, err := GetSendGrid(ctx)
-	if err != nil {
-		log.Errorf(ctx, "Unable to load sendgrid API key: %v; upload one or hope datastore gets fixed", err)
-		return err
+	if msgContext.userConfig.MailConfig.Digest != "" {
+		log.Infof(ctx, "%q gets %s mail digests, will queue the notification for the next digest", userId, msgContext.userConfig.MailConfig.Digest)
+		return queueMailDigestEntry(ctx, &MailDigestEntry{
+			UserId:         userId,
+			GameID:         gameID,
+			ChannelMembers: channelMembers,
+			MessageID:      messageID,
+			Host:           host,
+			Scheme:         scheme,
+		})
 	}
 
 	unsubscribeURL, err := auth.GetUnsubscribeURL(ctx, router, host, scheme, userId)
@@ -214,7 +225,7 @@ func sendMsgNotificationsToMail(ctx context.Context, host, scheme string, gameID
 	msgContext.mailData["unsubscribeURL"] = unsubscribeURL.String()
 
 	msg := sendgrid.NewMail()
-	msg.SetText(fmt.Sprintf("%s\n\nVisit %s to stop receiving email like this.\n\nVisit %s to see the latest phase in this game.", msgContext.message.Body, unsubscribeURL.String(), msgContext.mapURL.String()))
+	msg.SetText(msgContext.localizer.Sprintf("%s\n\nVisit %s to stop receiving email like this.\n\nVisit %s to see the latest phase in this game.", msgContext.message.Body, unsubscribeURL.String(), msgContext.mapURL.String()))
 	msg.SetSubject(
 		fmt.Sprintf(
 			"%s: %s => %s",
@@ -250,10 +261,8 @@ func sendMsgNotificationsToMail(ctx context.Context, host, scheme string, gameID
 	msg.SetFromEmail(fromEmail)
 	msg.SetFromName(string(msgContext.message.Sender))
 
-	client := sendgrid.NewSendGridClientWithApiKey(sendGridConf.APIKey)
-	client.Client = urlfetch.Client(ctx)
-	if err := client.Send(msg); err != nil {
-		log.Errorf(ctx, "Unable to send %v: %v; hope sendgrid gets fixed", msg, err)
+	if err := MailTransport.Send(ctx, &Notification{UserId: userId, Type: MessageNotification, GameID: gameID, Mail: msg}); err != nil {
+		log.Errorf(ctx, "Unable to send %v: %v; hope the mail transport gets fixed", msg, err)
 		return err
 	}
 	log.Infof(ctx, "Successfully sent %v", PP(msg))
@@ -281,20 +290,18 @@ func sendMsgNotificationsToFCM(ctx context.Context, host, scheme string, gameID
 		return err
 	}
 
-	if len(msgContext.userConfig.FCMTokens) == 0 {
-		log.Infof(ctx, "%q hasn't registered any FCM tokens, will skip sending notifiations", userId)
+	destinations := pushDestinations(msgContext.userConfig)
+	if len(destinations) == 0 {
+		log.Infof(ctx, "%q hasn't registered any FCM tokens or Web Push subscriptions, will skip sending notifiations", userId)
 		return nil
 	}
 
-	for _, fcmToken := range msgContext.userConfig.FCMTokens {
-		if fcmToken.Disabled || fcmToken.Value == "" {
+	for _, destination := range destinations {
+		if _, done := finishedTokens[destination.Value]; done {
 			continue
 		}
-		if _, done := finishedTokens[fcmToken.Value]; done {
-			continue
-		}
-		log.Infof(ctx, "Found an FCM token to send to: %v", PP(fcmToken))
-		finishedTokens[fcmToken.Value] = struct{}{}
+		log.Infof(ctx, "Found a push destination to send to: %v", destination.Value)
+		finishedTokens[destination.Value] = struct{}{}
 		notificationBody := msgContext.message.Body
 		if runes := []rune(notificationBody); len(runes) > 512 {
 			notificationBody = string(runes[:512]) + "..."
@@ -311,24 +318,22 @@ func sendMsgNotificationsToFCM(ctx context.Context, host, scheme string, gameID
 			ClickAction: fmt.Sprintf("%s://%s/Game/%s/Channel/%s/Messages", scheme, host, gameID.Encode(), channelMembers.String()),
 		}
 
-		fcmToken.MessageConfig.Customize(ctx, notificationPayload, msgContext.mailData)
+		destination.MessageConfig.Customize(ctx, notificationPayload, msgContext.mailData)
 
 		if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
-			if err := FCMSendToTokensFunc.EnqueueIn(
-				ctx,
-				0,
-				time.Duration(0),
-				notificationPayload,
-				dataPayload,
-				map[string][]string{
-					userId: []string{fcmToken.Value},
-				},
-			); err != nil {
-				log.Errorf(ctx, "Unable to enqueue actual sending of notification to %v/%v: %v; fix FCMSendToUsers or hope datastore gets fixed", userId, fcmToken.Value, err)
+			if err := destination.Transport.Send(ctx, &Notification{
+				UserId:  userId,
+				To:      destination.Value,
+				Type:    MessageNotification,
+				GameID:  gameID,
+				Payload: notificationPayload,
+				Data:    dataPayload,
+			}); err != nil {
+				log.Errorf(ctx, "Unable to enqueue actual sending of notification to %v/%v: %v; fix the transport or hope datastore gets fixed", userId, destination.Value, err)
 				return err
 			}
 
-			if len(msgContext.userConfig.FCMTokens) > len(finishedTokens) {
+			if len(destinations) > len(finishedTokens) {
 				if err := sendMsgNotificationsToFCMFunc.EnqueueIn(ctx, 0, host, scheme, gameID, channelMembers, messageID, userId, finishedTokens); err != nil {
 					log.Errorf(ctx, "Unable to enqueue sending of rest of notifications: %v; hope datastore gets fixed", err)
 					return err
@@ -364,31 +369,34 @@ func sendMsgNotificationsToUsers(ctx context.Context, host, scheme string, gameI
 			log.Errorf(ctx, "%v isn't a member of %v, wtf? Giving up.", uids[0], gameID)
 			return nil
 		}
-		channels, err := loadChannels(ctx, game, member.Nation)
+		// member.UnreadMessages was already updated when the message was created.
+		log.Infof(ctx, "%v has %v unread messages in %v", member.Nation, member.UnreadMessages, gameID)
+
+		gameState, err := loadGameStateOrDefault(ctx, gameID, member.Nation)
 		if err != nil {
-			log.Errorf(ctx, "Unable to load channels for %v in %v: %v; hope datastore gets fixed", member.Nation, gameID, err)
+			log.Errorf(ctx, "Unable to load game state for %v in %v: %v; hope datastore gets fixed", member.Nation, gameID, err)
 			return err
 		}
-		if err := countUnreadMessages(ctx, channels, member.Nation); err != nil {
-			log.Errorf(ctx, "Unable to count unread messages for %v in %v: %v; hope datastore gets fixed", member.Nation, gameID, err)
-			return err
-		}
-		total := 0
-		for _, channel := range channels {
-			total += channel.NMessagesSince.NMessages
-		}
-		member.UnreadMessages = total
-		if err := game.Save(ctx); err != nil {
-			log.Errorf(ctx, "Unable to save %v after updating unread messages for %v: %v; hope datastore gets fixed", gameID, member.Nation, err)
+		message := &Message{}
+		if err := datastore.Get(ctx, messageID, message); err != nil {
+			log.Errorf(ctx, "Unable to load message %v: %v; hope datastore gets fixed", messageID, err)
 			return err
 		}
 
-		if err := sendMsgNotificationsToFCMFunc.EnqueueIn(ctx, 0, host, scheme, gameID, channelMembers, messageID, uids[0], map[string]struct{}{}); err != nil {
-			log.Errorf(ctx, "Unable to enqueue sending FCM to %q: %v; hope datastore gets fixed", uids[0], err)
-			return err
+		if gameState.WantsMessageNotification(message) {
+			if err := sendMsgNotificationsToFCMFunc.EnqueueIn(ctx, 0, host, scheme, gameID, channelMembers, messageID, uids[0], map[string]struct{}{}); err != nil {
+				log.Errorf(ctx, "Unable to enqueue sending FCM to %q: %v; hope datastore gets fixed", uids[0], err)
+				return err
+			}
+			if err := sendMsgNotificationsToMailFunc.EnqueueIn(ctx, 0, host, scheme, gameID, channelMembers, messageID, uids[0]); err != nil {
+				log.Errorf(ctx, "Unable to enqueue sending mail to %q: %v; hope datastore gets fixed", uids[0], err)
+				return err
+			}
+		} else {
+			log.Infof(ctx, "%v doesn't want notifications about %v, will skip FCM and mail", member.Nation, messageID)
 		}
-		if err := sendMsgNotificationsToMailFunc.EnqueueIn(ctx, 0, host, scheme, gameID, channelMembers, messageID, uids[0]); err != nil {
-			log.Errorf(ctx, "Unable to enqueue sending mail to %q: %v; hope datastore gets fixed", uids[0], err)
+		if err := triggerWebhooks(ctx, webhookTrigger{Event: WebhookMessageReceived, GameID: gameID, UserIds: []string{uids[0]}, MessageID: messageID}); err != nil {
+			log.Errorf(ctx, "Unable to enqueue sending webhooks to %q: %v; hope datastore gets fixed", uids[0], err)
 			return err
 		}
 		if len(uids) > 1 {
@@ -464,6 +472,7 @@ func (c Channels) Item(r Request, gameID *datastore.Key, isMember bool) *Item {
 		[]string{
 			"Counters",
 			"Channels tell you how many messages they have, and how many new since you last loaded messages from them.",
+			"Use the `mark-all-read` link to mark all messages in all your channels of the game as read.",
 		},
 	}).AddLink(r.NewLink(Link{
 		Rel:         "self",
@@ -472,6 +481,12 @@ func (c Channels) Item(r Request, gameID *datastore.Key, isMember bool) *Item {
 	}))
 	if isMember {
 		channelsItem.AddLink(r.NewLink(MessageResource.Link("message", Create, []string{"game_id", gameID.Encode()})))
+		channelsItem.AddLink(r.NewLink(Link{
+			Rel:         "mark-all-read",
+			Route:       MarkAllReadRoute,
+			Method:      "POST",
+			RouteParams: []string{"game_id", gameID.Encode()},
+		}))
 	}
 	return channelsItem
 }
@@ -493,6 +508,10 @@ type SeenMarker struct {
 	Members Nations
 	Owner   godip.Nation
 	At      time.Time `methods:"POST"`
+	// Unread is the number of messages created after At, kept up to date when messages are created or deleted.
+	Unread int
+	// Counted is false for markers stored before Unread was introduced, whose Unread has to be counted once.
+	Counted bool
 }
 
 func SeenMarkerID(ctx context.Context, channelID *datastore.Key, owner godip.Nation) (*datastore.Key, error) {
@@ -518,6 +537,13 @@ func (c *Channel) Item(r Request) *Item {
 		Route:       ListMessagesRoute,
 		RouteParams: []string{"game_id", c.GameID.Encode(), "channel_members", c.Members.String()},
 	}))
+	if viewerNation, ok := r.Values()["viewer-nation"].(godip.Nation); ok && c.Members.Includes(viewerNation) {
+		channelItem.AddLink(r.NewLink(Link{
+			Rel:         "bridges",
+			Route:       ListChatBridgesRoute,
+			RouteParams: []string{"game_id", c.GameID.Encode(), "channel_members", c.Members.String()},
+		}))
+	}
 	return channelItem
 }
 
@@ -545,8 +571,13 @@ func (c *Channel) CountSince(ctx context.Context, since time.Time) error {
 	if err != nil {
 		return err
 	}
+	// Deleted messages are kept for moderation, but aren't counted in NMessages.
+	deleted, err := datastore.NewQuery(messageKind).Ancestor(channelID).Filter("Deleted=", true).Filter("CreatedAt>", since).Count(ctx)
+	if err != nil {
+		return err
+	}
 	c.NMessagesSince.Since = since
-	c.NMessagesSince.NMessages = count
+	c.NMessagesSince.NMessages = count - deleted
 	return nil
 }
 
@@ -562,6 +593,30 @@ func (m Messages) Item(r Request, gameID *datastore.Key, channelMembers Nations)
 			"Limiting messages",
 			"Messages normally contain all messages for the chosen channel, but if you provide a `since` query parameter they will only contain new messages since that time.",
 		},
+		[]string{
+			"Editing and deleting messages",
+			fmt.Sprintf("Senders can edit or delete their messages up to %v after creating them. Edited messages list their previous versions in `Edits`, and deleted messages are returned with an empty body and `Deleted` set.", messageEditWindow),
+			"Since edits, deletions and reactions don't change `CreatedAt`, they are only visible when loading messages without a `since` query parameter.",
+		},
+		[]string{
+			"Read receipts",
+			"In games with `EnableReadReceipts` set, messages list the channel members, other than the sender, that have loaded them in `ReadBy`.",
+		},
+		[]string{
+			"Mentions",
+			"Mention channel members in message bodies with `@` and their nation, like `@England`, or all channel members with `@all`. The mentioned members are listed in `Mentions`.",
+			"Mentioned members are notified even if they only want notifications about mentions, or none at all, for the channel, unless they turned off all notifications for the game.",
+		},
+		[]string{
+			"Reactions",
+			"Channel members can react to, or acknowledge, messages with short texts or emojis. Each nation can only add each reaction once per message.",
+		},
+		[]string{
+			"Attachments",
+			fmt.Sprintf("Messages can have an `Attachment` drawn on the map of the phase with `PhaseOrdinal`. Attachments of type `%s` propose `Orders` for any nations, and the proposed nations can copy them into their own orders using the `copy-orders` link.", OrdersAttachment),
+			fmt.Sprintf("Attachments of type `%s` are annotated map snapshots, with `Annotations` of type `%s` (from `Province` to `Destination`), `%s` or `%s`.", MapAttachment, dvars.ArrowAnnotation, dvars.CrossAnnotation, dvars.HighlightAnnotation),
+			"Follow the `attachment-map` link to preview an attachment.",
+		},
 	}).AddLink(r.NewLink(Link{
 		Rel:         "self",
 		Route:       ListMessagesRoute,
@@ -570,14 +625,104 @@ func (m Messages) Item(r Request, gameID *datastore.Key, channelMembers Nations)
 	return messagesItem
 }
 
+type MessageEdit struct {
+	Body     string `datastore:",noindex"`
+	EditedAt time.Time
+}
+
+type MessageReaction struct {
+	Nation   godip.Nation
+	Reaction string `methods:"POST"`
+}
+
 type Message struct {
 	ID             *datastore.Key `datastore:"-"`
 	GameID         *datastore.Key
 	ChannelMembers Nations `methods:"POST"`
 	Sender         godip.Nation
-	Body           string `methods:"POST" datastore:",noindex"`
+	Body           string `methods:"POST,PUT" datastore:",noindex"`
 	CreatedAt      time.Time
 	Age            time.Duration `datastore:"-" ticker:"true"`
+	Edits          []MessageEdit
+	Deleted        bool
+	DeletedAt      time.Time
+	Reactions      []MessageReaction
+	Attachment     MessageAttachment `methods:"POST"`
+	ReadBy         Nations           `datastore:"-"`
+	// Mentions are the channel members, other than the sender, mentioned in the body.
+	Mentions Nations
+}
+
+// OriginalBody returns the body the message had when it was created, before any edits.
+func (m *Message) OriginalBody() string {
+	if len(m.Edits) > 0 {
+		return m.Edits[0].Body
+	}
+	return m.Body
+}
+
+// containsMention returns whether the lower case body contains "@name", not followed by another letter or digit.
+func containsMention(body, name string) bool {
+	mention := "@" + name
+	for offset := 0; offset < len(body); {
+		index := strings.Index(body[offset:], mention)
+		if index == -1 {
+			return false
+		}
+		end := offset + index + len(mention)
+		if next, _ := utf8.DecodeRuneInString(body[end:]); end == len(body) || (!unicode.IsLetter(next) && !unicode.IsDigit(next)) {
+			return true
+		}
+		offset = end
+	}
+	return false
+}
+
+// ParseMentions populates Mentions with the channel members mentioned in the body, like "@England".
+// "@all" mentions all channel members.
+func (m *Message) ParseMentions() {
+	m.Mentions = nil
+	body := strings.ToLower(m.Body)
+	all := containsMention(body, "all")
+	for _, member := range m.ChannelMembers {
+		if member == m.Sender {
+			continue
+		}
+		if all || containsMention(body, strings.ToLower(string(member))) {
+			m.Mentions = append(m.Mentions, member)
+		}
+	}
+}
+
+// MentionsNation returns whether the message mentions nation.
+func (m *Message) MentionsNation(nation godip.Nation) bool {
+	return m.Mentions.Includes(nation)
+}
+
+// Redact removes the contents of deleted messages before they are shown to users.
+func (m *Message) Redact() {
+	if m.Deleted {
+		m.Body = ""
+		m.Edits = nil
+		m.Reactions = nil
+		m.Attachment = MessageAttachment{}
+		m.Mentions = nil
+	}
+}
+
+// eventRecipients returns the nations allowed to see game events about the message.
+func (m *Message) eventRecipients(game *Game) Nations {
+	if isPublic(game.Variant, m.ChannelMembers) || game.pressRevealedTo("") {
+		return nil
+	}
+	if game.pressRevealedTo(m.Sender) {
+		return Nations(variants.Variants[game.Variant].Nations)
+	}
+	return m.ChannelMembers
+}
+
+func (m *Message) editable() bool {
+	return !m.Deleted && time.Now().Sub(m.CreatedAt) < messageEditWindow
 }
 
 func (m *Message) NotifyRecipients(ctx context.Context, host, scheme string, channel *Channel, game *Game) error {
@@ -648,16 +793,61 @@ func (m *Message) NotifyRecipients(ctx context.Context, host, scheme string, cha
 }
 
 func (m *Message) Item(r Request) *Item {
-	return NewItem(m).SetName(string(m.Sender))
+	messageItem := NewItem(m).SetName(string(m.Sender))
+	viewer, _ := r.Values()["viewer-nation"].(godip.Nation)
+	if m.ID == nil || viewer == "" || m.Deleted {
+		return messageItem
+	}
+	routeParams := []string{"game_id", m.GameID.Encode(), "channel_members", m.ChannelMembers.String(), "message_id", fmt.Sprint(m.ID.IntID())}
+	if m.Attachment.Type != "" {
+		messageItem.AddLink(r.NewLink(Link{
+			Rel:         "attachment-map",
+			Route:       RenderMessageAttachmentMapRoute,
+			RouteParams: routeParams,
+		}))
+		if len(m.Attachment.ordersFor(viewer)) > 0 {
+			messageItem.AddLink(r.NewLink(Link{
+				Rel:         "copy-orders",
+				Method:      "POST",
+				Route:       CopyAttachmentOrdersRoute,
+				RouteParams: routeParams,
+			}))
+		}
+	}
+	if viewer == m.Sender && m.editable() {
+		messageItem.AddLink(r.NewLink(MessageResource.Link("update", Update, routeParams)))
+		messageItem.AddLink(r.NewLink(MessageResource.Link("delete", Delete, routeParams)))
+	}
+	if m.ChannelMembers.Includes(viewer) {
+		messageItem.AddLink(r.NewLink(MessageReactionResource.Link("react", Create, routeParams)))
+		for _, reaction := range m.Reactions {
+			if reaction.Nation == viewer {
+				messageItem.AddLink(r.NewLink(MessageReactionResource.Link("remove-reaction", Delete, append(routeParams, "reaction", reaction.Reaction))))
+			}
+		}
+	}
+	return messageItem
 }
 
 func createMessageHelper(ctx context.Context, r Request, message *Message) error {
-	if strings.TrimSpace(message.Body) == "" {
+	scheme := "http"
+	if r.Req().TLS != nil {
+		scheme = "https"
+	}
+	return createMessageForHost(ctx, r.Req().Host, scheme, message, nil)
+}
+
+// createMessageForHost stores message and notifies the recipients, using host and scheme to create links.
+// If beforeCommit is not nil, it's run inside the transaction storing the message, and an error from it
+// prevents the message from being stored.
+func createMessageForHost(ctx context.Context, host, scheme string, message *Message, beforeCommit func(ctx context.Context) error) error {
+	if strings.TrimSpace(message.Body) == "" && message.Attachment.Type == "" {
 		return HTTPErr{"can not create empty messages", http.StatusBadRequest}
 	}
 
 	message.CreatedAt = time.Now()
 	sort.Sort(message.ChannelMembers)
+	message.ParseMentions()
 
 	channelID, err := ChannelID(ctx, message.GameID, message.ChannelMembers)
 	if err != nil {
@@ -698,16 +888,26 @@ func createMessageHelper(ctx context.Context, r Request, message *Message) error
 		if message.ID, err = datastore.Put(ctx, datastore.NewIncompleteKey(ctx, messageKind, channelID), message); err != nil {
 			return err
 		}
+		if err := adjustUnreadMessages(ctx, game, channel, channelID, message, 1); err != nil {
+			return err
+		}
 		channel.NMessages += 1
-		if _, err = datastore.Put(ctx, channelID, channel); err != nil {
+		if _, err = datastore.PutMulti(ctx, []*datastore.Key{channelID, message.GameID}, []interface{}{channel, game}); err != nil {
 			return err
 		}
-
-		scheme := "http"
-		if r.Req().TLS != nil {
-			scheme = "https"
+		if err := publishGameEvent(ctx, message.GameID, messageEventType, message.eventRecipients(game), message.Sender, message); err != nil {
+			return err
+		}
+		if err := mirrorToChatBridgesFunc.EnqueueIn(ctx, 0, message.ID); err != nil {
+			return err
 		}
-		return message.NotifyRecipients(ctx, r.Req().Host, scheme, channel, game)
+		if beforeCommit != nil {
+			if err := beforeCommit(ctx); err != nil {
+				return err
+			}
+		}
+
+		return message.NotifyRecipients(ctx, host, scheme, channel, game)
 	}, &datastore.TransactionOptions{XG: true})
 }
 
@@ -754,13 +954,152 @@ func createMessage(w ResponseWriter, r Request) (*Message, error) {
 	message.GameID = gameID
 	message.Sender = member.Nation
 
+	if err := message.Attachment.validate(ctx, game, member.Nation); err != nil {
+		return nil, err
+	}
+
 	if err := createMessageHelper(ctx, r, message); err != nil {
 		return nil, err
 	}
 
+	r.Values()["viewer-nation"] = member.Nation
 	return message, nil
 }
 
+// updateMessageHelper loads the message identified by the request, runs mutate on it, and saves the message
+// and its channel in the same transaction. If mutate deletes the message, the unread counters are decreased.
+func updateMessageHelper(ctx context.Context, r Request, mutate func(member *Member, channel *Channel, message *Message) error) (*Message, error) {
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return nil, err
+	}
+
+	channelMembers := Nations{}
+	channelMembers.FromString(r.Vars()["channel_members"])
+
+	channelID, err := ChannelID(ctx, gameID, channelMembers)
+	if err != nil {
+		return nil, err
+	}
+
+	messageIntID, err := strconv.ParseInt(r.Vars()["message_id"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	messageID := datastore.NewKey(ctx, messageKind, "", messageIntID, channelID)
+
+	message := &Message{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		game := &Game{}
+		channel := &Channel{}
+		if err := datastore.GetMulti(ctx, []*datastore.Key{gameID, channelID, messageID}, []interface{}{game, channel, message}); err != nil {
+			return err
+		}
+		game.ID = gameID
+		message.ID = messageID
+
+		member, isMember := game.GetMemberByUserId(user.Id)
+		if !isMember {
+			return HTTPErr{"can only change messages in member games", http.StatusNotFound}
+		}
+		if !message.ChannelMembers.Includes(member.Nation) {
+			return HTTPErr{"can only change messages in member channels", http.StatusForbidden}
+		}
+		r.Values()["viewer-nation"] = member.Nation
+
+		wasDeleted := message.Deleted
+		if err := mutate(member, channel, message); err != nil {
+			return err
+		}
+
+		keys := []*datastore.Key{channelID, messageID}
+		values := []interface{}{channel, message}
+		if message.Deleted && !wasDeleted {
+			if err := adjustUnreadMessages(ctx, game, channel, channelID, message, -1); err != nil {
+				return err
+			}
+			keys = append(keys, gameID)
+			values = append(values, game)
+		}
+		if _, err := datastore.PutMulti(ctx, keys, values); err != nil {
+			return err
+		}
+
+		redacted := *message
+		redacted.Redact()
+		return publishGameEvent(ctx, gameID, messageUpdateEventType, message.eventRecipients(game), message.Sender, redacted)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+
+	message.Age = time.Now().Sub(message.CreatedAt)
+	message.Redact()
+
+	return message, nil
+}
+
+func updateMessage(w ResponseWriter, r Request) (*Message, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	bodyBytes, err := ioutil.ReadAll(r.Req().Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return updateMessageHelper(ctx, r, func(member *Member, channel *Channel, message *Message) error {
+		if message.Sender != member.Nation {
+			return HTTPErr{"can only edit your own messages", http.StatusForbidden}
+		}
+		if !message.editable() {
+			return HTTPErr{fmt.Sprintf("can only edit messages less than %v old", messageEditWindow), http.StatusPreconditionFailed}
+		}
+
+		edit := MessageEdit{
+			Body:     message.Body,
+			EditedAt: time.Now(),
+		}
+		if err := CopyBytes(message, r, bodyBytes, "PUT"); err != nil {
+			return err
+		}
+		if strings.TrimSpace(message.Body) == "" {
+			return HTTPErr{"can not edit messages to be empty", http.StatusBadRequest}
+		}
+		if message.Body == edit.Body {
+			return nil
+		}
+		message.Edits = append(message.Edits, edit)
+		// Mentions added by edits are listed, but don't cause new notifications.
+		message.ParseMentions()
+
+		return nil
+	})
+}
+
+func deleteMessage(w ResponseWriter, r Request) (*Message, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	return updateMessageHelper(ctx, r, func(member *Member, channel *Channel, message *Message) error {
+		if message.Sender != member.Nation {
+			return HTTPErr{"can only delete your own messages", http.StatusForbidden}
+		}
+		if !message.editable() {
+			return HTTPErr{fmt.Sprintf("can only delete messages less than %v old", messageEditWindow), http.StatusPreconditionFailed}
+		}
+
+		// The message is kept, so that flagging it still captures what was written.
+		message.Deleted = true
+		message.DeletedAt = time.Now()
+		channel.NMessages -= 1
+
+		return nil
+	})
+}
+
 func publicChannel(variant string) Nations {
 	publicChannel := make(Nations, len(variants.Variants[variant].Nations))
 	copy(publicChannel, variants.Variants[variant].Nations)
@@ -841,7 +1180,7 @@ func listMessages(w ResponseWriter, r Request) error {
 		}
 	}
 
-	if !game.Finished && !channelMembers.Includes(nation) && !isPublic(game.Variant, channelMembers) {
+	if !game.pressRevealedTo(nation) && !channelMembers.Includes(nation) && !isPublic(game.Variant, channelMembers) {
 		return HTTPErr{"can only list member channels", http.StatusForbidden}
 	}
 
@@ -883,78 +1222,53 @@ func listMessages(w ResponseWriter, r Request) error {
 	}
 
 	if nation != "" && len(messages) > 0 && (seenMarker == nil || seenMarker.At.Before(messages[0].CreatedAt)) {
-		seenMarker = &SeenMarker{
-			GameID:  gameID,
-			Owner:   nation,
-			Members: channelMembers,
-			At:      messages[0].CreatedAt,
-		}
-		seenMarkerID, err := seenMarker.ID(ctx)
-		if err != nil {
-			return err
-		}
 		if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
 			game := &Game{}
-			err = datastore.Get(ctx, gameID, game)
-			if err != nil {
+			channel := &Channel{}
+			if err := datastore.GetMulti(ctx, []*datastore.Key{gameID, channelID}, []interface{}{game, channel}); err != nil {
 				return err
 			}
 			game.ID = gameID
 
-			member, isMember := game.GetMemberByUserId(user.Id)
-			if !isMember {
+			if _, isMember := game.GetMemberByUserId(user.Id); !isMember {
 				return fmt.Errorf("not member of the game?")
 			}
 
-			channels, err := loadChannels(ctx, game, nation)
-			if err != nil {
-				return err
-			}
-			filteredChannels := Channels{}
-			for _, channel := range channels {
-				if channel.Members.String() != seenMarker.Members.String() {
-					filteredChannels = append(filteredChannels, channel)
-				}
-			}
-
-			if err := countUnreadMessages(ctx, filteredChannels, nation); err != nil {
+			if err := markChannelSeen(ctx, game, channel, nation, messages[0].CreatedAt); err != nil {
 				return err
 			}
 
-			unread := 0
-			for _, channel := range filteredChannels {
-				unread += channel.NMessagesSince.NMessages
-			}
-
-			member.UnreadMessages = unread
-			if err := game.Save(ctx); err != nil {
-				return err
-			}
-
-			if _, err = datastore.Put(ctx, seenMarkerID, seenMarker); err != nil {
-				return err
-			}
-
-			return nil
+			return game.Save(ctx)
 		}, &datastore.TransactionOptions{XG: false}); err != nil {
 			return err
 		}
 	}
 
+	if game.EnableReadReceipts && (channelMembers.Includes(nation) || game.pressRevealedTo(nation)) {
+		if err := loadReadReceipts(ctx, channelID, channelMembers, messages); err != nil {
+			return err
+		}
+	}
+
 	filteredMessages := make(Messages, 0, len(messages))
 	for _, msg := range messages {
 		if _, isMuted := mutedNats[msg.Sender]; !isMuted {
+			msg.Redact()
 			filteredMessages = append(filteredMessages, msg)
 		}
 	}
 
+	if nation != "" {
+		r.Values()["viewer-nation"] = nation
+	}
+
 	w.SetContent(filteredMessages.Item(r, gameID, channelMembers))
 	return nil
 }
 
 func loadChannels(ctx context.Context, game *Game, viewer godip.Nation) (Channels, error) {
 	channels := Channels{}
-	if game.Finished {
+	if game.pressRevealedTo(viewer) {
 		_, err := datastore.NewQuery(channelKind).Ancestor(game.ID).GetAll(ctx, &channels)
 		if err != nil {
 			return nil, err
@@ -981,8 +1295,11 @@ func loadChannels(ctx context.Context, game *Game, viewer godip.Nation) (Channel
 	return channels, nil
 }
 
+// countUnreadMessages sets NMessagesSince of the channels to the messages viewer hasn't seen. Seen markers
+// with incrementally counted unread messages are used as is, and only legacy markers cause counting queries.
 func countUnreadMessages(ctx context.Context, channels Channels, viewer godip.Nation) error {
 	seenMarkerTimes := make([]time.Time, len(channels))
+	counted := make([]bool, len(channels))
 
 	seenMarkerIDs := make([]*datastore.Key, len(channels))
 	for i := range channels {
@@ -1000,11 +1317,13 @@ func countUnreadMessages(ctx context.Context, channels Channels, viewer godip.Na
 	if err == nil {
 		for i := range channels {
 			seenMarkerTimes[i] = seenMarkers[i].At
+			counted[i] = seenMarkers[i].Counted
 		}
 	} else if merr, ok := err.(appengine.MultiError); ok {
 		for i, serr := range merr {
 			if serr == nil {
 				seenMarkerTimes[i] = seenMarkers[i].At
+				counted[i] = seenMarkers[i].Counted
 			} else if serr != datastore.ErrNoSuchEntity {
 				return err
 			}
@@ -1015,14 +1334,18 @@ func countUnreadMessages(ctx context.Context, channels Channels, viewer godip.Na
 
 	results := make(chan error)
 	for i := range channels {
-		go func(c *Channel, since time.Time) {
-			if since.IsZero() {
+		go func(c *Channel, marker *SeenMarker, since time.Time, counted bool) {
+			if counted {
+				c.NMessagesSince.Since = since
+				c.NMessagesSince.NMessages = marker.Unread
+				results <- nil
+			} else if since.IsZero() {
 				c.NMessagesSince.NMessages = c.NMessages
 				results <- nil
 			} else {
 				results <- c.CountSince(ctx, since)
 			}
-		}(&channels[i], seenMarkerTimes[i])
+		}(&channels[i], &seenMarkers[i], seenMarkerTimes[i], counted[i])
 	}
 	merr := appengine.MultiError{}
 	for range channels {
@@ -1072,6 +1395,7 @@ func listChannels(w ResponseWriter, r Request) error {
 		if err := countUnreadMessages(ctx, channels, nation); err != nil {
 			return err
 		}
+		r.Values()["viewer-nation"] = nation
 	} else {
 		for i := range channels {
 			channels[i].NMessagesSince.NMessages = channels[i].NMessages
@@ -1134,23 +1458,49 @@ func receiveMail(w ResponseWriter, r Request) error {
 	}
 
 	fromNation := parts[0]
-	messageID, err := datastore.DecodeKey(parts[1])
+	replyToID, err := datastore.DecodeKey(parts[1])
 	if err != nil {
-		e := fmt.Sprintf("Unable to decode message ID %q: %v.", parts[1], err)
+		e := fmt.Sprintf("Unable to decode reply ID %q: %v.", parts[1], err)
 		log.Errorf(ctx, e)
 		return sendEmailError(ctx, from, e)
 	}
 
+	okLines := stripQuotedReply(enmsg.Text, toAddress.Address)
+
+	if replyToID.Kind() == phaseKind {
+		return receivePhaseMail(ctx, from, godip.Nation(fromNation), replyToID, okLines)
+	}
+
 	message := &Message{}
-	if err := datastore.Get(ctx, messageID, message); err != nil {
+	if err := datastore.Get(ctx, replyToID, message); err != nil {
 		e := fmt.Sprintf("Unable to load original message from datastore, unable to create reply: %v", err)
 		log.Errorf(ctx, e)
 		return sendEmailError(ctx, from, e)
 	}
 
+	newMessage := &Message{
+		GameID:         message.GameID,
+		ChannelMembers: message.ChannelMembers,
+		Sender:         godip.Nation(fromNation),
+		Body:           strings.Join(okLines, "\n"),
+	}
+
+	if strings.TrimSpace(newMessage.Body) == "" {
+		e := "Unable to send empty message."
+		log.Errorf(ctx, e)
+		return sendEmailError(ctx, from, e)
+	}
+
+	log.Infof(ctx, "Received %v via email", PP(newMessage))
+
+	return createMessageHelper(ctx, r, newMessage)
+}
+
+// stripQuotedReply returns the lines of text before the quoted mail, identified by the line containing the address replied to.
+func stripQuotedReply(text string, address string) []string {
 	paragraphs := []string{}
 	paragraph := []string{}
-	for _, line := range strings.Split(enmsg.Text, "\n") {
+	for _, line := range strings.Split(text, "\n") {
 		paragraph = append(paragraph, line)
 		if strings.TrimSpace(line) == "" {
 			paragraphs = append(paragraphs, strings.Join(paragraph, "\n"))
@@ -1170,7 +1520,7 @@ func receiveMail(w ResponseWriter, r Request) error {
 			}
 		}
 
-		if strings.Contains(line, toAddress.Address) {
+		if strings.Contains(line, address) {
 			for i := len(okLines); i > 0; i-- {
 				if strings.TrimSpace(okLines[i-1]) == "" {
 					okLines = okLines[:i-1]
@@ -1183,20 +1533,5 @@ func receiveMail(w ResponseWriter, r Request) error {
 		okLines = append(okLines, strings.TrimRightFunc(line, unicode.IsSpace))
 	}
 
-	newMessage := &Message{
-		GameID:         message.GameID,
-		ChannelMembers: message.ChannelMembers,
-		Sender:         godip.Nation(fromNation),
-		Body:           strings.Join(okLines, "\n"),
-	}
-
-	if strings.TrimSpace(newMessage.Body) == "" {
-		e := "Unable to send empty message."
-		log.Errorf(ctx, e)
-		return sendEmailError(ctx, from, e)
-	}
-
-	log.Infof(ctx, "Received %v via email", PP(newMessage))
-
-	return createMessageHelper(ctx, r, newMessage)
+	return okLines
 }
@@ -0,0 +1,432 @@
+package game
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip"
+	"github.com/zond/godip/variants"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	chatBridgeKind    = "ChatBridge"
+	chatBridgeTimeout = 10 * time.Second
+)
+
+var (
+	mirrorToChatBridgesFunc *DelayFunc
+	postToChatBridgeFunc    *DelayFunc
+
+	ChatBridgeResource *Resource
+)
+
+func init() {
+	mirrorToChatBridgesFunc = NewDelayFunc("game-mirrorToChatBridges", mirrorToChatBridges)
+	postToChatBridgeFunc = NewDelayFunc("game-postToChatBridge", postToChatBridge)
+
+	ChatBridgeResource = &Resource{
+		Create:     createChatBridge,
+		Delete:     deleteChatBridge,
+		CreatePath: "/Game/{game_id}/Channel/{channel_members}/Bridge",
+		FullPath:   "/Game/{game_id}/Channel/{channel_members}/Bridge/{id}",
+		Listers: []Lister{
+			{
+				Path:    "/Game/{game_id}/Channel/{channel_members}/Bridges",
+				Route:   ListChatBridgesRoute,
+				Handler: listChatBridges,
+			},
+		},
+	}
+}
+
+type ChatBridges []ChatBridge
+
+func (c ChatBridges) Item(r Request, gameID *datastore.Key, channelMembers Nations) *Item {
+	bridgeItems := make(List, len(c))
+	for i := range c {
+		bridgeItems[i] = c[i].Item(r)
+	}
+	return NewItem(bridgeItems).SetName("bridges").SetDesc([][]string{
+		[]string{
+			"Chat bridges",
+			"Chat bridges mirror a channel into a room of an external chat service, like Discord or Slack.",
+			"Create a bridge with the `URL` of an incoming webhook of the external room, and all messages in the channel not sent by you will be posted there as JSON containing `username`, `text` and `content`.",
+		},
+		[]string{
+			"Replying",
+			"Each bridge has an `incoming` link. Configure the external service to post replies there, either as JSON with a `text` or `content` field, or as a form with a `text` field, and they will be sent to the channel from your nation.",
+			"Anyone knowing the `incoming` link can send messages as you, so delete the bridge if it leaks.",
+		},
+	}).AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListChatBridgesRoute,
+		RouteParams: []string{"game_id", gameID.Encode(), "channel_members", channelMembers.String()},
+	})).AddLink(r.NewLink(ChatBridgeResource.Link("create", Create, []string{"game_id", gameID.Encode(), "channel_members", channelMembers.String()})))
+}
+
+// ChatBridge mirrors a channel into an external chat room, on behalf of one member of the channel.
+type ChatBridge struct {
+	ID             *datastore.Key `datastore:"-"`
+	GameID         *datastore.Key
+	ChannelMembers Nations
+	Nation         godip.Nation
+	UserId         string
+	URL            string `methods:"POST" datastore:",noindex"`
+	Token          string `json:"-" datastore:",noindex"`
+	CreatedAt      time.Time
+}
+
+func (c *ChatBridge) Item(r Request) *Item {
+	return NewItem(c).SetName(c.URL).AddLink(r.NewLink(Link{
+		Rel:         "incoming",
+		Method:      "POST",
+		Route:       ReceiveChatBridgeMessageRoute,
+		RouteParams: []string{"token", c.Token},
+	})).AddLink(r.NewLink(ChatBridgeResource.Link("delete", Delete, []string{"game_id", c.GameID.Encode(), "channel_members", c.ChannelMembers.String(), "id", c.ID.Encode()})))
+}
+
+// ChatBridgeMessage is the body posted to external chat rooms. Discord reads Content and Slack reads Text.
+type ChatBridgeMessage struct {
+	Username string `json:"username"`
+	Text     string `json:"text"`
+	Content  string `json:"content"`
+}
+
+// chatBridgeReply is the body posted by external chat services to the incoming link.
+type chatBridgeReply struct {
+	Text    string `json:"text"`
+	Content string `json:"content"`
+	BotID   string `json:"bot_id"`
+}
+
+// parseChatBridgeReply returns the body of a reply posted to the incoming link of a bridge,
+// or an empty string if the reply should be ignored since it's posted by a bot (probably us).
+func parseChatBridgeReply(req *http.Request) (string, error) {
+	reply := &chatBridgeReply{}
+	media, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if media == "application/x-www-form-urlencoded" {
+		if err := req.ParseForm(); err != nil {
+			return "", err
+		}
+		reply.Text = req.PostForm.Get("text")
+		reply.BotID = req.PostForm.Get("bot_id")
+		if req.PostForm.Get("user_name") == "slackbot" {
+			return "", nil
+		}
+	} else {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return "", err
+		}
+		if err := json.Unmarshal(b, reply); err != nil {
+			return "", err
+		}
+	}
+	if reply.BotID != "" {
+		return "", nil
+	}
+	if reply.Text != "" {
+		return strings.TrimSpace(reply.Text), nil
+	}
+	return strings.TrimSpace(reply.Content), nil
+}
+
+func mirrorToChatBridges(ctx context.Context, messageID *datastore.Key) error {
+	log.Infof(ctx, "mirrorToChatBridges(..., %v)", messageID)
+
+	message := &Message{}
+	if err := datastore.Get(ctx, messageID, message); err != nil {
+		log.Errorf(ctx, "Unable to load message %v: %v; hope datastore gets fixed", messageID, err)
+		return err
+	}
+	if message.Deleted {
+		log.Infof(ctx, "%v is deleted, skipping mirroring", messageID)
+		return nil
+	}
+
+	bridges := ChatBridges{}
+	bridgeIDs, err := datastore.NewQuery(chatBridgeKind).Ancestor(messageID.Parent()).GetAll(ctx, &bridges)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load bridges for %v: %v; hope datastore gets fixed", messageID.Parent(), err)
+		return err
+	}
+
+	for i := range bridges {
+		// Messages sent by the bridged nation are probably sent via the bridge, and mirroring them back would cause loops.
+		if bridges[i].Nation == message.Sender {
+			continue
+		}
+		gameStateID, err := GameStateID(ctx, message.GameID, bridges[i].Nation)
+		if err != nil {
+			log.Errorf(ctx, "Unable to create game state ID for %v: %v; fix GameStateID", bridges[i].Nation, err)
+			return err
+		}
+		gameState := &GameState{}
+		if err := datastore.Get(ctx, gameStateID, gameState); err == nil {
+			if gameState.HasMuted(message.Sender) {
+				continue
+			}
+		} else if err != datastore.ErrNoSuchEntity {
+			log.Errorf(ctx, "Unable to load game state %v: %v; hope datastore gets fixed", gameStateID, err)
+			return err
+		}
+		body, err := json.Marshal(ChatBridgeMessage{
+			Username: string(message.Sender),
+			Text:     message.Body,
+			Content:  message.Body,
+		})
+		if err != nil {
+			log.Errorf(ctx, "Unable to marshal bridge message: %v; fix ChatBridgeMessage", err)
+			return err
+		}
+		if err := postToChatBridgeFunc.EnqueueIn(ctx, 0, bridgeIDs[i], body); err != nil {
+			log.Errorf(ctx, "Unable to enqueue posting to %v: %v; hope datastore gets fixed", bridgeIDs[i], err)
+			return err
+		}
+	}
+
+	log.Infof(ctx, "mirrorToChatBridges(..., %v) *** SUCCESS ***", messageID)
+
+	return nil
+}
+
+func postToChatBridge(ctx context.Context, bridgeID *datastore.Key, body []byte) error {
+	log.Infof(ctx, "postToChatBridge(..., %v, ...)", bridgeID)
+
+	bridge := &ChatBridge{}
+	if err := datastore.Get(ctx, bridgeID, bridge); err == datastore.ErrNoSuchEntity {
+		log.Infof(ctx, "Bridge %v has been deleted, skipping", bridgeID)
+		return nil
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to load bridge %v: %v; hope datastore gets fixed", bridgeID, err)
+		return err
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, chatBridgeTimeout)
+	defer cancel()
+	resp, err := urlfetch.Client(timeoutCtx).Post(bridge.URL, "application/json; charset=UTF-8", bytes.NewBuffer(body))
+	if err != nil {
+		log.Warningf(ctx, "Unable to post to %v: %v; will retry", bridge.URL, err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Warningf(ctx, "Posting to %v returned %v; will retry", bridge.URL, resp.Status)
+		return fmt.Errorf("bridge %v returned %v", bridge.URL, resp.Status)
+	}
+
+	log.Infof(ctx, "postToChatBridge(..., %v, ...) *** SUCCESS ***", bridgeID)
+
+	return nil
+}
+
+func receiveChatBridgeMessage(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	token := r.Vars()["token"]
+	plainToken, err := auth.DecodeString(ctx, token)
+	if err != nil {
+		log.Infof(ctx, "Unable to successfully decrypt bridge token %q: %v", token, err)
+		return HTTPErr{"badly encrypted token", http.StatusUnauthorized}
+	}
+	bridgeID, err := datastore.DecodeKey(plainToken)
+	if err != nil || bridgeID.Kind() != chatBridgeKind {
+		log.Errorf(ctx, "Decrypted token %q is not a bridge ID: %v", plainToken, err)
+		return HTTPErr{"unknown bridge", http.StatusNotFound}
+	}
+
+	bridge := &ChatBridge{}
+	if err := datastore.Get(ctx, bridgeID, bridge); err == datastore.ErrNoSuchEntity {
+		return HTTPErr{"unknown bridge", http.StatusNotFound}
+	} else if err != nil {
+		return err
+	}
+
+	body, err := parseChatBridgeReply(r.Req())
+	if err != nil {
+		return HTTPErr{fmt.Sprintf("unparseable reply: %v", err), http.StatusBadRequest}
+	}
+	if body == "" {
+		log.Infof(ctx, "Ignoring empty or bot reply to %v", bridgeID)
+		return nil
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, bridge.GameID, game); err != nil {
+		return err
+	}
+	if member, found := game.GetMemberByUserId(bridge.UserId); !found || member.Nation != bridge.Nation {
+		return HTTPErr{"bridge owner no longer plays the bridged nation", http.StatusForbidden}
+	}
+
+	message := &Message{
+		GameID:         bridge.GameID,
+		ChannelMembers: bridge.ChannelMembers,
+		Sender:         bridge.Nation,
+		Body:           body,
+	}
+
+	log.Infof(ctx, "Received %v via bridge %v", PP(message), bridgeID)
+
+	return createMessageHelper(ctx, r, message)
+}
+
+// loadBridgedChannel returns the game and member of the channel in the request that the user is allowed to bridge.
+func loadBridgedChannel(ctx context.Context, r Request, user *auth.User) (*Game, *Member, Nations, error) {
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return nil, nil, nil, err
+	}
+	game.ID = gameID
+
+	member, found := game.GetMemberByUserId(user.Id)
+	if !found {
+		return nil, nil, nil, HTTPErr{"can only bridge channels in member games", http.StatusNotFound}
+	}
+
+	channelMembers := Nations{}
+	channelMembers.FromString(r.Vars()["channel_members"])
+	if !channelMembers.Includes(member.Nation) {
+		return nil, nil, nil, HTTPErr{"can only bridge member channels", http.StatusForbidden}
+	}
+	for _, channelMember := range channelMembers {
+		if !Nations(variants.Variants[game.Variant].Nations).Includes(channelMember) {
+			return nil, nil, nil, HTTPErr{"unknown channel member", http.StatusBadRequest}
+		}
+	}
+
+	return game, member, channelMembers, nil
+}
+
+func createChatBridge(w ResponseWriter, r Request) (*ChatBridge, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	game, member, channelMembers, err := loadBridgedChannel(ctx, r, user)
+	if err != nil {
+		return nil, err
+	}
+
+	bridge := &ChatBridge{}
+	if err := Copy(bridge, r, "POST"); err != nil {
+		return nil, err
+	}
+	if err := validateCallbackURL(bridge.URL); err != nil {
+		return nil, err
+	}
+
+	channelID, err := ChannelID(ctx, game.ID, channelMembers)
+	if err != nil {
+		return nil, err
+	}
+
+	bridge.GameID = game.ID
+	bridge.ChannelMembers = channelMembers
+	bridge.Nation = member.Nation
+	bridge.UserId = user.Id
+	bridge.CreatedAt = time.Now()
+
+	// Allocate the ID first, since it's part of the token.
+	low, _, err := datastore.AllocateIDs(ctx, chatBridgeKind, channelID, 1)
+	if err != nil {
+		return nil, err
+	}
+	bridge.ID = datastore.NewKey(ctx, chatBridgeKind, "", low, channelID)
+	if bridge.Token, err = auth.EncodeString(ctx, bridge.ID.Encode()); err != nil {
+		return nil, err
+	}
+	if _, err := datastore.Put(ctx, bridge.ID, bridge); err != nil {
+		return nil, err
+	}
+
+	return bridge, nil
+}
+
+func deleteChatBridge(w ResponseWriter, r Request) (*ChatBridge, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	bridgeID, err := datastore.DecodeKey(r.Vars()["id"])
+	if err != nil {
+		return nil, err
+	}
+
+	bridge := &ChatBridge{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, bridgeID, bridge); err != nil {
+			return err
+		}
+		if bridge.UserId != user.Id {
+			return HTTPErr{"can only delete your own bridges", http.StatusForbidden}
+		}
+		return datastore.Delete(ctx, bridgeID)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+	bridge.ID = bridgeID
+
+	return bridge, nil
+}
+
+func listChatBridges(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	game, _, channelMembers, err := loadBridgedChannel(ctx, r, user)
+	if err != nil {
+		return err
+	}
+
+	channelID, err := ChannelID(ctx, game.ID, channelMembers)
+	if err != nil {
+		return err
+	}
+
+	// Filtered in memory, since there are only a few bridges per channel and this avoids a composite index.
+	found := ChatBridges{}
+	ids, err := datastore.NewQuery(chatBridgeKind).Ancestor(channelID).GetAll(ctx, &found)
+	if err != nil {
+		return err
+	}
+	bridges := ChatBridges{}
+	for i := range found {
+		if found[i].UserId == user.Id {
+			found[i].ID = ids[i]
+			bridges = append(bridges, found[i])
+		}
+	}
+
+	w.SetContent(bridges.Item(r, game.ID, channelMembers))
+	return nil
+}
@@ -0,0 +1,264 @@
+package game
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	chatExportTimeFormat = "2006-01-02 15:04:05 MST"
+)
+
+// ChatExportPhase contains the messages of a channel sent while a phase was the newest phase of the game.
+type ChatExportPhase struct {
+	PhaseOrdinal int64
+	Season       godip.Season
+	Year         int
+	Type         godip.PhaseType
+	CreatedAt    time.Time
+	ResolvedAt   time.Time
+	Messages     Messages
+}
+
+func (p *ChatExportPhase) String() string {
+	result := fmt.Sprintf("%s %d, %s (started %s", p.Season, p.Year, p.Type, p.CreatedAt.UTC().Format(chatExportTimeFormat))
+	if !p.ResolvedAt.IsZero() {
+		result += fmt.Sprintf(", resolved %s", p.ResolvedAt.UTC().Format(chatExportTimeFormat))
+	}
+	return result + ")"
+}
+
+type ChatExportChannel struct {
+	Members Nations
+	Phases  []ChatExportPhase
+}
+
+// ChatExport contains all channels of a finished game, with the messages grouped by phase.
+type ChatExport struct {
+	GameID     *datastore.Key
+	Desc       string
+	Variant    string
+	FinishedAt time.Time
+	Channels   []ChatExportChannel
+}
+
+// Text renders the export as plain text, suitable for quoting in writeups.
+func (c *ChatExport) Text() string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s (%s), finished %s\n", c.Desc, c.Variant, c.FinishedAt.UTC().Format(chatExportTimeFormat))
+	for _, channel := range c.Channels {
+		fmt.Fprintf(buf, "\n=== %s ===\n", strings.Replace(channel.Members.String(), ",", ", ", -1))
+		for i := range channel.Phases {
+			phase := &channel.Phases[i]
+			fmt.Fprintf(buf, "\n--- %s ---\n", phase.String())
+			for _, message := range phase.Messages {
+				fmt.Fprintf(buf, "[%s] %s: %s\n", message.CreatedAt.UTC().Format(chatExportTimeFormat), message.Sender, message.Body)
+			}
+		}
+	}
+	return buf.String()
+}
+
+var chatExportHTMLTemplate = template.Must(template.New("chatExport").Funcs(template.FuncMap{
+	"timestamp": func(t time.Time) string {
+		return t.UTC().Format(chatExportTimeFormat)
+	},
+	"join": func(n Nations) string {
+		return strings.Replace(n.String(), ",", ", ", -1)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Desc}}</title>
+<style>
+body { font-family: sans-serif; }
+.phase { color: #666; border-bottom: 1px solid #ccc; }
+.message .time { color: #999; font-size: smaller; }
+.message .body { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>{{.Desc}}</h1>
+<p>{{.Variant}}, finished {{timestamp .FinishedAt}}</p>
+{{range .Channels}}
+<h2>{{join .Members}}</h2>
+{{range .Phases}}
+<h3 class="phase">{{.String}}</h3>
+{{range .Messages}}
+<div class="message"><span class="time">{{timestamp .CreatedAt}}</span> <b>{{.Sender}}</b>: <span class="body">{{.Body}}</span></div>
+{{end}}
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// HTML renders the export as a standalone HTML page.
+func (c *ChatExport) HTML() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := chatExportHTMLTemplate.Execute(buf, c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// loadChatExport loads all channels and phases of the game in the request, and groups the messages
+// by the phase that was the newest when they were sent.
+func loadChatExport(ctx context.Context, r Request) (*ChatExport, error) {
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return nil, err
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return nil, err
+	}
+	game.ID = gameID
+
+	if !game.Finished {
+		return nil, HTTPErr{"can only export chat of finished games", http.StatusPreconditionFailed}
+	}
+	member, isMember := game.GetMemberByUserId(user.Id)
+	if !isMember {
+		return nil, HTTPErr{"can only export chat of member games", http.StatusNotFound}
+	}
+
+	channels, err := loadChannels(ctx, game, member.Nation)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Members.String() < channels[j].Members.String()
+	})
+
+	phases := Phases{}
+	if _, err := datastore.NewQuery(phaseKind).Ancestor(gameID).GetAll(ctx, &phases); err != nil {
+		return nil, err
+	}
+	sort.Slice(phases, func(i, j int) bool {
+		return phases[i].PhaseOrdinal < phases[j].PhaseOrdinal
+	})
+
+	export := &ChatExport{
+		GameID:     gameID,
+		Desc:       game.Desc,
+		Variant:    game.Variant,
+		FinishedAt: game.FinishedAt,
+		Channels:   make([]ChatExportChannel, len(channels)),
+	}
+	for i := range channels {
+		channelID, err := channels[i].ID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		messages := Messages{}
+		messageIDs, err := datastore.NewQuery(messageKind).Ancestor(channelID).Order("CreatedAt").GetAll(ctx, &messages)
+		if err != nil {
+			return nil, err
+		}
+		exportChannel := &export.Channels[i]
+		exportChannel.Members = channels[i].Members
+		exportChannel.Phases = []ChatExportPhase{}
+		phaseIdx := -1
+		for j, message := range messages {
+			if message.Deleted {
+				continue
+			}
+			message.ID = messageIDs[j]
+			newPhaseIdx := phaseIdx
+			for newPhaseIdx+1 < len(phases) && !phases[newPhaseIdx+1].CreatedAt.After(message.CreatedAt) {
+				newPhaseIdx++
+			}
+			if newPhaseIdx != phaseIdx || len(exportChannel.Phases) == 0 {
+				phaseIdx = newPhaseIdx
+				exportPhase := ChatExportPhase{
+					Messages: Messages{},
+				}
+				if phaseIdx > -1 {
+					meta := phases[phaseIdx].PhaseMeta
+					exportPhase.PhaseOrdinal = meta.PhaseOrdinal
+					exportPhase.Season = meta.Season
+					exportPhase.Year = meta.Year
+					exportPhase.Type = meta.Type
+					exportPhase.CreatedAt = meta.CreatedAt
+					exportPhase.ResolvedAt = meta.ResolvedAt
+				}
+				exportChannel.Phases = append(exportChannel.Phases, exportPhase)
+			}
+			lastPhase := &exportChannel.Phases[len(exportChannel.Phases)-1]
+			lastPhase.Messages = append(lastPhase.Messages, message)
+		}
+	}
+
+	return export, nil
+}
+
+func setChatExportHeaders(w ResponseWriter, export *ChatExport, contentType string, extension string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"chat-%d.%s\"", export.GameID.IntID(), extension))
+}
+
+func exportChatJSON(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	export, err := loadChatExport(ctx, r)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return err
+	}
+	setChatExportHeaders(w, export, "application/json; charset=UTF-8", "json")
+	_, err = w.Write(b)
+	return err
+}
+
+func exportChatText(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	export, err := loadChatExport(ctx, r)
+	if err != nil {
+		return err
+	}
+	setChatExportHeaders(w, export, "text/plain; charset=utf-8", "txt")
+	_, err = w.Write([]byte(export.Text()))
+	return err
+}
+
+func exportChatHTML(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	export, err := loadChatExport(ctx, r)
+	if err != nil {
+		return err
+	}
+	b, err := export.HTML()
+	if err != nil {
+		return err
+	}
+	setChatExportHeaders(w, export, "text/html; charset=utf-8", "html")
+	_, err = w.Write(b)
+	return err
+}
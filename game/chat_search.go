@@ -0,0 +1,327 @@
+package game
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip"
+	"github.com/zond/godip/variants"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	// Messages are loaded newest first in batches of this size, until enough matches are found.
+	searchBatchSize = 100
+	// Each search loads at most this many messages per channel, the rest are left to the next page.
+	maxSearchedMessages = 2000
+
+	searchDateFormat = "2006-01-02"
+)
+
+// messageQuery is a parsed search query, matching messages containing all terms.
+type messageQuery struct {
+	terms   []string
+	senders map[godip.Nation]struct{}
+	// after and before restrict the CreatedAt of the matched messages, unless zero.
+	after  time.Time
+	before time.Time
+}
+
+// parseMessageQuery splits query into lower case terms. Quoted phrases are kept as single terms,
+// terms like "from:Turkey" restrict the senders of the matched messages, and terms like
+// "after:2026-03-10" or "before:2026-03-10" restrict when they were sent.
+func parseMessageQuery(query string, nations []godip.Nation) *messageQuery {
+	result := &messageQuery{
+		senders: map[godip.Nation]struct{}{},
+	}
+	phrases := strings.Split(query, "\"")
+	for i, phrase := range phrases {
+		phrase = strings.ToLower(strings.TrimSpace(phrase))
+		if phrase == "" {
+			continue
+		}
+		if i%2 == 1 {
+			result.terms = append(result.terms, phrase)
+			continue
+		}
+		for _, term := range strings.Fields(phrase) {
+			if strings.HasPrefix(term, "from:") {
+				for _, nat := range nations {
+					if strings.ToLower(string(nat)) == term[len("from:"):] {
+						result.senders[nat] = struct{}{}
+					}
+				}
+				continue
+			}
+			if strings.HasPrefix(term, "after:") {
+				if date, err := time.Parse(searchDateFormat, term[len("after:"):]); err == nil {
+					result.after = date
+					continue
+				}
+			}
+			if strings.HasPrefix(term, "before:") {
+				if date, err := time.Parse(searchDateFormat, term[len("before:"):]); err == nil {
+					result.before = date
+					continue
+				}
+			}
+			result.terms = append(result.terms, term)
+		}
+	}
+	return result
+}
+
+func (q *messageQuery) empty() bool {
+	return len(q.terms) == 0 && len(q.senders) == 0 && q.after.IsZero() && q.before.IsZero()
+}
+
+func (q *messageQuery) matches(message *Message) bool {
+	if len(q.senders) > 0 {
+		if _, found := q.senders[message.Sender]; !found {
+			return false
+		}
+	}
+	body := strings.ToLower(message.Body)
+	for _, term := range q.terms {
+		if !strings.Contains(body, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// searchChannel returns the newest limit messages in the channel matching the query. If it gave up after
+// maxSearchedMessages, it also returns the CreatedAt of the oldest message it loaded.
+func searchChannel(ctx context.Context, channel *Channel, query *messageQuery, mutedNats map[godip.Nation]struct{}, limit int) (Messages, time.Time, error) {
+	channelID, err := channel.ID(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	q := datastore.NewQuery(messageKind).Ancestor(channelID).Order("-CreatedAt")
+	if !query.after.IsZero() {
+		q = q.Filter("CreatedAt>=", query.after)
+	}
+	if !query.before.IsZero() {
+		q = q.Filter("CreatedAt<", query.before)
+	}
+	result := Messages{}
+	var cursor *datastore.Cursor
+	var oldest time.Time
+	for searched := 0; searched < maxSearchedMessages; {
+		batch := q.Limit(searchBatchSize)
+		if cursor != nil {
+			batch = batch.Start(*cursor)
+		}
+		iter := batch.Run(ctx)
+		loaded := 0
+		for {
+			message := Message{}
+			messageID, err := iter.Next(&message)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return nil, time.Time{}, err
+			}
+			loaded++
+			oldest = message.CreatedAt
+			if message.Deleted {
+				continue
+			}
+			if _, isMuted := mutedNats[message.Sender]; isMuted {
+				continue
+			}
+			if query.matches(&message) {
+				message.ID = messageID
+				message.Age = time.Now().Sub(message.CreatedAt)
+				result = append(result, message)
+				if len(result) >= limit {
+					return result, time.Time{}, nil
+				}
+			}
+		}
+		if loaded < searchBatchSize {
+			return result, time.Time{}, nil
+		}
+		searched += loaded
+		nextCursor, err := iter.Cursor()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		cursor = &nextCursor
+	}
+	return result, oldest, nil
+}
+
+func searchMessages(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	limit := maxLimit
+	if limitS := r.Req().URL.Query().Get("limit"); limitS != "" {
+		if i, err := strconv.ParseInt(limitS, 10, 64); err == nil && i > 0 && int(i) < maxLimit {
+			limit = int(i)
+		}
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return err
+	}
+	game.ID = gameID
+
+	var nation godip.Nation
+	mutedNats := map[godip.Nation]struct{}{}
+	if member, found := game.GetMemberByUserId(user.Id); found {
+		nation = member.Nation
+		gameStateID, err := GameStateID(ctx, gameID, nation)
+		if err != nil {
+			return err
+		}
+		gameState := &GameState{}
+		if err = datastore.Get(ctx, gameStateID, gameState); err == nil {
+			for _, nat := range gameState.Muted {
+				mutedNats[nat] = struct{}{}
+			}
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+
+	queryString := r.Req().URL.Query().Get("q")
+	query := parseMessageQuery(queryString, variants.Variants[game.Variant].Nations)
+
+	beforeParam := r.Req().URL.Query().Get("before")
+	if beforeParam != "" {
+		before, err := time.Parse(time.RFC3339Nano, beforeParam)
+		if err != nil {
+			return HTTPErr{fmt.Sprintf("invalid before %q: %v", beforeParam, err), http.StatusBadRequest}
+		}
+		if query.before.IsZero() || before.Before(query.before) {
+			query.before = before
+		}
+	}
+
+	found := Messages{}
+	// Messages older than searchedUntil weren't searched in all channels, and are left to the next page.
+	var searchedUntil time.Time
+	if !query.empty() {
+		// Uses the same channel visibility rules as listChannels and listMessages.
+		channels, err := loadChannels(ctx, game, nation)
+		if err != nil {
+			return err
+		}
+
+		type channelResult struct {
+			messages Messages
+			oldest   time.Time
+			err      error
+		}
+		results := make(chan channelResult)
+		for i := range channels {
+			go func(c *Channel) {
+				// One more than the limit, to know whether there is a next page.
+				messages, oldest, err := searchChannel(ctx, c, query, mutedNats, limit+1)
+				results <- channelResult{messages, oldest, err}
+			}(&channels[i])
+		}
+		merr := appengine.MultiError{}
+		for range channels {
+			result := <-results
+			if result.err != nil {
+				merr = append(merr, result.err)
+			} else {
+				found = append(found, result.messages...)
+				if result.oldest.After(searchedUntil) {
+					searchedUntil = result.oldest
+				}
+			}
+		}
+		if len(merr) > 0 {
+			return merr
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].CreatedAt.After(found[j].CreatedAt)
+	})
+	if !searchedUntil.IsZero() {
+		searched := Messages{}
+		for i := range found {
+			if !found[i].CreatedAt.Before(searchedUntil) {
+				searched = append(searched, found[i])
+			}
+		}
+		found = searched
+	}
+	if len(found) > limit {
+		found = found[:limit]
+		searchedUntil = found[len(found)-1].CreatedAt
+	}
+
+	if nation != "" {
+		r.Values()["viewer-nation"] = nation
+	}
+
+	messageItems := make(List, len(found))
+	for i := range found {
+		messageItems[i] = found[i].Item(r)
+	}
+	selfQueryParams := url.Values{
+		"q": []string{queryString},
+	}
+	if beforeParam != "" {
+		selfQueryParams.Set("before", beforeParam)
+	}
+	messagesItem := NewItem(messageItems).SetName("messages").SetDesc([][]string{
+		[]string{
+			"Searching messages",
+			"Searches all channels you can see in this game for messages containing all words of the `q` query parameter, newest first.",
+			"Use double quotes to search for phrases, and add `from:Nation` to only find messages sent by that nation.",
+			fmt.Sprintf("Add `after:%s` or `before:%s` to only find messages sent on or after, or before, a UTC date.", searchDateFormat, searchDateFormat),
+			"Messages from muted nations and deleted messages are never found.",
+		},
+		[]string{
+			"Limiting results",
+			fmt.Sprintf("At most %d messages are returned, add a `limit` query parameter to return fewer.", maxLimit),
+			"If there may be more messages, the `next` link returns the older ones.",
+		},
+	}).AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       SearchMessagesRoute,
+		RouteParams: []string{"game_id", gameID.Encode()},
+		QueryParams: selfQueryParams,
+	}))
+	if !searchedUntil.IsZero() {
+		messagesItem.AddLink(r.NewLink(Link{
+			Rel:         "next",
+			Route:       SearchMessagesRoute,
+			RouteParams: []string{"game_id", gameID.Encode()},
+			QueryParams: url.Values{
+				"q":      []string{queryString},
+				"limit":  []string{fmt.Sprint(limit)},
+				"before": []string{searchedUntil.Format(time.RFC3339Nano)},
+			},
+		}))
+	}
+	w.SetContent(messagesItem)
+	return nil
+}
@@ -0,0 +1,248 @@
+package game
+
+import (
+	"fmt"
+	"net/mail"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/go-fcm"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"gopkg.in/sendgrid/sendgrid-go.v2"
+)
+
+const (
+	// A reminder is skipped if the deadline has been moved this much further away since it was scheduled.
+	deadlineReminderSlack = 5 * time.Minute
+)
+
+var (
+	scheduleDeadlineRemindersFunc *DelayFunc
+	sendDeadlineReminderFunc      *DelayFunc
+)
+
+func init() {
+	scheduleDeadlineRemindersFunc = NewDelayFunc("game-scheduleDeadlineReminders", scheduleDeadlineReminders)
+	sendDeadlineReminderFunc = NewDelayFunc("game-sendDeadlineReminder", sendDeadlineReminder)
+}
+
+// scheduleDeadlineReminders enqueues one reminder per configured number of minutes before the deadline of the
+// newest phase of the game. It is enqueued with the phase notifications, i.e. with the phase that just resolved,
+// or with the first phase when the game starts.
+func scheduleDeadlineReminders(ctx context.Context, host, scheme string, gameID *datastore.Key, phaseOrdinal int64, userId string) error {
+	log.Infof(ctx, "scheduleDeadlineReminders(..., %q, %q, %v, %v, %q)", host, scheme, gameID, phaseOrdinal, userId)
+
+	game := &Game{}
+	userConfig := &auth.UserConfig{}
+	if err := datastore.GetMulti(ctx, []*datastore.Key{gameID, auth.UserConfigID(ctx, auth.UserID(ctx, userId))}, []interface{}{game, userConfig}); err != nil {
+		if merr, ok := err.(appengine.MultiError); ok && merr[0] == nil && merr[1] == datastore.ErrNoSuchEntity {
+			log.Infof(ctx, "%q has no configuration, will skip scheduling reminders", userId)
+			return nil
+		}
+		log.Errorf(ctx, "Unable to load game and user config: %v; hope datastore gets fixed", err)
+		return err
+	}
+
+	if game.Finished || len(game.NewestPhaseMeta) == 0 {
+		log.Infof(ctx, "%v is finished or has no phases, will skip scheduling reminders", gameID)
+		return nil
+	}
+	phase := &game.NewestPhaseMeta[0]
+	// If the game has moved on past the phase following phaseOrdinal, the phase notifications of the newer
+	// phases schedule the reminders.
+	if phase.PhaseOrdinal != phaseOrdinal && phase.PhaseOrdinal != phaseOrdinal+1 {
+		log.Infof(ctx, "%v has already moved on to phase %v, will skip scheduling reminders", gameID, phase.PhaseOrdinal)
+		return nil
+	}
+	if phase.Resolved || phase.DeadlineAt.IsZero() {
+		log.Infof(ctx, "Phase %v of %v is resolved or has no deadline, will skip scheduling reminders", phase.PhaseOrdinal, gameID)
+		return nil
+	}
+
+	for _, minutes := range userConfig.DeadlineReminderMinutes {
+		at := deadlineReminderAt(phase.DeadlineAt, minutes, &userConfig.QuietHours)
+		if at.Before(time.Now()) {
+			continue
+		}
+		if err := sendDeadlineReminderFunc.EnqueueAt(ctx, at, host, scheme, gameID, phase.PhaseOrdinal, userId, minutes); err != nil {
+			log.Errorf(ctx, "Unable to enqueue reminder %v minutes before %v: %v; hope datastore gets fixed", minutes, phase.DeadlineAt, err)
+			return err
+		}
+	}
+
+	log.Infof(ctx, "scheduleDeadlineReminders(..., %q, %q, %v, %v, %q) *** SUCCESS ***", host, scheme, gameID, phaseOrdinal, userId)
+
+	return nil
+}
+
+// sendDeadlineReminder reminds the user about the deadline of the phase via FCM and email, unless the user has
+// given orders or is ready to resolve.
+func sendDeadlineReminder(ctx context.Context, host, scheme string, gameID *datastore.Key, phaseOrdinal int64, userId string, minutes int) error {
+	log.Infof(ctx, "sendDeadlineReminder(..., %q, %q, %v, %v, %q, %v)", host, scheme, gameID, phaseOrdinal, userId, minutes)
+
+	msgContext, err := getPhaseNotificationContext(ctx, host, scheme, gameID, phaseOrdinal, userId)
+	if err == noConfigError {
+		log.Infof(ctx, "%q has no configuration, will skip sending reminder", userId)
+		return nil
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to get phase notification context: %v; fix getPhaseNotificationContext or hope datastore gets fixed", err)
+		return err
+	}
+
+	if msgContext.game.Finished || msgContext.phase.Resolved {
+		log.Infof(ctx, "%v is already resolved, will skip sending reminder", msgContext.phaseID)
+		return nil
+	}
+	remaining := msgContext.phase.DeadlineAt.Sub(time.Now())
+	if deadlineReminderAt(msgContext.phase.DeadlineAt, minutes, &msgContext.userConfig.QuietHours).After(time.Now().Add(deadlineReminderSlack)) {
+		log.Infof(ctx, "Deadline of %v was moved to %v, will skip sending reminder", msgContext.phaseID, msgContext.phase.DeadlineAt)
+		return nil
+	}
+
+	phaseStateID, err := PhaseStateID(ctx, msgContext.phaseID, msgContext.member.Nation)
+	if err != nil {
+		log.Errorf(ctx, "PhaseStateID(..., %v, %v): %v; fix the PhaseStateID func", msgContext.phaseID, msgContext.member.Nation, err)
+		return err
+	}
+	phaseState := &PhaseState{}
+	if err := datastore.Get(ctx, phaseStateID, phaseState); err != nil && err != datastore.ErrNoSuchEntity {
+		log.Errorf(ctx, "Unable to load phase state %v: %v; hope datastore gets fixed", phaseStateID, err)
+		return err
+	}
+	gameState, err := loadGameStateOrDefault(ctx, gameID, msgContext.member.Nation)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load game state for %v in %v: %v; hope datastore gets fixed", msgContext.member.Nation, gameID, err)
+		return err
+	}
+	if !gameState.WantsPhaseNotifications() || phaseState.ReadyToResolve || phaseState.NoOrders || phaseState.Eliminated {
+		log.Infof(ctx, "%v doesn't need a reminder for %v, will skip sending reminder", msgContext.member.Nation, msgContext.phaseID)
+		return nil
+	}
+
+	orderMap, err := msgContext.phase.Orders(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load orders of %v: %v; hope datastore gets fixed", msgContext.phaseID, err)
+		return err
+	}
+	if len(orderMap[msgContext.member.Nation]) > 0 {
+		log.Infof(ctx, "%v has already given orders for %v, will skip sending reminder", msgContext.member.Nation, msgContext.phaseID)
+		return nil
+	}
+
+	remainingMinutes := int(remaining / time.Minute)
+	msgContext.mailData["remainingMinutes"] = remainingMinutes
+	msgContext.fcmData["type"] = "deadlineReminder"
+
+	title := msgContext.localizer.Sprintf(
+		"%s: %s deadline in %v",
+		msgContext.game.DescFor(msgContext.member.Nation),
+		phaseName(msgContext.localizer, &msgContext.phase.PhaseMeta),
+		remaining.Round(time.Minute),
+	)
+
+	if err := sendDeadlineReminderToFCM(ctx, msgContext, title); err != nil {
+		return err
+	}
+	if err := sendDeadlineReminderToMail(ctx, host, scheme, msgContext, title); err != nil {
+		return err
+	}
+
+	log.Infof(ctx, "sendDeadlineReminder(..., %q, %q, %v, %v, %q, %v) *** SUCCESS ***", host, scheme, gameID, phaseOrdinal, userId, minutes)
+
+	return nil
+}
+
+func sendDeadlineReminderToFCM(ctx context.Context, msgContext *phaseNotificationContext, title string) error {
+	dataPayload, err := NewFCMData(msgContext.fcmData)
+	if err != nil {
+		log.Errorf(ctx, "Unable to encode FCM data payload %v: %v; fix NewFCMData", msgContext.fcmData, err)
+		return err
+	}
+
+	for _, destination := range pushDestinations(msgContext.userConfig) {
+		notificationPayload := &fcm.NotificationPayload{
+			Title:       title,
+			Body:        msgContext.localizer.Sprintf("You haven't given any orders in %s yet.", msgContext.game.Desc),
+			Tag:         "diplicity-engine-deadline-reminder",
+			ClickAction: msgContext.mapURL.String(),
+		}
+
+		destination.ReminderConfig.Customize(ctx, notificationPayload, msgContext.mailData)
+
+		if err := destination.Transport.Send(ctx, &Notification{
+			UserId:  msgContext.user.Id,
+			To:      destination.Value,
+			Type:    DeadlineReminderNotification,
+			GameID:  msgContext.game.ID,
+			Payload: notificationPayload,
+			Data:    dataPayload,
+		}); err != nil {
+			log.Errorf(ctx, "Unable to enqueue actual sending of reminder to %v/%v: %v; hope datastore gets fixed", msgContext.user.Id, destination.Value, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sendDeadlineReminderToMail(ctx context.Context, host, scheme string, msgContext *phaseNotificationContext, subject string) error {
+	if !msgContext.userConfig.MailConfig.Enabled {
+		log.Infof(ctx, "%q hasn't enabled mail notifications, will skip sending reminder mail", msgContext.user.Id)
+		return nil
+	}
+
+	unsubscribeURL, err := auth.GetUnsubscribeURL(ctx, router, host, scheme, msgContext.user.Id)
+	if err != nil {
+		log.Errorf(ctx, "Unable to create unsubscribe URL for %q: %v; fix auth.GetUnsubscribeURL", msgContext.user.Id, err)
+		return err
+	}
+
+	msgContext.mailData["unsubscribeURL"] = unsubscribeURL.String()
+
+	msg := sendgrid.NewMail()
+	msg.SetText(msgContext.localizer.Sprintf(
+		"The deadline of %s is at %s, and you haven't given any orders or marked yourself ready yet.\n\nVisit %s to see the map, or reply to this email with orders, one per line, like \"A PAR - BUR\". Add a line with READY to mark yourself ready to resolve the phase.\n\nVisit %s to stop receiving email like this.",
+		msgContext.game.Desc,
+		msgContext.phase.DeadlineAt.UTC().Format(time.RFC1123),
+		msgContext.mapURL.String(),
+		unsubscribeURL.String()))
+	msg.SetSubject(subject)
+	msg.AddHeader("List-Unsubscribe", fmt.Sprintf("<%s>", unsubscribeURL.String()))
+
+	msgContext.userConfig.MailConfig.ReminderConfig.Customize(ctx, msg, msgContext.mailData)
+
+	recipEmail, err := mail.ParseAddress(msgContext.user.Email)
+	if err != nil {
+		log.Errorf(ctx, "Unable to parse email address of %v: %v; unable to recover, exiting", PP(msgContext.user), err)
+		return nil
+	}
+	msg.AddRecipient(recipEmail)
+	msg.AddToName(string(msgContext.member.Nation))
+
+	// Replies are handled like replies to phase notifications.
+	fromToken, err := auth.EncodeString(ctx, fmt.Sprintf("%s,%s", msgContext.member.Nation, msgContext.phaseID.Encode()))
+	if err != nil {
+		log.Errorf(ctx, "Unable to create auth token for reply address: %v; fix EncodeString or hope datastore gets fixed", err)
+		return err
+	}
+
+	fromAddress := fmt.Sprintf(fromAddressPattern, fromToken)
+	fromEmail, err := mail.ParseAddress(fromAddress)
+	if err != nil {
+		log.Errorf(ctx, "Unable to parse reply email address %q: %v; fix the address generation", fromAddress, err)
+		return err
+	}
+	msg.SetFromEmail(fromEmail)
+	msg.SetFromName(msgContext.game.Desc)
+
+	if err := MailTransport.Send(ctx, &Notification{UserId: msgContext.user.Id, Type: DeadlineReminderNotification, GameID: msgContext.game.ID, Mail: msg}); err != nil {
+		log.Errorf(ctx, "Unable to send %v: %v; hope the mail transport gets fixed", msg, err)
+		return err
+	}
+	log.Infof(ctx, "Successfully sent %v", PP(msg))
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/zond/go-fcm"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+var (
+	devFakes = &devFakeTransports{}
+)
+
+// DevFakeTransports configures the fake FCM service and mail delivery installed by the dev fake transports route.
+type DevFakeTransports struct {
+	// FCMErrors maps FCM tokens to the errors the fake FCM service reports for them, like "NotRegistered".
+	FCMErrors map[string]string
+}
+
+// DevFakeNotifications are the notifications recorded by the fake FCM service and mail delivery.
+type DevFakeNotifications struct {
+	FCM  []Notification
+	Mail []Notification
+}
+
+// devFakeTransports replace the FCM service and the SendGrid/SMTP mail delivery when installed, so that tests
+// against the dev server can see the notifications, while quiet hours and the notification log work as usual.
+type devFakeTransports struct {
+	lock      sync.RWMutex
+	fcm       *devTransport
+	fcmErrors map[string]string
+	mail      *devTransport
+}
+
+// devTransport records notifications instead of delivering them.
+type devTransport struct {
+	lock sync.Mutex
+	sent []Notification
+}
+
+func (d *devTransport) Send(ctx context.Context, notif *Notification) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.sent = append(d.sent, *notif)
+	return nil
+}
+
+// Sent returns the recorded notifications.
+func (d *devTransport) Sent() []Notification {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]Notification{}, d.sent...)
+}
+
+func (d *devFakeTransports) install(conf *DevFakeTransports) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.fcm = &devTransport{}
+	d.fcmErrors = conf.FCMErrors
+	d.mail = &devTransport{}
+}
+
+func (d *devFakeTransports) uninstall() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.fcm = nil
+	d.fcmErrors = nil
+	d.mail = nil
+}
+
+// FCM returns the fake FCM service, or nil if it isn't installed.
+func (d *devFakeTransports) FCM() *devTransport {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.fcm
+}
+
+// Mail returns the fake mail delivery, or nil if it isn't installed.
+func (d *devFakeTransports) Mail() *devTransport {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.mail
+}
+
+func (d *devFakeTransports) notifications() *DevFakeNotifications {
+	result := &DevFakeNotifications{
+		FCM:  []Notification{},
+		Mail: []Notification{},
+	}
+	if fake := d.FCM(); fake != nil {
+		result.FCM = fake.Sent()
+	}
+	if fake := d.Mail(); fake != nil {
+		result.Mail = fake.Sent()
+	}
+	return result
+}
+
+// fcmSend records the FCM message to each token with the fake FCM service, and responds like the FCM service
+// with the configured errors. It returns nil if the fake FCM service isn't installed.
+func (d *devFakeTransports) fcmSend(ctx context.Context, notif *fcm.NotificationPayload, data *FCMData, tokens []string, userByToken map[string]string, notifType string, gameID *datastore.Key) *fcm.FcmResponseStatus {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.fcm == nil {
+		return nil
+	}
+	resp := &fcm.FcmResponseStatus{
+		Ok:         true,
+		StatusCode: http.StatusOK,
+	}
+	for i, token := range tokens {
+		d.fcm.Send(ctx, &Notification{
+			UserId:  userByToken[token],
+			To:      token,
+			Type:    notifType,
+			GameID:  gameID,
+			Payload: notif,
+			Data:    data,
+		})
+		if errMsg, found := d.fcmErrors[token]; found {
+			resp.Results = append(resp.Results, map[string]string{"error": errMsg})
+			resp.Fail++
+		} else {
+			resp.Results = append(resp.Results, map[string]string{"message_id": fmt.Sprint(i)})
+			resp.Success++
+		}
+	}
+	return resp
+}
+
+// handleDevFakeTransports installs the fakes with PUT and uninstalls them with DELETE, and responds with the
+// notifications they recorded since they were installed.
+func handleDevFakeTransports(w ResponseWriter, r Request) error {
+	if !appengine.IsDevAppServer() {
+		return fmt.Errorf("only accessible in local dev mode")
+	}
+
+	var notifications *DevFakeNotifications
+	switch r.Req().Method {
+	case "PUT":
+		conf := &DevFakeTransports{}
+		if err := json.NewDecoder(r.Req().Body).Decode(conf); err != nil {
+			return HTTPErr{fmt.Sprintf("invalid fake transport configuration: %v", err), http.StatusBadRequest}
+		}
+		devFakes.install(conf)
+		notifications = devFakes.notifications()
+	case "DELETE":
+		notifications = devFakes.notifications()
+		devFakes.uninstall()
+	default:
+		notifications = devFakes.notifications()
+	}
+
+	b, err := json.MarshalIndent(notifications, "", "  ")
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	_, err = w.Write(b)
+	return err
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -193,37 +194,18 @@ func nestPut(m1 map[string]map[string]string, k1, k2, v string) {
 	m1[k1] = m2
 }
 
-func fcmSendToTokens(ctx context.Context, lastDelay time.Duration, notif *fcm.NotificationPayload, data *FCMData, tokens map[string][]string) error {
-	log.Infof(ctx, "fcmSendToTokens(..., %v, %v, %+v)", PP(notif), PP(data), tokens)
-
-	tokenStrings := []string{}
-	userByToken := map[string]string{}
-	for uid, userTokens := range tokens {
-		for _, tokenString := range userTokens {
-			if tokenString != "" {
-				tokenStrings = append(tokenStrings, tokenString)
-				userByToken[tokenString] = uid
-			} else {
-				log.Infof(ctx, "Ignoring empty token for %q", uid)
-			}
-		}
-	}
-
-	if len(tokenStrings) == 0 {
-		log.Infof(ctx, "No tokens left, exiting")
-		return nil
-	}
-
+// fcmSend sends the notification and data to the tokens via the FCM service.
+func fcmSend(ctx context.Context, notif *fcm.NotificationPayload, data *FCMData, tokens []string) (*fcm.FcmResponseStatus, error) {
 	fcmConf, err := getFCMConf(ctx)
 	if err != nil {
 		// Safe to retry, nothing got sent.
 		log.Errorf(ctx, "Unable to get FCMConf: %v; fix getFCMConf or hope datastore gets fixed", err)
-		return err
+		return nil, err
 	}
 
 	client := fcm.NewFcmClient(fcmConf.ServerKey)
 	client.SetHTTPClient(urlfetch.Client(ctx))
-	client.AppendDevices(tokenStrings)
+	client.AppendDevices(tokens)
 	if notif != nil {
 		client.SetNotificationPayload(notif)
 	}
@@ -235,21 +217,115 @@ func fcmSendToTokens(ctx context.Context, lastDelay time.Duration, notif *fcm.No
 	if err != nil {
 		// Safe to retry, nothing got sent probably.
 		log.Errorf(ctx, "%v unable to send: %v", PP(client), err)
-		return err
+		return nil, err
 	}
 
 	log.Infof(ctx, "Sent %v, received %v, %v in response", PP(client), PP(resp), err)
 
+	return resp, nil
+}
+
+func fcmSendToTokens(ctx context.Context, lastDelay time.Duration, notif *fcm.NotificationPayload, data *FCMData, tokens map[string][]string, notifType string, gameID *datastore.Key) error {
+	log.Infof(ctx, "fcmSendToTokens(..., %v, %v, %+v, %q, %v)", PP(notif), PP(data), tokens, notifType, gameID)
+
+	logEntries := []NotificationLogEntry{}
+	logResult := func(uid, token, status, errMsg string) {
+		logEntries = append(logEntries, NotificationLogEntry{
+			UserId:      uid,
+			Transport:   FCMNotificationTransport,
+			Type:        notifType,
+			GameID:      gameID,
+			Destination: token,
+			Status:      status,
+			Error:       errMsg,
+		})
+	}
+	defer func() {
+		logNotifications(ctx, logEntries...)
+	}()
+
+	quietHours := map[string]*auth.QuietHours{}
+	inQuietHours := false
+	for uid := range tokens {
+		userQuietHours, err := loadQuietHours(ctx, uid)
+		if err != nil {
+			return err
+		}
+		quietHours[uid] = userQuietHours
+		if start, _ := userQuietHours.Window(time.Now()); !start.IsZero() {
+			inQuietHours = true
+		}
+	}
+
+	if inQuietHours && len(tokens) > 1 {
+		// If we held some users and then failed sending to the rest, the retry would hold them again, so we
+		// give each user a task of their own instead.
+		log.Infof(ctx, "Some of %v users have quiet hours, splitting into one task per user", len(tokens))
+		for uid, userTokens := range tokens {
+			if err := FCMSendToTokensFunc.EnqueueIn(ctx, 0, time.Duration(0), notif, data, map[string][]string{uid: userTokens}, notifType, gameID); err != nil {
+				log.Errorf(ctx, "Unable to enqueue sending to %q: %v; hope datastore gets fixed", uid, err)
+				return err
+			}
+		}
+		return nil
+	}
+
+	for uid, userTokens := range tokens {
+		if held, err := holdForQuietHours(ctx, uid, quietHours[uid], NotificationLogEntry{
+			Transport:   FCMNotificationTransport,
+			Type:        notifType,
+			GameID:      gameID,
+			Destination: strings.Join(userTokens, ", "),
+		}, &heldNotificationArgs{Tokens: userTokens, Payload: notif, Data: data}); err != nil {
+			return err
+		} else if held {
+			delete(tokens, uid)
+		}
+	}
+
+	tokenStrings := []string{}
+	userByToken := map[string]string{}
+	for uid, userTokens := range tokens {
+		for _, tokenString := range userTokens {
+			if tokenString != "" {
+				tokenStrings = append(tokenStrings, tokenString)
+				userByToken[tokenString] = uid
+			} else {
+				log.Infof(ctx, "Ignoring empty token for %q", uid)
+			}
+		}
+	}
+
+	if len(tokenStrings) == 0 {
+		log.Infof(ctx, "No tokens left, exiting")
+		return nil
+	}
+
+	resp := devFakes.fcmSend(ctx, notif, data, tokenStrings, userByToken, notifType, gameID)
+	if resp == nil {
+		var err error
+		if resp, err = fcmSend(ctx, notif, data, tokenStrings); err != nil {
+			// Safe to retry, nothing got sent probably.
+			return err
+		}
+	}
+
 	if resp.StatusCode == 401 {
 		// Safe to retry, we will just keep delaying incrementally until the auth gets fixed.
-		msg := fmt.Sprintf("%v unable to send due to 401: %v; fix your authentication", PP(client), PP(resp))
+		msg := fmt.Sprintf("%v unable to send due to 401: %v; fix your authentication", tokenStrings, PP(resp))
 		log.Errorf(ctx, msg)
+		for _, token := range tokenStrings {
+			logResult(userByToken[token], token, NotificationRetrying, "FCM server authentication failed")
+		}
 		return fmt.Errorf(msg)
 	}
 
 	if resp.StatusCode == 400 {
 		// Can't retry, our payload is fucked up.
-		log.Errorf(ctx, "%v unable to send due to 400: %v; unable to recover", PP(client), PP(resp))
+		log.Errorf(ctx, "%v unable to send due to 400: %v; unable to recover", tokenStrings, PP(resp))
+		for _, token := range tokenStrings {
+			logResult(userByToken[token], token, NotificationFailed, "FCM rejected the notification")
+		}
 		return nil
 	}
 
@@ -277,6 +353,7 @@ func fcmSendToTokens(ctx context.Context, lastDelay time.Duration, notif *fcm.No
 				case "MismatchSenderId":
 					log.Errorf(ctx, "Token %q got %q, will remove it.", token, errMsg)
 					nestPut(idsToRemove, uid, token, errMsg)
+					logResult(uid, token, NotificationDisabled, errMsg)
 				case "Unavailable":
 					// Can be retried, it's supposed to be.
 					fallthrough
@@ -284,6 +361,7 @@ func fcmSendToTokens(ctx context.Context, lastDelay time.Duration, notif *fcm.No
 					// Can be retried, it's supposed to be.
 					log.Errorf(ctx, "Token %q got %q, will retry.", token, errMsg)
 					idsToRetry[uid] = append(idsToRetry[uid], token)
+					logResult(uid, token, NotificationRetrying, errMsg)
 				case "DeviceMessageRateExceeded":
 					fallthrough
 				case "TopicsMessageRateExceeded":
@@ -294,17 +372,22 @@ func fcmSendToTokens(ctx context.Context, lastDelay time.Duration, notif *fcm.No
 					fallthrough
 				case "InvalidPackageName":
 					log.Errorf(ctx, "Token %q got %q, wtf?", token, errMsg)
+					logResult(uid, token, NotificationFailed, errMsg)
 				case "InvalidParameters":
 					fallthrough
 				case "MessageTooBig":
 					log.Errorf(ctx, "Token %q got %q, SEND SMALLER MESSAGES DAMNIT!", token, errMsg)
+					logResult(uid, token, NotificationFailed, errMsg)
 				case "InvalidDataKey":
 					log.Errorf(ctx, "Token %q got %q, SEND CORRECT MESSAGES DAMNIT!", token, errMsg)
+					logResult(uid, token, NotificationFailed, errMsg)
 				default:
 					log.Errorf(ctx, "Token %q got %q, wtf?", token, errMsg)
+					logResult(uid, token, NotificationFailed, errMsg)
 				}
 				failures++
 			} else {
+				logResult(uid, token, NotificationSent, "")
 				successes++
 			}
 		}
@@ -319,6 +402,10 @@ func fcmSendToTokens(ctx context.Context, lastDelay time.Duration, notif *fcm.No
 				log.Errorf(ctx, "Unable to schedule repair of FCM tokens (to remove: %v, to update: %v): %v; hope that datastore gets fixed", PP(idsToRemove), PP(idsToUpdate), err)
 			}
 		}
+	} else {
+		for _, token := range tokenStrings {
+			logResult(userByToken[token], token, NotificationRetrying, fmt.Sprintf("FCM responded %v", resp.StatusCode))
+		}
 	}
 
 	if len(idsToRetry) > 0 {
@@ -335,13 +422,13 @@ func fcmSendToTokens(ctx context.Context, lastDelay time.Duration, notif *fcm.No
 			delay = at.Sub(time.Now())
 		}
 		// Finally, try to schedule again. If we can't then fuckall we'll try again with the entire payload.
-		if err := FCMSendToTokensFunc.EnqueueIn(ctx, delay, delay, notif, data, tokens); err != nil {
+		if err := FCMSendToTokensFunc.EnqueueIn(ctx, delay, delay, notif, data, tokens, notifType, gameID); err != nil {
 			log.Errorf(ctx, "Unable to schedule retry of %v, %v to %+v in %v: %v", PP(notif), PP(data), tokens, delay, err)
 			return err
 		}
 	}
 
-	log.Infof(ctx, "fcmSendToTokens(..., %v, %v, %+v) *** SUCCESS ***", PP(notif), PP(data), tokens)
+	log.Infof(ctx, "fcmSendToTokens(..., %v, %v, %+v, %q, %v) *** SUCCESS ***", PP(notif), PP(data), tokens, notifType, gameID)
 
 	return nil
 }
@@ -40,6 +40,13 @@ const (
 	PreferenceAllocation
 )
 
+const (
+	// Finished games revealed all press to everyone before games could choose, so that is the zero value.
+	RevealPressToPublic PressReveal = iota
+	RevealPressToMembers
+	HidePress
+)
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 
@@ -142,6 +149,9 @@ func init() {
 
 type AllocationMethod int
 
+// PressReveal decides who can read all channels and messages of a game once it has finished.
+type PressReveal int
+
 type SendGrid struct {
 	APIKey string
 }
@@ -410,7 +420,9 @@ type Game struct {
 	DisableConferenceChat bool             `methods:"POST"`
 	DisableGroupChat      bool             `methods:"POST"`
 	DisablePrivateChat    bool             `methods:"POST"`
+	EnableReadReceipts    bool             `methods:"POST"`
 	NationAllocation      AllocationMethod `methods:"POST"`
+	RevealPress           PressReveal      `methods:"POST"`
 
 	NMembers int
 	Members  Members
@@ -479,9 +491,15 @@ func (g *Game) canMergeInto(o *Game, avoid *auth.User) bool {
 	if g.DisablePrivateChat != o.DisablePrivateChat {
 		return false
 	}
+	if g.EnableReadReceipts != o.EnableReadReceipts {
+		return false
+	}
 	if g.NationAllocation != o.NationAllocation {
 		return false
 	}
+	if g.RevealPress != o.RevealPress {
+		return false
+	}
 	if g.NMembers+o.NMembers > len(variants.Variants[g.Variant].Nations) {
 		return false
 	}
@@ -493,6 +511,20 @@ func (g *Game) canMergeInto(o *Game, avoid *auth.User) bool {
 	return true
 }
 
+// pressRevealedTo returns whether viewer, or non members if viewer is empty, can read all channels of the game.
+func (g *Game) pressRevealedTo(viewer godip.Nation) bool {
+	if !g.Finished {
+		return false
+	}
+	switch g.RevealPress {
+	case RevealPressToPublic:
+		return true
+	case RevealPressToMembers:
+		return viewer != ""
+	}
+	return false
+}
+
 func (g *Game) Refresh() {
 	if !g.CreatedAt.IsZero() {
 		g.CreatedAgo = g.CreatedAt.Sub(time.Now())
@@ -583,6 +615,30 @@ func (g *Game) Item(r Request) *Item {
 				gameItem.AddLink(r.NewLink(MemberResource.Link("leave", Delete, []string{"game_id", g.ID.Encode(), "user_id", user.Id})))
 			}
 			gameItem.AddLink(r.NewLink(MemberResource.Link("update-membership", Update, []string{"game_id", g.ID.Encode(), "user_id", user.Id})))
+			if g.Started && !g.Finished {
+				gameItem.AddLink(r.NewLink(Link{
+					Rel:         "pending-messages",
+					Route:       ListPendingMessagesRoute,
+					RouteParams: []string{"game_id", g.ID.Encode()},
+				}))
+			}
+			if g.Finished {
+				gameItem.AddLink(r.NewLink(Link{
+					Rel:         "chat-export-json",
+					Route:       ExportChatJSONRoute,
+					RouteParams: []string{"game_id", g.ID.Encode()},
+				}))
+				gameItem.AddLink(r.NewLink(Link{
+					Rel:         "chat-export-text",
+					Route:       ExportChatTextRoute,
+					RouteParams: []string{"game_id", g.ID.Encode()},
+				}))
+				gameItem.AddLink(r.NewLink(Link{
+					Rel:         "chat-export-html",
+					Route:       ExportChatHTMLRoute,
+					RouteParams: []string{"game_id", g.ID.Encode()},
+				}))
+			}
 		} else {
 			if g.Joinable() {
 				gameItem.AddLink(r.NewLink(MemberResource.Link("join", Create, []string{"game_id", g.ID.Encode()})))
@@ -594,6 +650,16 @@ func (g *Game) Item(r Request) *Item {
 				Route:       ListChannelsRoute,
 				RouteParams: []string{"game_id", g.ID.Encode()},
 			}))
+			gameItem.AddLink(r.NewLink(Link{
+				Rel:         "search-messages",
+				Route:       SearchMessagesRoute,
+				RouteParams: []string{"game_id", g.ID.Encode()},
+			}))
+			gameItem.AddLink(r.NewLink(Link{
+				Rel:         "events",
+				Route:       StreamGameEventsRoute,
+				RouteParams: []string{"game_id", g.ID.Encode()},
+			}))
 		}
 		if g.Started {
 			gameItem.AddLink(r.NewLink(Link{
@@ -714,6 +780,9 @@ func createGame(w ResponseWriter, r Request) (*Game, error) {
 	if game.PhaseLengthMinutes > MAX_PHASE_DEADLINE {
 		return nil, HTTPErr{"no games with more than 30 day deadlines allowed", http.StatusBadRequest}
 	}
+	if game.RevealPress < RevealPressToPublic || game.RevealPress > HidePress {
+		return nil, HTTPErr{fmt.Sprintf("unknown press reveal %v, pick %v, %v or %v", game.RevealPress, RevealPressToPublic, RevealPressToMembers, HidePress), http.StatusBadRequest}
+	}
 	game.CreatedAt = time.Now()
 
 	if !game.NoMerge && !game.Private {
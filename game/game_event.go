@@ -0,0 +1,307 @@
+package game
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	gameEventKind = "GameEvent"
+
+	messageEventType       = "message"
+	messageUpdateEventType = "message-update"
+	phaseStateEventType    = "phase-state"
+	phaseEventType         = "phase"
+
+	// App Engine buffers responses, so instead of keeping the stream open forever we wait for events until
+	// gameEventStreamTimeout and then let the client reconnect.
+	gameEventStreamTimeout = 50 * time.Second
+	gameEventPollInterval  = time.Second
+	gameEventRetry         = time.Second
+	gameEventRetention     = 24 * time.Hour
+	// Events are stamped before the transactions publishing them commit, so streams look this far back for events
+	// committed late, and skip the ones they already sent.
+	gameEventCommitSlack = 30 * time.Second
+)
+
+var (
+	pruneGameEventsFunc *DelayFunc
+)
+
+func init() {
+	pruneGameEventsFunc = NewDelayFunc("game-pruneGameEvents", pruneGameEvents)
+}
+
+// GameEvent is a change in a game pushed to the game event stream.
+type GameEvent struct {
+	GameID *datastore.Key
+	Type   string
+	// Recipients are the nations allowed to see the event, or empty if it's visible to anyone allowed to see the game.
+	Recipients Nations
+	// Nation is the nation causing the event, used to filter out events from muted nations.
+	Nation    godip.Nation
+	Payload   []byte `datastore:",noindex"`
+	CreatedAt time.Time
+}
+
+func (g *GameEvent) visibleTo(nation godip.Nation, mutedNats map[godip.Nation]struct{}) bool {
+	if _, isMuted := mutedNats[g.Nation]; isMuted && g.Nation != "" {
+		return false
+	}
+	return len(g.Recipients) == 0 || g.Recipients.Includes(nation)
+}
+
+// gameEventCursor is where a game event stream stopped, and the event IDs of the events it sent within the
+// commit slack before that.
+type gameEventCursor struct {
+	Since time.Time
+	Sent  map[int64]time.Time
+}
+
+// parseGameEventCursor parses stream event IDs, which are the creation time in nanoseconds of the last sent event,
+// followed by ",<datastore ID>@<creation time in nanoseconds>" for each recently sent event.
+func parseGameEventCursor(s string) (*gameEventCursor, error) {
+	parts := strings.Split(s, ",")
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &gameEventCursor{
+		Since: time.Unix(0, nanos),
+		Sent:  map[int64]time.Time{},
+	}
+	for _, part := range parts[1:] {
+		idAndNanos := strings.Split(part, "@")
+		if len(idAndNanos) != 2 {
+			return nil, fmt.Errorf("unparseable sent event %q", part)
+		}
+		id, err := strconv.ParseInt(idAndNanos[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sentNanos, err := strconv.ParseInt(idAndNanos[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		cursor.Sent[id] = time.Unix(0, sentNanos)
+	}
+	return cursor, nil
+}
+
+func (c *gameEventCursor) String() string {
+	ids := make([]int64, 0, len(c.Sent))
+	for id := range c.Sent {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%d", c.Since.UnixNano())
+	for _, id := range ids {
+		fmt.Fprintf(buf, ",%d@%d", id, c.Sent[id].UnixNano())
+	}
+	return buf.String()
+}
+
+// add marks an event as sent, and forgets the sent events too old to be committed late.
+func (c *gameEventCursor) add(id int64, createdAt time.Time) {
+	if createdAt.After(c.Since) {
+		c.Since = createdAt
+	}
+	c.Sent[id] = createdAt
+	oldest := c.Since.Add(-gameEventCommitSlack)
+	for sentID, sentAt := range c.Sent {
+		if !sentAt.After(oldest) {
+			delete(c.Sent, sentID)
+		}
+	}
+}
+
+func gameEventsMemcacheKey(gameID *datastore.Key) string {
+	return fmt.Sprintf("game-events/%s", gameID.Encode())
+}
+
+// publishGameEvent stores an event for the game event stream. It's intended to be run inside the transaction
+// making the change, so that the event is only stored if the change is.
+func publishGameEvent(ctx context.Context, gameID *datastore.Key, typ string, recipients Nations, nation godip.Nation, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	event := &GameEvent{
+		GameID:     gameID,
+		Type:       typ,
+		Recipients: recipients,
+		Nation:     nation,
+		Payload:    b,
+		CreatedAt:  time.Now(),
+	}
+	if _, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, gameEventKind, gameID), event); err != nil {
+		return err
+	}
+	// The counter only wakes up waiting streams, so failing to increment it just delays delivery.
+	if _, err := memcache.Increment(ctx, gameEventsMemcacheKey(gameID), 1, 0); err != nil {
+		log.Warningf(ctx, "Unable to increment game event counter for %v: %v", gameID, err)
+	}
+	return nil
+}
+
+func pruneGameEvents(ctx context.Context, gameID *datastore.Key) error {
+	log.Infof(ctx, "pruneGameEvents(..., %v)", gameID)
+
+	ids, err := datastore.NewQuery(gameEventKind).Ancestor(gameID).Filter("CreatedAt<", time.Now().Add(-gameEventRetention)).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load old game events for %v: %v; hope datastore gets fixed", gameID, err)
+		return err
+	}
+
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > maxLimit {
+			batch = batch[:maxLimit]
+		}
+		if err := datastore.DeleteMulti(ctx, batch); err != nil {
+			log.Errorf(ctx, "Unable to delete %v old game events: %v; hope datastore gets fixed", len(batch), err)
+			return err
+		}
+		ids = ids[len(batch):]
+	}
+
+	log.Infof(ctx, "pruneGameEvents(..., %v) *** SUCCESS ***", gameID)
+
+	return nil
+}
+
+func streamGameEvents(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return err
+	}
+	game.ID = gameID
+
+	var nation godip.Nation
+	mutedNats := map[godip.Nation]struct{}{}
+	if member, found := game.GetMemberByUserId(user.Id); found {
+		nation = member.Nation
+		gameStateID, err := GameStateID(ctx, gameID, nation)
+		if err != nil {
+			return err
+		}
+		gameState := &GameState{}
+		if err = datastore.Get(ctx, gameStateID, gameState); err == nil {
+			for _, nat := range gameState.Muted {
+				mutedNats[nat] = struct{}{}
+			}
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+
+	// Event IDs are cursors, so the stream can resume where it left off.
+	cursor := &gameEventCursor{
+		Since: time.Now(),
+		Sent:  map[int64]time.Time{},
+	}
+	lastEventID := r.Req().Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.Req().URL.Query().Get("last_event_id")
+	}
+	// New streams only get events created after they connect.
+	connectedAt := cursor.Since
+	if lastEventID != "" {
+		if cursor, err = parseGameEventCursor(lastEventID); err != nil {
+			return HTTPErr{"unparseable event ID", http.StatusBadRequest}
+		}
+		connectedAt = time.Time{}
+	}
+	if oldest := time.Now().Add(-gameEventRetention); cursor.Since.Before(oldest) {
+		cursor.Since = oldest
+	}
+
+	type sentEvent struct {
+		id    string
+		event GameEvent
+	}
+	events := []sentEvent{}
+	deadline := time.Now().Add(gameEventStreamTimeout)
+	lastCounter := ""
+	recheck := true
+	for len(events) == 0 && time.Now().Before(deadline) {
+		counter := ""
+		if item, err := memcache.Get(ctx, gameEventsMemcacheKey(gameID)); err == nil {
+			counter = string(item.Value)
+		} else if err != memcache.ErrCacheMiss {
+			log.Warningf(ctx, "Unable to load game event counter for %v: %v", gameID, err)
+		}
+		if recheck || counter != lastCounter {
+			// Check once more after a change, in case the publishing transaction wasn't committed yet.
+			recheck = counter != lastCounter
+			lastCounter = counter
+
+			found := []GameEvent{}
+			ids, err := datastore.NewQuery(gameEventKind).Ancestor(gameID).Filter("CreatedAt>", cursor.Since.Add(-gameEventCommitSlack)).Order("CreatedAt").GetAll(ctx, &found)
+			if err != nil {
+				return err
+			}
+			for i, event := range found {
+				if _, wasSent := cursor.Sent[ids[i].IntID()]; wasSent {
+					continue
+				}
+				cursor.add(ids[i].IntID(), event.CreatedAt)
+				if event.CreatedAt.After(connectedAt) && event.visibleTo(nation, mutedNats) {
+					events = append(events, sentEvent{
+						id:    cursor.String(),
+						event: event,
+					})
+				}
+			}
+		}
+		if len(events) == 0 {
+			time.Sleep(gameEventPollInterval)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "retry: %d\n\n", gameEventRetry/time.Millisecond)
+	for _, sent := range events {
+		fmt.Fprintf(buf, "id: %s\nevent: %s\ndata: %s\n\n", sent.id, sent.event.Type, sent.event.Payload)
+	}
+	if len(events) == 0 {
+		// Make sure the client resumes from where we stopped looking, even if it didn't see any events.
+		fmt.Fprintf(buf, "id: %s\n\n", cursor.String())
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 
 	"github.com/zond/diplicity/auth"
 	"github.com/zond/godip"
@@ -19,6 +20,13 @@ const (
 	gameStateKind = "GameState"
 )
 
+const (
+	AllNotifications         = ""
+	PhaseNotificationsOnly   = "PhaseOnly"
+	MentionNotificationsOnly = "MentionsOnly"
+	NoNotifications          = "None"
+)
+
 var GameStateResource *Resource
 
 func init() {
@@ -57,14 +65,108 @@ func (g GameStates) Item(r Request, gameID *datastore.Key) *Item {
 			"Adding another member nation to the 'Muted' list will hide all press from that member.",
 			"Note that messages from muted members will still count towards the totals in the channel listings.",
 		},
+		[]string{
+			"Notifications",
+			fmt.Sprintf("`Notifications` decides which FCM and email notifications the member gets for the game: all (`%s`), only new phases (`%s`), new phases and messages mentioning the member nation (`%s`), or nothing (`%s`).", AllNotifications, PhaseNotificationsOnly, MentionNotificationsOnly, NoNotifications),
+			"`ChannelNotifications` overrides `Notifications` for messages in single channels, identified by their comma separated members like `Austria,England`.",
+			fmt.Sprintf("Messages mentioning the member nation cause notifications regardless of the channel, unless `Notifications` is `%s`.", NoNotifications),
+		},
 	})
 	return gameStatesItem
 }
 
+type ChannelNotifications struct {
+	// Channel is the comma separated list of channel members.
+	Channel       string `methods:"PUT"`
+	Notifications string `methods:"PUT"`
+}
+
 type GameState struct {
-	GameID *datastore.Key
-	Nation godip.Nation
-	Muted  []godip.Nation `methods:"PUT"`
+	GameID               *datastore.Key
+	Nation               godip.Nation
+	Muted                []godip.Nation         `methods:"PUT"`
+	Notifications        string                 `methods:"PUT"`
+	ChannelNotifications []ChannelNotifications `methods:"PUT"`
+}
+
+func validNotifications(notifications string) bool {
+	switch notifications {
+	case AllNotifications, PhaseNotificationsOnly, MentionNotificationsOnly, NoNotifications:
+		return true
+	}
+	return false
+}
+
+// validateNotifications verifies the notification preferences, and sorts the channel members.
+func (g *GameState) validateNotifications(variant string) error {
+	if !validNotifications(g.Notifications) {
+		return HTTPErr{fmt.Sprintf("unknown notifications %q", g.Notifications), http.StatusBadRequest}
+	}
+	nations := Nations(variants.Variants[variant].Nations)
+	for i := range g.ChannelNotifications {
+		channelNotifications := &g.ChannelNotifications[i]
+		if !validNotifications(channelNotifications.Notifications) {
+			return HTTPErr{fmt.Sprintf("unknown notifications %q", channelNotifications.Notifications), http.StatusBadRequest}
+		}
+		members := Nations{}
+		members.FromString(channelNotifications.Channel)
+		if len(members) < 2 || !members.Includes(g.Nation) {
+			return HTTPErr{fmt.Sprintf("%q is not a member channel", channelNotifications.Channel), http.StatusBadRequest}
+		}
+		for _, member := range members {
+			if !nations.Includes(member) {
+				return HTTPErr{fmt.Sprintf("unknown channel member %q", member), http.StatusBadRequest}
+			}
+		}
+		sort.Sort(members)
+		channelNotifications.Channel = members.String()
+	}
+	return nil
+}
+
+// notificationsFor returns the notification preference for messages in the channel.
+func (g *GameState) notificationsFor(channelMembers Nations) string {
+	sorted := append(Nations{}, channelMembers...)
+	sort.Sort(sorted)
+	for _, channelNotifications := range g.ChannelNotifications {
+		if channelNotifications.Channel == sorted.String() {
+			return channelNotifications.Notifications
+		}
+	}
+	return g.Notifications
+}
+
+func (g *GameState) WantsPhaseNotifications() bool {
+	return g.Notifications != NoNotifications
+}
+
+// WantsMessageNotification returns whether the member wants to be notified about the message.
+// Mentions override everything except turning off all notifications for the game.
+func (g *GameState) WantsMessageNotification(message *Message) bool {
+	if message.MentionsNation(g.Nation) && g.Notifications != NoNotifications {
+		return true
+	}
+	switch g.notificationsFor(message.ChannelMembers) {
+	case NoNotifications, PhaseNotificationsOnly, MentionNotificationsOnly:
+		return false
+	}
+	return true
+}
+
+// loadGameStateOrDefault loads the game state of nation, or returns an empty game state if the nation hasn't stored one.
+func loadGameStateOrDefault(ctx context.Context, gameID *datastore.Key, nation godip.Nation) (*GameState, error) {
+	gameStateID, err := GameStateID(ctx, gameID, nation)
+	if err != nil {
+		return nil, err
+	}
+	gameState := &GameState{}
+	if err := datastore.Get(ctx, gameStateID, gameState); err == datastore.ErrNoSuchEntity {
+		gameState.GameID = gameID
+		gameState.Nation = nation
+	} else if err != nil {
+		return nil, err
+	}
+	return gameState, nil
 }
 
 func (g *GameState) HasMuted(nat godip.Nation) bool {
@@ -149,6 +251,10 @@ func updateGameState(w ResponseWriter, r Request) (*GameState, error) {
 		gameState.GameID = gameID
 		gameState.Nation = member.Nation
 
+		if err := gameState.validateNotifications(game.Variant); err != nil {
+			return err
+		}
+
 		return gameState.Save(ctx)
 	}, &datastore.TransactionOptions{XG: false}); err != nil {
 		return nil, err
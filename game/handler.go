@@ -71,6 +71,10 @@ const (
 	ListOptionsRoute                = "ListOptions"
 	ListChannelsRoute               = "ListChannels"
 	ListMessagesRoute               = "ListMessages"
+	MarkAllReadRoute                = "MarkAllRead"
+	ExportChatJSONRoute             = "ExportChatJSON"
+	ExportChatTextRoute             = "ExportChatText"
+	ExportChatHTMLRoute             = "ExportChatHTML"
 	ListBansRoute                   = "ListBans"
 	ListTopRatedPlayersRoute        = "ListTopRatedPlayers"
 	ListTopReliablePlayersRoute     = "ListTopReliablePlayers"
@@ -80,6 +84,7 @@ const (
 	ListFlaggedMessagesRoute        = "ListFlaggedMessages"
 	DevResolvePhaseTimeoutRoute     = "DevResolvePhaseTimeout"
 	DevUserStatsUpdateRoute         = "DevUserStatsUpdate"
+	DevFakeTransportsRoute          = "DevFakeTransports"
 	ReceiveMailRoute                = "ReceiveMail"
 	RenderPhaseMapRoute             = "RenderPhaseMap"
 	ReRateRoute                     = "ReRate"
@@ -88,6 +93,23 @@ const (
 	ResaveRoute                     = "Resave"
 	AllocateNationsRoute            = "AllocateNations"
 	ReapInactiveWaitingPlayersRoute = "ReapInactiveWaitingPlayersRoute"
+	SendMailDigestsRoute            = "SendMailDigests"
+	OrderNotationRoute              = "OrderNotation"
+	RenderPhaseReportTextRoute      = "RenderPhaseReportText"
+	ListRollbacksRoute              = "ListRollbacks"
+	ListWebhooksRoute               = "ListWebhooks"
+	ListChatBridgesRoute            = "ListChatBridges"
+	ReceiveChatBridgeMessageRoute   = "ReceiveChatBridgeMessage"
+	RenderMessageAttachmentMapRoute = "RenderMessageAttachmentMap"
+	ListPendingMessagesRoute        = "ListPendingMessages"
+	CopyAttachmentOrdersRoute       = "CopyAttachmentOrders"
+	SearchMessagesRoute             = "SearchMessages"
+	StreamGameEventsRoute           = "StreamGameEvents"
+	VAPIDPublicKeyRoute             = "VAPIDPublicKey"
+	ListNotificationLogRoute        = "ListNotificationLog"
+	PruneNotificationLogsRoute      = "PruneNotificationLogs"
+	DeadlinesICalendarRoute         = "DeadlinesICalendar"
+	ResetDeadlinesCalendarRoute     = "ResetDeadlinesCalendar"
 )
 
 type userStatsHandler struct {
@@ -540,10 +562,12 @@ func createAllocation(w ResponseWriter, r Request) (*Allocation, error) {
 }
 
 type configuration struct {
-	OAuth      *auth.OAuth
-	FCMConf    *FCMConf
-	SendGrid   *SendGrid
-	Superusers *auth.Superusers
+	OAuth       *auth.OAuth
+	FCMConf     *FCMConf
+	WebPushConf *WebPushConf
+	SendGrid    *SendGrid
+	SMTP        *SMTPConf
+	Superusers  *auth.Superusers
 }
 
 func handleConfigure(w ResponseWriter, r Request) error {
@@ -563,11 +587,21 @@ func handleConfigure(w ResponseWriter, r Request) error {
 			return err
 		}
 	}
+	if conf.WebPushConf != nil {
+		if err := SetWebPushConf(ctx, conf.WebPushConf); err != nil {
+			return err
+		}
+	}
 	if conf.SendGrid != nil {
 		if err := SetSendGrid(ctx, conf.SendGrid); err != nil {
 			return err
 		}
 	}
+	if conf.SMTP != nil {
+		if err := SetSMTPConf(ctx, conf.SMTP); err != nil {
+			return err
+		}
+	}
 	if conf.Superusers != nil {
 		if err := auth.SetSuperusers(ctx, conf.Superusers); err != nil {
 			return err
@@ -757,17 +791,36 @@ func ejectMember(ctx context.Context, gameID *datastore.Key, userId string) erro
 
 func SetupRouter(r *mux.Router) {
 	router = r
+	AddPostProc(renderOrderValidationError)
 	Handle(r, "/_reap-inactive-waiting-players", []string{"GET"}, ReapInactiveWaitingPlayersRoute, handleReapInactiveWaitingPlayers)
+	Handle(r, "/_send-mail-digests", []string{"GET"}, SendMailDigestsRoute, handleSendMailDigests)
+	Handle(r, "/_prune-notification-logs", []string{"GET"}, PruneNotificationLogsRoute, handlePruneNotificationLogs)
 	Handle(r, "/_re-save", []string{"GET"}, ResaveRoute, handleResave)
 	Handle(r, "/_configure", []string{"POST"}, ConfigureRoute, handleConfigure)
 	Handle(r, "/_re-rate", []string{"GET"}, ReRateRoute, handleReRate)
 	Handle(r, "/_ah/mail/{recipient}", []string{"POST"}, ReceiveMailRoute, receiveMail)
+	Handle(r, "/ChatBridge/{token}", []string{"POST"}, ReceiveChatBridgeMessageRoute, receiveChatBridgeMessage)
 	Handle(r, "/", []string{"GET"}, IndexRoute, handleIndex)
 	Handle(r, "/Game/{game_id}/Channels", []string{"GET"}, ListChannelsRoute, listChannels)
+	Handle(r, "/Game/{game_id}/MarkAllRead", []string{"POST"}, MarkAllReadRoute, markAllMessagesRead)
+	Handle(r, "/Game/{game_id}/Chat.json", []string{"GET"}, ExportChatJSONRoute, exportChatJSON)
+	Handle(r, "/Game/{game_id}/Chat.txt", []string{"GET"}, ExportChatTextRoute, exportChatText)
+	Handle(r, "/Game/{game_id}/Chat.html", []string{"GET"}, ExportChatHTMLRoute, exportChatHTML)
+	Handle(r, "/Game/{game_id}/Messages/Search", []string{"GET"}, SearchMessagesRoute, searchMessages)
+	Handle(r, "/Game/{game_id}/Events", []string{"GET"}, StreamGameEventsRoute, streamGameEvents)
+	Handle(r, "/WebPush/VAPIDPublicKey", []string{"GET"}, VAPIDPublicKeyRoute, handleVAPIDPublicKey)
+	Handle(r, "/User/{user_id}/NotificationLog", []string{"GET"}, ListNotificationLogRoute, listNotificationLog)
+	Handle(r, "/User/{user_id}/Deadlines.ics", []string{"GET"}, DeadlinesICalendarRoute, deadlinesICalendar)
+	Handle(r, "/User/{user_id}/DeadlinesCalendar/Reset", []string{"POST"}, ResetDeadlinesCalendarRoute, resetDeadlinesCalendar)
 	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/_dev_resolve_timeout", []string{"GET"}, DevResolvePhaseTimeoutRoute, devResolvePhaseTimeout)
 	Handle(r, "/User/{user_id}/Stats/_dev_update", []string{"PUT"}, DevUserStatsUpdateRoute, devUserStatsUpdate)
+	Handle(r, "/_dev_fake_transports", []string{"GET", "PUT", "DELETE"}, DevFakeTransportsRoute, handleDevFakeTransports)
 	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/Options", []string{"GET"}, ListOptionsRoute, listOptions)
 	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/Map", []string{"GET"}, RenderPhaseMapRoute, renderPhaseMap)
+	Handle(r, "/Game/{game_id}/Channel/{channel_members}/Messages/{message_id}/Attachment/Map", []string{"GET"}, RenderMessageAttachmentMapRoute, renderMessageAttachmentMap)
+	Handle(r, "/Game/{game_id}/Channel/{channel_members}/Messages/{message_id}/Attachment/Orders", []string{"POST"}, CopyAttachmentOrdersRoute, copyMessageAttachmentOrders)
+	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/OrderNotation", []string{"GET"}, OrderNotationRoute, handleOrderNotation)
+	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/Report.txt", []string{"GET"}, RenderPhaseReportTextRoute, renderPhaseReportText)
 	Handle(r, "/GlobalStats", []string{"GET"}, GlobalStatsRoute, handleGlobalStats)
 	Handle(r, "/Rss", []string{"GET"}, RssRoute, handleRss)
 	HandleResource(r, GameResource)
@@ -776,11 +829,17 @@ func SetupRouter(r *mux.Router) {
 	HandleResource(r, PhaseResource)
 	HandleResource(r, OrderResource)
 	HandleResource(r, MessageResource)
+	HandleResource(r, MessageReactionResource)
 	HandleResource(r, PhaseStateResource)
 	HandleResource(r, GameStateResource)
 	HandleResource(r, GameResultResource)
 	HandleResource(r, BanResource)
 	HandleResource(r, PhaseResultResource)
+	HandleResource(r, PhaseReportResource)
+	HandleResource(r, RollbackResource)
+	HandleResource(r, WebhookResource)
+	HandleResource(r, ChatBridgeResource)
+	HandleResource(r, PendingMessageResource)
 	HandleResource(r, UserStatsResource)
 	HandleResource(r, MessageFlagResource)
 	HandleResource(r, FlaggedMessagesResource)
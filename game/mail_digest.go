@@ -0,0 +1,293 @@
+package game
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"sort"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"gopkg.in/sendgrid/sendgrid-go.v2"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	mailDigestEntryKind = "MailDigestEntry"
+
+	// Daily digests are sent by the first hourly run after the oldest entry is this old, to allow for cron jitter.
+	dailyMailDigestAge = 23 * time.Hour
+)
+
+var (
+	sendMailDigestFunc *DelayFunc
+)
+
+func init() {
+	sendMailDigestFunc = NewDelayFunc("game-sendMailDigest", sendMailDigest)
+}
+
+// MailDigestEntry is a message or phase notification waiting to be included in the next mail digest of a user.
+// Entries are children of the user, and phase entries have no MessageID.
+type MailDigestEntry struct {
+	UserId         string
+	GameID         *datastore.Key
+	ChannelMembers Nations
+	MessageID      *datastore.Key
+	PhaseOrdinal   int64
+	Host           string
+	Scheme         string
+	CreatedAt      time.Time
+}
+
+// queueMailDigestEntry stores entry, with a key derived from the message or phase to make retried notifications idempotent.
+func queueMailDigestEntry(ctx context.Context, entry *MailDigestEntry) error {
+	name := ""
+	if entry.MessageID != nil {
+		name = entry.MessageID.Encode()
+	} else {
+		phaseID, err := PhaseID(ctx, entry.GameID, entry.PhaseOrdinal)
+		if err != nil {
+			return err
+		}
+		name = phaseID.Encode()
+	}
+	entry.CreatedAt = time.Now()
+	_, err := datastore.Put(ctx, datastore.NewKey(ctx, mailDigestEntryKind, name, 0, auth.UserID(ctx, entry.UserId)), entry)
+	return err
+}
+
+func handleSendMailDigests(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	ids, err := datastore.NewQuery(mailDigestEntryKind).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	userIds := map[string]bool{}
+	for _, id := range ids {
+		userIds[id.Parent().StringID()] = true
+	}
+	log.Infof(ctx, "Found %v mail digest entries for %v users", len(ids), len(userIds))
+
+	for userId := range userIds {
+		if err := sendMailDigestFunc.EnqueueIn(ctx, 0, userId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func replyAddress(ctx context.Context, nation string, replyToID *datastore.Key) (string, error) {
+	fromToken, err := auth.EncodeString(ctx, fmt.Sprintf("%s,%s", nation, replyToID.Encode()))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(fromAddressPattern, fromToken), nil
+}
+
+// loadNewPhase loads the phase a phase notification for phaseOrdinal is about. Phase notifications are sent with
+// the phase that just resolved, or with the first phase when the game starts.
+func loadNewPhase(ctx context.Context, gameID *datastore.Key, phaseOrdinal int64) (*Phase, error) {
+	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
+	if err != nil {
+		return nil, err
+	}
+	phase := &Phase{}
+	if err := datastore.Get(ctx, phaseID, phase); err != nil {
+		return nil, err
+	}
+	if !phase.Resolved {
+		return phase, nil
+	}
+	if phaseID, err = PhaseID(ctx, gameID, phaseOrdinal+1); err != nil {
+		return nil, err
+	}
+	phase = &Phase{}
+	if err := datastore.Get(ctx, phaseID, phase); err != nil {
+		return nil, err
+	}
+	return phase, nil
+}
+
+func sendMailDigest(ctx context.Context, userId string) error {
+	log.Infof(ctx, "sendMailDigest(..., %q)", userId)
+
+	userID := auth.UserID(ctx, userId)
+
+	entries := []MailDigestEntry{}
+	entryIDs, err := datastore.NewQuery(mailDigestEntryKind).Ancestor(userID).GetAll(ctx, &entries)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load mail digest entries for %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+	if len(entries) == 0 {
+		log.Infof(ctx, "%q has no mail digest entries, exiting", userId)
+		return nil
+	}
+
+	user := &auth.User{}
+	userConfig := &auth.UserConfig{}
+	if err := datastore.GetMulti(ctx, []*datastore.Key{userID, auth.UserConfigID(ctx, userID)}, []interface{}{user, userConfig}); err != nil {
+		log.Errorf(ctx, "Unable to load user and user config for %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+
+	if !userConfig.MailConfig.Enabled {
+		log.Infof(ctx, "%q has disabled mail notifications, dropping %v mail digest entries", userId, len(entries))
+		return datastore.DeleteMulti(ctx, entryIDs)
+	}
+
+	localizer := auth.NewUserLocalizer(user, userConfig)
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+	if userConfig.MailConfig.Digest == auth.DailyMailDigest && time.Now().Sub(entries[0].CreatedAt) < dailyMailDigestAge {
+		log.Infof(ctx, "Oldest mail digest entry for %q is from %v, waiting for a day to pass", userId, entries[0].CreatedAt)
+		return nil
+	}
+
+	// Group the entries per game, keeping the games in the order of their first entry.
+	gameIDs := []*datastore.Key{}
+	entriesByGame := map[string][]MailDigestEntry{}
+	for _, entry := range entries {
+		encoded := entry.GameID.Encode()
+		if _, found := entriesByGame[encoded]; !found {
+			gameIDs = append(gameIDs, entry.GameID)
+		}
+		entriesByGame[encoded] = append(entriesByGame[encoded], entry)
+	}
+	games := make(Games, len(gameIDs))
+	if err := datastore.GetMulti(ctx, gameIDs, games); err != nil {
+		log.Errorf(ctx, "Unable to load games %+v: %v; hope datastore gets fixed", gameIDs, err)
+		return err
+	}
+
+	host, scheme := entries[len(entries)-1].Host, entries[len(entries)-1].Scheme
+
+	buf := &bytes.Buffer{}
+	nMessages, nPhases := 0, 0
+	for gameIdx, gameID := range gameIDs {
+		game := &games[gameIdx]
+		game.ID = gameID
+		member, isMember := game.GetMemberByUserId(userId)
+		if !isMember {
+			log.Infof(ctx, "%q is no longer a member of %v, skipping its digest entries", userId, gameID)
+			continue
+		}
+		fmt.Fprintf(buf, "=== %s ===\n\n", game.DescFor(member.Nation))
+
+		channelEntries := map[string][]MailDigestEntry{}
+		channelNames := []string{}
+		for _, entry := range entriesByGame[gameID.Encode()] {
+			if entry.MessageID == nil {
+				phase, err := loadNewPhase(ctx, gameID, entry.PhaseOrdinal)
+				if err == datastore.ErrNoSuchEntity {
+					continue
+				} else if err != nil {
+					log.Errorf(ctx, "Unable to load the new phase of phase %v in %v: %v; hope datastore gets fixed", entry.PhaseOrdinal, gameID, err)
+					return err
+				}
+				mapURL, err := router.Get(RenderPhaseMapRoute).URL("game_id", gameID.Encode(), "phase_ordinal", fmt.Sprint(phase.PhaseOrdinal))
+				if err != nil {
+					return err
+				}
+				mapURL.Host = entry.Host
+				mapURL.Scheme = entry.Scheme
+				// Only the newest phase accepts orders, even if the game has moved on since the entry was queued.
+				replyToID, err := newestPhaseID(ctx, game)
+				if err != nil {
+					return err
+				}
+				address, err := replyAddress(ctx, string(member.Nation), replyToID)
+				if err != nil {
+					return err
+				}
+				buf.WriteString(localizer.Sprintf("New phase: %s\n%s\nReply with orders to %s\n\n", phaseName(localizer, &phase.PhaseMeta), mapURL.String(), address))
+				nPhases++
+				continue
+			}
+			name := entry.ChannelMembers.String()
+			if _, found := channelEntries[name]; !found {
+				channelNames = append(channelNames, name)
+			}
+			channelEntries[name] = append(channelEntries[name], entry)
+		}
+
+		for _, name := range channelNames {
+			messageIDs := make([]*datastore.Key, len(channelEntries[name]))
+			for i, entry := range channelEntries[name] {
+				messageIDs[i] = entry.MessageID
+			}
+			messages := make(Messages, len(messageIDs))
+			if err := datastore.GetMulti(ctx, messageIDs, messages); err != nil {
+				log.Errorf(ctx, "Unable to load messages %+v: %v; hope datastore gets fixed", messageIDs, err)
+				return err
+			}
+			fmt.Fprintf(buf, "--- %s ---\n", game.AbbrNats(channelEntries[name][0].ChannelMembers).String())
+			for _, message := range messages {
+				if message.Deleted {
+					continue
+				}
+				fmt.Fprintf(buf, "%s: %s\n", game.AbbrNat(message.Sender), message.Body)
+				nMessages++
+			}
+			address, err := replyAddress(ctx, string(member.Nation), messageIDs[len(messageIDs)-1])
+			if err != nil {
+				return err
+			}
+			buf.WriteString(localizer.Sprintf("Reply to this channel at %s\n\n", address))
+		}
+	}
+
+	if nMessages+nPhases > 0 {
+		unsubscribeURL, err := auth.GetUnsubscribeURL(ctx, router, host, scheme, userId)
+		if err != nil {
+			log.Errorf(ctx, "Unable to create unsubscribe URL for %q: %v; fix auth.GetUnsubscribeURL", userId, err)
+			return err
+		}
+		buf.WriteString(localizer.Sprintf("Visit %s to stop receiving email like this.", unsubscribeURL.String()))
+
+		msg := sendgrid.NewMail()
+		msg.SetText(buf.String())
+		msg.SetSubject(localizer.Sprintf("Diplicity digest: %d new messages, %d new phases", nMessages, nPhases))
+		msg.AddHeader("List-Unsubscribe", fmt.Sprintf("<%s>", unsubscribeURL.String()))
+
+		recipEmail, err := mail.ParseAddress(user.Email)
+		if err != nil {
+			log.Errorf(ctx, "Unable to parse email address of %v: %v; unable to recover, dropping digest", PP(user), err)
+			return datastore.DeleteMulti(ctx, entryIDs)
+		}
+		msg.AddRecipient(recipEmail)
+
+		if err = msg.SetFrom(noreplyFromAddr); err != nil {
+			log.Errorf(ctx, "Unable to set from address %q: %v; fix the address", noreplyFromAddr, err)
+			return err
+		}
+		msg.SetFromName("Diplicity")
+
+		if err := MailTransport.Send(ctx, &Notification{UserId: userId, Type: MailDigestNotification, Mail: msg}); err != nil {
+			log.Errorf(ctx, "Unable to send %v: %v; hope the mail transport gets fixed", msg, err)
+			return err
+		}
+		log.Infof(ctx, "Successfully sent %v", PP(msg))
+	}
+
+	// Only the entries included in this digest are removed, new ones will be in the next digest.
+	if err := datastore.DeleteMulti(ctx, entryIDs); err != nil {
+		log.Errorf(ctx, "Unable to delete mail digest entries %+v: %v; hope datastore gets fixed", entryIDs, err)
+		return err
+	}
+
+	log.Infof(ctx, "sendMailDigest(..., %q) *** SUCCESS ***", userId)
+
+	return nil
+}
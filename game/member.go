@@ -162,7 +162,14 @@ func deleteMemberHelper(ctx context.Context, gameID *datastore.Key, userId strin
 			return datastore.Delete(ctx, gameID)
 		}
 		game.Members = newMembers
-		return game.Save(ctx)
+		if err := game.Save(ctx); err != nil {
+			return err
+		}
+		uids := []string{member.User.Id}
+		for _, remaining := range newMembers {
+			uids = append(uids, remaining.User.Id)
+		}
+		return triggerWebhooks(ctx, webhookTrigger{Event: WebhookMemberLeft, GameID: gameID, UserIds: uids, Member: member})
 	}, &datastore.TransactionOptions{XG: false}); err != nil {
 		return nil, err
 	}
@@ -219,6 +226,13 @@ func createMemberHelper(
 		if err := game.Save(ctx); err != nil {
 			return err
 		}
+		uids := []string{}
+		for _, existing := range game.Members {
+			uids = append(uids, existing.User.Id)
+		}
+		if err := triggerWebhooks(ctx, webhookTrigger{Event: WebhookMemberJoined, GameID: gameID, UserIds: uids, Member: member}); err != nil {
+			return err
+		}
 		if len(game.Members) == len(variants.Variants[game.Variant].Nations) {
 			scheme := "http"
 			if r.Req().TLS != nil {
@@ -0,0 +1,260 @@
+package game
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip"
+	"github.com/zond/godip/variants"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	dvars "github.com/zond/diplicity/variants"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	OrdersAttachment = "Orders"
+	MapAttachment    = "Map"
+
+	maxAttachmentOrders      = 100
+	maxAttachmentAnnotations = 100
+)
+
+// ProposedOrder is an order suggested in a message, not necessarily for the sender.
+type ProposedOrder struct {
+	Nation godip.Nation `methods:"POST"`
+	// Order contains the order parts separated by spaces, like "par Move bur".
+	Order string `methods:"POST"`
+}
+
+func (p ProposedOrder) Parts() []string {
+	return strings.Fields(p.Order)
+}
+
+// MessageAttachment is structured content attached to a message, rendered on the map of a phase.
+type MessageAttachment struct {
+	// Type is empty for messages without attachments, OrdersAttachment for proposed order sets
+	// and MapAttachment for annotated map snapshots.
+	Type         string `methods:"POST"`
+	PhaseOrdinal int64  `methods:"POST"`
+	// Orders are drawn as arrows on the map, and can be copied by the nations they are proposed for.
+	Orders []ProposedOrder `methods:"POST"`
+	// Annotations are only drawn on the map, and are colored by the sender.
+	Annotations []dvars.Annotation `methods:"POST"`
+}
+
+func (a *MessageAttachment) ordersFor(nation godip.Nation) []ProposedOrder {
+	result := []ProposedOrder{}
+	for _, order := range a.Orders {
+		if order.Nation == nation {
+			result = append(result, order)
+		}
+	}
+	return result
+}
+
+// validate verifies that the attachment makes sense for the phase and variant, and sets the
+// nation of all annotations to sender.
+func (a *MessageAttachment) validate(ctx context.Context, game *Game, sender godip.Nation) error {
+	switch a.Type {
+	case "":
+		if len(a.Orders) > 0 || len(a.Annotations) > 0 {
+			return HTTPErr{"attachments need a type", http.StatusBadRequest}
+		}
+		return nil
+	case OrdersAttachment:
+		if len(a.Orders) == 0 {
+			return HTTPErr{"order attachments need orders", http.StatusBadRequest}
+		}
+	case MapAttachment:
+	default:
+		return HTTPErr{fmt.Sprintf("unknown attachment type %q", a.Type), http.StatusBadRequest}
+	}
+	if len(a.Orders) > maxAttachmentOrders || len(a.Annotations) > maxAttachmentAnnotations {
+		return HTTPErr{"attachment too large", http.StatusBadRequest}
+	}
+
+	phaseID, err := PhaseID(ctx, game.ID, a.PhaseOrdinal)
+	if err != nil {
+		return err
+	}
+	if err := datastore.Get(ctx, phaseID, &Phase{}); err == datastore.ErrNoSuchEntity {
+		return HTTPErr{"no such phase", http.StatusBadRequest}
+	} else if err != nil {
+		return err
+	}
+
+	variant := variants.Variants[game.Variant]
+	nations := Nations(variant.Nations)
+	for _, order := range a.Orders {
+		if !nations.Includes(order.Nation) {
+			return HTTPErr{fmt.Sprintf("unknown nation %q", order.Nation), http.StatusBadRequest}
+		}
+		if _, err := variant.Parser.Parse(order.Parts()); err != nil {
+			return HTTPErr{fmt.Sprintf("unparseable order %q: %v", order.Order, err), http.StatusBadRequest}
+		}
+	}
+	graph := variant.Graph()
+	for i := range a.Annotations {
+		annotation := &a.Annotations[i]
+		annotation.Nation = sender
+		provinces := []godip.Province{annotation.Province}
+		switch annotation.Type {
+		case dvars.ArrowAnnotation:
+			provinces = append(provinces, annotation.Destination)
+		case dvars.CrossAnnotation, dvars.HighlightAnnotation:
+			annotation.Destination = ""
+		default:
+			return HTTPErr{fmt.Sprintf("unknown annotation type %q", annotation.Type), http.StatusBadRequest}
+		}
+		for _, prov := range provinces {
+			if !graph.Has(prov) {
+				return HTTPErr{fmt.Sprintf("unknown province %q", prov), http.StatusBadRequest}
+			}
+		}
+	}
+	return nil
+}
+
+// loadAttachedMessage loads the game and message in the request, and the nation of the user,
+// verifying that the user can see the message.
+func loadAttachedMessage(ctx context.Context, r Request) (*Game, *Message, godip.Nation, error) {
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, nil, "", HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	channelMembers := Nations{}
+	channelMembers.FromString(r.Vars()["channel_members"])
+	channelID, err := ChannelID(ctx, gameID, channelMembers)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	messageIntID, err := strconv.ParseInt(r.Vars()["message_id"], 10, 64)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	messageID := datastore.NewKey(ctx, messageKind, "", messageIntID, channelID)
+
+	game := &Game{}
+	message := &Message{}
+	if err := datastore.GetMulti(ctx, []*datastore.Key{gameID, messageID}, []interface{}{game, message}); err != nil {
+		return nil, nil, "", err
+	}
+	game.ID = gameID
+	message.ID = messageID
+
+	var nation godip.Nation
+	if member, found := game.GetMemberByUserId(user.Id); found {
+		nation = member.Nation
+	}
+
+	if !game.pressRevealedTo(nation) && !channelMembers.Includes(nation) && !isPublic(game.Variant, channelMembers) {
+		return nil, nil, "", HTTPErr{"can only load messages in member channels", http.StatusForbidden}
+	}
+	if message.Deleted || message.Attachment.Type == "" {
+		return nil, nil, "", HTTPErr{"message has no attachment", http.StatusNotFound}
+	}
+
+	return game, message, nation, nil
+}
+
+func renderMessageAttachmentMap(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	game, message, _, err := loadAttachedMessage(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	user := r.Values()["user"].(*auth.User)
+
+	phaseID, err := PhaseID(ctx, game.ID, message.Attachment.PhaseOrdinal)
+	if err != nil {
+		return err
+	}
+	userConfigID := auth.UserConfigID(ctx, auth.UserID(ctx, user.Id))
+
+	phase := &Phase{}
+	userConfig := &auth.UserConfig{}
+	if err := datastore.GetMulti(ctx, []*datastore.Key{phaseID, userConfigID}, []interface{}{phase, userConfig}); err != nil {
+		if merr, ok := err.(appengine.MultiError); !ok || merr[0] != nil || merr[1] != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+
+	ordersToDisplay := map[godip.Nation]map[godip.Province][]string{}
+	for _, order := range message.Attachment.Orders {
+		parts := order.Parts()
+		if len(parts) == 0 {
+			continue
+		}
+		nationOrders, found := ordersToDisplay[order.Nation]
+		if !found {
+			nationOrders = map[godip.Province][]string{}
+			ordersToDisplay[order.Nation] = nationOrders
+		}
+		nationOrders[godip.Province(parts[0])] = parts[1:]
+	}
+
+	vPhase := phase.toVariantsPhase(game.Variant, ordersToDisplay)
+	// Only the proposal is interesting, not what happened when the phase resolved.
+	vPhase.Resolutions = nil
+	vPhase.Annotations = message.Attachment.Annotations
+
+	return dvars.RenderPhaseMap(w, r, vPhase, userConfig.Colors)
+}
+
+func copyMessageAttachmentOrders(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	game, message, nation, err := loadAttachedMessage(ctx, r)
+	if err != nil {
+		return err
+	}
+	if nation == "" {
+		return HTTPErr{"can only copy orders in member games", http.StatusNotFound}
+	}
+
+	proposed := message.Attachment.ordersFor(nation)
+	if len(proposed) == 0 {
+		return HTTPErr{"no orders proposed for your nation", http.StatusNotFound}
+	}
+
+	user := r.Values()["user"].(*auth.User)
+
+	phase := &Phase{}
+	phaseID, err := PhaseID(ctx, game.ID, message.Attachment.PhaseOrdinal)
+	if err != nil {
+		return err
+	}
+	if err := datastore.Get(ctx, phaseID, phase); err != nil {
+		return err
+	}
+
+	orders := Orders{}
+	for _, proposal := range proposed {
+		order := &Order{
+			Parts: proposal.Parts(),
+		}
+		if err := createOrderHelper(ctx, game.ID, message.Attachment.PhaseOrdinal, user.Id, order); err != nil {
+			return err
+		}
+		orders = append(orders, *order)
+	}
+
+	w.SetContent(orders.Item(r, game.ID, phase))
+	return nil
+}
@@ -59,6 +59,8 @@ type FlaggedMessage struct {
 	ChannelMembers string
 	Sender         godip.Nation
 	Body           string
+	OriginalBody   string
+	Deleted        bool
 	CreatedAt      time.Time
 	AuthorId       string
 }
@@ -178,6 +180,8 @@ func createMessageFlag(w ResponseWriter, r Request) (*MessageFlag, error) {
 			ChannelMembers: message.ChannelMembers.String(),
 			Sender:         message.Sender,
 			Body:           message.Body,
+			OriginalBody:   message.OriginalBody(),
+			Deleted:        message.Deleted,
 			CreatedAt:      message.CreatedAt,
 			AuthorId:       userByNation[message.Sender].Id,
 		}
@@ -0,0 +1,89 @@
+package game
+
+import (
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/appengine"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	maxReactionLength = 16
+)
+
+var (
+	MessageReactionResource *Resource
+)
+
+func init() {
+	MessageReactionResource = &Resource{
+		Create:     createMessageReaction,
+		Delete:     deleteMessageReaction,
+		CreatePath: "/Game/{game_id}/Channel/{channel_members}/Messages/{message_id}/Reactions",
+		FullPath:   "/Game/{game_id}/Channel/{channel_members}/Messages/{message_id}/Reactions/{reaction}",
+	}
+}
+
+func (m *MessageReaction) Item(r Request) *Item {
+	return NewItem(m).SetName(m.Reaction)
+}
+
+func createMessageReaction(w ResponseWriter, r Request) (*MessageReaction, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	reaction := &MessageReaction{}
+	if err := Copy(reaction, r, "POST"); err != nil {
+		return nil, err
+	}
+	reaction.Reaction = strings.TrimSpace(reaction.Reaction)
+	if reaction.Reaction == "" {
+		return nil, HTTPErr{"can not create empty reactions", http.StatusBadRequest}
+	}
+	if utf8.RuneCountInString(reaction.Reaction) > maxReactionLength {
+		return nil, HTTPErr{"reaction too long", http.StatusBadRequest}
+	}
+
+	if _, err := updateMessageHelper(ctx, r, func(member *Member, channel *Channel, message *Message) error {
+		if message.Deleted {
+			return HTTPErr{"can not react to deleted messages", http.StatusPreconditionFailed}
+		}
+		reaction.Nation = member.Nation
+		for _, existing := range message.Reactions {
+			if existing == *reaction {
+				return nil
+			}
+		}
+		message.Reactions = append(message.Reactions, *reaction)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return reaction, nil
+}
+
+func deleteMessageReaction(w ResponseWriter, r Request) (*MessageReaction, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	reaction := &MessageReaction{
+		Reaction: r.Vars()["reaction"],
+	}
+
+	if _, err := updateMessageHelper(ctx, r, func(member *Member, channel *Channel, message *Message) error {
+		reaction.Nation = member.Nation
+		for i, existing := range message.Reactions {
+			if existing == *reaction {
+				message.Reactions = append(message.Reactions[:i], message.Reactions[i+1:]...)
+				return nil
+			}
+		}
+		return HTTPErr{"no such reaction", http.StatusNotFound}
+	}); err != nil {
+		return nil, err
+	}
+
+	return reaction, nil
+}
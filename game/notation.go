@@ -0,0 +1,402 @@
+package game
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip"
+	"github.com/zond/godip/variants"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	vrt "github.com/zond/godip/variants/common"
+
+	. "github.com/zond/goaeoas"
+)
+
+var (
+	notationCoastReg = regexp.MustCompile(`\(\s*([^)\s]+)\s*\)`)
+	notationDashReg  = regexp.MustCompile(`\s*(->|=>|-|–)\s*`)
+)
+
+// Keywords of the written order notation, mapped to the godip order type they introduce.
+var notationOrderTypes = map[string]godip.OrderType{
+	"-":        godip.Move,
+	"M":        godip.Move,
+	"MOVE":     godip.Move,
+	"MOVES":    godip.Move,
+	"R":        godip.Move,
+	"RETREAT":  godip.Move,
+	"RETREATS": godip.Move,
+	"H":        godip.Hold,
+	"HOLD":     godip.Hold,
+	"HOLDS":    godip.Hold,
+	"S":        godip.Support,
+	"SUPPORT":  godip.Support,
+	"SUPPORTS": godip.Support,
+	"C":        godip.Convoy,
+	"CONVOY":   godip.Convoy,
+	"CONVOYS":  godip.Convoy,
+	"B":        godip.Build,
+	"BUILD":    godip.Build,
+	"BUILDS":   godip.Build,
+	"D":        godip.Disband,
+	"DISBAND":  godip.Disband,
+	"DISBANDS": godip.Disband,
+	"REMOVE":   godip.Disband,
+}
+
+type notationParser struct {
+	variant   vrt.Variant
+	provinces map[string]godip.Province
+	tokens    []string
+	pos       int
+}
+
+func newNotationParser(variant vrt.Variant, notation string) *notationParser {
+	p := &notationParser{
+		variant:   variant,
+		provinces: map[string]godip.Province{},
+	}
+	for _, prov := range variant.Graph().Provinces() {
+		p.provinces[strings.ToUpper(string(prov))] = prov
+	}
+	notation = strings.ToUpper(strings.TrimSpace(notation))
+	notation = strings.TrimRight(notation, ".;,")
+	notation = notationCoastReg.ReplaceAllString(notation, "/$1")
+	notation = notationDashReg.ReplaceAllString(notation, " - ")
+	p.tokens = strings.Fields(notation)
+	return p
+}
+
+func (p *notationParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *notationParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *notationParser) unitType(tok string) (godip.UnitType, bool) {
+	for _, typ := range p.variant.UnitTypes {
+		upper := strings.ToUpper(string(typ))
+		if tok == upper || tok == upper[:1] {
+			return typ, true
+		}
+	}
+	return "", false
+}
+
+func (p *notationParser) province() (godip.Province, error) {
+	tok := p.next()
+	if tok == "" {
+		return "", fmt.Errorf("expected province at end of order")
+	}
+	if prov, found := p.provinces[tok]; found {
+		return prov, nil
+	}
+	return "", fmt.Errorf("unknown province %q", tok)
+}
+
+// unit parses an optional unit type followed by a province.
+func (p *notationParser) unit() (godip.UnitType, godip.Province, error) {
+	var typ godip.UnitType
+	if foundType, isType := p.unitType(p.peek()); isType && p.pos+1 < len(p.tokens) {
+		// Only consume the unit type if it is followed by a province.
+		if _, isProv := p.provinces[p.tokens[p.pos+1]]; isProv {
+			typ = foundType
+			p.next()
+		}
+	}
+	prov, err := p.province()
+	return typ, prov, err
+}
+
+func (p *notationParser) done() error {
+	if tok := p.peek(); tok != "" {
+		return fmt.Errorf("unexpected %q after end of order", strings.Join(p.tokens[p.pos:], " "))
+	}
+	return nil
+}
+
+func (p *notationParser) parse() ([]string, error) {
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("empty order")
+	}
+
+	// Prefixed adjustment orders, e.g. "BUILD A PAR" or "REMOVE F BRE".
+	_, isProv := p.provinces[p.peek()]
+	if orderType := notationOrderTypes[p.peek()]; !isProv && (orderType == godip.Build || orderType == godip.Disband) {
+		p.next()
+		typ, prov, err := p.unit()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.done(); err != nil {
+			return nil, err
+		}
+		if orderType == godip.Build {
+			if typ == "" {
+				return nil, fmt.Errorf("builds must specify unit type")
+			}
+			return []string{string(prov), string(godip.Build), string(typ)}, nil
+		}
+		return []string{string(prov), string(godip.Disband)}, nil
+	}
+
+	typ, src, err := p.unit()
+	if err != nil {
+		return nil, err
+	}
+
+	keyword := p.next()
+	orderType, found := notationOrderTypes[keyword]
+	if !found {
+		if keyword == "" {
+			return nil, fmt.Errorf("missing order type")
+		}
+		return nil, fmt.Errorf("unknown order type %q", keyword)
+	}
+
+	parts := []string{string(src), string(orderType)}
+	switch orderType {
+	case godip.Move:
+		dst, err := p.province()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, string(dst))
+		if p.peek() == "VIA" {
+			p.next()
+			if tok := p.peek(); tok == "C" || tok == "CONVOY" {
+				p.next()
+			}
+			parts[1] = string(godip.MoveViaConvoy)
+		}
+	case godip.Support:
+		_, supported, err := p.unit()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() == "-" {
+			p.next()
+			dst, err := p.province()
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, string(supported), string(dst))
+		} else {
+			if tok := p.peek(); tok == "H" || tok == "HOLD" {
+				p.next()
+			}
+			parts = append(parts, string(supported), string(supported))
+		}
+	case godip.Convoy:
+		_, convoyed, err := p.unit()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != "-" {
+			return nil, fmt.Errorf("convoys must specify destination")
+		}
+		dst, err := p.province()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, string(convoyed), string(dst))
+	case godip.Build:
+		if typ == "" {
+			return nil, fmt.Errorf("builds must specify unit type")
+		}
+		parts = append(parts, string(typ))
+	}
+
+	if err := p.done(); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// ParseOrderNotation parses an order written in standard notation, e.g. "A PAR - BUR" or
+// "F NTH C A LON - NWY", into the order parts understood by the godip parser of the variant.
+func ParseOrderNotation(variant vrt.Variant, notation string) ([]string, error) {
+	parts, err := newNotationParser(variant, notation).parse()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := variant.Parser.Parse(parts); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+func notationProvince(prov string) string {
+	return strings.ToUpper(prov)
+}
+
+func notationUnit(units map[godip.Province]godip.Unit, prov string) string {
+	unit, found := units[godip.Province(prov)]
+	if !found {
+		unit, found = units[godip.Province(prov).Super()]
+	}
+	if !found || unit.Type == "" {
+		return notationProvince(prov)
+	}
+	return fmt.Sprintf("%s %s", string(unit.Type)[:1], notationProvince(prov))
+}
+
+// FormatOrderNotation formats order parts in standard notation.
+// Units are used to prefix provinces with unit types, and may be nil.
+func FormatOrderNotation(parts []string, units map[godip.Province]godip.Unit) string {
+	if len(parts) < 2 {
+		return strings.ToUpper(strings.Join(parts, " "))
+	}
+	src := notationUnit(units, parts[0])
+	switch godip.OrderType(parts[1]) {
+	case godip.Move:
+		if len(parts) == 3 {
+			return fmt.Sprintf("%s - %s", src, notationProvince(parts[2]))
+		}
+	case godip.MoveViaConvoy:
+		if len(parts) == 3 {
+			return fmt.Sprintf("%s - %s via convoy", src, notationProvince(parts[2]))
+		}
+	case godip.Hold:
+		return fmt.Sprintf("%s H", src)
+	case godip.Support:
+		if len(parts) == 4 {
+			if parts[2] == parts[3] {
+				return fmt.Sprintf("%s S %s", src, notationUnit(units, parts[2]))
+			}
+			return fmt.Sprintf("%s S %s - %s", src, notationUnit(units, parts[2]), notationProvince(parts[3]))
+		}
+	case godip.Convoy:
+		if len(parts) == 4 {
+			return fmt.Sprintf("%s C %s - %s", src, notationUnit(units, parts[2]), notationProvince(parts[3]))
+		}
+	case godip.Build:
+		if len(parts) == 3 && parts[2] != "" {
+			return fmt.Sprintf("Build %s %s", parts[2][:1], notationProvince(parts[0]))
+		}
+	case godip.Disband:
+		return fmt.Sprintf("%s Disband", src)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (p *Phase) unitMap() map[godip.Province]godip.Unit {
+	units := map[godip.Province]godip.Unit{}
+	for _, unit := range p.Units {
+		units[unit.Province] = unit.Unit
+	}
+	for _, dislodged := range p.Dislodgeds {
+		units[dislodged.Province] = dislodged.Dislodged
+	}
+	return units
+}
+
+// orderNotations returns the orders of the phase in standard notation, prefixed by nation and sorted.
+func (p *Phase) orderNotations(ctx context.Context) ([]string, error) {
+	orderMap, err := p.Orders(ctx)
+	if err != nil {
+		return nil, err
+	}
+	units := p.unitMap()
+	result := []string{}
+	for nation, nationOrders := range orderMap {
+		for prov, parts := range nationOrders {
+			result = append(result, fmt.Sprintf("%s: %s", nation, FormatOrderNotation(append([]string{string(prov)}, parts...), units)))
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+type OrderNotation struct {
+	Notation string
+	Parts    []string
+}
+
+func (o *OrderNotation) Item(r Request) *Item {
+	return NewItem(o).SetName(o.Notation).SetDesc([][]string{
+		[]string{
+			"Order notation",
+			"Orders can be written in standard notation, e.g. `A PAR - BUR`, `F NTH C A LON - NWY`, `A MUN S A KIE - BER`, `F BRE H`, `A PAR - BUR via convoy`, `Build A PAR` or `F BRE Disband`.",
+			"Provinces use the abbreviations of the variant, and coasts can be written as `STP/NC` or `STP(NC)`.",
+			"Unit types are optional except when building.",
+		},
+		[]string{
+			"Parsing",
+			"Provide the query parameter `notation` to parse a written order into the `Parts` to use when creating an order.",
+		},
+		[]string{
+			"Formatting",
+			"Provide the query parameter `parts` (space separated) to format order parts in standard notation, using the units of the phase.",
+		},
+	})
+}
+
+func handleOrderNotation(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if _, ok := r.Values()["user"].(*auth.User); !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	phaseOrdinal, err := strconv.ParseInt(r.Vars()["phase_ordinal"], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
+	if err != nil {
+		return err
+	}
+
+	game := &Game{}
+	phase := &Phase{}
+	if err := datastore.GetMulti(ctx, []*datastore.Key{gameID, phaseID}, []interface{}{game, phase}); err != nil {
+		return err
+	}
+	game.ID = gameID
+
+	variant, found := variants.Variants[game.Variant]
+	if !found {
+		return HTTPErr{"unknown variant", http.StatusInternalServerError}
+	}
+
+	result := &OrderNotation{}
+	if notation := r.Req().URL.Query().Get("notation"); notation != "" {
+		parts, err := ParseOrderNotation(variant, notation)
+		if err != nil {
+			return HTTPErr{err.Error(), http.StatusBadRequest}
+		}
+		result.Parts = parts
+	} else if parts := strings.Fields(r.Req().URL.Query().Get("parts")); len(parts) > 0 {
+		result.Parts = parts
+	} else {
+		return HTTPErr{"one of notation or parts must be provided", http.StatusBadRequest}
+	}
+	result.Notation = FormatOrderNotation(result.Parts, phase.unitMap())
+
+	w.SetContent(result.Item(r))
+	return nil
+}
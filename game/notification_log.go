@@ -0,0 +1,171 @@
+package game
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	notificationLogEntryKind = "NotificationLogEntry"
+
+	maxNotificationLogEntries = 100
+	notificationLogTTL        = 30 * 24 * time.Hour
+
+	FCMNotificationTransport     = "FCM"
+	WebPushNotificationTransport = "WebPush"
+	MailNotificationTransport    = "Mail"
+
+	MessageNotification          = "message"
+	PhaseNotification            = "phase"
+	DeadlineReminderNotification = "deadlineReminder"
+	MailDigestNotification       = "digest"
+	// QuietHoursSummaryNotification summarizes several notifications held during quiet hours.
+	QuietHoursSummaryNotification = "quietHoursSummary"
+
+	// NotificationSent means the transport service accepted the notification.
+	NotificationSent = "Sent"
+	// NotificationRetrying means delivery failed temporarily, and will be retried.
+	NotificationRetrying = "Retrying"
+	// NotificationFailed means delivery failed permanently.
+	NotificationFailed = "Failed"
+	// NotificationDisabled means the FCM token or Web Push subscription was disabled because of the error.
+	NotificationDisabled = "Disabled"
+	// NotificationHeld means the notification will be delivered when the quiet hours of the user end.
+	NotificationHeld = "Held"
+)
+
+var (
+	pruneNotificationLogFunc *DelayFunc
+)
+
+func init() {
+	pruneNotificationLogFunc = NewDelayFunc("game-pruneNotificationLog", pruneNotificationLog)
+}
+
+// NotificationLogEntry records the outcome of delivering a notification to one destination of a user.
+// Entries are children of the user.
+type NotificationLogEntry struct {
+	UserId    string
+	Transport string
+	Type      string
+	GameID    *datastore.Key
+	// Destination is the FCM token, Web Push endpoint or email address delivered to.
+	Destination string `datastore:",noindex"`
+	Status      string
+	Error       string `datastore:",noindex"`
+	CreatedAt   time.Time
+}
+
+type NotificationLogEntries []NotificationLogEntry
+
+func (n NotificationLogEntries) Item(r Request, userId string) *Item {
+	entryItems := make(List, len(n))
+	for i := range n {
+		entryItems[i] = NewItem(n[i]).SetName(n[i].Type)
+	}
+	return NewItem(entryItems).SetName("notification-log").SetDesc([][]string{
+		[]string{
+			"Notification log",
+			fmt.Sprintf("The latest %v notification deliveries to your FCM tokens, Web Push subscriptions and email address, newest first. Entries older than %v days are removed.", maxNotificationLogEntries, int(notificationLogTTL/(24*time.Hour))),
+			fmt.Sprintf("`Transport` is %q, %q or %q, and `Type` is %q, %q, %q or %q.", FCMNotificationTransport, WebPushNotificationTransport, MailNotificationTransport, MessageNotification, PhaseNotification, DeadlineReminderNotification, MailDigestNotification),
+			fmt.Sprintf("`Status` is %q, %q (with the temporary `Error`), %q (with the `Error`), %q if the FCM token or Web Push subscription was disabled because of the `Error`, or %q if delivery waits for the end of your quiet hours.", NotificationSent, NotificationRetrying, NotificationFailed, NotificationDisabled, NotificationHeld),
+		},
+	}).AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListNotificationLogRoute,
+		RouteParams: []string{"user_id", userId},
+	}))
+}
+
+// logNotifications stores the entries. Failures are only logged, since they must not affect the deliveries.
+func logNotifications(ctx context.Context, entries ...NotificationLogEntry) {
+	ids := []*datastore.Key{}
+	toStore := NotificationLogEntries{}
+	for _, entry := range entries {
+		if entry.UserId == "" {
+			continue
+		}
+		entry.CreatedAt = time.Now()
+		ids = append(ids, datastore.NewIncompleteKey(ctx, notificationLogEntryKind, auth.UserID(ctx, entry.UserId)))
+		toStore = append(toStore, entry)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	if _, err := datastore.PutMulti(ctx, ids, toStore); err != nil {
+		log.Errorf(ctx, "Unable to store notification log entries %v: %v; hope datastore gets fixed", PP(toStore), err)
+	}
+}
+
+func pruneNotificationLog(ctx context.Context, userId string) error {
+	log.Infof(ctx, "pruneNotificationLog(..., %q)", userId)
+
+	ids, err := datastore.NewQuery(notificationLogEntryKind).Ancestor(auth.UserID(ctx, userId)).Filter("CreatedAt<", time.Now().Add(-notificationLogTTL)).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load old notification log entries of %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+	if err := datastore.DeleteMulti(ctx, ids); err != nil {
+		log.Errorf(ctx, "Unable to delete %v old notification log entries of %q: %v; hope datastore gets fixed", len(ids), userId, err)
+		return err
+	}
+
+	log.Infof(ctx, "pruneNotificationLog(..., %q) *** SUCCESS ***", userId)
+
+	return nil
+}
+
+// handlePruneNotificationLogs is run daily by cron, and prunes the logs of all users with old entries, whether
+// they ever look at their log or not.
+func handlePruneNotificationLogs(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	ids, err := datastore.NewQuery(notificationLogEntryKind).Filter("CreatedAt<", time.Now().Add(-notificationLogTTL)).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	userIds := map[string]bool{}
+	for _, id := range ids {
+		userIds[id.Parent().StringID()] = true
+	}
+	log.Infof(ctx, "Found %v old notification log entries for %v users", len(ids), len(userIds))
+
+	for userId := range userIds {
+		if err := pruneNotificationLogFunc.EnqueueIn(ctx, 0, userId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func listNotificationLog(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if user.Id != r.Vars()["user_id"] {
+		return HTTPErr{"can only list your own notification log", http.StatusForbidden}
+	}
+
+	entries := NotificationLogEntries{}
+	if _, err := datastore.NewQuery(notificationLogEntryKind).Ancestor(auth.UserID(ctx, user.Id)).Order("-CreatedAt").Limit(maxNotificationLogEntries).GetAll(ctx, &entries); err != nil {
+		return err
+	}
+
+	w.SetContent(entries.Item(r, user.Id))
+	return nil
+}
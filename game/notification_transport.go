@@ -0,0 +1,110 @@
+package game
+
+import (
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/go-fcm"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+	"gopkg.in/sendgrid/sendgrid-go.v2"
+)
+
+// NotificationTransport delivers notifications to users via some external service.
+type NotificationTransport interface {
+	// Send delivers the notification, or enqueues delivering it. Push transports enqueue, so Send can be
+	// called inside transactions.
+	Send(ctx context.Context, notif *Notification) error
+}
+
+// Notification is a notification to a single destination of a user.
+// Push transports deliver Payload and Data to the FCM token or Web Push endpoint in To, while mail transports
+// deliver Mail to its recipients. Type and GameID describe the notification in the notification log.
+type Notification struct {
+	UserId  string
+	To      string
+	Type    string
+	GameID  *datastore.Key
+	Payload *fcm.NotificationPayload
+	Data    *FCMData
+	Mail    *sendgrid.SGMail
+}
+
+var (
+	// The transports used for all notifications. Replace them with FakeTransports to test notification flows
+	// without network access.
+	FCMTransport     NotificationTransport = fcmTransport{}
+	WebPushTransport NotificationTransport = webPushTransport{}
+	MailTransport    NotificationTransport = configuredMailTransport{}
+)
+
+type fcmTransport struct{}
+
+func (fcmTransport) Send(ctx context.Context, notif *Notification) error {
+	return FCMSendToTokensFunc.EnqueueIn(
+		ctx,
+		0,
+		time.Duration(0),
+		notif.Payload,
+		notif.Data,
+		map[string][]string{
+			notif.UserId: []string{notif.To},
+		},
+		notif.Type,
+		notif.GameID,
+	)
+}
+
+type sendGridTransport struct{}
+
+func (sendGridTransport) Send(ctx context.Context, notif *Notification) error {
+	sendGridConf, err := GetSendGrid(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load sendgrid API key: %v; upload one or hope datastore gets fixed", err)
+		return err
+	}
+	client := sendgrid.NewSendGridClientWithApiKey(sendGridConf.APIKey)
+	client.Client = urlfetch.Client(ctx)
+	return client.Send(notif.Mail)
+}
+
+// pushDestination is an FCM token or Web Push subscription of a user, with the transport delivering to it.
+type pushDestination struct {
+	Value          string
+	Transport      NotificationTransport
+	MessageConfig  auth.FCMNotificationConfig
+	PhaseConfig    auth.FCMNotificationConfig
+	ReminderConfig auth.FCMNotificationConfig
+}
+
+// pushDestinations returns the enabled FCM tokens and Web Push subscriptions of the user.
+func pushDestinations(userConfig *auth.UserConfig) []pushDestination {
+	result := []pushDestination{}
+	for _, fcmToken := range userConfig.FCMTokens {
+		if fcmToken.Disabled || fcmToken.Value == "" {
+			continue
+		}
+		result = append(result, pushDestination{
+			Value:          fcmToken.Value,
+			Transport:      FCMTransport,
+			MessageConfig:  fcmToken.MessageConfig,
+			PhaseConfig:    fcmToken.PhaseConfig,
+			ReminderConfig: fcmToken.ReminderConfig,
+		})
+	}
+	for _, subscription := range userConfig.WebPushSubscriptions {
+		if subscription.Disabled || subscription.Endpoint == "" {
+			continue
+		}
+		result = append(result, pushDestination{
+			Value:          subscription.Endpoint,
+			Transport:      WebPushTransport,
+			MessageConfig:  subscription.MessageConfig,
+			PhaseConfig:    subscription.PhaseConfig,
+			ReminderConfig: subscription.ReminderConfig,
+		})
+	}
+	return result
+}
@@ -13,6 +13,7 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
 
 	. "github.com/zond/goaeoas"
 )
@@ -46,8 +47,10 @@ func (o Orders) Item(r Request, gameID *datastore.Key, phase *Phase) *Item {
 	if !phase.Resolved {
 		r.Values()["is-unresolved"] = true
 	}
+	units := phase.unitMap()
 	orderItems := make(List, len(o))
 	for i := range o {
+		o[i].Notation = FormatOrderNotation(o[i].Parts, units)
 		orderItems[i] = o[i].Item(r)
 	}
 	ordersItem := NewItem(orderItems).SetName("orders").AddLink(r.NewLink(Link{
@@ -63,6 +66,7 @@ type Order struct {
 	PhaseOrdinal int64
 	Nation       godip.Nation
 	Parts        []string `methods:"POST,PUT" separator:" "`
+	Notation     string   `datastore:"-"`
 }
 
 func OrderID(ctx context.Context, phaseID *datastore.Key, srcProvince godip.Province) (*datastore.Key, error) {
@@ -219,23 +223,15 @@ func updateOrder(w ResponseWriter, r Request) (*Order, error) {
 
 		variant := variants.Variants[game.Variant]
 
-		parsedOrder, err := variant.Parser.Parse(order.Parts)
-		if err != nil {
-			return err
-		}
-
 		s, err := phase.State(ctx, variant, nil)
 		if err != nil {
 			return err
 		}
 
-		validNation, err := parsedOrder.Validate(s)
-		if err != nil {
+		if err := ValidateOrder(variant, s, member.Nation, order.Parts); err != nil {
 			return err
 		}
-		if validNation != member.Nation {
-			return HTTPErr{"can't issue orders for others", http.StatusForbidden}
-		}
+		order.Notation = FormatOrderNotation(order.Parts, phase.unitMap())
 
 		if godip.Province(order.Parts[0]).Super() != godip.Province(srcProvince).Super() {
 			return HTTPErr{"unable to change source province for order", http.StatusBadRequest}
@@ -267,17 +263,25 @@ func createOrder(w ResponseWriter, r Request) (*Order, error) {
 		return nil, err
 	}
 
-	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
-	if err != nil {
+	order := &Order{}
+	if err := Copy(order, r, "POST"); err != nil {
 		return nil, err
 	}
 
-	bodyBytes, err := ioutil.ReadAll(r.Req().Body)
-	if err != nil {
+	if err := createOrderHelper(ctx, gameID, phaseOrdinal, user.Id, order); err != nil {
 		return nil, err
 	}
-	order := &Order{}
-	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+
+	return order, nil
+}
+
+func createOrderHelper(ctx context.Context, gameID *datastore.Key, phaseOrdinal int64, userId string, order *Order) error {
+	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
+	if err != nil {
+		return err
+	}
+
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
 		game := &Game{}
 		phase := &Phase{}
 		if err := datastore.GetMulti(ctx, []*datastore.Key{gameID, phaseID}, []interface{}{game, phase}); err != nil {
@@ -287,7 +291,7 @@ func createOrder(w ResponseWriter, r Request) (*Order, error) {
 		if phase.Resolved {
 			return HTTPErr{"can only create orders for unresolved phases", http.StatusPreconditionFailed}
 		}
-		member, isMember := game.GetMemberByUserId(user.Id)
+		member, isMember := game.GetMemberByUserId(userId)
 		if !isMember {
 			return HTTPErr{"can only create orders for member games", http.StatusNotFound}
 		}
@@ -308,34 +312,21 @@ func createOrder(w ResponseWriter, r Request) (*Order, error) {
 			valuesToSave = append(valuesToSave, phaseState)
 		}
 
-		err = CopyBytes(order, r, bodyBytes, "POST")
-		if err != nil {
-			return err
-		}
-
 		order.GameID = gameID
 		order.PhaseOrdinal = phaseOrdinal
 		order.Nation = member.Nation
 
 		variant := variants.Variants[game.Variant]
 
-		parsedOrder, err := variant.Parser.Parse(order.Parts)
-		if err != nil {
-			return err
-		}
-
 		s, err := phase.State(ctx, variant, nil)
 		if err != nil {
 			return err
 		}
 
-		validNation, err := parsedOrder.Validate(s)
-		if err != nil {
+		if err := ValidateOrder(variant, s, member.Nation, order.Parts); err != nil {
 			return err
 		}
-		if validNation != member.Nation {
-			return HTTPErr{"can't issue orders for others", http.StatusForbidden}
-		}
+		order.Notation = FormatOrderNotation(order.Parts, phase.unitMap())
 
 		orderID, err := OrderID(ctx, phaseID, godip.Province(order.Parts[0]))
 		if err != nil {
@@ -346,11 +337,7 @@ func createOrder(w ResponseWriter, r Request) (*Order, error) {
 		valuesToSave = append(valuesToSave, order)
 		_, err = datastore.PutMulti(ctx, keysToSave, valuesToSave)
 		return err
-	}, &datastore.TransactionOptions{XG: false}); err != nil {
-		return nil, err
-	}
-
-	return order, nil
+	}, &datastore.TransactionOptions{XG: false})
 }
 
 func listOrders(w ResponseWriter, r Request) error {
@@ -406,3 +393,93 @@ func listOrders(w ResponseWriter, r Request) error {
 	w.SetContent(toReturn.Item(r, gameID, phase))
 	return nil
 }
+
+// Commands, apart from orders, understood in replies to phase notification mail.
+var mailPhaseStateCommands = map[string]func(*PhaseState){
+	"READY":    func(p *PhaseState) { p.ReadyToResolve = true },
+	"NOTREADY": func(p *PhaseState) { p.ReadyToResolve = false },
+	"UNREADY":  func(p *PhaseState) { p.ReadyToResolve = false },
+	"DIAS":     func(p *PhaseState) { p.WantsDIAS = true },
+	"NODIAS":   func(p *PhaseState) { p.WantsDIAS = false },
+}
+
+func receivePhaseMail(ctx context.Context, from string, nation godip.Nation, phaseID *datastore.Key, paragraphs []string) error {
+	gameID := phaseID.Parent()
+	phaseOrdinal := phaseID.IntID()
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		e := fmt.Sprintf("Unable to load game from datastore, unable to accept orders: %v", err)
+		log.Errorf(ctx, e)
+		return sendEmailError(ctx, from, e)
+	}
+	game.ID = gameID
+
+	member, isMember := game.GetMemberByNation(nation)
+	if !isMember {
+		e := fmt.Sprintf("%v is no longer a member of %v, unable to accept orders.", nation, game.Desc)
+		log.Errorf(ctx, e)
+		return sendEmailError(ctx, from, e)
+	}
+
+	variant := variants.Variants[game.Variant]
+
+	results := []string{}
+	failures := 0
+	commands := []func(*PhaseState){}
+	for _, line := range strings.Split(strings.Join(paragraphs, "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, ">") {
+			continue
+		}
+		if line == "--" {
+			break
+		}
+		if command, found := mailPhaseStateCommands[strings.ToUpper(strings.Join(strings.Fields(line), ""))]; found {
+			commands = append(commands, command)
+			results = append(results, fmt.Sprintf("%s: OK", line))
+			continue
+		}
+		parts, err := ParseOrderNotation(variant, line)
+		if err != nil {
+			failures++
+			results = append(results, fmt.Sprintf("%s: %v", line, err))
+			continue
+		}
+		order := &Order{Parts: parts}
+		if err := createOrderHelper(ctx, gameID, phaseOrdinal, member.User.Id, order); err != nil {
+			failures++
+			results = append(results, fmt.Sprintf("%s: %v", line, err))
+			continue
+		}
+		results = append(results, fmt.Sprintf("%s: OK", order.Notation))
+	}
+
+	if len(results) == 0 {
+		e := "Unable to find any orders or commands in mail."
+		log.Errorf(ctx, e)
+		return sendEmailError(ctx, from, e)
+	}
+
+	if len(commands) > 0 {
+		if _, err := updatePhaseStateHelper(ctx, gameID, phaseOrdinal, member.User.Id, nation, func(phaseState *PhaseState) error {
+			for _, command := range commands {
+				command(phaseState)
+			}
+			return nil
+		}); err != nil {
+			e := fmt.Sprintf("Unable to update phase state: %v", err)
+			log.Errorf(ctx, e)
+			return sendEmailError(ctx, from, e)
+		}
+	}
+
+	log.Infof(ctx, "Received %+v via email from %v in %v", results, nation, phaseID)
+
+	localizer := auth.LoadLocalizerByEmail(ctx, from)
+	subject := localizer.Sprintf("%s: orders accepted", game.DescFor(nation))
+	if failures > 0 {
+		subject = localizer.Sprintf("%s: %d orders not accepted", game.DescFor(nation), failures)
+	}
+	return sendEmailReply(ctx, from, subject, localizer.Sprintf("Your recent mail to diplicity was processed.\n\n%s", strings.Join(results, "\n")))
+}
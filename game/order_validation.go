@@ -0,0 +1,202 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/zond/godip"
+	"github.com/zond/godip/state"
+
+	vrt "github.com/zond/godip/variants/common"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	ErrUnparseableOrder = "ErrUnparseableOrder"
+	ErrInvalidOrderType = "ErrInvalidOrderType"
+	ErrNotOwnUnit       = "ErrNotOwnUnit"
+)
+
+// OrderValidationError is returned instead of a plain HTTPErr when order parts are rejected,
+// so that clients can point out the offending part and suggest alternatives.
+type OrderValidationError struct {
+	// Code is either one of the godip validation errors (like ErrMissingUnit or ErrIllegalMove),
+	// or one of ErrUnparseableOrder, ErrInvalidOrderType or ErrNotOwnUnit.
+	Code string
+	// Message is a human readable description of the problem.
+	Message string
+	// Parts are the rejected order parts.
+	Parts []string
+	// PartIndex is the index in Parts of the first part not present in the options tree,
+	// or len(Parts) if the order is missing parts.
+	PartIndex int
+	// Part is the offending part, or empty if the order is missing parts.
+	Part string
+	// Suggestions are the valid alternatives for the offending part according to the options tree.
+	Suggestions []string
+
+	status int
+}
+
+func (o *OrderValidationError) Error() string {
+	if o.Part == "" {
+		return fmt.Sprintf("%v: %v (order incomplete after %+v)", o.Code, o.Message, o.Parts[:o.PartIndex])
+	}
+	return fmt.Sprintf("%v: %v (%q at position %d)", o.Code, o.Message, o.Part, o.PartIndex)
+}
+
+func (o *OrderValidationError) Status() int {
+	if o.status == 0 {
+		return http.StatusBadRequest
+	}
+	return o.status
+}
+
+var orderValidationMessages = map[string]string{
+	ErrUnparseableOrder:                              "the order parts can't be parsed as an order",
+	ErrInvalidOrderType:                              "no such order type",
+	ErrNotOwnUnit:                                    "can't issue orders for others",
+	godip.ErrInvalidSource.Error():                   "no such province",
+	godip.ErrInvalidDestination.Error():              "no such destination province",
+	godip.ErrInvalidTarget.Error():                   "no such target province",
+	godip.ErrInvalidPhase.Error():                    "order type not allowed in this phase",
+	godip.ErrMissingUnit.Error():                     "no unit in province",
+	godip.ErrIllegalDestination.Error():              "unit can't go there",
+	godip.ErrMissingConvoyPath.Error():               "no convoy path to destination",
+	godip.ErrIllegalMove.Error():                     "unit can't reach destination",
+	godip.ErrIllegalSupportPosition.Error():          "unit can't support from its position",
+	godip.ErrIllegalSupportDestination.Error():       "unit can't support into destination",
+	godip.ErrIllegalSupportDestinationNation.Error(): "unit can't support into destination",
+	godip.ErrMissingSupportUnit.Error():              "no unit to support",
+	godip.ErrIllegalSupportMove.Error():              "supported unit can't reach destination",
+	godip.ErrIllegalConvoyUnit.Error():               "only fleets can convoy",
+	godip.ErrIllegalConvoyPath.Error():               "no convoy path",
+	godip.ErrIllegalConvoyMove.Error():               "convoyed unit can't reach destination",
+	godip.ErrMissingConvoyee.Error():                 "no unit to convoy",
+	godip.ErrIllegalConvoyer.Error():                 "unit can't convoy",
+	godip.ErrIllegalConvoyee.Error():                 "unit can't be convoyed",
+	godip.ErrIllegalBuild.Error():                    "can't build there",
+	godip.ErrIllegalDisband.Error():                  "can't disband there",
+	godip.ErrOccupiedSupplyCenter.Error():            "supply center is occupied",
+	godip.ErrMissingSupplyCenter.Error():             "no supply center in province",
+	godip.ErrMissingSurplus.Error():                  "no builds available",
+	godip.ErrIllegalUnitType.Error():                 "unit type not allowed there",
+	godip.ErrMissingDeficit.Error():                  "no disbands required",
+	godip.ErrOccupiedDestination.Error():             "destination is occupied",
+	godip.ErrIllegalRetreat.Error():                  "unit can't retreat there",
+	godip.ErrHostileSupplyCenter.Error():             "supply center is owned by someone else",
+}
+
+// ValidateOrder parses and validates parts as an order for nation in s. If the order is rejected,
+// the returned error is an *OrderValidationError.
+func ValidateOrder(variant vrt.Variant, s *state.State, nation godip.Nation, parts []string) error {
+	newErr := func(code string, status int) *OrderValidationError {
+		verr := &OrderValidationError{
+			Code:   code,
+			Parts:  parts,
+			status: status,
+		}
+		if verr.Message = orderValidationMessages[code]; verr.Message == "" {
+			verr.Message = code
+		}
+		verr.PartIndex, verr.Suggestions = findOptionsMismatch(s.Phase().Options(s, nation), parts)
+		if verr.PartIndex < len(parts) {
+			verr.Part = parts[verr.PartIndex]
+		}
+		return verr
+	}
+
+	if len(parts) < 2 {
+		return newErr(ErrUnparseableOrder, 0)
+	}
+	parsedOrder, err := variant.Parser.Parse(parts)
+	if err != nil {
+		for _, orderType := range variant.Parser.OrderTypes() {
+			if string(orderType) == parts[1] {
+				return newErr(ErrUnparseableOrder, 0)
+			}
+		}
+		return newErr(ErrInvalidOrderType, 0)
+	}
+
+	validNation, err := parsedOrder.Validate(s)
+	if err != nil {
+		return newErr(err.Error(), 0)
+	}
+	if validNation != nation {
+		return newErr(ErrNotOwnUnit, http.StatusForbidden)
+	}
+
+	return nil
+}
+
+// findOptionsMismatch walks the options tree along parts, and returns the index of the first part
+// not found along with the alternatives at that position.
+func findOptionsMismatch(options godip.Options, parts []string) (int, []string) {
+	for idx, part := range parts {
+		next, found := findOption(options, part)
+		if !found {
+			return idx, optionKeys(options)
+		}
+		options = next
+		if idx == 1 {
+			// Skip the level describing the actual source province (with coast) of the unit.
+			var src godip.Options
+			for key, child := range options {
+				if _, ok := key.(godip.SrcProvince); !ok {
+					continue
+				}
+				if src == nil || fmt.Sprint(key) == parts[0] {
+					src = child
+				}
+			}
+			if src != nil {
+				options = src
+			}
+		}
+	}
+	return len(parts), optionKeys(options)
+}
+
+func findOption(options godip.Options, part string) (godip.Options, bool) {
+	for key, child := range options {
+		if fmt.Sprint(key) == part {
+			return child, true
+		}
+	}
+	return nil, false
+}
+
+func optionKeys(options godip.Options) []string {
+	result := make([]string, 0, len(options))
+	for key := range options {
+		result = append(result, fmt.Sprint(key))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func renderOrderValidationError(w ResponseWriter, r Request, errI error) (bool, error) {
+	verr, ok := errI.(*OrderValidationError)
+	if !ok {
+		return true, errI
+	}
+
+	if r.Media() != "application/json" {
+		return true, HTTPErr{verr.Error(), verr.Status()}
+	}
+
+	b, err := json.Marshal(verr)
+	if err != nil {
+		return true, err
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(verr.Status())
+	if _, err := w.Write(b); err != nil {
+		return false, err
+	}
+	return false, nil
+}
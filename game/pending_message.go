@@ -0,0 +1,344 @@
+package game
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip"
+	"github.com/zond/godip/variants"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	pendingMessageKind = "PendingMessage"
+
+	// Task queue ETAs can't be more than 30 days in the future.
+	maxPendingMessageDelay = 30 * 24 * time.Hour
+)
+
+var (
+	deliverPendingMessageFunc       *DelayFunc
+	deliverPhasePendingMessagesFunc *DelayFunc
+
+	PendingMessageResource *Resource
+
+	errPendingMessageCancelled = errors.New("pending message cancelled")
+)
+
+func init() {
+	deliverPendingMessageFunc = NewDelayFunc("game-deliverPendingMessage", deliverPendingMessage)
+	deliverPhasePendingMessagesFunc = NewDelayFunc("game-deliverPhasePendingMessages", deliverPhasePendingMessages)
+
+	PendingMessageResource = &Resource{
+		Create:     createPendingMessage,
+		Delete:     deletePendingMessage,
+		CreatePath: "/Game/{game_id}/PendingMessage",
+		FullPath:   "/Game/{game_id}/PendingMessage/{id}",
+		Listers: []Lister{
+			{
+				Path:    "/Game/{game_id}/PendingMessages",
+				Route:   ListPendingMessagesRoute,
+				Handler: listPendingMessages,
+			},
+		},
+	}
+}
+
+type PendingMessages []PendingMessage
+
+func (p PendingMessages) Item(r Request, gameID *datastore.Key) *Item {
+	pendingItems := make(List, len(p))
+	for i := range p {
+		pendingItems[i] = p[i].Item(r)
+	}
+	return NewItem(pendingItems).SetName("pending-messages").SetDesc([][]string{
+		[]string{
+			"Pending messages",
+			"Pending messages are messages you have written, but that won't be sent until later.",
+			fmt.Sprintf("Set `DeliverAt` to send the message at a given time (at most %v in the future), or `AfterPhaseOrdinal` to send it right after that phase resolves.", maxPendingMessageDelay),
+			"Pending messages can be cancelled until they are sent.",
+		},
+	}).AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListPendingMessagesRoute,
+		RouteParams: []string{"game_id", gameID.Encode()},
+	})).AddLink(r.NewLink(PendingMessageResource.Link("create", Create, []string{"game_id", gameID.Encode()})))
+}
+
+// PendingMessage is a message waiting to be sent at DeliverAt, or after the phase with AfterPhaseOrdinal resolves.
+type PendingMessage struct {
+	ID                *datastore.Key `datastore:"-"`
+	GameID            *datastore.Key
+	UserId            string
+	ChannelMembers    Nations `methods:"POST"`
+	Sender            godip.Nation
+	Body              string    `methods:"POST" datastore:",noindex"`
+	DeliverAt         time.Time `methods:"POST"`
+	AfterPhaseOrdinal int64     `methods:"POST"`
+	Host              string
+	Scheme            string
+	CreatedAt         time.Time
+}
+
+func (p *PendingMessage) Item(r Request) *Item {
+	return NewItem(p).SetName(p.ChannelMembers.String()).AddLink(r.NewLink(PendingMessageResource.Link("cancel", Delete, []string{"game_id", p.GameID.Encode(), "id", p.ID.Encode()})))
+}
+
+func deliverPendingMessage(ctx context.Context, pendingID *datastore.Key) error {
+	log.Infof(ctx, "deliverPendingMessage(..., %v)", pendingID)
+
+	pending := &PendingMessage{}
+	if err := datastore.Get(ctx, pendingID, pending); err == datastore.ErrNoSuchEntity {
+		log.Infof(ctx, "%v was cancelled or already delivered, skipping", pendingID)
+		return nil
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to load %v: %v; hope datastore gets fixed", pendingID, err)
+		return err
+	}
+
+	message := &Message{
+		GameID:         pending.GameID,
+		ChannelMembers: pending.ChannelMembers,
+		Sender:         pending.Sender,
+		Body:           pending.Body,
+	}
+	// Deleting the pending message in the same transaction as creating the message, to make sure it's only sent once.
+	if err := createMessageForHost(ctx, pending.Host, pending.Scheme, message, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, pendingID, &PendingMessage{}); err == datastore.ErrNoSuchEntity {
+			return errPendingMessageCancelled
+		} else if err != nil {
+			return err
+		}
+		return datastore.Delete(ctx, pendingID)
+	}); err == errPendingMessageCancelled {
+		log.Infof(ctx, "%v was cancelled during delivery, skipping", pendingID)
+		return nil
+	} else if _, isHTTPErr := err.(HTTPErr); isHTTPErr {
+		// The game no longer allows the message, retrying won't help.
+		log.Warningf(ctx, "Unable to deliver %v: %v; dropping it", PP(pending), err)
+		return datastore.Delete(ctx, pendingID)
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to deliver %v: %v; hope datastore gets fixed", PP(pending), err)
+		return err
+	}
+
+	log.Infof(ctx, "deliverPendingMessage(..., %v) *** SUCCESS ***", pendingID)
+
+	return nil
+}
+
+func deliverPhasePendingMessages(ctx context.Context, gameID *datastore.Key, phaseOrdinal int64) error {
+	log.Infof(ctx, "deliverPhasePendingMessages(..., %v, %v)", gameID, phaseOrdinal)
+
+	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
+	if err != nil {
+		log.Errorf(ctx, "PhaseID(..., %v, %v): %v; fix the PhaseID func", gameID, phaseOrdinal, err)
+		return err
+	}
+	phase := &Phase{}
+	if err := datastore.Get(ctx, phaseID, phase); err == datastore.ErrNoSuchEntity {
+		log.Infof(ctx, "Phase %v not found, probably due to a rollback; skipping", phaseID)
+		return nil
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to load phase %v: %v; hope datastore gets fixed", phaseID, err)
+		return err
+	}
+	if !phase.Resolved {
+		log.Infof(ctx, "Phase %v isn't resolved yet, skipping", phaseID)
+		return nil
+	}
+
+	// Filtered in memory, since there are only a few pending messages per game and this avoids a composite index.
+	pendings := PendingMessages{}
+	pendingIDs, err := datastore.NewQuery(pendingMessageKind).Ancestor(gameID).GetAll(ctx, &pendings)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load pending messages for %v: %v; hope datastore gets fixed", gameID, err)
+		return err
+	}
+	for i := range pendings {
+		if pendings[i].AfterPhaseOrdinal != phaseOrdinal {
+			continue
+		}
+		if err := deliverPendingMessageFunc.EnqueueIn(ctx, 0, pendingIDs[i]); err != nil {
+			log.Errorf(ctx, "Unable to enqueue delivery of %v: %v; hope datastore gets fixed", pendingIDs[i], err)
+			return err
+		}
+	}
+
+	log.Infof(ctx, "deliverPhasePendingMessages(..., %v, %v) *** SUCCESS ***", gameID, phaseOrdinal)
+
+	return nil
+}
+
+func createPendingMessage(w ResponseWriter, r Request) (*PendingMessage, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return nil, err
+	}
+
+	pending := &PendingMessage{}
+	if err := Copy(pending, r, "POST"); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(pending.Body) == "" {
+		return nil, HTTPErr{"can not create empty messages", http.StatusBadRequest}
+	}
+	if pending.DeliverAt.IsZero() == (pending.AfterPhaseOrdinal == 0) {
+		return nil, HTTPErr{"pending messages need exactly one of DeliverAt and AfterPhaseOrdinal", http.StatusBadRequest}
+	}
+	if !pending.DeliverAt.IsZero() {
+		if pending.DeliverAt.Before(time.Now()) {
+			return nil, HTTPErr{"can only deliver messages in the future", http.StatusBadRequest}
+		}
+		if pending.DeliverAt.After(time.Now().Add(maxPendingMessageDelay)) {
+			return nil, HTTPErr{fmt.Sprintf("can only deliver messages at most %v in the future", maxPendingMessageDelay), http.StatusBadRequest}
+		}
+	}
+
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		game := &Game{}
+		if err := datastore.Get(ctx, gameID, game); err != nil {
+			return err
+		}
+		game.ID = gameID
+		if !game.Started || game.Finished {
+			return HTTPErr{"can only create pending messages in running games", http.StatusPreconditionFailed}
+		}
+
+		member, found := game.GetMemberByUserId(user.Id)
+		if !found {
+			return HTTPErr{"can only create pending messages in member games", http.StatusNotFound}
+		}
+		if !pending.ChannelMembers.Includes(member.Nation) {
+			return HTTPErr{"can only send messages to member channels", http.StatusForbidden}
+		}
+		for _, channelMember := range pending.ChannelMembers {
+			if !Nations(variants.Variants[game.Variant].Nations).Includes(channelMember) {
+				return HTTPErr{"unknown channel member", http.StatusBadRequest}
+			}
+		}
+
+		if pending.AfterPhaseOrdinal != 0 {
+			phaseID, err := PhaseID(ctx, gameID, pending.AfterPhaseOrdinal)
+			if err != nil {
+				return err
+			}
+			phase := &Phase{}
+			if err := datastore.Get(ctx, phaseID, phase); err == datastore.ErrNoSuchEntity {
+				return HTTPErr{"no such phase", http.StatusBadRequest}
+			} else if err != nil {
+				return err
+			}
+			if phase.Resolved {
+				return HTTPErr{"can only deliver messages after unresolved phases", http.StatusBadRequest}
+			}
+		}
+
+		sort.Sort(pending.ChannelMembers)
+		pending.GameID = gameID
+		pending.UserId = user.Id
+		pending.Sender = member.Nation
+		pending.Host = r.Req().Host
+		pending.Scheme = "http"
+		if r.Req().TLS != nil {
+			pending.Scheme = "https"
+		}
+		pending.CreatedAt = time.Now()
+
+		var err error
+		if pending.ID, err = datastore.Put(ctx, datastore.NewIncompleteKey(ctx, pendingMessageKind, gameID), pending); err != nil {
+			return err
+		}
+		if !pending.DeliverAt.IsZero() {
+			return deliverPendingMessageFunc.EnqueueAt(ctx, pending.DeliverAt, pending.ID)
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+
+	return pending, nil
+}
+
+func deletePendingMessage(w ResponseWriter, r Request) (*PendingMessage, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	pendingID, err := datastore.DecodeKey(r.Vars()["id"])
+	if err != nil {
+		return nil, err
+	}
+	if pendingID.Kind() != pendingMessageKind {
+		return nil, HTTPErr{"not a pending message", http.StatusBadRequest}
+	}
+
+	pending := &PendingMessage{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, pendingID, pending); err == datastore.ErrNoSuchEntity {
+			return HTTPErr{"message already sent or cancelled", http.StatusNotFound}
+		} else if err != nil {
+			return err
+		}
+		if pending.UserId != user.Id {
+			return HTTPErr{"can only cancel your own messages", http.StatusForbidden}
+		}
+		return datastore.Delete(ctx, pendingID)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+	pending.ID = pendingID
+
+	return pending, nil
+}
+
+func listPendingMessages(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	found := PendingMessages{}
+	ids, err := datastore.NewQuery(pendingMessageKind).Ancestor(gameID).GetAll(ctx, &found)
+	if err != nil {
+		return err
+	}
+	pendings := PendingMessages{}
+	for i := range found {
+		if found[i].UserId == user.Id {
+			found[i].ID = ids[i]
+			pendings = append(pendings, found[i])
+		}
+	}
+
+	w.SetContent(pendings.Item(r, gameID))
+	return nil
+}
@@ -21,7 +21,6 @@ import (
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/urlfetch"
 	"gopkg.in/sendgrid/sendgrid-go.v2"
 
 	dvars "github.com/zond/diplicity/variants"
@@ -98,11 +97,26 @@ type phaseNotificationContext struct {
 	member       *Member
 	user         *auth.User
 	userConfig   *auth.UserConfig
+	localizer    *auth.Localizer
 	mapURL       *url.URL
 	fcmData      map[string]interface{}
 	mailData     map[string]interface{}
 }
 
+// phaseName returns the translated name of the phase, like "Spring 1901, Movement".
+func phaseName(localizer *auth.Localizer, phaseMeta *PhaseMeta) string {
+	return fmt.Sprintf("%s %d, %s", localizer.Translate(string(phaseMeta.Season)), phaseMeta.Year, localizer.Translate(string(phaseMeta.Type)))
+}
+
+// newestPhaseID returns the ID of the newest phase of the game, the only one accepting orders unless the game
+// is finished.
+func newestPhaseID(ctx context.Context, game *Game) (*datastore.Key, error) {
+	if len(game.NewestPhaseMeta) == 0 {
+		return nil, fmt.Errorf("%v has no phases", game.ID)
+	}
+	return PhaseID(ctx, game.ID, game.NewestPhaseMeta[0].PhaseOrdinal)
+}
+
 func getPhaseNotificationContext(ctx context.Context, host, scheme string, gameID *datastore.Key, phaseOrdinal int64, userId string) (*phaseNotificationContext, error) {
 	res := &phaseNotificationContext{}
 
@@ -136,6 +150,7 @@ func getPhaseNotificationContext(ctx context.Context, host, scheme string, gameI
 		}
 	}
 	res.game.ID = gameID
+	res.localizer = auth.NewUserLocalizer(res.user, res.userConfig)
 
 	isMember := false
 	res.member, isMember = res.game.GetMemberByUserId(userId)
@@ -206,10 +221,15 @@ func sendPhaseNotificationsToMail(ctx context.Context, host, scheme string, game
 		return nil
 	}
 
-	sendGridConf, err := GetSendGrid(ctx)
-	if err != nil {
-		log.Errorf(ctx, "Unable to load sendgrid API key: %v; upload one or hope datastore gets fixed", err)
-		return err
+	if msgContext.userConfig.MailConfig.Digest != "" {
+		log.Infof(ctx, "%q gets %s mail digests, will queue the notification for the next digest", userId, msgContext.userConfig.MailConfig.Digest)
+		return queueMailDigestEntry(ctx, &MailDigestEntry{
+			UserId:       userId,
+			GameID:       gameID,
+			PhaseOrdinal: phaseOrdinal,
+			Host:         host,
+			Scheme:       scheme,
+		})
 	}
 
 	unsubscribeURL, err := auth.GetUnsubscribeURL(ctx, router, host, scheme, userId)
@@ -220,19 +240,33 @@ func sendPhaseNotificationsToMail(ctx context.Context, host, scheme string, game
 
 	msgContext.mailData["unsubscribeURL"] = unsubscribeURL.String()
 
+	previousOrders := ""
+	// The notification is sent with the phase that just resolved, so its orders are the orders of the previous
+	// phase. When the game starts the phase is unresolved, and there are no previous orders.
+	if msgContext.phase.Resolved {
+		notations, err := msgContext.phase.orderNotations(ctx)
+		if err != nil {
+			log.Errorf(ctx, "Unable to load orders of previous phase %v: %v; hope datastore gets fixed", msgContext.phaseID, err)
+			return err
+		}
+		msgContext.mailData["previousOrders"] = notations
+		if len(notations) > 0 {
+			previousOrders = msgContext.localizer.Sprintf("Orders of the previous phase:\n\n%s\n\n", strings.Join(notations, "\n"))
+		}
+	}
+
 	msg := sendgrid.NewMail()
-	msg.SetText(fmt.Sprintf(
-		"%s has a new phase: %s.\n\nVisit %s to stop receiving email like this.",
+	msg.SetText(msgContext.localizer.Sprintf(
+		"%s has a new phase: %s.\n\n%sReply to this email with orders, one per line, like \"A PAR - BUR\" or \"F NTH C A LON - NWY\". Add a line with READY to mark yourself ready to resolve the phase, or DIAS to vote for a draw including all surviving players.\n\nVisit %s to stop receiving email like this.",
 		msgContext.game.Desc,
 		msgContext.mapURL.String(),
+		previousOrders,
 		unsubscribeURL.String()))
 	msg.SetSubject(
 		fmt.Sprintf(
-			"%s: %s %d, %s",
+			"%s: %s",
 			msgContext.game.DescFor(msgContext.member.Nation),
-			msgContext.phase.Season,
-			msgContext.phase.Year,
-			msgContext.phase.Type,
+			phaseName(msgContext.localizer, &msgContext.phase.PhaseMeta),
 		),
 	)
 	msg.AddHeader("List-Unsubscribe", fmt.Sprintf("<%s>", unsubscribeURL.String()))
@@ -247,12 +281,29 @@ func sendPhaseNotificationsToMail(ctx context.Context, host, scheme string, game
 	msg.AddRecipient(recipEmail)
 	msg.AddToName(string(msgContext.member.Nation))
 
-	msg.SetFrom(noreplyFromAddr)
+	// Replies give orders for the new phase, not for the phase that just resolved.
+	replyToID, err := newestPhaseID(ctx, msgContext.game)
+	if err != nil {
+		log.Errorf(ctx, "Unable to find the newest phase of %v: %v; fix newestPhaseID", gameID, err)
+		return err
+	}
+	fromToken, err := auth.EncodeString(ctx, fmt.Sprintf("%s,%s", msgContext.member.Nation, replyToID.Encode()))
+	if err != nil {
+		log.Errorf(ctx, "Unable to create auth token for reply address: %v; fix EncodeString or hope datastore gets fixed", err)
+		return err
+	}
+
+	fromAddress := fmt.Sprintf(fromAddressPattern, fromToken)
+	fromEmail, err := mail.ParseAddress(fromAddress)
+	if err != nil {
+		log.Errorf(ctx, "Unable to parse reply email address %q: %v; fix the address generation", fromAddress, err)
+		return err
+	}
+	msg.SetFromEmail(fromEmail)
+	msg.SetFromName(msgContext.game.Desc)
 
-	client := sendgrid.NewSendGridClientWithApiKey(sendGridConf.APIKey)
-	client.Client = urlfetch.Client(ctx)
-	if err := client.Send(msg); err != nil {
-		log.Errorf(ctx, "Unable to send %v: %v; hope sendgrid gets fixed", msg, err)
+	if err := MailTransport.Send(ctx, &Notification{UserId: userId, Type: PhaseNotification, GameID: gameID, Mail: msg}); err != nil {
+		log.Errorf(ctx, "Unable to send %v: %v; hope the mail transport gets fixed", msg, err)
 		return err
 	}
 	log.Infof(ctx, "Successfully sent %v", PP(msg))
@@ -280,45 +331,39 @@ func sendPhaseNotificationsToFCM(ctx context.Context, host, scheme string, gameI
 		return err
 	}
 
-	for _, fcmToken := range msgContext.userConfig.FCMTokens {
-		if fcmToken.Disabled {
-			continue
-		}
-		if _, done := finishedTokens[fcmToken.Value]; done {
+	destinations := pushDestinations(msgContext.userConfig)
+	for _, destination := range destinations {
+		if _, done := finishedTokens[destination.Value]; done {
 			continue
 		}
-		finishedTokens[fcmToken.Value] = struct{}{}
+		finishedTokens[destination.Value] = struct{}{}
 		notificationPayload := &fcm.NotificationPayload{
 			Title: fmt.Sprintf(
-				"%s: %s %d, %s",
+				"%s: %s",
 				msgContext.game.DescFor(msgContext.member.Nation),
-				msgContext.phase.Season,
-				msgContext.phase.Year,
-				msgContext.phase.Type,
+				phaseName(msgContext.localizer, &msgContext.phase.PhaseMeta),
 			),
-			Body:        fmt.Sprintf("%s has a new phase.", msgContext.game.Desc),
+			Body:        msgContext.localizer.Sprintf("%s has a new phase.", msgContext.game.Desc),
 			Tag:         "diplicity-engine-new-phase",
 			ClickAction: msgContext.mapURL.String(),
 		}
 
-		fcmToken.PhaseConfig.Customize(ctx, notificationPayload, msgContext.mailData)
+		destination.PhaseConfig.Customize(ctx, notificationPayload, msgContext.mailData)
 
 		if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
-			if err := FCMSendToTokensFunc.EnqueueIn(
-				ctx,
-				0,
-				time.Duration(0),
-				notificationPayload,
-				dataPayload,
-				map[string][]string{
-					userId: []string{fcmToken.Value},
-				},
-			); err != nil {
-				log.Errorf(ctx, "Unable to enqueue actual sending of notification to %v/%v: %v; fix FCMSendToUsers or hope datastore gets fixed", userId, fcmToken.Value, err)
+			if err := destination.Transport.Send(ctx, &Notification{
+				UserId:  userId,
+				To:      destination.Value,
+				Type:    PhaseNotification,
+				GameID:  gameID,
+				Payload: notificationPayload,
+				Data:    dataPayload,
+			}); err != nil {
+				log.Errorf(ctx, "Unable to enqueue actual sending of notification to %v/%v: %v; fix the transport or hope datastore gets fixed", userId, destination.Value, err)
 				return err
 			}
 
-			if len(msgContext.userConfig.FCMTokens) > len(finishedTokens) {
+			if len(destinations) > len(finishedTokens) {
 				if err := sendPhaseNotificationsToFCMFunc.EnqueueIn(ctx, 0, host, scheme, gameID, phaseOrdinal, userId, finishedTokens); err != nil {
 					log.Errorf(ctx, "Unable to enqueue sending of rest of notifications: %v; hope datastore gets fixed", err)
 					return err
@@ -343,12 +388,39 @@ func sendPhaseNotificationsToUsers(ctx context.Context, host, scheme string, gam
 	log.Infof(ctx, "sendPhaseNotificationsToUsers(..., %q, %q, %v, %v, %+v)", host, scheme, gameID, phaseOrdinal, uids)
 
 	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
-		if err := sendPhaseNotificationsToFCMFunc.EnqueueIn(ctx, 0, host, scheme, gameID, phaseOrdinal, uids[0], map[string]struct{}{}); err != nil {
-			log.Errorf(ctx, "Unable to enqueue sending to %q: %v; hope datastore gets fixed", uids[0], err)
+		game := &Game{}
+		if err := datastore.Get(ctx, gameID, game); err != nil {
+			log.Errorf(ctx, "Unable to load game %v: %v; hope datastore gets fixed", gameID, err)
 			return err
 		}
-		if err := sendPhaseNotificationsToMailFunc.EnqueueIn(ctx, 0, host, scheme, gameID, phaseOrdinal, uids[0]); err != nil {
-			log.Errorf(ctx, "Unable to enqueue sending mail to %q: %v; hope datastore gets fixed", uids[0], err)
+		wantsNotifications := true
+		if member, isMember := game.GetMemberByUserId(uids[0]); isMember {
+			gameState, err := loadGameStateOrDefault(ctx, gameID, member.Nation)
+			if err != nil {
+				log.Errorf(ctx, "Unable to load game state for %v in %v: %v; hope datastore gets fixed", member.Nation, gameID, err)
+				return err
+			}
+			wantsNotifications = gameState.WantsPhaseNotifications()
+		}
+
+		if wantsNotifications {
+			if err := sendPhaseNotificationsToFCMFunc.EnqueueIn(ctx, 0, host, scheme, gameID, phaseOrdinal, uids[0], map[string]struct{}{}); err != nil {
+				log.Errorf(ctx, "Unable to enqueue sending to %q: %v; hope datastore gets fixed", uids[0], err)
+				return err
+			}
+			if err := sendPhaseNotificationsToMailFunc.EnqueueIn(ctx, 0, host, scheme, gameID, phaseOrdinal, uids[0]); err != nil {
+				log.Errorf(ctx, "Unable to enqueue sending mail to %q: %v; hope datastore gets fixed", uids[0], err)
+				return err
+			}
+		} else {
+			log.Infof(ctx, "%q doesn't want phase notifications for %v, will skip FCM and mail", uids[0], gameID)
+		}
+		if err := triggerWebhooks(ctx, webhookTrigger{GameID: gameID, UserIds: []string{uids[0]}, PhaseOrdinal: phaseOrdinal}); err != nil {
+			log.Errorf(ctx, "Unable to enqueue sending webhooks to %q: %v; hope datastore gets fixed", uids[0], err)
+			return err
+		}
+		if err := scheduleDeadlineRemindersFunc.EnqueueIn(ctx, 0, host, scheme, gameID, phaseOrdinal, uids[0]); err != nil {
+			log.Errorf(ctx, "Unable to enqueue scheduling deadline reminders to %q: %v; hope datastore gets fixed", uids[0], err)
 			return err
 		}
 		if len(uids) > 1 {
@@ -391,6 +463,10 @@ func resolvePhaseHelper(ctx context.Context, gameID *datastore.Key, phaseOrdinal
 		keys := []*datastore.Key{gameID, phaseID}
 		values := []interface{}{game, phase}
 		if err := datastore.GetMulti(ctx, keys, values); err != nil {
+			if merr, ok := err.(appengine.MultiError); ok && merr[0] == nil && merr[1] == datastore.ErrNoSuchEntity {
+				log.Infof(ctx, "Phase %v not found, probably due to a rollback; skipping resolution", phaseID)
+				return nil
+			}
 			log.Errorf(ctx, "datastore.GetMulti(..., %v, %v): %v; hope datastore will get fixed", keys, values, err)
 			return err
 		}
@@ -415,6 +491,16 @@ func resolvePhaseHelper(ctx context.Context, gameID *datastore.Key, phaseOrdinal
 		return err
 	}
 
+	// Outside of the transaction, since Act already enqueues as many transactional tasks as allowed.
+	if err := pruneGameEventsFunc.EnqueueIn(ctx, 0, gameID); err != nil {
+		log.Errorf(ctx, "Unable to enqueue pruning of game events: %v; hope datastore gets fixed", err)
+		return err
+	}
+	if err := deliverPhasePendingMessagesFunc.EnqueueIn(ctx, 0, gameID, phaseOrdinal); err != nil {
+		log.Errorf(ctx, "Unable to enqueue delivery of pending messages: %v; hope datastore gets fixed", err)
+		return err
+	}
+
 	log.Infof(ctx, "timeoutResolvePhase(..., %v, %v): *** SUCCESS ***", gameID, phaseOrdinal)
 
 	return nil
@@ -702,6 +788,11 @@ func (p *PhaseResolver) Act() error {
 	}
 	p.Game.NewestPhaseMeta = []PhaseMeta{newPhase.PhaseMeta}
 
+	if err := publishGameEvent(p.Context, p.Game.ID, phaseEventType, nil, "", newPhase.PhaseMeta); err != nil {
+		log.Errorf(p.Context, "Unable to publish new phase event: %v; hope datastore will get fixed", err)
+		return err
+	}
+
 	if p.Game.Finished {
 
 		// Store a game result if it is finished.
@@ -1141,6 +1232,11 @@ func (p *Phase) Item(r Request) *Item {
 			Rel:         "map",
 			Route:       RenderPhaseMapRoute,
 			RouteParams: []string{"game_id", p.GameID.Encode(), "phase_ordinal", fmt.Sprint(p.PhaseOrdinal)},
+		})).
+		AddLink(r.NewLink(Link{
+			Rel:         "order-notation",
+			Route:       OrderNotationRoute,
+			RouteParams: []string{"game_id", p.GameID.Encode(), "phase_ordinal", fmt.Sprint(p.PhaseOrdinal)},
 		}))
 	_, isMember := r.Values()[memberNationFlag]
 	if isMember || p.Resolved {
@@ -1167,6 +1263,7 @@ func (p *Phase) Item(r Request) *Item {
 	}
 	if p.Resolved {
 		phaseItem.AddLink(r.NewLink(PhaseResultResource.Link("phase-result", Load, []string{"game_id", p.GameID.Encode(), "phase_ordinal", fmt.Sprint(p.PhaseOrdinal)})))
+		phaseItem.AddLink(r.NewLink(PhaseReportResource.Link("phase-report", Load, []string{"game_id", p.GameID.Encode(), "phase_ordinal", fmt.Sprint(p.PhaseOrdinal)})))
 	}
 	return phaseItem
 }
@@ -0,0 +1,402 @@
+package game
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+var PhaseReportResource = &Resource{
+	Load:     loadPhaseReport,
+	FullPath: "/Game/{game_id}/Phase/{phase_ordinal}/Report",
+}
+
+var camelCaseReg = regexp.MustCompile("([a-z])([A-Z])")
+
+type PhaseReportOrder struct {
+	Nation   godip.Nation
+	Parts    []string
+	Notation string
+	Success  bool
+	Result   string
+}
+
+type PhaseReportUnit struct {
+	Nation   godip.Nation
+	Province godip.Province
+	Unit     string
+	Note     string
+}
+
+type PhaseReportSCChange struct {
+	Province godip.Province
+	From     godip.Nation
+	To       godip.Nation
+}
+
+type PhaseReport struct {
+	GameID       *datastore.Key
+	PhaseOrdinal int64
+	Season       godip.Season
+	Year         int
+	Type         godip.PhaseType
+	Orders       []PhaseReportOrder
+	Dislodgeds   []PhaseReportUnit
+	Builds       []PhaseReportUnit
+	Disbands     []PhaseReportUnit
+	SCChanges    []PhaseReportSCChange
+	Text         string
+}
+
+func (p *PhaseReport) Item(r Request) *Item {
+	return NewItem(p).SetName("phase-report").
+		AddLink(r.NewLink(PhaseReportResource.Link("self", Load, []string{"game_id", p.GameID.Encode(), "phase_ordinal", fmt.Sprint(p.PhaseOrdinal)}))).
+		AddLink(r.NewLink(Link{
+			Rel:         "text",
+			Route:       RenderPhaseReportTextRoute,
+			RouteParams: []string{"game_id", p.GameID.Encode(), "phase_ordinal", fmt.Sprint(p.PhaseOrdinal)},
+		})).
+		SetDesc([][]string{
+			[]string{
+				"Phase report",
+				"A phase report describes the outcome of a resolved phase: each order with whether it succeeded and why not, units dislodged, units built or disbanded, and supply centers changing owner.",
+				"`Text` contains the same report as plain text, also available via the `text` link.",
+			},
+		})
+}
+
+// humanizeResolution turns a godip error, e.g. "ErrIllegalSupportDestination", into "illegal support destination".
+func humanizeResolution(name string) string {
+	return strings.ToLower(camelCaseReg.ReplaceAllString(strings.TrimPrefix(name, "Err"), "$1 $2"))
+}
+
+func describeResolution(resolution string, units map[godip.Province]godip.Unit) string {
+	split := strings.SplitN(resolution, ":", 2)
+	if len(split) == 1 {
+		return humanizeResolution(split[0])
+	}
+	prov := godip.Province(split[1])
+	switch split[0] {
+	case "ErrBounce":
+		if _, found := units[prov]; found {
+			return fmt.Sprintf("bounced with %s", notationUnit(units, split[1]))
+		}
+		return fmt.Sprintf("bounced in %s", notationProvince(split[1]))
+	case "ErrSupportBroken":
+		return fmt.Sprintf("support cut by %s", notationUnit(units, split[1]))
+	case "ErrConvoyDislodged":
+		return fmt.Sprintf("convoying %s dislodged", notationUnit(units, split[1]))
+	}
+	return fmt.Sprintf("%s (%s)", humanizeResolution(split[0]), strings.ToUpper(split[1]))
+}
+
+// NewPhaseReport creates a report of the resolution of phase, using the orders given for it and the phase created
+// by the resolution.
+func NewPhaseReport(phase *Phase, orderMap map[godip.Nation]map[godip.Province][]string, nextPhase *Phase) *PhaseReport {
+	report := &PhaseReport{
+		GameID:       phase.GameID,
+		PhaseOrdinal: phase.PhaseOrdinal,
+		Season:       phase.Season,
+		Year:         phase.Year,
+		Type:         phase.Type,
+	}
+	units := phase.unitMap()
+	resolutions := map[godip.Province]string{}
+	for _, resolution := range phase.Resolutions {
+		resolutions[resolution.Province] = resolution.Resolution
+	}
+
+	ordered := map[godip.Province]bool{}
+	for nation, nationOrders := range orderMap {
+		for prov, parts := range nationOrders {
+			ordered[prov.Super()] = true
+			order := PhaseReportOrder{
+				Nation:   nation,
+				Parts:    append([]string{string(prov)}, parts...),
+				Notation: FormatOrderNotation(append([]string{string(prov)}, parts...), units),
+			}
+			resolution, found := resolutions[prov]
+			if !found {
+				resolution, found = resolutions[prov.Super()]
+			}
+			if !found || resolution == "OK" {
+				order.Success = true
+				order.Result = "succeeded"
+			} else {
+				order.Result = describeResolution(resolution, units)
+			}
+			report.Orders = append(report.Orders, order)
+		}
+	}
+	if phase.Type == godip.Movement {
+		for _, unit := range phase.Units {
+			if !ordered[unit.Province.Super()] {
+				report.Orders = append(report.Orders, PhaseReportOrder{
+					Nation:   unit.Unit.Nation,
+					Parts:    []string{string(unit.Province), string(godip.Hold)},
+					Notation: FormatOrderNotation([]string{string(unit.Province), string(godip.Hold)}, units),
+					Success:  true,
+					Result:   "no order given",
+				})
+			}
+		}
+	}
+	sort.Slice(report.Orders, func(i, j int) bool {
+		if report.Orders[i].Nation != report.Orders[j].Nation {
+			return report.Orders[i].Nation < report.Orders[j].Nation
+		}
+		return report.Orders[i].Notation < report.Orders[j].Notation
+	})
+
+	if nextPhase != nil {
+		for _, dislodged := range nextPhase.Dislodgeds {
+			unit := PhaseReportUnit{
+				Nation:   dislodged.Dislodged.Nation,
+				Province: dislodged.Province,
+				Unit:     fmt.Sprintf("%s %s", string(dislodged.Dislodged.Type)[:1], notationProvince(string(dislodged.Province))),
+			}
+			for _, dislodger := range nextPhase.Dislodgers {
+				if dislodger.Dislodger.Super() == dislodged.Province.Super() {
+					unit.Note = fmt.Sprintf("dislodged by %s", notationUnit(units, string(dislodger.Province)))
+				}
+			}
+			report.Dislodgeds = append(report.Dislodgeds, unit)
+		}
+
+		nextUnits := nextPhase.unitMap()
+		switch phase.Type {
+		case godip.Retreat:
+			for _, dislodged := range phase.Dislodgeds {
+				if resolutions[dislodged.Province] != "OK" || !ordered[dislodged.Province.Super()] {
+					report.Disbands = append(report.Disbands, PhaseReportUnit{
+						Nation:   dislodged.Dislodged.Nation,
+						Province: dislodged.Province,
+						Unit:     notationUnit(units, string(dislodged.Province)),
+						Note:     "failed to retreat",
+					})
+				}
+			}
+		case godip.Adjustment:
+			for _, unit := range phase.Units {
+				if next, found := nextUnits[unit.Province]; !found || next != unit.Unit {
+					report.Disbands = append(report.Disbands, PhaseReportUnit{
+						Nation:   unit.Unit.Nation,
+						Province: unit.Province,
+						Unit:     notationUnit(units, string(unit.Province)),
+					})
+				}
+			}
+			for _, unit := range nextPhase.Units {
+				if prev, found := units[unit.Province]; !found || prev != unit.Unit {
+					report.Builds = append(report.Builds, PhaseReportUnit{
+						Nation:   unit.Unit.Nation,
+						Province: unit.Province,
+						Unit:     notationUnit(nextUnits, string(unit.Province)),
+					})
+				}
+			}
+		}
+
+		owners := map[godip.Province]godip.Nation{}
+		for _, sc := range phase.SCs {
+			owners[sc.Province] = sc.Owner
+		}
+		for _, sc := range nextPhase.SCs {
+			if owners[sc.Province] != sc.Owner {
+				report.SCChanges = append(report.SCChanges, PhaseReportSCChange{
+					Province: sc.Province,
+					From:     owners[sc.Province],
+					To:       sc.Owner,
+				})
+			}
+			delete(owners, sc.Province)
+		}
+		for prov, owner := range owners {
+			if owner != "" {
+				report.SCChanges = append(report.SCChanges, PhaseReportSCChange{
+					Province: prov,
+					From:     owner,
+				})
+			}
+		}
+	}
+	for _, units := range [][]PhaseReportUnit{report.Dislodgeds, report.Builds, report.Disbands} {
+		sort.Slice(units, func(i, j int) bool {
+			if units[i].Nation != units[j].Nation {
+				return units[i].Nation < units[j].Nation
+			}
+			return units[i].Province < units[j].Province
+		})
+	}
+	sort.Slice(report.SCChanges, func(i, j int) bool {
+		return report.SCChanges[i].Province < report.SCChanges[j].Province
+	})
+
+	report.Text = report.format(reportTextFormat)
+	return report
+}
+
+type reportFormat struct {
+	heading func(string) string
+	start   string
+	item    func(string) string
+	end     string
+}
+
+var (
+	reportTextFormat = reportFormat{
+		heading: func(s string) string { return fmt.Sprintf("\n%s:\n", s) },
+		item:    func(s string) string { return fmt.Sprintf("  %s\n", s) },
+	}
+	reportMarkdownFormat = reportFormat{
+		heading: func(s string) string { return fmt.Sprintf("\n\n**%s**\n", s) },
+		item:    func(s string) string { return fmt.Sprintf("\n* %s", s) },
+	}
+	reportHtmlFormat = reportFormat{
+		heading: func(s string) string { return fmt.Sprintf("<p><b>%s</b></p>", s) },
+		start:   "<ul>",
+		item:    func(s string) string { return fmt.Sprintf("<li>%s</li>", s) },
+		end:     "</ul>",
+	}
+)
+
+func (p *PhaseReport) format(f reportFormat) string {
+	result := ""
+	section := func(heading string, items []string) {
+		if len(items) == 0 {
+			return
+		}
+		result += f.heading(heading) + f.start
+		for _, item := range items {
+			result += f.item(item)
+		}
+		result += f.end
+	}
+
+	nationOrders := map[godip.Nation][]string{}
+	nations := []godip.Nation{}
+	for _, order := range p.Orders {
+		if _, found := nationOrders[order.Nation]; !found {
+			nations = append(nations, order.Nation)
+		}
+		if order.Success {
+			nationOrders[order.Nation] = append(nationOrders[order.Nation], fmt.Sprintf("%s: %s", order.Notation, order.Result))
+		} else {
+			nationOrders[order.Nation] = append(nationOrders[order.Nation], fmt.Sprintf("%s: failed, %s", order.Notation, order.Result))
+		}
+	}
+	for _, nation := range nations {
+		section(string(nation), nationOrders[nation])
+	}
+
+	units := func(units []PhaseReportUnit) []string {
+		result := []string{}
+		for _, unit := range units {
+			line := fmt.Sprintf("%s %s", unit.Nation, unit.Unit)
+			if unit.Note != "" {
+				line += fmt.Sprintf(" %s", unit.Note)
+			}
+			result = append(result, line)
+		}
+		return result
+	}
+	section("Dislodged", units(p.Dislodgeds))
+	section("Built", units(p.Builds))
+	section("Disbanded", units(p.Disbands))
+
+	scChanges := []string{}
+	for _, change := range p.SCChanges {
+		from, to := string(change.From), string(change.To)
+		if from == "" {
+			from = "Neutral"
+		}
+		if to == "" {
+			to = "Neutral"
+		}
+		scChanges = append(scChanges, fmt.Sprintf("%s: %s -> %s", notationProvince(string(change.Province)), from, to))
+	}
+	section("Supply centers", scChanges)
+
+	return result
+}
+
+func (p *PhaseReport) String() string {
+	return fmt.Sprintf("%s %d, %s\n%s", p.Season, p.Year, p.Type, p.Text)
+}
+
+func loadPhaseReport(w ResponseWriter, r Request) (*PhaseReport, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	if _, ok := r.Values()["user"].(*auth.User); !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return nil, err
+	}
+
+	phaseOrdinal, err := strconv.ParseInt(r.Vars()["phase_ordinal"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
+	if err != nil {
+		return nil, err
+	}
+
+	phase := &Phase{}
+	if err := datastore.Get(ctx, phaseID, phase); err != nil {
+		return nil, err
+	}
+	if !phase.Resolved {
+		return nil, HTTPErr{"can only report resolved phases", http.StatusPreconditionFailed}
+	}
+
+	return phase.Report(ctx)
+}
+
+// Report loads the orders and the following phase, and creates a phase report.
+// If the following phase doesn't exist (i.e. the game ended), the report will only contain the orders.
+func (p *Phase) Report(ctx context.Context) (*PhaseReport, error) {
+	orderMap, err := p.Orders(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	nextPhaseID, err := PhaseID(ctx, p.GameID, p.PhaseOrdinal+1)
+	if err != nil {
+		return nil, err
+	}
+
+	nextPhase := &Phase{}
+	if err := datastore.Get(ctx, nextPhaseID, nextPhase); err == datastore.ErrNoSuchEntity {
+		nextPhase = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return NewPhaseReport(p, orderMap, nextPhase), nil
+}
+
+func renderPhaseReportText(w ResponseWriter, r Request) error {
+	report, err := loadPhaseReport(w, r)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = w.Write([]byte(report.String()))
+	return err
+}
@@ -136,15 +136,22 @@ func updatePhaseState(w ResponseWriter, r Request) (*PhaseState, error) {
 
 	nation := godip.Nation(r.Vars()["nation"])
 
-	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
+	bodyBytes, err := ioutil.ReadAll(r.Req().Body)
 	if err != nil {
 		return nil, err
 	}
 
-	bodyBytes, err := ioutil.ReadAll(r.Req().Body)
+	return updatePhaseStateHelper(ctx, gameID, phaseOrdinal, user.Id, nation, func(phaseState *PhaseState) error {
+		return CopyBytes(phaseState, r, bodyBytes, "PUT")
+	})
+}
+
+func updatePhaseStateHelper(ctx context.Context, gameID *datastore.Key, phaseOrdinal int64, userId string, nation godip.Nation, mutate func(*PhaseState) error) (*PhaseState, error) {
+	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
 	if err != nil {
 		return nil, err
 	}
+
 	phaseState := &PhaseState{}
 	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
 		game := &Game{}
@@ -153,7 +160,7 @@ func updatePhaseState(w ResponseWriter, r Request) (*PhaseState, error) {
 			return err
 		}
 		game.ID = gameID
-		member, isMember := game.GetMemberByUserId(user.Id)
+		member, isMember := game.GetMemberByUserId(userId)
 		if !isMember {
 			return HTTPErr{"can only update phase state of member games", http.StatusNotFound}
 		}
@@ -174,8 +181,7 @@ func updatePhaseState(w ResponseWriter, r Request) (*PhaseState, error) {
 			return err
 		}
 
-		err = CopyBytes(phaseState, r, bodyBytes, "PUT")
-		if err != nil {
+		if err := mutate(phaseState); err != nil {
 			return err
 		}
 		if phaseState.NoOrders {
@@ -194,6 +200,12 @@ func updatePhaseState(w ResponseWriter, r Request) (*PhaseState, error) {
 			return err
 		}
 
+		eventPhaseState := *phaseState
+		eventPhaseState.ZippedOptions = nil
+		if err := publishGameEvent(ctx, gameID, phaseStateEventType, Nations{member.Nation}, member.Nation, eventPhaseState); err != nil {
+			return err
+		}
+
 		if phaseState.ReadyToResolve {
 			allStates := []PhaseState{}
 			if _, err := datastore.NewQuery(phaseStateKind).Ancestor(phaseID).GetAll(ctx, &allStates); err != nil {
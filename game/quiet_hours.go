@@ -0,0 +1,353 @@
+package game
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/go-fcm"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"gopkg.in/sendgrid/sendgrid-go.v2"
+)
+
+const (
+	heldNotificationKind  = "HeldNotification"
+	quietHoursReleaseKind = "QuietHoursRelease"
+
+	// Deadline reminders that would be sent during quiet hours are sent this long before the quiet hours start,
+	// to leave room for task queue delays.
+	quietHoursReminderLead = 5 * time.Minute
+)
+
+var (
+	sendHeldMailFunc          *DelayFunc
+	sendHeldNotificationsFunc *DelayFunc
+)
+
+func init() {
+	sendHeldMailFunc = NewDelayFunc("game-sendHeldMail", sendHeldMail)
+	sendHeldNotificationsFunc = NewDelayFunc("game-sendHeldNotifications", sendHeldNotifications)
+}
+
+// HeldNotification is a notification held during the quiet hours of a user. Held notifications are children of
+// the user, and are delivered together per transport when the quiet hours end.
+type HeldNotification struct {
+	UserId      string
+	Transport   string
+	Type        string
+	GameID      *datastore.Key
+	Destination string `datastore:",noindex"`
+	// Args is the JSON encoded heldNotificationArgs.
+	Args   []byte `datastore:",noindex"`
+	HeldAt time.Time
+}
+
+// heldNotificationArgs are what the transport needs to deliver a held notification.
+type heldNotificationArgs struct {
+	Tokens   []string                 `json:",omitempty"`
+	Endpoint string                   `json:",omitempty"`
+	Payload  *fcm.NotificationPayload `json:",omitempty"`
+	Data     *FCMData                 `json:",omitempty"`
+	Mail     *sendgrid.SGMail         `json:",omitempty"`
+}
+
+// QuietHoursRelease is when the notifications held using a transport, which is the key name, get delivered to
+// the user that is its parent.
+type QuietHoursRelease struct {
+	At time.Time
+}
+
+// loadQuietHours returns the quiet hours of the user, which are disabled if the user has no configuration.
+func loadQuietHours(ctx context.Context, userId string) (*auth.QuietHours, error) {
+	userConfig := &auth.UserConfig{}
+	if err := datastore.Get(ctx, auth.UserConfigID(ctx, auth.UserID(ctx, userId)), userConfig); err != nil && err != datastore.ErrNoSuchEntity {
+		log.Errorf(ctx, "Unable to load user config of %q: %v; hope datastore gets fixed", userId, err)
+		return nil, err
+	}
+	return &userConfig.QuietHours, nil
+}
+
+// heldNotificationKey returns the key of the held notification, derived from its content to make retried
+// notifications idempotent.
+func heldNotificationKey(ctx context.Context, userId string, logEntry NotificationLogEntry, args []byte) *datastore.Key {
+	gameID := ""
+	if logEntry.GameID != nil {
+		gameID = logEntry.GameID.Encode()
+	}
+	hash := sha256.Sum256([]byte(strings.Join([]string{logEntry.Transport, logEntry.Type, gameID, logEntry.Destination, string(args)}, "\x00")))
+	return datastore.NewKey(ctx, heldNotificationKind, hex.EncodeToString(hash[:]), 0, auth.UserID(ctx, userId))
+}
+
+// scheduleHeldNotifications makes sure held notifications using the transport are delivered to the user at end.
+// It must run in a transaction in the entity group of the user.
+func scheduleHeldNotifications(ctx context.Context, userId, transport string, end time.Time) error {
+	releaseID := datastore.NewKey(ctx, quietHoursReleaseKind, transport, 0, auth.UserID(ctx, userId))
+	release := &QuietHoursRelease{}
+	if err := datastore.Get(ctx, releaseID, release); err == nil && release.At.Equal(end) {
+		return nil
+	} else if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	release.At = end
+	if _, err := datastore.Put(ctx, releaseID, release); err != nil {
+		return err
+	}
+	return sendHeldNotificationsFunc.EnqueueAt(ctx, end, userId, transport)
+}
+
+// holdForQuietHours stores the notification to be delivered, together with anything else held using the same
+// transport, at the end of the current quiet hours of the user, and logs the notification as held. It returns
+// whether the notification was held, i.e. whether the caller should skip delivering it now.
+func holdForQuietHours(ctx context.Context, userId string, quietHours *auth.QuietHours, logEntry NotificationLogEntry, args *heldNotificationArgs) (bool, error) {
+	_, end := quietHours.Window(time.Now())
+	if end.IsZero() {
+		return false, nil
+	}
+	argBytes, err := json.Marshal(args)
+	if err != nil {
+		log.Errorf(ctx, "Unable to marshal %v: %v; fix heldNotificationArgs", PP(args), err)
+		return false, err
+	}
+	heldID := heldNotificationKey(ctx, userId, logEntry, argBytes)
+	alreadyHeld := false
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, heldID, &HeldNotification{}); err == nil {
+			alreadyHeld = true
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if _, err := datastore.Put(ctx, heldID, &HeldNotification{
+			UserId:      userId,
+			Transport:   logEntry.Transport,
+			Type:        logEntry.Type,
+			GameID:      logEntry.GameID,
+			Destination: logEntry.Destination,
+			Args:        argBytes,
+			HeldAt:      time.Now(),
+		}); err != nil {
+			return err
+		}
+		return scheduleHeldNotifications(ctx, userId, logEntry.Transport, end)
+	}, nil); err != nil {
+		log.Errorf(ctx, "Unable to hold %v notification to %q until %v: %v; hope datastore gets fixed", logEntry.Type, userId, end, err)
+		return false, err
+	}
+	if alreadyHeld {
+		log.Infof(ctx, "%v notification to %q is already held, skipping", logEntry.Type, logEntry.Destination)
+		return true, nil
+	}
+	log.Infof(ctx, "%q has quiet hours until %v, holding %v notification to %q", userId, end, logEntry.Type, logEntry.Destination)
+	logEntry.UserId = userId
+	logEntry.Status = NotificationHeld
+	logNotifications(ctx, logEntry)
+	return true, nil
+}
+
+// deadlineReminderAt returns when to send the reminder minutes before the deadline, moved to just before the quiet
+// hours if it would be sent during them.
+func deadlineReminderAt(deadline time.Time, minutes int, quietHours *auth.QuietHours) time.Time {
+	at := deadline.Add(-time.Duration(minutes) * time.Minute)
+	if start, _ := quietHours.Window(at); !start.IsZero() {
+		return start.Add(-quietHoursReminderLead)
+	}
+	return at
+}
+
+func sendHeldMail(ctx context.Context, userId string, notifType string, gameID *datastore.Key, msg *sendgrid.SGMail) error {
+	log.Infof(ctx, "sendHeldMail(..., %q, %q, %v, %v)", userId, notifType, gameID, PP(msg))
+
+	if err := MailTransport.Send(ctx, &Notification{UserId: userId, Type: notifType, GameID: gameID, Mail: msg}); err != nil {
+		log.Errorf(ctx, "Unable to send %v: %v; hope the mail transport gets fixed", PP(msg), err)
+		return err
+	}
+
+	log.Infof(ctx, "sendHeldMail(..., %q, %q, %v, %v) *** SUCCESS ***", userId, notifType, gameID, PP(msg))
+
+	return nil
+}
+
+// heldSummary returns a push summarizing the held pushes, which are sorted oldest first, and opening the latest one.
+func heldSummary(localizer *auth.Localizer, held []heldNotificationArgs) *heldNotificationArgs {
+	latest := held[len(held)-1]
+	titles := []string{}
+	for _, args := range held {
+		if args.Payload != nil && args.Payload.Title != "" {
+			titles = append(titles, args.Payload.Title)
+		}
+	}
+	summary := &heldNotificationArgs{
+		Tokens:   latest.Tokens,
+		Endpoint: latest.Endpoint,
+		Payload: &fcm.NotificationPayload{
+			Title: localizer.Sprintf("%d notifications during your quiet hours", len(held)),
+			Body:  strings.Join(titles, "\n"),
+			Tag:   "diplicity-engine-quiet-hours",
+		},
+		Data: latest.Data,
+	}
+	if latest.Payload != nil {
+		summary.Payload.ClickAction = latest.Payload.ClickAction
+	}
+	return summary
+}
+
+// heldMailSummary returns a mail containing the held mails, which are sorted oldest first.
+func heldMailSummary(localizer *auth.Localizer, held []heldNotificationArgs) (*sendgrid.SGMail, error) {
+	latest := held[len(held)-1].Mail
+	buf := &bytes.Buffer{}
+	for _, args := range held {
+		fmt.Fprintf(buf, "=== %s ===\n\n%s\n\n", args.Mail.Subject, args.Mail.Text)
+	}
+	msg := sendgrid.NewMail()
+	msg.SetText(buf.String())
+	msg.SetSubject(localizer.Sprintf("%d mails during your quiet hours", len(held)))
+	msg.To = latest.To
+	msg.ToName = latest.ToName
+	if unsubscribe, found := latest.Headers["List-Unsubscribe"]; found {
+		msg.AddHeader("List-Unsubscribe", unsubscribe)
+	}
+	if err := msg.SetFrom(noreplyFromAddr); err != nil {
+		return nil, err
+	}
+	msg.SetFromName("Diplicity")
+	return msg, nil
+}
+
+// deliverHeld enqueues delivering the notifications held using the transport to the same destination, which are
+// sorted oldest first. A single notification is delivered as is, and several are summarized in one.
+func deliverHeld(ctx context.Context, localizer *auth.Localizer, userId, transport string, held []HeldNotification) error {
+	heldArgs := make([]heldNotificationArgs, len(held))
+	for i := range held {
+		if err := json.Unmarshal(held[i].Args, &heldArgs[i]); err != nil {
+			return err
+		}
+	}
+	args, notifType, gameID := &heldArgs[0], held[0].Type, held[0].GameID
+	if len(held) > 1 {
+		args, notifType, gameID = heldSummary(localizer, heldArgs), QuietHoursSummaryNotification, nil
+	}
+	switch transport {
+	case FCMNotificationTransport:
+		return FCMSendToTokensFunc.EnqueueIn(ctx, 0, time.Duration(0), args.Payload, args.Data, map[string][]string{userId: args.Tokens}, notifType, gameID)
+	case WebPushNotificationTransport:
+		return webPushSendFunc.EnqueueIn(ctx, 0, userId, args.Endpoint, args.Payload, args.Data, notifType, gameID)
+	case MailNotificationTransport:
+		msg := args.Mail
+		if len(held) > 1 {
+			var err error
+			if msg, err = heldMailSummary(localizer, heldArgs); err != nil {
+				return err
+			}
+		}
+		return sendHeldMailFunc.EnqueueIn(ctx, 0, userId, notifType, gameID, msg)
+	}
+	return fmt.Errorf("unknown transport %q", transport)
+}
+
+func sendHeldNotifications(ctx context.Context, userId, transport string) error {
+	log.Infof(ctx, "sendHeldNotifications(..., %q, %q)", userId, transport)
+
+	userID := auth.UserID(ctx, userId)
+	user := &auth.User{}
+	userConfig := &auth.UserConfig{}
+	if err := datastore.GetMulti(ctx, []*datastore.Key{userID, auth.UserConfigID(ctx, userID)}, []interface{}{user, userConfig}); err != nil {
+		log.Errorf(ctx, "Unable to load user and user config for %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+
+	if _, end := userConfig.QuietHours.Window(time.Now()); !end.IsZero() {
+		log.Infof(ctx, "%q has quiet hours until %v, postponing delivery", userId, end)
+		if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			return scheduleHeldNotifications(ctx, userId, transport, end)
+		}, nil); err != nil {
+			log.Errorf(ctx, "Unable to postpone delivering held %v notifications to %q until %v: %v; hope datastore gets fixed", transport, userId, end, err)
+			return err
+		}
+		return nil
+	}
+
+	allHeld := []HeldNotification{}
+	allHeldIDs, err := datastore.NewQuery(heldNotificationKind).Ancestor(userID).GetAll(ctx, &allHeld)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load held notifications for %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+
+	// Group the notifications per destination, keeping each group oldest first.
+	heldIDs := []*datastore.Key{}
+	held := []HeldNotification{}
+	for i := range allHeld {
+		if allHeld[i].Transport == transport {
+			heldIDs = append(heldIDs, allHeldIDs[i])
+			held = append(held, allHeld[i])
+		}
+	}
+	sort.Sort(heldNotificationsByAge{ids: heldIDs, held: held})
+	destinations := []string{}
+	groups := map[string][]int{}
+	for i := range held {
+		if _, found := groups[held[i].Destination]; !found {
+			destinations = append(destinations, held[i].Destination)
+		}
+		groups[held[i].Destination] = append(groups[held[i].Destination], i)
+	}
+	log.Infof(ctx, "Found %v held %v notifications to %v destinations of %q", len(held), transport, len(destinations), userId)
+
+	localizer := auth.NewUserLocalizer(user, userConfig)
+
+	for _, destination := range destinations {
+		groupIDs := []*datastore.Key{}
+		groupHeld := []HeldNotification{}
+		for _, i := range groups[destination] {
+			groupIDs = append(groupIDs, heldIDs[i])
+			groupHeld = append(groupHeld, held[i])
+		}
+		// Deleting the held notifications in the same transaction as enqueueing their delivery makes retries safe.
+		if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			if err := datastore.Get(ctx, groupIDs[0], &HeldNotification{}); err == datastore.ErrNoSuchEntity {
+				log.Infof(ctx, "Held notifications to %q are already delivered, skipping", destination)
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := datastore.DeleteMulti(ctx, groupIDs); err != nil {
+				return err
+			}
+			return deliverHeld(ctx, localizer, userId, transport, groupHeld)
+		}, nil); err != nil {
+			log.Errorf(ctx, "Unable to deliver %v held notifications to %q: %v; hope datastore gets fixed", len(groupHeld), destination, err)
+			return err
+		}
+	}
+
+	log.Infof(ctx, "sendHeldNotifications(..., %q, %q) *** SUCCESS ***", userId, transport)
+
+	return nil
+}
+
+type heldNotificationsByAge struct {
+	ids  []*datastore.Key
+	held []HeldNotification
+}
+
+func (h heldNotificationsByAge) Len() int {
+	return len(h.held)
+}
+
+func (h heldNotificationsByAge) Less(i, j int) bool {
+	return h.held[i].HeldAt.Before(h.held[j].HeldAt)
+}
+
+func (h heldNotificationsByAge) Swap(i, j int) {
+	h.ids[i], h.ids[j] = h.ids[j], h.ids[i]
+	h.held[i], h.held[j] = h.held[j], h.held[i]
+}
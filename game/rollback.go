@@ -0,0 +1,527 @@
+package game
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip/variants"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	rollbackKind      = "Rollback"
+	rollbackOrderKind = "RollbackOrder"
+)
+
+const (
+	// RollbackDeleting rollbacks are saving the orders to replay and deleting the later phases.
+	RollbackDeleting = "Deleting"
+	// RollbackReplaying rollbacks have reopened the phase rolled back to, and are resolving the later phases again.
+	RollbackReplaying = "Replaying"
+	// RollbackDone rollbacks are complete.
+	RollbackDone = "Done"
+)
+
+var (
+	rollbackGameFunc *DelayFunc
+	replayPhaseFunc  *DelayFunc
+	RollbackResource *Resource
+)
+
+func init() {
+	rollbackGameFunc = NewDelayFunc("game-rollbackGame", rollbackGame)
+	replayPhaseFunc = NewDelayFunc("game-replayPhase", replayPhase)
+	RollbackResource = &Resource{
+		Create:     createRollback,
+		CreatePath: "/Game/{game_id}/Rollback",
+		Listers: []Lister{
+			{
+				Path:    "/Game/{game_id}/Rollbacks",
+				Route:   ListRollbacksRoute,
+				Handler: listRollbacks,
+			},
+		},
+	}
+}
+
+type Rollbacks []Rollback
+
+func (r Rollbacks) Item(req Request, gameID *datastore.Key) *Item {
+	rollbackItems := make(List, len(r))
+	for i := range r {
+		rollbackItems[i] = r[i].Item(req)
+	}
+	return NewItem(rollbackItems).SetName("rollbacks").AddLink(req.NewLink(Link{
+		Rel:         "self",
+		Route:       ListRollbacksRoute,
+		RouteParams: []string{"game_id", gameID.Encode()},
+	})).SetDesc([][]string{
+		[]string{
+			"Rollbacks",
+			"The audit log of all rollbacks of this game. The Status of a rollback is Deleting while the later phases are deleted, Replaying while they are resolved again, and Done when it is complete.",
+		},
+	})
+}
+
+// Rollback is the audit record of a superuser rolling a game back to an earlier phase. It is stored before the game
+// is touched, and its Status tracks the progress of the rollback so that every step can be retried.
+type Rollback struct {
+	GameID             *datastore.Key
+	PhaseOrdinal       int64 `methods:"POST"`
+	Resolve            bool  `methods:"POST"`
+	NewestPhaseOrdinal int64
+	UserId             string
+	DeletedEntities    int
+	ReplayedOrders     int
+	// ReplayPhaseOrdinal is the phase being replayed while Replaying.
+	ReplayPhaseOrdinal int64
+	Status             string
+	CreatedAt          time.Time
+}
+
+func (r *Rollback) Item(req Request) *Item {
+	return NewItem(r).SetName(fmt.Sprintf("rollback-%d-to-%d", r.NewestPhaseOrdinal, r.PhaseOrdinal))
+}
+
+func requireSuperuser(ctx context.Context, r Request) (*auth.User, error) {
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if appengine.IsDevAppServer() {
+		return user, nil
+	}
+
+	superusers, err := auth.GetSuperusers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !superusers.Includes(user.Id) {
+		return nil, HTTPErr{"unauthorized", http.StatusForbidden}
+	}
+
+	return user, nil
+}
+
+func createRollback(w ResponseWriter, r Request) (*Rollback, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, err := requireSuperuser(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return nil, err
+	}
+
+	rollback := &Rollback{}
+	if err := Copy(rollback, r, "POST"); err != nil {
+		return nil, err
+	}
+	rollback.GameID = gameID
+	rollback.UserId = user.Id
+	rollback.Status = RollbackDeleting
+	rollback.CreatedAt = time.Now()
+
+	// Store the audit record and enqueue the rollback together, so that the rollback is retried until it's done.
+
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		game := &Game{}
+		if err := datastore.Get(ctx, gameID, game); err != nil {
+			return err
+		}
+
+		if !game.Started || len(game.NewestPhaseMeta) == 0 {
+			return HTTPErr{"can only roll back started games", http.StatusPreconditionFailed}
+		}
+		rollback.NewestPhaseOrdinal = game.NewestPhaseMeta[0].PhaseOrdinal
+		if rollback.PhaseOrdinal < 1 || rollback.PhaseOrdinal > rollback.NewestPhaseOrdinal {
+			return HTTPErr{fmt.Sprintf("can only roll back to phases between 1 and %d", rollback.NewestPhaseOrdinal), http.StatusBadRequest}
+		}
+		if rollback.PhaseOrdinal == rollback.NewestPhaseOrdinal && !game.Finished {
+			return HTTPErr{"can't roll back to the newest unresolved phase", http.StatusBadRequest}
+		}
+
+		earlierRollbacks := Rollbacks{}
+		if _, err := datastore.NewQuery(rollbackKind).Ancestor(gameID).GetAll(ctx, &earlierRollbacks); err != nil {
+			return err
+		}
+		for _, earlierRollback := range earlierRollbacks {
+			if earlierRollback.Status == RollbackDeleting || earlierRollback.Status == RollbackReplaying {
+				return HTTPErr{"can't roll back a game that is already being rolled back", http.StatusPreconditionFailed}
+			}
+		}
+
+		rollbackID, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, rollbackKind, gameID), rollback)
+		if err != nil {
+			return err
+		}
+		return rollbackGameFunc.EnqueueIn(ctx, 0, rollbackID)
+	}, nil); err != nil {
+		return nil, err
+	}
+
+	log.Infof(ctx, "%q started rolling back game %v from phase %v to phase %v", user.Id, gameID, rollback.NewestPhaseOrdinal, rollback.PhaseOrdinal)
+
+	return rollback, nil
+}
+
+// rollbackGame saves the orders to replay, deletes the later phases and reopens the phase rolled back to. Every step
+// can be run again, so a failed rollback is retried until it has reopened the phase.
+func rollbackGame(ctx context.Context, rollbackID *datastore.Key) error {
+	log.Infof(ctx, "rollbackGame(..., %v)", rollbackID)
+
+	rollback := &Rollback{}
+	if err := datastore.Get(ctx, rollbackID, rollback); err != nil {
+		log.Errorf(ctx, "Unable to load rollback %v: %v; hope datastore gets fixed", rollbackID, err)
+		return err
+	}
+	if rollback.Status != RollbackDeleting {
+		log.Infof(ctx, "Rollback %v is already %v; skipping", rollbackID, rollback.Status)
+		return nil
+	}
+	gameID := rollback.GameID
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		log.Errorf(ctx, "Unable to load game %v: %v; hope datastore gets fixed", gameID, err)
+		return err
+	}
+	// The game stays finished until the phase is reopened, so this is the same in every retry.
+	wasFinished := game.Finished
+
+	// Save the orders of the later phases as children of the rollback before deleting anything, including the orders
+	// already given for the newest phase. They are keyed by the orders, so retries overwrite them, and retries after
+	// some phases were deleted keep the orders saved for them.
+
+	if rollback.Resolve {
+		for phaseOrdinal := rollback.PhaseOrdinal + 1; phaseOrdinal <= rollback.NewestPhaseOrdinal; phaseOrdinal++ {
+			phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
+			if err != nil {
+				log.Errorf(ctx, "PhaseID(..., %v, %v): %v; fix the PhaseID func", gameID, phaseOrdinal, err)
+				return err
+			}
+			orders := []Order{}
+			orderIDs, err := datastore.NewQuery(orderKind).Ancestor(phaseID).GetAll(ctx, &orders)
+			if err != nil {
+				log.Errorf(ctx, "Unable to load orders of %v: %v; hope datastore gets fixed", phaseID, err)
+				return err
+			}
+			savedOrderIDs := make([]*datastore.Key, len(orderIDs))
+			for i, orderID := range orderIDs {
+				savedOrderIDs[i] = datastore.NewKey(ctx, rollbackOrderKind, orderID.Encode(), 0, rollbackID)
+			}
+			if _, err := datastore.PutMulti(ctx, savedOrderIDs, orders); err != nil {
+				log.Errorf(ctx, "Unable to save orders of %v: %v; hope datastore gets fixed", phaseID, err)
+				return err
+			}
+		}
+	}
+
+	// Delete everything belonging to the later phases, and the results of the rolled back phases.
+
+	toDelete := []*datastore.Key{}
+	for phaseOrdinal := rollback.PhaseOrdinal; phaseOrdinal <= rollback.NewestPhaseOrdinal; phaseOrdinal++ {
+		phaseResultID, err := PhaseResultID(ctx, gameID, phaseOrdinal)
+		if err != nil {
+			log.Errorf(ctx, "PhaseResultID(..., %v, %v): %v; fix the PhaseResultID func", gameID, phaseOrdinal, err)
+			return err
+		}
+		toDelete = append(toDelete, phaseResultID)
+		if phaseOrdinal == rollback.PhaseOrdinal {
+			continue
+		}
+		phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
+		if err != nil {
+			log.Errorf(ctx, "PhaseID(..., %v, %v): %v; fix the PhaseID func", gameID, phaseOrdinal, err)
+			return err
+		}
+		// Includes the phase itself, and all orders and phase states of it.
+		ids, err := datastore.NewQuery("").Ancestor(phaseID).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			log.Errorf(ctx, "Unable to load the contents of %v: %v; hope datastore gets fixed", phaseID, err)
+			return err
+		}
+		toDelete = append(toDelete, ids...)
+	}
+	if wasFinished {
+		toDelete = append(toDelete, GameResultID(ctx, gameID))
+	}
+	for len(toDelete) > 0 {
+		batch := toDelete
+		if len(batch) > maxLimit {
+			batch = batch[:maxLimit]
+		}
+		if err := datastore.DeleteMulti(ctx, batch); err != nil {
+			if merr, ok := err.(appengine.MultiError); ok {
+				for _, serr := range merr {
+					if serr != nil && serr != datastore.ErrNoSuchEntity {
+						log.Errorf(ctx, "Unable to delete %v: %v; hope datastore gets fixed", batch, err)
+						return err
+					}
+				}
+			} else {
+				log.Errorf(ctx, "Unable to delete %v: %v; hope datastore gets fixed", batch, err)
+				return err
+			}
+		}
+		rollback.DeletedEntities += len(batch)
+		if _, err := datastore.Put(ctx, rollbackID, rollback); err != nil {
+			log.Errorf(ctx, "Unable to save progress of rollback %v: %v; hope datastore gets fixed", rollbackID, err)
+			return err
+		}
+		toDelete = toDelete[len(batch):]
+	}
+
+	replayedOrders, err := datastore.NewQuery(rollbackOrderKind).Ancestor(rollbackID).KeysOnly().Count(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Unable to count the saved orders of rollback %v: %v; hope datastore gets fixed", rollbackID, err)
+		return err
+	}
+
+	// Reopen the phase rolled back to.
+
+	phaseID, err := PhaseID(ctx, gameID, rollback.PhaseOrdinal)
+	if err != nil {
+		log.Errorf(ctx, "PhaseID(..., %v, %v): %v; fix the PhaseID func", gameID, rollback.PhaseOrdinal, err)
+		return err
+	}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		phase := &Phase{}
+		if err := datastore.GetMulti(ctx, []*datastore.Key{rollbackID, gameID, phaseID}, []interface{}{rollback, game, phase}); err != nil {
+			return err
+		}
+		game.ID = gameID
+		if rollback.Status != RollbackDeleting {
+			return nil
+		}
+
+		phaseStates := PhaseStates{}
+		phaseStateIDs, err := datastore.NewQuery(phaseStateKind).Ancestor(phaseID).GetAll(ctx, &phaseStates)
+		if err != nil {
+			return err
+		}
+		// Forget the readiness and DIAS votes from before the rollback, so that the members get to order again.
+		// Like for new phases, members without options and on probation are ready and want DIAS by default.
+		for i := range phaseStates {
+			phaseStates[i].ReadyToResolve = phaseStates[i].NoOrders || phaseStates[i].OnProbation
+			phaseStates[i].WantsDIAS = phaseStates[i].OnProbation
+		}
+		if _, err := datastore.PutMulti(ctx, phaseStateIDs, phaseStates); err != nil {
+			return err
+		}
+
+		phase.Resolved = false
+		phase.ResolvedAt = time.Time{}
+		phase.Resolutions = nil
+		phase.DeadlineAt = time.Now().Add(time.Minute * game.PhaseLengthMinutes)
+		if err := phase.Save(ctx); err != nil {
+			return err
+		}
+		if err := phase.Recalc(); err != nil {
+			return err
+		}
+
+		game.Finished = false
+		game.FinishedAt = time.Time{}
+		game.NewestPhaseMeta = []PhaseMeta{phase.PhaseMeta}
+		for i := range game.Members {
+			for _, phaseState := range phaseStates {
+				if phaseState.Nation == game.Members[i].Nation {
+					game.Members[i].NewestPhaseState = phaseState
+				}
+			}
+		}
+		if err := game.Save(ctx); err != nil {
+			return err
+		}
+
+		if rollback.Resolve {
+			rollback.Status = RollbackReplaying
+			rollback.ReplayPhaseOrdinal = rollback.PhaseOrdinal
+			if err := replayPhaseFunc.EnqueueIn(ctx, 0, rollbackID, rollback.PhaseOrdinal); err != nil {
+				return err
+			}
+		} else {
+			rollback.Status = RollbackDone
+			if err := phase.ScheduleResolution(ctx); err != nil {
+				return err
+			}
+		}
+
+		if wasFinished {
+			if !game.Private {
+				if err := UpdateGlickosASAP(ctx); err != nil {
+					return err
+				}
+			}
+			uids := make([]string, len(game.Members))
+			for i, member := range game.Members {
+				uids[i] = member.User.Id
+			}
+			if err := UpdateUserStatsASAP(ctx, uids); err != nil {
+				return err
+			}
+		}
+
+		rollback.ReplayedOrders = replayedOrders
+		_, err = datastore.Put(ctx, rollbackID, rollback)
+		return err
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		log.Errorf(ctx, "Unable to reopen phase %v: %v; hope datastore gets fixed", phaseID, err)
+		return err
+	}
+
+	log.Infof(ctx, "%q rolled back game %v from phase %v to phase %v, deleting %v entities and saving %v orders to replay", rollback.UserId, gameID, rollback.NewestPhaseOrdinal, rollback.PhaseOrdinal, rollback.DeletedEntities, rollback.ReplayedOrders)
+
+	log.Infof(ctx, "rollbackGame(..., %v): *** SUCCESS ***", rollbackID)
+
+	return nil
+}
+
+// replayPhase restores the saved orders of a rolled back phase and resolves it using the current godip, and then
+// continues with the next phase. The newest phase before the rollback only gets its orders restored, since it
+// wasn't resolved before the rollback either. Replays of phases that are already done are skipped, so each phase
+// is retried until it has been replayed.
+func replayPhase(ctx context.Context, rollbackID *datastore.Key, phaseOrdinal int64) error {
+	log.Infof(ctx, "replayPhase(..., %v, %v)", rollbackID, phaseOrdinal)
+
+	rollback := &Rollback{}
+	if err := datastore.Get(ctx, rollbackID, rollback); err != nil {
+		log.Errorf(ctx, "Unable to load rollback %v: %v; hope datastore gets fixed", rollbackID, err)
+		return err
+	}
+	if rollback.Status != RollbackReplaying || rollback.ReplayPhaseOrdinal != phaseOrdinal {
+		log.Infof(ctx, "Rollback %v is %v at phase %v; skipping", rollbackID, rollback.Status, rollback.ReplayPhaseOrdinal)
+		return nil
+	}
+	gameID := rollback.GameID
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		log.Errorf(ctx, "Unable to load game %v: %v; hope datastore gets fixed", gameID, err)
+		return err
+	}
+	game.ID = gameID
+
+	if game.Finished {
+		log.Infof(ctx, "Game %v finished during replay; stopping", gameID)
+		return advanceReplay(ctx, rollbackID, phaseOrdinal, true)
+	}
+
+	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
+	if err != nil {
+		log.Errorf(ctx, "PhaseID(..., %v, %v): %v; fix the PhaseID func", gameID, phaseOrdinal, err)
+		return err
+	}
+	phase := &Phase{}
+	if err := datastore.Get(ctx, phaseID, phase); err != nil {
+		log.Errorf(ctx, "Unable to load phase %v: %v; hope datastore gets fixed", phaseID, err)
+		return err
+	}
+
+	if !phase.Resolved {
+		savedOrders := []Order{}
+		if _, err := datastore.NewQuery(rollbackOrderKind).Ancestor(rollbackID).Filter("PhaseOrdinal=", phaseOrdinal).GetAll(ctx, &savedOrders); err != nil {
+			log.Errorf(ctx, "Unable to load the saved orders of rollback %v: %v; hope datastore gets fixed", rollbackID, err)
+			return err
+		}
+
+		variant := variants.Variants[game.Variant]
+		s, err := phase.State(ctx, variant, nil)
+		if err != nil {
+			log.Errorf(ctx, "Unable to create godip State for %v: %v; fix godip!", PP(phase), err)
+			return err
+		}
+		for i := range savedOrders {
+			order := &savedOrders[i]
+			parsedOrder, err := variant.Parser.Parse(order.Parts)
+			if err != nil {
+				log.Warningf(ctx, "Unable to parse replayed order %v: %v; skipping it", PP(order), err)
+				continue
+			}
+			if validNation, err := parsedOrder.Validate(s); err != nil || validNation != order.Nation {
+				log.Warningf(ctx, "Replayed order %v is no longer valid (%v, %v); skipping it", PP(order), validNation, err)
+				continue
+			}
+			if err := order.Save(ctx); err != nil {
+				log.Errorf(ctx, "Unable to save replayed order %v: %v; hope datastore gets fixed", PP(order), err)
+				return err
+			}
+		}
+
+		if phaseOrdinal < rollback.NewestPhaseOrdinal {
+			if err := resolvePhaseHelper(ctx, gameID, phaseOrdinal, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := advanceReplay(ctx, rollbackID, phaseOrdinal, phaseOrdinal >= rollback.NewestPhaseOrdinal); err != nil {
+		return err
+	}
+
+	log.Infof(ctx, "replayPhase(..., %v, %v): *** SUCCESS ***", rollbackID, phaseOrdinal)
+
+	return nil
+}
+
+// advanceReplay moves the replay of a rollback from phaseOrdinal to the next phase, or marks the rollback as done,
+// unless a retried replay of the phase already did.
+func advanceReplay(ctx context.Context, rollbackID *datastore.Key, phaseOrdinal int64, done bool) error {
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		rollback := &Rollback{}
+		if err := datastore.Get(ctx, rollbackID, rollback); err != nil {
+			return err
+		}
+		if rollback.Status != RollbackReplaying || rollback.ReplayPhaseOrdinal != phaseOrdinal {
+			return nil
+		}
+		if done {
+			rollback.Status = RollbackDone
+		} else {
+			rollback.ReplayPhaseOrdinal = phaseOrdinal + 1
+			if err := replayPhaseFunc.EnqueueIn(ctx, 0, rollbackID, phaseOrdinal+1); err != nil {
+				return err
+			}
+		}
+		_, err := datastore.Put(ctx, rollbackID, rollback)
+		return err
+	}, nil); err != nil {
+		log.Errorf(ctx, "Unable to advance the replay of rollback %v: %v; hope datastore gets fixed", rollbackID, err)
+		return err
+	}
+	return nil
+}
+
+func listRollbacks(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if _, err := requireSuperuser(ctx, r); err != nil {
+		return err
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	rollbacks := Rollbacks{}
+	if _, err := datastore.NewQuery(rollbackKind).Ancestor(gameID).Order("-CreatedAt").GetAll(ctx, &rollbacks); err != nil {
+		return err
+	}
+
+	w.SetContent(rollbacks.Item(r, gameID))
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/zond/diplicity/auth"
 	"github.com/zond/diplicity/variants"
+	"google.golang.org/appengine"
 
 	. "github.com/zond/goaeoas"
 )
@@ -33,6 +34,12 @@ func handleIndex(w ResponseWriter, r Request) error {
 				"In the final redirect, the query parameter `token` will be your OAuth2 token.",
 				"Use this token as the URL parameter `token`, or use it inside an `Authorization: Bearer ...` header to authenticate requests.",
 			},
+			[]string{
+				"Deadline calendar",
+				"The `deadlines-calendar` link is an iCalendar feed with the next deadline of each of your started games.",
+				"It is authenticated by the `t` query parameter instead of your OAuth2 token, so that calendar apps can subscribe to it. Keep it secret.",
+				"`POST` to the `reset-deadlines-calendar` link to replace the token if the calendar URL leaked. The response links to the new calendar URL, and the old one stops working.",
+			},
 			[]string{
 				"Source code",
 				"The source code for this service can be found at https://github.com/zond/diplicity.",
@@ -76,6 +83,10 @@ func handleIndex(w ResponseWriter, r Request) error {
 			},
 		}))
 	} else {
+		calendarToken, err := CalendarToken(appengine.NewContext(r.Req()), user.Id)
+		if err != nil {
+			return err
+		}
 		index.AddLink(r.NewLink(Link{
 			Rel:   "logout",
 			Route: auth.LogoutRoute,
@@ -122,6 +133,18 @@ func handleIndex(w ResponseWriter, r Request) error {
 			Rel:         "approved-frontends",
 			Route:       auth.ListRedirectURLsRoute,
 			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink(Link{
+			Rel:         "notification-log",
+			Route:       ListNotificationLogRoute,
+			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink((&DeadlinesCalendar{
+			UserId: user.Id,
+			Token:  calendarToken,
+		}).Link("deadlines-calendar"))).AddLink(r.NewLink(Link{
+			Rel:         "reset-deadlines-calendar",
+			Route:       ResetDeadlinesCalendarRoute,
+			RouteParams: []string{"user_id", user.Id},
+			Method:      "POST",
 		})).AddLink(r.NewLink(GameResource.Link("create-game", Create, nil))).
 			AddLink(r.NewLink(auth.UserConfigResource.Link("user-config", Load, []string{"user_id", user.Id}))).
 			AddLink(r.NewLink(Link{
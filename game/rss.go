@@ -105,7 +105,7 @@ func updateNeeded(r Request, checked string, modified string) bool {
 	return diff.Hours() > 1
 }
 
-func makeSummaryHtml(phase Phase, nationsList []godip.Nation, scCount map[godip.Nation]int,
+func makeSummaryHtml(phase Phase, report *PhaseReport, nationsList []godip.Nation, scCount map[godip.Nation]int,
 	unitCount map[godip.Nation]int, dislodgedCount map[godip.Nation]int) string {
 	summary := "<table>"
 	if len(phase.Dislodgeds) > 0 {
@@ -125,10 +125,13 @@ func makeSummaryHtml(phase Phase, nationsList []godip.Nation, scCount map[godip.
 		summary += "</tr>"
 	}
 	summary += "</table>"
+	if report != nil {
+		summary += report.format(reportHtmlFormat)
+	}
 	return summary
 }
 
-func makeSummaryMarkdown(phase Phase, nationsList []godip.Nation, scCount map[godip.Nation]int,
+func makeSummaryMarkdown(phase Phase, report *PhaseReport, nationsList []godip.Nation, scCount map[godip.Nation]int,
 	unitCount map[godip.Nation]int, dislodgedCount map[godip.Nation]int) string {
 	summary := ""
 	if len(phase.Dislodgeds) > 0 {
@@ -147,10 +150,13 @@ func makeSummaryMarkdown(phase Phase, nationsList []godip.Nation, scCount map[go
 			summary += fmt.Sprintf(" %d | %d | %+d |", scCount[nation], unitCount[nation], delta)
 		}
 	}
+	if report != nil {
+		summary += report.format(reportMarkdownFormat)
+	}
 	return summary
 }
 
-func makeSummary(phase Phase, format string) string {
+func makeSummary(phase Phase, report *PhaseReport, format string) string {
 	// A set of all nations still in the game.
 	nations := map[godip.Nation]bool{}
 	// SC Count
@@ -184,9 +190,9 @@ func makeSummary(phase Phase, format string) string {
 	})
 
 	if format == "markdown" {
-		return makeSummaryMarkdown(phase, nationsList, scCount, unitCount, dislodgedCount)
+		return makeSummaryMarkdown(phase, report, nationsList, scCount, unitCount, dislodgedCount)
 	}
-	return makeSummaryHtml(phase, nationsList, scCount, unitCount, dislodgedCount)
+	return makeSummaryHtml(phase, report, nationsList, scCount, unitCount, dislodgedCount)
 }
 
 // Supported query parameters:
@@ -196,6 +202,7 @@ func makeSummary(phase Phase, format string) string {
 //   gameLimit: The maximum number of games to return in the results.
 //   phaseLimit: The maximum number of phases from each game to return.
 //   format: The format of the description (e.g. "html" or "markdown").
+//   orders: If "true", include the phase report (orders and their outcome) in the description.
 func handleRss(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
@@ -297,7 +304,13 @@ func handleRss(w ResponseWriter, r Request) error {
 				return err
 			}
 			format := uq.Get("format")
-			description := makeSummary(phase, format)
+			var report *PhaseReport
+			if uq.Get("orders") == "true" {
+				if report, err = phase.Report(ctx); err != nil {
+					return err
+				}
+			}
+			description := makeSummary(phase, report, format)
 			phaseURL, err := makeURL(RenderPhaseMapRoute, "game_id", game.ID.Encode(), "phase_ordinal", fmt.Sprint(phase.PhaseOrdinal))
 			if err != nil {
 				return err
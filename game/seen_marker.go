@@ -0,0 +1,243 @@
+package game
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+// countUnread makes sure s.Unread is correct, by counting the messages created after s.At
+// if the marker was stored before unread messages were counted incrementally.
+func (s *SeenMarker) countUnread(ctx context.Context, channel *Channel) error {
+	if s.Counted {
+		return nil
+	}
+	if err := channel.CountSince(ctx, s.At); err != nil {
+		return err
+	}
+	s.Unread = channel.NMessagesSince.NMessages
+	s.Counted = true
+	return nil
+}
+
+// adjustUnreadMessages adds delta to the unread counters of the channel members (except the sender) that haven't
+// seen message yet. It must run in the transaction creating or deleting the message, and the caller has to save
+// the game afterwards. Queries in the transaction don't see the message even if it's already stored, so legacy
+// markers get counted without it before delta is added.
+func adjustUnreadMessages(ctx context.Context, game *Game, channel *Channel, channelID *datastore.Key, message *Message, delta int) error {
+	owners := Nations{}
+	markerIDs := []*datastore.Key{}
+	for _, nat := range channel.Members {
+		if nat == message.Sender {
+			continue
+		}
+		markerID, err := SeenMarkerID(ctx, channelID, nat)
+		if err != nil {
+			return err
+		}
+		owners = append(owners, nat)
+		markerIDs = append(markerIDs, markerID)
+	}
+	markers := make([]SeenMarker, len(markerIDs))
+	found := make([]bool, len(markerIDs))
+	if err := datastore.GetMulti(ctx, markerIDs, markers); err == nil {
+		for i := range found {
+			found[i] = true
+		}
+	} else if merr, ok := err.(appengine.MultiError); ok {
+		for i, serr := range merr {
+			if serr == nil {
+				found[i] = true
+			} else if serr != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+	} else {
+		return err
+	}
+
+	keysToSave := []*datastore.Key{}
+	valuesToSave := []interface{}{}
+	for i, owner := range owners {
+		// Missing markers mean that nothing in the channel is seen, which is computed from channel.NMessages.
+		if found[i] {
+			if !markers[i].At.Before(message.CreatedAt) {
+				continue
+			}
+			if err := markers[i].countUnread(ctx, channel); err != nil {
+				return err
+			}
+			markers[i].Unread = nonNegative(markers[i].Unread + delta)
+			keysToSave = append(keysToSave, markerIDs[i])
+			valuesToSave = append(valuesToSave, &markers[i])
+		}
+		if member, isMember := game.GetMemberByNation(owner); isMember {
+			member.UnreadMessages = nonNegative(member.UnreadMessages + delta)
+		}
+	}
+	if len(keysToSave) > 0 {
+		if _, err := datastore.PutMulti(ctx, keysToSave, valuesToSave); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markChannelSeen moves the seen marker of viewer in channel to at, and updates the unread counters.
+// It must run in a transaction, and the caller has to save the game afterwards.
+func markChannelSeen(ctx context.Context, game *Game, channel *Channel, viewer godip.Nation, at time.Time) error {
+	channelID, err := channel.ID(ctx)
+	if err != nil {
+		return err
+	}
+	markerID, err := SeenMarkerID(ctx, channelID, viewer)
+	if err != nil {
+		return err
+	}
+	marker := &SeenMarker{}
+	if err := datastore.Get(ctx, markerID, marker); err == datastore.ErrNoSuchEntity {
+		marker = &SeenMarker{
+			GameID:  game.ID,
+			Members: channel.Members,
+			Owner:   viewer,
+			Unread:  channel.NMessages,
+			Counted: true,
+		}
+	} else if err != nil {
+		return err
+	} else if err := marker.countUnread(ctx, channel); err != nil {
+		return err
+	}
+	if !marker.At.Before(at) {
+		return nil
+	}
+
+	oldUnread := marker.Unread
+	if err := channel.CountSince(ctx, at); err != nil {
+		return err
+	}
+	marker.At = at
+	marker.Unread = channel.NMessagesSince.NMessages
+	if member, isMember := game.GetMemberByNation(viewer); isMember {
+		member.UnreadMessages = nonNegative(member.UnreadMessages + marker.Unread - oldUnread)
+	}
+	_, err = datastore.Put(ctx, markerID, marker)
+	return err
+}
+
+// loadReadReceipts sets ReadBy of messages to the channel members, other than the senders, that have seen them.
+func loadReadReceipts(ctx context.Context, channelID *datastore.Key, channelMembers Nations, messages Messages) error {
+	markerIDs := make([]*datastore.Key, len(channelMembers))
+	for i, nat := range channelMembers {
+		var err error
+		if markerIDs[i], err = SeenMarkerID(ctx, channelID, nat); err != nil {
+			return err
+		}
+	}
+	markers := make([]SeenMarker, len(markerIDs))
+	if err := datastore.GetMulti(ctx, markerIDs, markers); err != nil {
+		if merr, ok := err.(appengine.MultiError); ok {
+			for _, serr := range merr {
+				if serr != nil && serr != datastore.ErrNoSuchEntity {
+					return err
+				}
+			}
+		} else {
+			return err
+		}
+	}
+	for i := range messages {
+		messages[i].ReadBy = Nations{}
+		for j, nat := range channelMembers {
+			if nat != messages[i].Sender && !markers[j].At.Before(messages[i].CreatedAt) {
+				messages[i].ReadBy = append(messages[i].ReadBy, nat)
+			}
+		}
+	}
+	return nil
+}
+
+func nonNegative(i int) int {
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
+func markAllMessagesRead(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	var channels Channels
+	var nation godip.Nation
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		game := &Game{}
+		if err := datastore.Get(ctx, gameID, game); err != nil {
+			return err
+		}
+		game.ID = gameID
+
+		member, isMember := game.GetMemberByUserId(user.Id)
+		if !isMember {
+			return HTTPErr{"can only mark messages read in member games", http.StatusNotFound}
+		}
+		nation = member.Nation
+
+		channels, err = loadChannels(ctx, game, member.Nation)
+		if err != nil {
+			return err
+		}
+		// No messages are created after now, so unlike markChannelSeen this doesn't have to count anything,
+		// and can replace the markers without loading them.
+		now := time.Now()
+		markerIDs := make([]*datastore.Key, len(channels))
+		markers := make([]SeenMarker, len(channels))
+		for i := range channels {
+			channelID, err := channels[i].ID(ctx)
+			if err != nil {
+				return err
+			}
+			if markerIDs[i], err = SeenMarkerID(ctx, channelID, member.Nation); err != nil {
+				return err
+			}
+			markers[i] = SeenMarker{
+				GameID:  gameID,
+				Members: channels[i].Members,
+				Owner:   member.Nation,
+				At:      now,
+				Counted: true,
+			}
+			channels[i].NMessagesSince = NMessagesSince{
+				Since: now,
+			}
+		}
+		if _, err := datastore.PutMulti(ctx, markerIDs, markers); err != nil {
+			return err
+		}
+		// Whatever rounding errors the counters had, they're gone now.
+		member.UnreadMessages = 0
+		return game.Save(ctx)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return err
+	}
+
+	r.Values()["viewer-nation"] = nation
+	w.SetContent(channels.Item(r, gameID, true))
+	return nil
+}
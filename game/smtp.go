@@ -0,0 +1,320 @@
+package game
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/socket"
+	"gopkg.in/sendgrid/sendgrid-go.v2"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	smtpConfKind = "SMTPConf"
+
+	smtpTimeout = 30 * time.Second
+)
+
+var (
+	prodSMTPConf     *SMTPConf
+	prodSMTPConfLock = sync.RWMutex{}
+)
+
+// SMTPConf configures sending all mail via an SMTP server instead of SendGrid.
+type SMTPConf struct {
+	// Addr is the host:port of the server, e.g. "smtp.example.com:587".
+	Addr     string
+	Username string
+	Password string
+	// StartTLS requires the server to support STARTTLS, and upgrades the connection before authenticating.
+	// Without it, the password is only sent to servers on localhost.
+	StartTLS bool
+	// EnvelopeFrom is the MAIL FROM address, for servers that don't relay mail from the reply addresses.
+	// Defaults to the From address of each mail.
+	EnvelopeFrom string
+}
+
+func getSMTPConfKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, smtpConfKind, prodKey, 0, nil)
+}
+
+func SetSMTPConf(ctx context.Context, smtpConf *SMTPConf) error {
+	if _, _, err := net.SplitHostPort(smtpConf.Addr); err != nil {
+		return HTTPErr{fmt.Sprintf("SMTPConf address %q isn't host:port: %v", smtpConf.Addr, err), http.StatusBadRequest}
+	}
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		currentSMTPConf := &SMTPConf{}
+		if err := datastore.Get(ctx, getSMTPConfKey(ctx), currentSMTPConf); err == nil {
+			return HTTPErr{"SMTPConf already configured", http.StatusBadRequest}
+		}
+		if _, err := datastore.Put(ctx, getSMTPConfKey(ctx), smtpConf); err != nil {
+			return err
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: false})
+}
+
+func getSMTPConf(ctx context.Context) (*SMTPConf, error) {
+	prodSMTPConfLock.RLock()
+	if prodSMTPConf != nil {
+		defer prodSMTPConfLock.RUnlock()
+		return prodSMTPConf, nil
+	}
+	prodSMTPConfLock.RUnlock()
+	prodSMTPConfLock.Lock()
+	defer prodSMTPConfLock.Unlock()
+	foundConf := &SMTPConf{}
+	if err := datastore.Get(ctx, getSMTPConfKey(ctx), foundConf); err != nil {
+		return nil, err
+	}
+	prodSMTPConf = foundConf
+	return prodSMTPConf, nil
+}
+
+// configuredMailTransport sends mail via SMTP if an SMTPConf is configured, and via SendGrid otherwise.
+type configuredMailTransport struct{}
+
+// Mail to users is held during their quiet hours, and recorded in their notification logs.
+func (configuredMailTransport) Send(ctx context.Context, notif *Notification) error {
+	if notif.UserId != "" {
+		quietHours, err := loadQuietHours(ctx, notif.UserId)
+		if err != nil {
+			return err
+		}
+		if held, err := holdForQuietHours(ctx, notif.UserId, quietHours, NotificationLogEntry{
+			Transport:   MailNotificationTransport,
+			Type:        notif.Type,
+			GameID:      notif.GameID,
+			Destination: strings.Join(notif.Mail.To, ", "),
+		}, &heldNotificationArgs{Mail: notif.Mail}); err != nil || held {
+			return err
+		}
+	}
+	var transport NotificationTransport = sendGridTransport{}
+	smtpConf, err := getSMTPConf(ctx)
+	if fake := devFakes.Mail(); fake != nil {
+		transport = fake
+	} else if err == nil {
+		transport = smtpTransport{conf: smtpConf}
+	} else if err != datastore.ErrNoSuchEntity {
+		log.Errorf(ctx, "Unable to load SMTPConf: %v; hope datastore gets fixed", err)
+		return err
+	}
+	logEntry := NotificationLogEntry{
+		UserId:      notif.UserId,
+		Transport:   MailNotificationTransport,
+		Type:        notif.Type,
+		GameID:      notif.GameID,
+		Destination: strings.Join(notif.Mail.To, ", "),
+		Status:      NotificationSent,
+	}
+	if err := transport.Send(ctx, notif); err != nil {
+		// The mail notification tasks return the error, and get retried.
+		logEntry.Status = NotificationRetrying
+		logEntry.Error = err.Error()
+		logNotifications(ctx, logEntry)
+		return err
+	}
+	logNotifications(ctx, logEntry)
+	return nil
+}
+
+type smtpTransport struct {
+	conf *SMTPConf
+}
+
+func (s smtpTransport) Send(ctx context.Context, notif *Notification) error {
+	conn, err := socket.DialTimeout(ctx, "tcp", s.conf.Addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	return SendSMTPMail(conn, s.conf, notif.Mail)
+}
+
+func formatAddresses(addresses, names []string) string {
+	result := make([]string, len(addresses))
+	for i, address := range addresses {
+		formatted := &mail.Address{Address: address}
+		// Like SendGrid, names only apply if there is one per address.
+		if len(names) == len(addresses) {
+			formatted.Name = names[i]
+		}
+		result[i] = formatted.String()
+	}
+	return strings.Join(result, ", ")
+}
+
+func writeQuotedPrintable(w *bytes.Buffer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// NewSMTPMessage renders msg as a MIME message, with alternative text and HTML parts if it has an HTML body.
+// Replies go to the From address unless msg has a ReplyTo, so that replies reach receiveMail even if the SMTP
+// server rewrites the sender.
+func NewSMTPMessage(msg *sendgrid.SGMail, now time.Time) ([]byte, error) {
+	from := &mail.Address{Name: msg.FromName, Address: msg.From}
+	replyTo := msg.From
+	if msg.ReplyTo != "" {
+		replyTo = msg.ReplyTo
+	}
+	messageIDBytes := make([]byte, 16)
+	if _, err := rand.Read(messageIDBytes); err != nil {
+		return nil, err
+	}
+	domain := "diplicity"
+	if at := strings.LastIndex(msg.From, "@"); at != -1 {
+		domain = msg.From[at+1:]
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("From", from.String())
+	header.Set("To", formatAddresses(msg.To, msg.ToName))
+	if len(msg.Cc) > 0 {
+		header.Set("Cc", formatAddresses(msg.Cc, nil))
+	}
+	header.Set("Reply-To", (&mail.Address{Address: replyTo}).String())
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header.Set("Date", now.Format(time.RFC1123Z))
+	header.Set("Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(messageIDBytes), domain))
+	header.Set("MIME-Version", "1.0")
+	for k, v := range msg.Headers {
+		header.Set(k, v)
+	}
+
+	body := &bytes.Buffer{}
+	if msg.HTML == "" {
+		header.Set("Content-Type", "text/plain; charset=UTF-8")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		if err := writeQuotedPrintable(body, msg.Text); err != nil {
+			return nil, err
+		}
+	} else {
+		parts := multipart.NewWriter(body)
+		header.Set("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", parts.Boundary()))
+		for _, part := range []struct {
+			contentType string
+			content     string
+		}{
+			{"text/plain; charset=UTF-8", msg.Text},
+			{"text/html; charset=UTF-8", msg.HTML},
+		} {
+			w, err := parts.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              []string{part.contentType},
+				"Content-Transfer-Encoding": []string{"quoted-printable"},
+			})
+			if err != nil {
+				return nil, err
+			}
+			partBody := &bytes.Buffer{}
+			if err := writeQuotedPrintable(partBody, part.content); err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(partBody.Bytes()); err != nil {
+				return nil, err
+			}
+		}
+		if err := parts.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := &bytes.Buffer{}
+	for _, k := range keys {
+		fmt.Fprintf(result, "%s: %s\r\n", k, header.Get(k))
+	}
+	result.WriteString("\r\n")
+	result.Write(body.Bytes())
+	return result.Bytes(), nil
+}
+
+// SendSMTPMail sends msg over conn, which is closed afterwards.
+func SendSMTPMail(conn net.Conn, conf *SMTPConf, msg *sendgrid.SGMail) error {
+	host, _, err := net.SplitHostPort(conf.Addr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if conf.StartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%q doesn't support STARTTLS", conf.Addr)
+		}
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if conf.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", conf.Username, conf.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	envelopeFrom := conf.EnvelopeFrom
+	if envelopeFrom == "" {
+		envelopeFrom = msg.From
+	}
+	if err := client.Mail(envelopeFrom); err != nil {
+		return err
+	}
+	for _, recipients := range [][]string{msg.To, msg.Cc, msg.Bcc} {
+		for _, recipient := range recipients {
+			if err := client.Rcpt(recipient); err != nil {
+				return err
+			}
+		}
+	}
+
+	body, err := NewSMTPMessage(msg, time.Now())
+	if err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,448 @@
+package game
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/go-fcm"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	webPushConfKind = "WebPushConf"
+
+	// Push services accept bodies of up to 4096 bytes, which we send as a single aes128gcm record.
+	webPushRecordSize = 4096
+	// The aes128gcm header is salt, record size, key length and the 65 byte public key.
+	webPushHeaderSize = 16 + 4 + 1 + 65
+	// Each record gets a padding delimiter and an authentication tag.
+	maxWebPushPayload = webPushRecordSize - webPushHeaderSize - 1 - 16
+
+	webPushTTL        = 24 * time.Hour
+	vapidTokenExpiry  = 12 * time.Hour
+	vapidJWTHeader    = `{"typ":"JWT","alg":"ES256"}`
+	webPushKeyInfo    = "WebPush: info\x00"
+	webPushCEKInfo    = "Content-Encoding: aes128gcm\x00"
+	webPushNonceInfo  = "Content-Encoding: nonce\x00"
+	webPushKeyLen     = 32
+	webPushCEKLen     = 16
+	webPushNonceLen   = 12
+	webPushSaltLen    = 16
+	webPushAuthLen    = 16
+	webPushPaddingEnd = 2
+)
+
+var (
+	webPushSendFunc     *DelayFunc
+	prodWebPushConf     *WebPushConf
+	prodWebPushConfLock = sync.RWMutex{}
+)
+
+func init() {
+	webPushSendFunc = NewDelayFunc("game-webPushSend", webPushSend)
+}
+
+// WebPushConf is the VAPID key pair identifying this server to Web Push services.
+type WebPushConf struct {
+	// PublicKey is the URL safe base64 uncompressed P-256 point that clients use as applicationServerKey.
+	PublicKey string
+	// PrivateKey is the URL safe base64 private scalar.
+	PrivateKey string
+	// Subject is a mailto: or https: URL where push services can contact the operator.
+	Subject string
+}
+
+// NewWebPushConf generates a new VAPID key pair.
+func NewWebPushConf(subject string) (*WebPushConf, error) {
+	private, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &WebPushConf{
+		PublicKey:  base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), x, y)),
+		PrivateKey: base64.RawURLEncoding.EncodeToString(private),
+		Subject:    subject,
+	}, nil
+}
+
+func (w *WebPushConf) privateKey() (*ecdsa.PrivateKey, error) {
+	b, err := auth.DecodeWebPushKey(w.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != webPushKeyLen {
+		return nil, fmt.Errorf("VAPID private key isn't %v bytes", webPushKeyLen)
+	}
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+		},
+		D: new(big.Int).SetBytes(b),
+	}
+	key.PublicKey.X, key.PublicKey.Y = elliptic.P256().ScalarBaseMult(b)
+	if base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), key.PublicKey.X, key.PublicKey.Y)) != strings.TrimRight(w.PublicKey, "=") {
+		return nil, fmt.Errorf("VAPID public key doesn't match the private key")
+	}
+	return key, nil
+}
+
+func getWebPushConfKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, webPushConfKind, prodKey, 0, nil)
+}
+
+func SetWebPushConf(ctx context.Context, webPushConf *WebPushConf) error {
+	if _, err := webPushConf.privateKey(); err != nil {
+		return HTTPErr{err.Error(), http.StatusBadRequest}
+	}
+	if !strings.HasPrefix(webPushConf.Subject, "mailto:") && !strings.HasPrefix(webPushConf.Subject, "https:") {
+		return HTTPErr{"WebPushConf subject must be a mailto: or https: URL", http.StatusBadRequest}
+	}
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		currentWebPushConf := &WebPushConf{}
+		if err := datastore.Get(ctx, getWebPushConfKey(ctx), currentWebPushConf); err == nil {
+			return HTTPErr{"WebPushConf already configured", http.StatusBadRequest}
+		}
+		if _, err := datastore.Put(ctx, getWebPushConfKey(ctx), webPushConf); err != nil {
+			return err
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: false})
+}
+
+func getWebPushConf(ctx context.Context) (*WebPushConf, error) {
+	prodWebPushConfLock.RLock()
+	if prodWebPushConf != nil {
+		defer prodWebPushConfLock.RUnlock()
+		return prodWebPushConf, nil
+	}
+	prodWebPushConfLock.RUnlock()
+	prodWebPushConfLock.Lock()
+	defer prodWebPushConfLock.Unlock()
+	foundConf := &WebPushConf{}
+	if err := datastore.Get(ctx, getWebPushConfKey(ctx), foundConf); err != nil {
+		return nil, err
+	}
+	prodWebPushConf = foundConf
+	return prodWebPushConf, nil
+}
+
+func handleVAPIDPublicKey(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	conf, err := getWebPushConf(ctx)
+	if err == datastore.ErrNoSuchEntity {
+		return HTTPErr{"Web Push isn't configured", http.StatusNotFound}
+	} else if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	_, err = w.Write([]byte(conf.PublicKey))
+	return err
+}
+
+type webPushTransport struct{}
+
+func (webPushTransport) Send(ctx context.Context, notif *Notification) error {
+	return webPushSendFunc.EnqueueIn(ctx, 0, notif.UserId, notif.To, notif.Payload, notif.Data, notif.Type, notif.GameID)
+}
+
+// webPushMessage is the JSON pushed to Web Push subscriptions, mirroring the notification and data of FCM messages.
+type webPushMessage struct {
+	Notification *fcm.NotificationPayload `json:"notification,omitempty"`
+	Data         *FCMData                 `json:"data,omitempty"`
+}
+
+func fixedBytes(i *big.Int) []byte {
+	b := i.Bytes()
+	result := make([]byte, webPushKeyLen)
+	copy(result[webPushKeyLen-len(b):], b)
+	return result
+}
+
+func hkdfBytes(secret, salt []byte, info string, n int) ([]byte, error) {
+	result := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// webPushAEAD derives the content encryption key and nonce of RFC 8291 from the ECDH secret between the
+// subscription (user agent) and the ephemeral application server key.
+func webPushAEAD(ecdhSecret, authSecret, uaPublic, asPublic, salt []byte) (cipher.AEAD, []byte, error) {
+	ikm, err := hkdfBytes(ecdhSecret, authSecret, webPushKeyInfo+string(uaPublic)+string(asPublic), webPushKeyLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	cek, err := hkdfBytes(ikm, salt, webPushCEKInfo, webPushCEKLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := hkdfBytes(ikm, salt, webPushNonceInfo, webPushNonceLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, nonce, nil
+}
+
+// encryptWebPush encrypts the payload for the subscription as a single aes128gcm record.
+func encryptWebPush(subscription *auth.WebPushSubscription, payload []byte) ([]byte, error) {
+	if len(payload) > maxWebPushPayload {
+		return nil, fmt.Errorf("payload of %v bytes is larger than %v bytes", len(payload), maxWebPushPayload)
+	}
+	uaPublic, err := auth.DecodeWebPushKey(subscription.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := auth.DecodeWebPushKey(subscription.Auth)
+	if err != nil {
+		return nil, err
+	}
+	if len(authSecret) != webPushAuthLen {
+		return nil, fmt.Errorf("auth secret isn't %v bytes", webPushAuthLen)
+	}
+	ux, uy := elliptic.Unmarshal(elliptic.P256(), uaPublic)
+	if ux == nil {
+		return nil, fmt.Errorf("%q isn't a P-256 public key", subscription.P256dh)
+	}
+	asPrivate, ax, ay, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := elliptic.Marshal(elliptic.P256(), ax, ay)
+	sx, _ := elliptic.P256().ScalarMult(ux, uy, asPrivate)
+
+	salt := make([]byte, webPushSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, nonce, err := webPushAEAD(fixedBytes(sx), authSecret, uaPublic, asPublic, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write(salt)
+	if err := binary.Write(buf, binary.BigEndian, uint32(webPushRecordSize)); err != nil {
+		return nil, err
+	}
+	buf.WriteByte(byte(len(asPublic)))
+	buf.Write(asPublic)
+
+	plaintext := make([]byte, len(payload), len(payload)+1)
+	copy(plaintext, payload)
+	plaintext = append(plaintext, webPushPaddingEnd)
+	return aead.Seal(buf.Bytes(), nonce, plaintext, nil), nil
+}
+
+// vapidAuthorization returns the VAPID Authorization header for pushing to endpoint, as described in RFC 8292.
+func vapidAuthorization(conf *WebPushConf, endpoint string, expiry time.Time) (string, error) {
+	key, err := conf.privateKey()
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": fmt.Sprintf("%s://%s", u.Scheme, u.Host),
+		"exp": expiry.Unix(),
+		"sub": conf.Subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(vapidJWTHeader)) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	signature := append(fixedBytes(r), fixedBytes(s)...)
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", unsigned, base64.RawURLEncoding.EncodeToString(signature), strings.TrimRight(conf.PublicKey, "=")), nil
+}
+
+// NewWebPushRequest creates an encrypted and VAPID authorized push of payload to the subscription.
+func NewWebPushRequest(conf *WebPushConf, subscription *auth.WebPushSubscription, payload []byte, ttl time.Duration) (*http.Request, error) {
+	body, err := encryptWebPush(subscription, payload)
+	if err != nil {
+		return nil, err
+	}
+	authorization, err := vapidAuthorization(conf, subscription.Endpoint, time.Now().Add(vapidTokenExpiry))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(int(ttl/time.Second)))
+	return req, nil
+}
+
+func disableWebPushSubscription(ctx context.Context, userId, endpoint, note string) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		userConfigID := auth.UserConfigID(ctx, auth.UserID(ctx, userId))
+		userConfig := &auth.UserConfig{}
+		if err := datastore.Get(ctx, userConfigID, userConfig); err != nil {
+			return err
+		}
+		for i := range userConfig.WebPushSubscriptions {
+			subscription := &userConfig.WebPushSubscriptions[i]
+			if subscription.Endpoint == endpoint {
+				subscription.Disabled = true
+				subscription.Note = note
+			}
+		}
+		_, err := datastore.Put(ctx, userConfigID, userConfig)
+		return err
+	}, &datastore.TransactionOptions{XG: false})
+}
+
+func webPushSend(ctx context.Context, userId, endpoint string, notif *fcm.NotificationPayload, data *FCMData, notifType string, gameID *datastore.Key) error {
+	log.Infof(ctx, "webPushSend(..., %q, %q, %v, %v, %q, %v)", userId, endpoint, PP(notif), PP(data), notifType, gameID)
+
+	logResult := func(status, errMsg string) {
+		logNotifications(ctx, NotificationLogEntry{
+			UserId:      userId,
+			Transport:   WebPushNotificationTransport,
+			Type:        notifType,
+			GameID:      gameID,
+			Destination: endpoint,
+			Status:      status,
+			Error:       errMsg,
+		})
+	}
+
+	userConfig := &auth.UserConfig{}
+	if err := datastore.Get(ctx, auth.UserConfigID(ctx, auth.UserID(ctx, userId)), userConfig); err == datastore.ErrNoSuchEntity {
+		log.Infof(ctx, "%q has no configuration, will skip sending notification", userId)
+		return nil
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to load user config for %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+	if held, err := holdForQuietHours(ctx, userId, &userConfig.QuietHours, NotificationLogEntry{
+		Transport:   WebPushNotificationTransport,
+		Type:        notifType,
+		GameID:      gameID,
+		Destination: endpoint,
+	}, &heldNotificationArgs{Endpoint: endpoint, Payload: notif, Data: data}); err != nil || held {
+		return err
+	}
+
+	var subscription *auth.WebPushSubscription
+	for i := range userConfig.WebPushSubscriptions {
+		if userConfig.WebPushSubscriptions[i].Endpoint == endpoint && !userConfig.WebPushSubscriptions[i].Disabled {
+			subscription = &userConfig.WebPushSubscriptions[i]
+		}
+	}
+	if subscription == nil {
+		log.Infof(ctx, "%q no longer has an enabled subscription to %q, will skip sending notification", userId, endpoint)
+		return nil
+	}
+
+	conf, err := getWebPushConf(ctx)
+	if err != nil {
+		// Safe to retry, nothing got sent.
+		log.Errorf(ctx, "Unable to get WebPushConf: %v; upload one or hope datastore gets fixed", err)
+		return err
+	}
+
+	payload, err := json.Marshal(webPushMessage{Notification: notif, Data: data})
+	if err != nil {
+		log.Errorf(ctx, "Unable to marshal %v, %v: %v; unable to recover, exiting", PP(notif), PP(data), err)
+		return nil
+	}
+	if len(payload) > maxWebPushPayload {
+		log.Infof(ctx, "Payload of %v bytes is too large, will send the notification without data", len(payload))
+		if payload, err = json.Marshal(webPushMessage{Notification: notif}); err != nil {
+			log.Errorf(ctx, "Unable to marshal %v: %v; unable to recover, exiting", PP(notif), err)
+			return nil
+		}
+	}
+
+	req, err := NewWebPushRequest(conf, subscription, payload, webPushTTL)
+	if err != nil {
+		// Can't retry, the subscription or the configuration is broken.
+		log.Errorf(ctx, "Unable to create push to %q: %v; unable to recover, exiting", endpoint, err)
+		logResult(NotificationFailed, err.Error())
+		return nil
+	}
+
+	resp, err := urlfetch.Client(ctx).Do(req)
+	if err != nil {
+		// Safe to retry, nothing got sent probably.
+		log.Errorf(ctx, "Unable to push to %q: %v; hope the push service gets fixed", endpoint, err)
+		logResult(NotificationRetrying, err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode > 199 && resp.StatusCode < 300:
+		log.Infof(ctx, "Pushed %v bytes to %q, received %v", len(payload), endpoint, resp.Status)
+		logResult(NotificationSent, "")
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		log.Errorf(ctx, "Subscription %q got %v, will disable it.", endpoint, resp.Status)
+		if err := disableWebPushSubscription(ctx, userId, endpoint, fmt.Sprintf("Disabled at %v due to %v from the push service.", time.Now(), resp.Status)); err != nil {
+			log.Errorf(ctx, "Unable to disable subscription %q of %q: %v; hope datastore gets fixed", endpoint, userId, err)
+			return err
+		}
+		logResult(NotificationDisabled, resp.Status)
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode > 499:
+		// Safe to retry, the push service will hopefully recover.
+		msg := fmt.Sprintf("Unable to push to %q due to %v: %s; hope the push service gets fixed", endpoint, resp.Status, respBody)
+		log.Errorf(ctx, msg)
+		logResult(NotificationRetrying, resp.Status)
+		return fmt.Errorf(msg)
+	default:
+		// Can't retry, our push is fucked up.
+		log.Errorf(ctx, "Unable to push to %q due to %v: %s; unable to recover", endpoint, resp.Status, respBody)
+		logResult(NotificationFailed, fmt.Sprintf("%v: %s", resp.Status, respBody))
+		return nil
+	}
+
+	log.Infof(ctx, "webPushSend(..., %q, %q, %v, %v, %q, %v) *** SUCCESS ***", userId, endpoint, PP(notif), PP(data), notifType, gameID)
+
+	return nil
+}
@@ -0,0 +1,436 @@
+package game
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	webhookKind = "Webhook"
+
+	WebhookGameStarted     = "game-started"
+	WebhookPhaseResolved   = "phase-resolved"
+	WebhookMessageReceived = "message-received"
+	WebhookGameFinished    = "game-finished"
+	WebhookMemberJoined    = "member-joined"
+	WebhookMemberLeft      = "member-left"
+
+	webhookSignatureHeader = "X-Diplicity-Signature"
+	webhookEventHeader     = "X-Diplicity-Event"
+	webhookTimeout         = 10 * time.Second
+)
+
+var (
+	webhookEvents = []string{
+		WebhookGameStarted,
+		WebhookPhaseResolved,
+		WebhookMessageReceived,
+		WebhookGameFinished,
+		WebhookMemberJoined,
+		WebhookMemberLeft,
+	}
+
+	sendWebhooksFunc   *DelayFunc
+	deliverWebhookFunc *DelayFunc
+
+	WebhookResource *Resource
+)
+
+func init() {
+	sendWebhooksFunc = NewDelayFunc("game-sendWebhooks", sendWebhooks)
+	deliverWebhookFunc = NewDelayFunc("game-deliverWebhook", deliverWebhook)
+
+	WebhookResource = &Resource{
+		Create:     createWebhook,
+		Delete:     deleteWebhook,
+		CreatePath: "/User/{user_id}/Webhook",
+		FullPath:   "/Webhook/{id}",
+		Listers: []Lister{
+			{
+				Path:    "/User/{user_id}/Webhooks",
+				Route:   ListWebhooksRoute,
+				Handler: listWebhooks,
+			},
+		},
+	}
+}
+
+type Webhooks []Webhook
+
+func (w Webhooks) Item(r Request, userId string) *Item {
+	webhookItems := make(List, len(w))
+	for i := range w {
+		webhookItems[i] = w[i].Item(r)
+	}
+	return NewItem(webhookItems).SetName("webhooks").SetDesc([][]string{
+		[]string{
+			"Webhooks",
+			"Webhooks get a JSON `POST` for each event in the games you are a member of, containing the event, the game, and depending on the event the phase, message or member concerned.",
+			fmt.Sprintf("The events are %v. Webhooks without `Events` get all of them, and webhooks with a `GameID` only get events from that game.", webhookEvents),
+		},
+		[]string{
+			"Signatures",
+			fmt.Sprintf("Each request has a `%s` header containing `sha256=` and the hex encoded HMAC-SHA256 of the body, using the `Secret` of the webhook as key.", webhookSignatureHeader),
+			"Failed deliveries, including responses other than 2xx, are retried with exponential backoff.",
+		},
+	}).AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListWebhooksRoute,
+		RouteParams: []string{"user_id", userId},
+	})).AddLink(r.NewLink(WebhookResource.Link("create", Create, []string{"user_id", userId})))
+}
+
+type Webhook struct {
+	ID        *datastore.Key `datastore:"-"`
+	UserId    string
+	GameID    *datastore.Key `methods:"POST"`
+	URL       string         `methods:"POST" datastore:",noindex"`
+	Events    []string       `methods:"POST"`
+	Secret    string         `datastore:",noindex"`
+	CreatedAt time.Time
+}
+
+func (w *Webhook) Item(r Request) *Item {
+	return NewItem(w).SetName(w.URL).AddLink(r.NewLink(WebhookResource.Link("delete", Delete, []string{"id", w.ID.Encode()})))
+}
+
+func (w *Webhook) wants(event string, gameID *datastore.Key) bool {
+	if w.GameID != nil && !w.GameID.Equal(gameID) {
+		return false
+	}
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, wanted := range w.Events {
+		if wanted == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload is the body posted to webhooks.
+type WebhookPayload struct {
+	Event     string
+	Game      *Game
+	Phase     *PhaseMeta `json:",omitempty"`
+	Message   *Message   `json:",omitempty"`
+	Member    *Member    `json:",omitempty"`
+	CreatedAt time.Time
+}
+
+// SignWebhookPayload returns the value of the signature header for body.
+func SignWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookTrigger describes an event to send to the webhooks of a set of users.
+type webhookTrigger struct {
+	// Event is the event to send, or empty if the events should be derived from the phase at PhaseOrdinal.
+	Event        string
+	GameID       *datastore.Key
+	UserIds      []string
+	PhaseOrdinal int64
+	MessageID    *datastore.Key
+	Member       *Member
+}
+
+// triggerWebhooks enqueues sending event to the webhooks of userIds. Since it uses a single task,
+// it's safe to run inside transactions.
+func triggerWebhooks(ctx context.Context, trigger webhookTrigger) error {
+	if len(trigger.UserIds) == 0 {
+		return nil
+	}
+	return sendWebhooksFunc.EnqueueIn(ctx, 0, trigger)
+}
+
+func sendWebhooks(ctx context.Context, trigger webhookTrigger) error {
+	log.Infof(ctx, "sendWebhooks(..., %+v)", trigger)
+
+	payload := &WebhookPayload{
+		Event:     trigger.Event,
+		Game:      &Game{},
+		Member:    trigger.Member,
+		CreatedAt: time.Now(),
+	}
+	if err := datastore.Get(ctx, trigger.GameID, payload.Game); err == datastore.ErrNoSuchEntity {
+		log.Infof(ctx, "Game %v is gone, skipping webhooks", trigger.GameID)
+		return nil
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to load game %v: %v; hope datastore gets fixed", trigger.GameID, err)
+		return err
+	}
+	payload.Game.ID = trigger.GameID
+
+	events := []string{}
+	if trigger.Event != "" {
+		events = append(events, trigger.Event)
+	}
+	if trigger.PhaseOrdinal > 0 {
+		phaseID, err := PhaseID(ctx, trigger.GameID, trigger.PhaseOrdinal)
+		if err != nil {
+			log.Errorf(ctx, "PhaseID(..., %v, %v): %v; fix the PhaseID func", trigger.GameID, trigger.PhaseOrdinal, err)
+			return err
+		}
+		phase := &Phase{}
+		if err := datastore.Get(ctx, phaseID, phase); err != nil {
+			log.Errorf(ctx, "Unable to load phase %v: %v; hope datastore gets fixed", phaseID, err)
+			return err
+		}
+		payload.Phase = &phase.PhaseMeta
+		if trigger.Event == "" {
+			if phase.Resolved {
+				events = append(events, WebhookPhaseResolved)
+				// The game finishes when the phase after the last resolved phase gets created already resolved.
+				if payload.Game.Finished && len(payload.Game.NewestPhaseMeta) > 0 && payload.Game.NewestPhaseMeta[0].PhaseOrdinal == phase.PhaseOrdinal+1 {
+					events = append(events, WebhookGameFinished)
+				}
+			} else if phase.PhaseOrdinal == 1 {
+				events = append(events, WebhookGameStarted)
+			}
+		}
+	}
+	if trigger.MessageID != nil {
+		payload.Message = &Message{}
+		if err := datastore.Get(ctx, trigger.MessageID, payload.Message); err != nil {
+			log.Errorf(ctx, "Unable to load message %v: %v; hope datastore gets fixed", trigger.MessageID, err)
+			return err
+		}
+		payload.Message.ID = trigger.MessageID
+	}
+
+	for _, userId := range trigger.UserIds {
+		webhooks := Webhooks{}
+		ids, err := datastore.NewQuery(webhookKind).Filter("UserId=", userId).GetAll(ctx, &webhooks)
+		if err != nil {
+			log.Errorf(ctx, "Unable to load webhooks for %q: %v; hope datastore gets fixed", userId, err)
+			return err
+		}
+		if len(webhooks) == 0 {
+			continue
+		}
+
+		game := *payload.Game
+		game.Members = make([]Member, len(payload.Game.Members))
+		copy(game.Members, payload.Game.Members)
+		viewer := &auth.User{Id: userId}
+		_, isMember := game.GetMemberByUserId(userId)
+		game.Redact(viewer)
+		var member *Member
+		if payload.Member != nil {
+			memberCopy := *payload.Member
+			memberCopy.Redact(viewer, isMember, game.Started)
+			member = &memberCopy
+		}
+
+		for _, event := range events {
+			userPayload := *payload
+			userPayload.Event = event
+			userPayload.Game = &game
+			userPayload.Member = member
+			body, err := json.Marshal(userPayload)
+			if err != nil {
+				log.Errorf(ctx, "Unable to marshal webhook payload %v: %v; fix WebhookPayload", PP(userPayload), err)
+				return err
+			}
+			for i := range webhooks {
+				if !webhooks[i].wants(event, trigger.GameID) {
+					continue
+				}
+				if err := deliverWebhookFunc.EnqueueIn(ctx, 0, ids[i], event, body); err != nil {
+					log.Errorf(ctx, "Unable to enqueue delivery to %v: %v; hope datastore gets fixed", ids[i], err)
+					return err
+				}
+			}
+		}
+	}
+
+	log.Infof(ctx, "sendWebhooks(..., %+v) *** SUCCESS ***", trigger)
+
+	return nil
+}
+
+func deliverWebhook(ctx context.Context, webhookID *datastore.Key, event string, body []byte) error {
+	log.Infof(ctx, "deliverWebhook(..., %v, %q, ...)", webhookID, event)
+
+	webhook := &Webhook{}
+	if err := datastore.Get(ctx, webhookID, webhook); err == datastore.ErrNoSuchEntity {
+		log.Infof(ctx, "Webhook %v has been deleted, skipping delivery", webhookID)
+		return nil
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to load webhook %v: %v; hope datastore gets fixed", webhookID, err)
+		return err
+	}
+
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewBuffer(body))
+	if err != nil {
+		log.Errorf(ctx, "Unable to create request for %v: %v; giving up", webhook.URL, err)
+		return nil
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set(webhookEventHeader, event)
+	req.Header.Set(webhookSignatureHeader, SignWebhookPayload(webhook.Secret, body))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	resp, err := urlfetch.Client(timeoutCtx).Do(req)
+	if err != nil {
+		log.Warningf(ctx, "Unable to deliver %q to %v: %v; will retry", event, webhook.URL, err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Warningf(ctx, "Delivering %q to %v returned %v; will retry", event, webhook.URL, resp.Status)
+		return fmt.Errorf("webhook %v returned %v", webhook.URL, resp.Status)
+	}
+
+	log.Infof(ctx, "deliverWebhook(..., %v, %q, ...) *** SUCCESS ***", webhookID, event)
+
+	return nil
+}
+
+// validateCallbackURL verifies that u is suitable for posting game data to. Plain http is only allowed on the dev server.
+func validateCallbackURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Host == "" {
+		return HTTPErr{"unparseable URL", http.StatusBadRequest}
+	}
+	if parsed.Scheme != "https" && !(appengine.IsDevAppServer() && parsed.Scheme == "http") {
+		return HTTPErr{"URLs must use https", http.StatusBadRequest}
+	}
+	return nil
+}
+
+func createWebhook(w ResponseWriter, r Request) (*Webhook, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if user.Id != r.Vars()["user_id"] {
+		return nil, HTTPErr{"can only create your own webhooks", http.StatusForbidden}
+	}
+
+	webhook := &Webhook{}
+	if err := Copy(webhook, r, "POST"); err != nil {
+		return nil, err
+	}
+
+	if err := validateCallbackURL(webhook.URL); err != nil {
+		return nil, err
+	}
+
+	for _, event := range webhook.Events {
+		found := false
+		for _, known := range webhookEvents {
+			if known == event {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, HTTPErr{fmt.Sprintf("unknown webhook event %q", event), http.StatusBadRequest}
+		}
+	}
+
+	if webhook.GameID != nil {
+		game := &Game{}
+		if err := datastore.Get(ctx, webhook.GameID, game); err != nil {
+			return nil, err
+		}
+		if _, isMember := game.GetMemberByUserId(user.Id); !isMember {
+			return nil, HTTPErr{"can only create webhooks for member games", http.StatusForbidden}
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	webhook.Secret = hex.EncodeToString(secret)
+	webhook.UserId = user.Id
+	webhook.CreatedAt = time.Now()
+
+	var err error
+	if webhook.ID, err = datastore.Put(ctx, datastore.NewIncompleteKey(ctx, webhookKind, nil), webhook); err != nil {
+		return nil, err
+	}
+
+	return webhook, nil
+}
+
+func deleteWebhook(w ResponseWriter, r Request) (*Webhook, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	webhookID, err := datastore.DecodeKey(r.Vars()["id"])
+	if err != nil {
+		return nil, err
+	}
+
+	webhook := &Webhook{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, webhookID, webhook); err != nil {
+			return err
+		}
+		if webhook.UserId != user.Id {
+			return HTTPErr{"can only delete your own webhooks", http.StatusForbidden}
+		}
+		return datastore.Delete(ctx, webhookID)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+	webhook.ID = webhookID
+
+	return webhook, nil
+}
+
+func listWebhooks(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if user.Id != r.Vars()["user_id"] {
+		return HTTPErr{"can only list your own webhooks", http.StatusForbidden}
+	}
+
+	webhooks := Webhooks{}
+	ids, err := datastore.NewQuery(webhookKind).Filter("UserId=", user.Id).GetAll(ctx, &webhooks)
+	if err != nil {
+		return err
+	}
+	for i := range ids {
+		webhooks[i].ID = ids[i]
+	}
+
+	w.SetContent(webhooks.Item(r, user.Id))
+	return nil
+}
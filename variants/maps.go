@@ -159,6 +159,17 @@ func RenderPhaseMap(w ResponseWriter, r Request, phase *Phase, colors []string)
 			jsBuf = append(jsBuf, fmt.Sprintf("map.addCross(%q, '#ff0000');", prov))
 		}
 	}
+	for _, annotation := range phase.Annotations {
+		nationVariable := makeNationVariable(annotation.Nation)
+		switch annotation.Type {
+		case ArrowAnnotation:
+			jsBuf = append(jsBuf, fmt.Sprintf("map.addArrow([%q, %q], col%s);", annotation.Province, annotation.Destination, nationVariable))
+		case CrossAnnotation:
+			jsBuf = append(jsBuf, fmt.Sprintf("map.addCross(%q, col%s);", annotation.Province, nationVariable))
+		case HighlightAnnotation:
+			jsBuf = append(jsBuf, fmt.Sprintf("map.highlightProvince(%q);", annotation.Province))
+		}
+	}
 
 	htmlNode := NewEl("html")
 	headNode := htmlNode.AddEl("head")
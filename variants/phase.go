@@ -28,6 +28,24 @@ type Phase struct {
 	Dislodgers    map[godip.Province]godip.Province            `methods:"POST"`
 	Bounces       map[godip.Province]map[godip.Province]bool   `methods:"POST"`
 	Resolutions   map[godip.Province]string                    `methods:"POST"`
+	Annotations   []Annotation                                 `methods:"POST"`
+}
+
+const (
+	ArrowAnnotation     = "Arrow"
+	CrossAnnotation     = "Cross"
+	HighlightAnnotation = "Highlight"
+)
+
+// Annotation is a mark drawn on the map by a player, not related to any order.
+type Annotation struct {
+	// Type is one of ArrowAnnotation, CrossAnnotation or HighlightAnnotation.
+	Type string `methods:"POST"`
+	// Nation decides the color of the annotation.
+	Nation   godip.Nation   `methods:"POST"`
+	Province godip.Province `methods:"POST"`
+	// Destination is the province arrows point to.
+	Destination godip.Province `methods:"POST"`
 }
 
 func (p *Phase) FromQuery(q url.Values) error {